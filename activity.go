@@ -0,0 +1,159 @@
+//go:build darwin || linux
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// activityGrace bounds how long a short-lived hook process waits for a
+// background activity POST before exiting.
+const activityGrace = 2 * time.Second
+
+// defaultHeartbeatInterval is how often connect reports that the session is
+// still alive, overridable with GREENLIGHT_HEARTBEAT or heartbeat in the
+// config file ("0" disables it).
+const defaultHeartbeatInterval = 60 * time.Second
+
+// stampActivity adds a client timestamp and, if relayID is set, a per-relay
+// monotonic sequence number to an activity payload so the server can order
+// events that arrive out of order.
+func stampActivity(payload map[string]interface{}, relayID string) {
+	payload["client_ts"] = time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	if relayID != "" {
+		if seq, err := nextActivitySeq(relayID); err == nil {
+			payload["seq"] = seq
+		} else {
+			log.Printf("activity: seq counter: %v", err)
+		}
+	}
+}
+
+// postActivity stamps payload and POSTs it to /activity in the background,
+// retrying transient failures (see postWithRetry). The returned channel is
+// closed when the request completes.
+func postActivity(baseURL, relayID string, payload map[string]interface{}) <-chan struct{} {
+	stampActivity(payload, relayID)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := postWithRetry("activity", func() (*http.Response, error) {
+			return postJSON(baseURL+"/activity", payload, 10*time.Second)
+		})
+		if err != nil {
+			log.Printf("activity: POST error: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}()
+	return done
+}
+
+// sessionExitPayload describes how the agent ended for a session_exit
+// event: its exit code, or -1 and the signal that killed it.
+func sessionExitPayload(state *os.ProcessState) map[string]interface{} {
+	payload := map[string]interface{}{
+		"event":     "session_exit",
+		"exit_code": state.ExitCode(),
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		payload["signal"] = status.Signal().String()
+	}
+	return payload
+}
+
+// waitBackground waits for a background request to finish, up to activityGrace.
+func waitBackground(done <-chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(activityGrace):
+	}
+}
+
+// nextActivitySeq increments and returns the sequence counter for a relay.
+// The counter lives in a temp file so it is shared by the short-lived hook
+// processes.
+func nextActivitySeq(relayID string) (int64, error) {
+	return reserveSeq(filepath.Join(os.TempDir(), "greenlight-seq-"+relayID), 1)
+}
+
+// transcriptSeqPath returns the file holding the last transcript sequence
+// number sent over the relay for relayID.
+func transcriptSeqPath(relayID string) string {
+	return filepath.Join(os.TempDir(), "greenlight-transcript-seq-"+relayID)
+}
+
+// reserveSeq adds n to the counter in the file at path and returns the
+// first of the n numbers reserved. An exclusive flock serializes
+// concurrent updates.
+func reserveSeq(path string, n int64) (int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return 0, err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	buf := make([]byte, 32)
+	k, _ := f.ReadAt(buf, 0)
+	last, _ := strconv.ParseInt(strings.TrimSpace(string(buf[:k])), 10, 64)
+
+	if err := f.Truncate(0); err != nil {
+		return 0, err
+	}
+	if _, err := f.WriteAt([]byte(strconv.FormatInt(last+n, 10)), 0); err != nil {
+		return 0, err
+	}
+	return last + 1, nil
+}
+
+// heartbeatInterval resolves the heartbeat interval: env > config file >
+// default. Zero disables heartbeats.
+func heartbeatInterval() time.Duration {
+	v := envOrConfig("GREENLIGHT_HEARTBEAT", "heartbeat")
+	if v == "" {
+		return defaultHeartbeatInterval
+	}
+	if v == "0" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Warning: invalid heartbeat interval %q, using %v", v, defaultHeartbeatInterval)
+		return defaultHeartbeatInterval
+	}
+	return d
+}
+
+// heartbeat POSTs a heartbeat event to /activity every interval until done
+// is closed, so the server can tell an idle session from one whose
+// greenlight has died.
+func heartbeat(baseURL, deviceID, project, relayID, agent string, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			postActivity(baseURL, relayID, map[string]interface{}{
+				"device_id": deviceID,
+				"event":     "heartbeat",
+				"project":   project,
+				"relay_id":  relayID,
+				"agent":     agent,
+			})
+		case <-done:
+			return
+		}
+	}
+}
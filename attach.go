@@ -0,0 +1,135 @@
+//go:build darwin || linux
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// detachKey ends an attach session (Ctrl-], as in telnet).
+const detachKey = 0x1d
+
+// runAttach joins an existing relay session as a viewer/controller. No child
+// process is launched: output from the session is written to the local
+// terminal and local keystrokes are sent to the session over the WebSocket.
+func runAttach(args []string) {
+	fs := flag.NewFlagSet("attach", flag.ExitOnError)
+	relayID := fs.String("relay-id", "", "Relay ID of the session to attach to (required)")
+	deviceID := fs.String("device-id", "", "Device ID (overrides GREENLIGHT_DEVICE_ID env and config file)")
+	project := fs.String("project", "", "Project name (overrides GREENLIGHT_PROJECT env and config file)")
+	fs.Parse(args)
+
+	if *relayID == "" {
+		fmt.Fprintf(os.Stderr, "greenlight attach: --relay-id is required\n")
+		os.Exit(1)
+	}
+
+	// Resolve device ID and project: flag > env > config file
+	cfg := resolveConfig(*deviceID, *project)
+	devID := cfg.DeviceID
+	if devID == "" {
+		fmt.Fprintf(os.Stderr, "greenlight attach: device ID is required (use --device-id, GREENLIGHT_DEVICE_ID, or set device_id in ~/.greenlight/config)\n")
+		os.Exit(1)
+	}
+
+	proj := cfg.Project
+	if proj != "" {
+		var err error
+		if proj, err = normalizeProject(proj); err != nil {
+			fmt.Fprintf(os.Stderr, "greenlight attach: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	relayURL, err := relayURLFor(proj)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight attach: %v\n", err)
+		os.Exit(1)
+	}
+	if relayURL == "" {
+		fmt.Fprintf(os.Stderr, "greenlight attach: no relay server URL configured\n")
+		os.Exit(1)
+	}
+	if _, err := relayTransport(); err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight attach: %v\n", err)
+		os.Exit(1)
+	}
+
+	u, err := relayWSURL(relayURL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight attach: %v\n", err)
+		os.Exit(1)
+	}
+	q := u.Query()
+	q.Set("relay_id", *relayID)
+	q.Set("role", "viewer")
+	if proj != "" {
+		q.Set("project", proj)
+	}
+	u.RawQuery = q.Encode()
+
+	// Frames from the session are terminal output, so display them as-is
+	ws := NewWSClient(u.String(), wsAuthToken(devID), WSModeRW, func(data []byte) error {
+		_, err := os.Stdout.Write(data)
+		return err
+	})
+	ws.verbatim = true
+	wsRejected := make(chan error, 1)
+	ws.onFatal = func(err error) { wsRejected <- err }
+
+	var orig syscall.Termios
+	if err := makeRaw(int(os.Stdin.Fd()), &orig); err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight attach: stdin is not a terminal: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "greenlight: attached to %s (press Ctrl-] to detach)\r\n", *relayID)
+
+	go ws.Run()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGHUP)
+
+	// local stdin → relay, until the detach key or EOF
+	stdinDone := make(chan struct{})
+	go func() {
+		defer close(stdinDone)
+		buf := make([]byte, 4096)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				data := buf[:n]
+				if idx := bytes.IndexByte(data, detachKey); idx >= 0 {
+					if idx > 0 {
+						ws.Send(data[:idx])
+					}
+					return
+				}
+				ws.Send(data)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var rejected error
+	select {
+	case <-stdinDone:
+	case <-sigCh:
+	case rejected = <-wsRejected:
+	}
+	signal.Stop(sigCh)
+
+	ws.Close()
+	restoreTerm(int(os.Stdin.Fd()), &orig)
+	if rejected != nil {
+		fmt.Fprintf(os.Stderr, "\ngreenlight attach: %s\n", explainFatal(rejected))
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "\ngreenlight: detached\n")
+}
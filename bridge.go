@@ -4,17 +4,162 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// transcriptFrame wraps a raw JSONL transcript line in the WebSocket
+// text frame envelope. seq numbers the session's frames from 1 so the
+// server can detect gaps; it and relayID are left out when zero, for
+// frames that haven't been numbered yet.
+func transcriptFrame(line, relayID string, seq int64) string {
+	if seq == 0 {
+		return fmt.Sprintf(`{"type":"transcript","data":%s}`, line)
+	}
+	return fmt.Sprintf(`{"type":"transcript","relay_id":%q,"seq":%d,"data":%s}`, relayID, seq, line)
+}
+
+// transcriptBatchFrame wraps several transcript lines in one frame, with
+// seq numbering the first of them.
+func transcriptBatchFrame(lines []string, relayID string, seq int64) string {
+	return fmt.Sprintf(`{"type":"transcript","relay_id":%q,"seq":%d,"lines":[%s]}`, relayID, seq, strings.Join(lines, ","))
+}
+
+// transcriptBatchMax is the most lines tailBridge puts in one frame when
+// batching.
+const transcriptBatchMax = 50
+
+// transcriptBatchWindow returns how long tailBridge collects transcript
+// lines into one frame, from GREENLIGHT_TRANSCRIPT_BATCH or
+// transcript_batch in the config file. Zero, the default, sends each line
+// as its own frame: the relay doesn't acknowledge frames, so batching is
+// only for relays known to accept the "lines" form.
+func transcriptBatchWindow() time.Duration {
+	v := envOrConfig("GREENLIGHT_TRANSCRIPT_BATCH", "transcript_batch")
+	if v == "" || v == "0" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("Warning: invalid transcript batch window %q, using 0", v)
+		return 0
+	}
+	return d
+}
+
+// transcriptDedupSize returns how many recently sent transcript lines are
+// remembered so an identical line isn't sent again, from
+// GREENLIGHT_TRANSCRIPT_DEDUP or transcript_dedup in the config file. Zero,
+// the default, turns deduplication off.
+func transcriptDedupSize() int {
+	v := envOrConfig("GREENLIGHT_TRANSCRIPT_DEDUP", "transcript_dedup")
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Printf("Warning: invalid transcript dedup size %q, using 0", v)
+		return 0
+	}
+	return n
+}
+
+// lineDedup remembers the hashes of the last size distinct transcript
+// lines sent in a session. It backs up the stream offset, which can't
+// tell a re-read or rewritten line from a new one. A nil *lineDedup
+// remembers nothing.
+type lineDedup struct {
+	size  int
+	order [][sha256.Size]byte // ring of remembered hashes, oldest at next
+	next  int
+	seen  map[[sha256.Size]byte]bool
+}
+
+// newLineDedup returns a lineDedup for size lines, or nil if size is 0.
+func newLineDedup(size int) *lineDedup {
+	if size <= 0 {
+		return nil
+	}
+	return &lineDedup{size: size, seen: make(map[[sha256.Size]byte]bool)}
+}
+
+// duplicate reports whether line was among the last lines seen, and
+// remembers it if not.
+func (d *lineDedup) duplicate(line string) bool {
+	if d == nil {
+		return false
+	}
+	h := sha256.Sum256([]byte(line))
+	if d.seen[h] {
+		return true
+	}
+	if len(d.order) < d.size {
+		d.order = append(d.order, h)
+	} else {
+		delete(d.seen, d.order[d.next])
+		d.order[d.next] = h
+		d.next = (d.next + 1) % d.size
+	}
+	d.seen[h] = true
+	return false
+}
+
+// maxBridgeFragment bounds how much invalid JSON tailBridge holds back
+// waiting for the rest of a fragment.
+const maxBridgeFragment = 1 << 20
+
+// fragmentBuffer reassembles transcript lines that were split into
+// fragments (e.g. by a partial write), so only valid JSON is wrapped in a
+// transcript frame.
+type fragmentBuffer struct {
+	held string
+}
+
+// add returns the complete JSON value once line completes it, or false if
+// the line is buffered as a fragment.
+func (b *fragmentBuffer) add(line string) (string, bool) {
+	if b.held != "" {
+		if joined := b.held + line; json.Valid([]byte(joined)) {
+			b.held = ""
+			return joined, true
+		}
+	}
+	if json.Valid([]byte(line)) {
+		b.discard()
+		return line, true
+	}
+	b.held += line
+	if len(b.held) > maxBridgeFragment {
+		b.discard()
+	}
+	return "", false
+}
+
+// discard drops any held fragment that never became valid JSON.
+func (b *fragmentBuffer) discard() {
+	if b.held != "" {
+		log.Printf("bridge: dropping %d bytes of invalid JSON", len(b.held))
+		b.held = ""
+	}
+}
+
 // tailBridge tails the bridge file and sends each line over the WebSocket
-// as a JSON transcript message. Blocks until done is closed or an error occurs.
+// as a JSON transcript message, numbered by ws's count of transcript lines.
+// The number is part of the frame, so a frame queued while the relay is
+// unreachable keeps it. Blocks until done is closed or an error occurs.
 // After done is closed, drains any remaining lines before returning.
-func tailBridge(path string, ws *WSClient, done <-chan struct{}) {
+//
+// With a batch window (see transcriptBatchWindow), lines arriving within
+// the window of the first are sent together in one frame, in order, once
+// the window closes or transcriptBatchMax lines have been collected.
+func tailBridge(path, relayID string, ws *WSClient, done <-chan struct{}) {
 	// Wait for the bridge file to appear (hook creates it)
 	var f *os.File
 	for {
@@ -35,6 +180,50 @@ func tailBridge(path string, ws *WSClient, done <-chan struct{}) {
 	// Seek to end — no backfill, fresh session
 	f.Seek(0, io.SeekEnd)
 
+	window := transcriptBatchWindow()
+	var batch []string
+	var batchStart time.Time
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		// Numbering is kept per relay session, so it carries on when the
+		// session is reattached or resumed by a later connect
+		n := int64(len(batch))
+		count := ws.transcriptLines.Add(n)
+		seq, err := reserveSeq(transcriptSeqPath(relayID), n)
+		if err != nil {
+			log.Printf("bridge: seq counter: %v", err)
+			seq = count - n + 1
+		}
+		if n == 1 {
+			ws.SendText([]byte(transcriptFrame(batch[0], relayID, seq)))
+		} else {
+			ws.SendText([]byte(transcriptBatchFrame(batch, relayID, seq)))
+		}
+		batch = nil
+	}
+
+	var frags fragmentBuffer
+	dedup := newLineDedup(transcriptDedupSize())
+	send := func(line string) {
+		data, ok := frags.add(line)
+		if !ok {
+			return
+		}
+		if dedup.duplicate(data) {
+			log.Printf("bridge: skipping duplicate transcript line")
+			return
+		}
+		if len(batch) == 0 {
+			batchStart = time.Now()
+		}
+		batch = append(batch, data)
+		if window <= 0 || len(batch) >= transcriptBatchMax {
+			flush()
+		}
+	}
+
 	reader := bufio.NewReader(f)
 	var partial string
 	stopping := false
@@ -50,15 +239,15 @@ func tailBridge(path string, ws *WSClient, done <-chan struct{}) {
 					fullLine := trimNewline(partial + line)
 					partial = ""
 					if fullLine != "" {
-						msg := fmt.Sprintf(`{"type":"transcript","data":%s}`, fullLine)
-						ws.SendText([]byte(msg))
+						send(fullLine)
 					}
 				} else {
 					// EOF or error — send any remaining buffered partial
 					if partial != "" {
-						msg := fmt.Sprintf(`{"type":"transcript","data":%s}`, partial)
-						ws.SendText([]byte(msg))
+						send(partial)
 					}
+					frags.discard()
+					flush()
 					return
 				}
 			}
@@ -77,21 +266,32 @@ func tailBridge(path string, ws *WSClient, done <-chan struct{}) {
 			fullLine := trimNewline(partial + line)
 			partial = ""
 			if fullLine != "" {
-				msg := fmt.Sprintf(`{"type":"transcript","data":%s}`, fullLine)
-				ws.SendText([]byte(msg))
+				send(fullLine)
 			}
 		} else if line != "" {
 			// Partial line (no newline yet) — buffer it
 			partial += line
 		}
 
+		// Send a batch whose window has closed
+		if len(batch) > 0 && time.Since(batchStart) >= window {
+			flush()
+		}
+
 		if err != nil {
 			if err != io.EOF {
 				log.Printf("bridge: read error: %v", err)
+				flush()
 				return
 			}
 			// EOF — wait for more data
-			time.Sleep(100 * time.Millisecond)
+			delay := 100 * time.Millisecond
+			if len(batch) > 0 {
+				if left := window - time.Since(batchStart); left < delay {
+					delay = left
+				}
+			}
+			time.Sleep(delay)
 		}
 	}
 }
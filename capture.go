@@ -0,0 +1,128 @@
+//go:build darwin || linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// captureRecord is one line of a WebSocket capture file
+// (GREENLIGHT_WS_CAPTURE). Data is base64-encoded by encoding/json.
+type captureRecord struct {
+	TS   string `json:"ts"`
+	Dir  string `json:"dir"`  // "in" (from server) or "out" (to server)
+	Type string `json:"type"` // "binary" or "text"
+	Data []byte `json:"data"`
+}
+
+// wsCapture appends every frame sent or received by a WSClient to a JSONL
+// file, for debugging the relay protocol. A nil *wsCapture records nothing.
+type wsCapture struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// openCapture opens the capture file named by GREENLIGHT_WS_CAPTURE, or
+// returns nil if it isn't set.
+func openCapture() *wsCapture {
+	path := os.Getenv("GREENLIGHT_WS_CAPTURE")
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("ws: capture: %v", err)
+		return nil
+	}
+	return &wsCapture{f: f, enc: json.NewEncoder(f)}
+}
+
+func (w *wsCapture) record(dir string, typ websocket.MessageType, data []byte) {
+	if w == nil {
+		return
+	}
+	t := "binary"
+	if typ == websocket.MessageText {
+		t = "text"
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.enc.Encode(captureRecord{
+		TS:   time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		Dir:  dir,
+		Type: t,
+		Data: data,
+	})
+}
+
+func (w *wsCapture) close() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.f.Close()
+}
+
+// runWSReplay feeds the inbound frames of a capture file through the same
+// frame handling as a live connection, printing what would be injected
+// into the PTY instead of writing it.
+func runWSReplay(args []string) {
+	if len(args) != 1 || args[0] == "--help" || args[0] == "-h" {
+		fmt.Fprintf(os.Stderr, "Usage: greenlight ws-replay <capture-file>\n")
+		os.Exit(1)
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight ws-replay: %v\n", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	c := &WSClient{
+		mode: WSModeRW,
+		inject: func(data []byte) error {
+			fmt.Printf("inject %q\n", data)
+			return nil
+		},
+		selectPane: func(id int) bool {
+			fmt.Printf("select_pane %d\n", id)
+			return true
+		},
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var rec captureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			fmt.Fprintf(os.Stderr, "greenlight ws-replay: line %d: %v\n", line, err)
+			os.Exit(1)
+		}
+		if rec.Dir != "in" {
+			continue
+		}
+		typ := websocket.MessageBinary
+		if rec.Type == "text" {
+			typ = websocket.MessageText
+		}
+		fmt.Printf("# %s %s %d bytes\n", rec.TS, rec.Type, len(rec.Data))
+		c.handleFrame(typ, rec.Data)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight ws-replay: %v\n", err)
+		os.Exit(1)
+	}
+}
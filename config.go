@@ -4,35 +4,463 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
-// readConfigValue reads a value by key from ~/.greenlight/config.
-// The config file uses simple key=value format, one per line.
+// configPath returns the config file location. $XDG_CONFIG_HOME/greenlight/config
+// is used if XDG_CONFIG_HOME is set, unless only the legacy
+// ~/.greenlight/config exists, in which case that is kept.
+func configPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	legacy := filepath.Join(home, ".greenlight", "config")
+
+	// The spec says relative values are invalid and should be ignored
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" && filepath.IsAbs(xdg) {
+		path := filepath.Join(xdg, "greenlight", "config")
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+		if _, err := os.Stat(legacy); err != nil {
+			return path, nil
+		}
+	}
+	return legacy, nil
+}
+
+// runConfigPath prints the resolved config file path.
+func runConfigPath(args []string) {
+	path, err := configPath()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight: cannot determine config path: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(path)
+}
+
+// runConfig reads and edits settings: get prints a key's value and list
+// prints them all, as greenlight would use them (see loadConfig) with
+// environment variables expanded. set adds or replaces a key in the global
+// config file, rewriting key=value files in place and keeping comments and
+// the order of other keys.
+func runConfig(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: greenlight config get <key> | set <key> <value> | list\n")
+		os.Exit(1)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+	path, err := configPath()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight config: cannot determine config path: %v\n", err)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "get":
+		if len(args) != 2 {
+			usage()
+		}
+		v, ok := loadConfig()[args[1]]
+		if !ok {
+			os.Exit(1)
+		}
+		fmt.Println(expandConfigValue(v))
+	case "set":
+		if len(args) != 3 {
+			usage()
+		}
+		if err := setConfigValue(path, args[1], args[2]); err != nil {
+			fmt.Fprintf(os.Stderr, "greenlight config: %v\n", err)
+			os.Exit(1)
+		}
+		if jsonPath, err := jsonConfigPath(); err == nil {
+			if _, ok := readJSONConfigFile(jsonPath)[args[1]]; ok {
+				fmt.Fprintf(os.Stderr, "greenlight config: warning: %s also sets %s and takes precedence\n", jsonPath, args[1])
+			}
+		}
+	case "list":
+		if len(args) != 1 {
+			usage()
+		}
+		m := loadConfig()
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Printf("%s=%s\n", k, expandConfigValue(m[k]))
+		}
+	default:
+		usage()
+	}
+}
+
+// setConfigValue sets key to value in the key=value config file at path,
+// creating the file and its directory if needed. The first line setting
+// key is replaced, or a line is appended if there is none.
+func setConfigValue(path, key, value string) error {
+	if err := validateConfigEntry(key, value); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		return fmt.Errorf("%s is a JSON config file; edit it by hand", path)
+	}
+
+	entry := key + "=" + value
+	lines := strings.SplitAfter(string(data), "\n")
+	replaced := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if k, _, ok := strings.Cut(trimmed, "="); ok && strings.TrimSpace(k) == key {
+			lines[i] = entry + "\n"
+			replaced = true
+			break
+		}
+	}
+	out := strings.Join(lines, "")
+	if !replaced {
+		if out != "" && !strings.HasSuffix(out, "\n") {
+			out += "\n"
+		}
+		out += entry + "\n"
+	}
+
+	// The file may hold a token, so only its owner may read a new one; an
+	// existing file keeps its permissions
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(out), 0600)
+}
+
+// validateConfigEntry rejects keys that can't be written as a key=value
+// line, and values that greenlight would refuse for keys it checks.
+// Values referring to environment variables aren't checked, since they
+// are only known when the config is read.
+func validateConfigEntry(key, value string) error {
+	if key == "" || strings.HasPrefix(key, "#") || strings.ContainsAny(key, "= \t\r\n") {
+		return fmt.Errorf("invalid key %q", key)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("invalid value for %s: must be a single line", key)
+	}
+	if strings.Contains(value, "$") {
+		return nil
+	}
+
+	switch {
+	case key == "device_id":
+		if !uuidPattern.MatchString(value) {
+			return fmt.Errorf("invalid device ID %q (expected UUID format)", value)
+		}
+	case key == "project":
+		if _, err := normalizeProject(value); err != nil {
+			return err
+		}
+	case key == "relay_url" || strings.HasPrefix(key, "relay."):
+		if err := checkRelayURL(value); err != nil {
+			return err
+		}
+	case key == "settings_file":
+		if _, err := settingsFile(value); err != nil {
+			return err
+		}
+	case key == "ctrl_z":
+		if value != "auto" && value != "suspend" && value != "pass" {
+			return fmt.Errorf("invalid Ctrl-Z mode %q (want auto, suspend or pass)", value)
+		}
+	}
+	return nil
+}
+
+// readConfigValue reads a value by key from the config file, with
+// environment variables expanded (see expandConfigValue).
 // Returns empty string if the file doesn't exist or the key is not found.
 func readConfigValue(key string) string {
-	home, err := os.UserHomeDir()
+	return expandConfigValue(loadConfig()[key])
+}
+
+// expandConfigValue replaces $NAME and ${NAME} in a config value with the
+// environment variable's value, or nothing if it is unset. "$$" is a
+// literal '$'. A malformed reference expands to nothing: a '$' not
+// followed by a name, '{' or '$' is dropped, as is an unterminated or
+// invalid ${...} and everything after it.
+func expandConfigValue(v string) string {
+	if !strings.Contains(v, "$") {
+		return v
+	}
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] != '$' {
+			b.WriteByte(v[i])
+			continue
+		}
+		rest := v[i+1:]
+		switch {
+		case strings.HasPrefix(rest, "$"):
+			b.WriteByte('$')
+			i++
+		case strings.HasPrefix(rest, "{"):
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				return b.String()
+			}
+			if name := rest[1:end]; validEnvName(name) {
+				b.WriteString(os.Getenv(name))
+			}
+			i += end + 1
+		default:
+			n := 0
+			for n < len(rest) && isEnvNameByte(rest[n], n == 0) {
+				n++
+			}
+			b.WriteString(os.Getenv(rest[:n]))
+			i += n
+		}
+	}
+	return b.String()
+}
+
+func validEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isEnvNameByte(name[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func isEnvNameByte(c byte, first bool) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || !first && '0' <= c && c <= '9'
+}
+
+// envOrConfig returns the value of the environment variable env, falling
+// back to key in the config file.
+func envOrConfig(env, key string) string {
+	if v := os.Getenv(env); v != "" {
+		return v
+	}
+	return readConfigValue(key)
+}
+
+// loadConfig reads all key/value pairs from the config file (see
+// configPath), overridden by those in config.json next to it (see
+// jsonConfigPath) and then by those in the project's .greenlight file (see
+// localConfigPath) except for globalOnlyConfigKeys.
+// Returns nil if none of the files exist or can be parsed.
+func loadConfig() map[string]string {
+	var m map[string]string
+	if path, err := configPath(); err == nil {
+		m = readConfigFile(path)
+	}
+	if path, err := jsonConfigPath(); err == nil {
+		if js := readJSONConfigFile(path); len(js) > 0 {
+			if m == nil {
+				m = make(map[string]string, len(js))
+			}
+			for k, v := range js {
+				m[k] = v
+			}
+		}
+	}
+
+	path := localConfigPath()
+	if path == "" {
+		return m
+	}
+	local := readConfigFile(path)
+	if m == nil && len(local) > 0 {
+		m = make(map[string]string, len(local))
+	}
+	for k, v := range local {
+		if globalOnlyConfigKey(k) {
+			log.Printf("config: ignoring %q in %s: it can only be set in the global config", k, path)
+			continue
+		}
+		m[k] = v
+	}
+	return m
+}
+
+// readConfigFile reads a config file. The file uses simple key=value
+// format, one per line, unless its first non-whitespace character is '{',
+// in which case it is parsed as a JSON object with the same keys.
+// Returns nil if the file doesn't exist or can't be parsed.
+func readConfigFile(path string) map[string]string {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return ""
+		return nil
 	}
-	f, err := os.Open(filepath.Join(home, ".greenlight", "config"))
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		m, err := parseJSONConfig(trimmed)
+		if err != nil {
+			log.Printf("config: %v", err)
+			return nil
+		}
+		return m
+	}
+	return parseKeyValueConfig(data)
+}
+
+// jsonConfigPath returns the location of the optional JSON config, next to
+// the config file (normally ~/.greenlight/config.json).
+func jsonConfigPath() (string, error) {
+	path, err := configPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(path), "config.json"), nil
+}
+
+// readJSONConfigFile reads a config file that is always JSON (see
+// parseJSONConfig). Returns nil if the file doesn't exist or can't be parsed.
+func readJSONConfigFile(path string) map[string]string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	m, err := parseJSONConfig(bytes.TrimSpace(data))
+	if err != nil {
+		log.Printf("config: %s: %v", path, err)
+		return nil
+	}
+	return m
+}
+
+// resolvedConfig is the device and project a command runs as.
+type resolvedConfig struct {
+	DeviceID string
+	Project  string // as given, not yet normalized
+}
+
+// resolveConfig resolves the device ID and project the same way for every
+// command: flag > env > config (see loadConfig). Empty flags are skipped,
+// so commands without the flags pass "". Either field is empty if it isn't
+// set anywhere.
+func resolveConfig(deviceFlag, projectFlag string) resolvedConfig {
+	c := resolvedConfig{DeviceID: deviceFlag, Project: projectFlag}
+	if c.DeviceID == "" {
+		c.DeviceID = envOrConfig("GREENLIGHT_DEVICE_ID", "device_id")
+	}
+	if c.Project == "" {
+		c.Project = envOrConfig("GREENLIGHT_PROJECT", "project")
+	}
+	return c
+}
+
+// localConfigName is the per-project config file, so a repository can
+// commit settings such as its project name.
+const localConfigName = ".greenlight"
+
+// localConfigPath returns the nearest .greenlight file in the working
+// directory or its parents, looking no higher than the repository root
+// (the first directory containing .git). Returns "" if there is none.
+func localConfigPath() string {
+	dir, err := os.Getwd()
 	if err != nil {
 		return ""
 	}
-	defer f.Close()
+	for {
+		// ~/.greenlight is the directory holding the global config
+		path := filepath.Join(dir, localConfigName)
+		if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() {
+			return path
+		}
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return ""
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// globalOnlyConfigKey reports whether key is ignored in a project's
+// .greenlight file. A file that comes with a repository must not choose
+// the command that is run, the device that approves requests, where the
+// session is relayed, or credentials.
+func globalOnlyConfigKey(key string) bool {
+	switch key {
+	case "agent", "device_id", "token", "proxy", "ca_cert", "client_cert", "client_key", "relay_url":
+		return true
+	}
+	return strings.HasPrefix(key, "relay.")
+}
 
-	scanner := bufio.NewScanner(f)
+// parseKeyValueConfig parses key=value lines, skipping blanks and # comments.
+func parseKeyValueConfig(data []byte) map[string]string {
+	m := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
 		k, v, ok := strings.Cut(line, "=")
-		if ok && strings.TrimSpace(k) == key {
-			return strings.TrimSpace(v)
+		if !ok {
+			continue
+		}
+		k = strings.TrimSpace(k)
+		if _, seen := m[k]; !seen {
+			m[k] = strings.TrimSpace(v)
+		}
+	}
+	return m
+}
+
+// parseJSONConfig parses a JSON object. Non-string scalar values are
+// converted to their string form so they read the same as key=value entries,
+// and nested objects are flattened to dotted keys, so
+// {"relay":{"team-a":"wss://..."}} is the same as relay.team-a=wss://...
+func parseJSONConfig(data []byte) (map[string]string, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse JSON config: %w", err)
+	}
+	m := make(map[string]string, len(raw))
+	flattenJSONConfig(m, "", raw)
+	return m, nil
+}
+
+func flattenJSONConfig(m map[string]string, prefix string, raw map[string]interface{}) {
+	for k, v := range raw {
+		k = prefix + k
+		switch v := v.(type) {
+		case string:
+			m[k] = v
+		case nil:
+		case map[string]interface{}:
+			flattenJSONConfig(m, k+".", v)
+		case []interface{}:
+			log.Printf("config: ignoring non-scalar value for %q", k)
+		default:
+			m[k] = fmt.Sprint(v)
 		}
 	}
-	return ""
 }
@@ -7,54 +7,224 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
+// defaultBridgeDrainTimeout bounds how long connect waits for the bridge
+// tailer on exit, overridable with GREENLIGHT_BRIDGE_DRAIN_TIMEOUT or
+// bridge_drain_timeout in the config file.
+const defaultBridgeDrainTimeout = 5 * time.Second
+
 func runConnect(args []string) {
 	fs := flag.NewFlagSet("connect", flag.ExitOnError)
 	resume := fs.String("resume", "", "Resume a previous Claude Code session by ID")
+	resumeLast := fs.Bool("resume-last", false, "Resume the most recent Claude Code session for the project")
+	reattach := fs.Bool("reattach", false, "Reuse the relay session last used for the project in this directory, so the app shows it as the same session")
+	agent := fs.String("agent", "", `Agent command to launch, with any default args (overrides GREENLIGHT_AGENT env and config file; default "claude")`)
 	deviceID := fs.String("device-id", "", "Device ID (overrides GREENLIGHT_DEVICE_ID env and config file)")
 	project := fs.String("project", "", "Project name (overrides GREENLIGHT_PROJECT env and config file)")
+	noEnroll := fs.Bool("no-enroll", false, "Skip session enrollment (reduces security; only for relays pre-authorized out-of-band)")
+	asyncEnroll := fs.Bool("async-enroll", false, "Start the agent without waiting for the session to be approved; permission requests are denied until it is")
+	force := fs.Bool("force", false, "Install hooks even if the current directory doesn't look like a project")
+	allowFilePush := fs.Bool("allow-file-push", false, "Let the relay write files into "+filePushDir+" in the current directory")
+	hookList := fs.String("hooks", "", "Comma-separated extra hook events to register besides SessionStart and PermissionRequest (e.g. Stop,PreToolUse)")
+	global := fs.Bool("global", false, "Install hooks in ~/.claude/settings.json for every project instead of ./.claude/settings.local.json")
+	settingsFileFlag := fs.String("settings-file", "", `Project settings file in .claude to install hooks into: "settings.local.json" (default) or "settings.json"`)
+	noHooks := fs.Bool("no-hooks", false, "Don't install hooks: mirror the session to the app without intercepting permission requests")
+	record := fs.String("record", "", "Record the session's output to this file in asciicast v2 format")
+	recordMaxSize := fs.String("record-max-size", "", "Start a new --record segment once the file would grow past this size (e.g. 10M), moving the old one to FILE.1, FILE.2, ...")
+	recordGzip := fs.Bool("record-gzip", false, "Gzip --record segments as they are rotated out")
+	verbose := fs.Bool("verbose", false, "Write log messages into the --record file as markers (the terminal is in use)")
+	summary := fs.Bool("summary", false, "Print session statistics when the session ends")
+	mirror := fs.Bool("mirror-input", false, "Also send input from the app back to the relay as remote_input frames, and save it in the --record file, for auditing")
+	rawInject := fs.Bool("raw-inject", false, "Type input from the app into the agent exactly as received, without turning newlines into a separate Enter")
+	shellPane := fs.Bool("shell-pane", false, "Also relay a shell ($SHELL) as a second pane, selectable from the app")
+	wsModeFlag := fs.String("ws-mode", "rw", `Relay direction: "rw", "r" (input from the app only) or "w" (output to the app only)`)
+	waitTranscript := fs.Duration("wait-transcript", 0, "How long to wait for the transcript file to appear before giving up on relaying it (overrides GREENLIGHT_TRANSCRIPT_WAIT env and config file; default 30s)")
+	idleTimeout := fs.Duration("idle-timeout", 0, "End the session after this long without input or output (e.g. 30m; 0 disables)")
+	metricsAddr := fs.String("metrics-addr", "", "Serve Prometheus metrics on this address (e.g. :9100; localhost unless a host is given)")
+	dryRun := fs.Bool("dry-run", false, "Enroll, install hooks and test the relay connection, then exit without launching the agent")
+	insecure := fs.Bool("insecure", false, "Skip TLS certificate verification for the relay and server (local testing only; same as GREENLIGHT_INSECURE_SKIP_VERIFY=1)")
+	statusKeys := fs.String("status-keys", "", `Key sequence that toggles the status overlay, in caret notation (default "^G^G", "none" to disable)`)
 	fs.Parse(args)
 
-	if wsURL == "" {
-		fmt.Fprintf(os.Stderr, "greenlight: no relay server URL configured (binary must be built with -ldflags)\n")
-		os.Exit(1)
+	// Everything after "--" is passed through to the agent
+	passthrough := fs.Args()
+	if n := len(args) - len(passthrough); len(passthrough) > 0 && (n == 0 || args[n-1] != "--") {
+		fmt.Fprintf(os.Stderr, "greenlight: unexpected argument %q (put arguments for the agent after --)\n", passthrough[0])
+		os.Exit(2)
 	}
 
-	// Build the claude command
-	command := "claude"
-	var cmdArgs []string
-	if *resume != "" {
-		cmdArgs = append(cmdArgs, "--resume", *resume)
+	if *resume != "" && *resumeLast {
+		fmt.Fprintf(os.Stderr, "greenlight: --resume and --resume-last are mutually exclusive\n")
+		os.Exit(1)
 	}
-
-	// Resolve device ID: flag > env > config file
-	devID := *deviceID
-	if devID == "" {
-		devID = os.Getenv("GREENLIGHT_DEVICE_ID")
+	if *asyncEnroll && *noEnroll {
+		fmt.Fprintf(os.Stderr, "greenlight: --async-enroll and --no-enroll are mutually exclusive\n")
+		os.Exit(1)
 	}
-	if devID == "" {
-		devID = readConfigValue("device_id")
+	if *noHooks && (*hookList != "" || *global) {
+		fmt.Fprintf(os.Stderr, "greenlight: --no-hooks can't be combined with --hooks or --global\n")
+		os.Exit(1)
+	}
+	if *verbose && *record == "" {
+		fmt.Fprintf(os.Stderr, "greenlight: --verbose needs --record: the terminal is in use, so log messages go into the recording\n")
+		os.Exit(1)
+	}
+	if (*recordMaxSize != "" || *recordGzip) && *record == "" {
+		fmt.Fprintf(os.Stderr, "greenlight: --record-max-size and --record-gzip need --record\n")
+		os.Exit(1)
+	}
+	var maxRecordSize int64
+	if *recordMaxSize != "" {
+		var err error
+		if maxRecordSize, err = parseByteSize(*recordMaxSize); err != nil {
+			fmt.Fprintf(os.Stderr, "greenlight: --record-max-size: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *waitTranscript < 0 {
+		fmt.Fprintf(os.Stderr, "greenlight: --wait-transcript must not be negative\n")
+		os.Exit(1)
+	}
+	if *idleTimeout < 0 {
+		fmt.Fprintf(os.Stderr, "greenlight: --idle-timeout must not be negative\n")
+		os.Exit(1)
+	}
+	wsMode, err := parseWSMode(*wsModeFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight: --ws-mode: %v\n", err)
+		fs.Usage()
+		os.Exit(2)
 	}
+	hookEvents, err := parseHookEvents(*hookList)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight: --hooks: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Resolve device ID and project: flag > env > config file
+	cfg := resolveConfig(*deviceID, *project)
+	devID := cfg.DeviceID
 	if devID == "" {
 		fmt.Fprintf(os.Stderr, "greenlight: device ID is required (use --device-id, GREENLIGHT_DEVICE_ID, or set device_id in ~/.greenlight/config)\n")
 		fmt.Fprintf(os.Stderr, "greenlight: your device ID can be found on the About tab in the Greenlight app\n")
 		os.Exit(1)
 	}
 
-	// Resolve project: flag > env > config file (required)
-	proj := *project
+	proj := cfg.Project
 	if proj == "" {
-		proj = os.Getenv("GREENLIGHT_PROJECT")
+		fmt.Fprintf(os.Stderr, "greenlight: project name is required (use --project)\n")
+		os.Exit(1)
 	}
-	if proj == "" {
-		proj = readConfigValue("project")
+	proj, err = normalizeProject(proj)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight: %v\n", err)
+		os.Exit(1)
 	}
-	if proj == "" {
-		fmt.Fprintf(os.Stderr, "greenlight: project name is required (use --project)\n")
+
+	if *resumeLast {
+		*resume = lastSession(proj)
+		if *resume == "" {
+			fmt.Fprintf(os.Stderr, "greenlight: no previous session found for project %q\n", proj)
+			os.Exit(1)
+		}
+		log.Printf("Resuming last session %s", *resume)
+	}
+
+	agentFields, err := agentCommand(*agent)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight: %v\n", err)
+		os.Exit(1)
+	}
+	command := agentFields[0]
+	if err := checkAgentInstalled(command); err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight: %v\n", err)
+		os.Exit(1)
+	}
+	cmdArgs := append([]string(nil), agentFields[1:]...)
+	if *resume != "" {
+		cmdArgs = append(cmdArgs, "--resume", *resume)
+	}
+
+	// Without hooks nothing tells us the conversation ID, so choose it
+	// ourselves and stream its transcript from connect
+	var conversationID string
+	if *noHooks && agentNameFor(command) == "claude-code" {
+		conversationID = *resume
+		if conversationID == "" {
+			conversationID = generateUUID()
+			cmdArgs = append(cmdArgs, "--session-id", conversationID)
+		}
+	}
+	cmdArgs = append(cmdArgs, passthrough...)
+
+	relayURL, err := relayURLFor(proj)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight: %v\n", err)
+		os.Exit(1)
+	}
+	if relayURL == "" {
+		fmt.Fprintf(os.Stderr, "greenlight: no relay server URL configured (binary must be built with -ldflags, or set relay.%s in the config file)\n", proj)
+		os.Exit(1)
+	}
+
+	// Refuse to scatter hooks into $HOME, / or non-project directories
+	useGlobal := globalHooks(*global)
+	settingsName, err := settingsFile(*settingsFileFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight: %v\n", err)
+		os.Exit(1)
+	}
+	settingsPath, err := hookSettingsPath(useGlobal, settingsName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight: %v\n", err)
+		os.Exit(1)
+	}
+	if !*force && !useGlobal && !*noHooks {
+		if err := checkHookDir("."); err != nil {
+			fmt.Fprintf(os.Stderr, "greenlight: refusing to install hooks: %v\n", err)
+			fmt.Fprintf(os.Stderr, "greenlight: run from your project directory, or pass --force to install here anyway\n")
+			os.Exit(1)
+		}
+	}
+
+	// Resolve status overlay keys: flag > env > config file > default
+	keys := *statusKeys
+	if keys == "" {
+		keys = os.Getenv("GREENLIGHT_STATUS_KEYS")
+	}
+	if keys == "" {
+		keys = readConfigValue("status_keys")
+	}
+	if keys == "" {
+		keys = defaultStatusKeys
+	}
+	var statusSeq []byte
+	if keys != "none" {
+		seq, err := parseKeySequence(keys)
+		if err != nil || len(seq) == 0 {
+			fmt.Fprintf(os.Stderr, "greenlight: invalid status keys %q\n", keys)
+			os.Exit(1)
+		}
+		statusSeq = seq
+	}
+
+	// Resolve Ctrl-Z handling: env > config file > auto. "auto" suspends
+	// only when a shell is doing job control and can resume us.
+	suspendOnCtrlZ := false
+	switch mode := envOrConfig("GREENLIGHT_CTRL_Z", "ctrl_z"); mode {
+	case "", "auto":
+		suspendOnCtrlZ = jobControl(int(os.Stdin.Fd()))
+	case "suspend":
+		suspendOnCtrlZ = true
+	case "pass":
+	default:
+		fmt.Fprintf(os.Stderr, "greenlight: invalid Ctrl-Z mode %q (want auto, suspend or pass)\n", mode)
 		os.Exit(1)
 	}
 
@@ -63,37 +233,68 @@ func runConnect(args []string) {
 	if *resume != "" {
 		relayID = lookupRelayID(*resume)
 	}
+	cwd, _ := filepath.Abs(".")
+	if relayID == "" && *reattach && cwd != "" {
+		if relayID = lookupDirRelayID(cwd, proj); relayID != "" {
+			log.Printf("Reattaching to relay session %s", relayID)
+		}
+	}
 	if relayID == "" {
 		relayID = generateUUID()
 	}
-	dialURL := wsURL
-	u, err := url.Parse(dialURL)
+	dialURL, err := relayDialURL(relayURL, relayID, proj)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "greenlight: bad relay URL: %v\n", err)
+		fmt.Fprintf(os.Stderr, "greenlight: %v\n", err)
 		os.Exit(1)
 	}
-	q := u.Query()
-	q.Set("relay_id", relayID)
-	q.Set("project", proj)
-	u.RawQuery = q.Encode()
-	dialURL = u.String()
 
-	// Derive HTTP base URL for enrollment
-	baseURL, err := serverBaseURL()
-	if err != nil {
+	if *insecure {
+		// Set in the environment so the hooks and streamers the agent
+		// starts skip verification too
+		os.Setenv("GREENLIGHT_INSECURE_SKIP_VERIFY", "1")
+	}
+
+	// Fail early on bad TLS settings rather than on the first request
+	if _, err := relayTransport(); err != nil {
 		fmt.Fprintf(os.Stderr, "greenlight: %v\n", err)
 		os.Exit(1)
 	}
 
-	// Enroll session with the relay server
-	if err := enrollSession(baseURL, devID, relayID, proj); err != nil {
-		fmt.Fprintf(os.Stderr, "greenlight: session enrollment failed: %v\n", err)
-		os.Exit(1)
+	// With --async-enroll, enrollment happens in the background once the
+	// agent is running (see enrollInBackground)
+	enrollLater := *asyncEnroll && !*dryRun
+	if !enrollLater {
+		if err := enrollUnlessSkipped(relayURL, devID, relayID, proj, *noEnroll); err != nil {
+			fmt.Fprintf(os.Stderr, "greenlight: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *dryRun {
+		dryRunConnect(dryRunInfo{
+			devID:        devID,
+			proj:         proj,
+			relayID:      relayID,
+			dialURL:      dialURL,
+			token:        wsAuthToken(devID),
+			noEnroll:     *noEnroll,
+			settingsPath: settingsPath,
+			hookEvents:   hookEvents,
+			global:       useGlobal,
+			noHooks:      *noHooks,
+		})
+		return
+	}
+
+	if cwd != "" {
+		saveDirRelayID(cwd, relayID, proj)
 	}
 
 	// Install Claude Code hooks
-	if err := installHooks(); err != nil {
-		log.Printf("Warning: failed to install hooks: %v", err)
+	if !*noHooks {
+		if err := installHooks(settingsPath, hookEvents, useGlobal); err != nil {
+			log.Printf("Warning: failed to install hooks: %v", err)
+		}
 	}
 
 	// Create bridge file for transcript relay
@@ -103,19 +304,103 @@ func runConnect(args []string) {
 	}
 	defer os.Remove(bridgePath)
 
+	// With --no-hooks there is no hook to start the streamer
+	if conversationID != "" {
+		wait := *waitTranscript
+		if wait == 0 {
+			if wait, err = transcriptWait(); err != nil {
+				fmt.Fprintf(os.Stderr, "greenlight: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		saveRelayID(conversationID, relayID, proj)
+		go streamToBridge(claudeTranscriptPath(cwd, conversationID), conversationID, bridgePath, wait)
+	}
+
 	// Export greenlight vars into the child process
 	exportEnvs := map[string]string{
 		"GREENLIGHT_DEVICE_ID":  devID,
 		"GREENLIGHT_SESSION_ID": relayID,
 		"GREENLIGHT_PROJECT":    proj,
 		"GREENLIGHT_BRIDGE":     bridgePath,
+		"GREENLIGHT_AGENT_NAME": agentNameFor(command),
+	}
+	if *noEnroll {
+		exportEnvs["GREENLIGHT_NO_ENROLL"] = "1"
+	}
+	if *waitTranscript > 0 {
+		// Picked up by the streamer the hook starts
+		exportEnvs["GREENLIGHT_TRANSCRIPT_WAIT"] = waitTranscript.String()
+	}
+	if enrollLater {
+		clearEnrollmentMarker(relayID)
+		exportEnvs["GREENLIGHT_ASYNC_ENROLL"] = "1"
 	}
 
-	r, err := New(command, cmdArgs, dialURL, devID, WSModeRW, exportEnvs)
+	r, err := New(command, cmdArgs, dialURL, wsAuthToken(devID), wsMode, exportEnvs)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "greenlight: %v\n", err)
 		os.Exit(1)
 	}
+	if statusSeq != nil {
+		r.statusKeys = newKeyMatcher(statusSeq)
+	}
+	r.suspendOnCtrlZ = suspendOnCtrlZ
+	r.idleTimeout = *idleTimeout
+	r.requestPending = func() bool { return requestPending(relayID) }
+	if *record != "" {
+		rec, err := newRecorder(*record, maxRecordSize, *recordGzip)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "greenlight: record: %v\n", err)
+			os.Exit(1)
+		}
+		r.recorder = rec
+		if verboseLogs(*verbose) {
+			mirrorLogs(recorderLog{rec})
+		}
+	}
+	if *shellPane {
+		shell := os.Getenv("SHELL")
+		if shell == "" {
+			shell = "/bin/sh"
+		}
+		if err := r.AddPane(shell, nil); err != nil {
+			fmt.Fprintf(os.Stderr, "greenlight: shell pane: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	// A relay that refuses us won't change its mind: end the session
+	// rather than relaying nowhere
+	wsRejected := make(chan error, 1)
+	if r.ws != nil {
+		r.ws.onFatal = func(err error) {
+			wsRejected <- err
+			r.Stop()
+		}
+		if enrollLater {
+			r.ws.awaitingApproval = func() bool {
+				_, err := os.Stat(enrollmentMarker(relayID))
+				return err != nil
+			}
+		}
+	}
+	if *rawInject && r.ws != nil {
+		r.ws.verbatim = true
+	}
+	if mirrorInputEnabled(*mirror) && r.ws != nil {
+		r.ws.onInput = r.mirrorInput
+	}
+	if spillEnabled() && r.ws != nil {
+		r.ws.EnableSpill(relayID)
+	}
+	if *allowFilePush && r.ws != nil {
+		cwd, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "greenlight: %v\n", err)
+			os.Exit(1)
+		}
+		r.ws.fileRoot = filepath.Join(cwd, filePushDir)
+	}
 
 	// Start bridge tailer — sends transcript lines from bridge file over WebSocket
 	var bridgeDone chan struct{}
@@ -123,28 +408,291 @@ func runConnect(args []string) {
 	if r.ws != nil {
 		bridgeDone = make(chan struct{})
 		bridgeFinished = make(chan struct{})
-		go func() {
-			tailBridge(bridgePath, r.ws, bridgeDone)
+		r.spawn(func() {
+			tailBridge(bridgePath, relayID, r.ws, bridgeDone)
 			close(bridgeFinished)
-		}()
+		})
+	}
+
+	stopMetrics := func() {}
+	if *metricsAddr != "" {
+		stop, err := startMetricsServer(*metricsAddr, r.ws)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "greenlight: metrics: %v\n", err)
+			os.Exit(1)
+		}
+		stopMetrics = stop
+	}
+
+	// Report that the session is alive while it runs, idle or not, and
+	// when the app takes control; enroll it if that was deferred
+	sessionDone := make(chan struct{})
+	if baseURL, err := serverBaseURL(relayURL); err == nil {
+		if interval := heartbeatInterval(); interval > 0 {
+			r.spawn(func() { heartbeat(baseURL, devID, proj, relayID, agentNameFor(command), interval, sessionDone) })
+		}
+		if enrollLater {
+			r.spawn(func() { enrollInBackground(baseURL, devID, relayID, proj, sessionDone) })
+		}
+		r.onRemoteInput = func() {
+			postActivity(baseURL, relayID, map[string]interface{}{
+				"device_id": devID,
+				"event":     "remote_input",
+				"project":   proj,
+				"relay_id":  relayID,
+				"agent":     agentNameFor(command),
+			})
+		}
+		if r.ws != nil {
+			r.ws.onConnect = func(reconnect int) {
+				payload := map[string]interface{}{
+					"device_id": devID,
+					"event":     "relay_connected",
+					"project":   proj,
+					"relay_id":  relayID,
+					"agent":     agentNameFor(command),
+				}
+				if reconnect > 0 {
+					payload["reconnect"] = reconnect
+				}
+				postActivity(baseURL, relayID, payload)
+			}
+			r.ws.onDisconnect = func(err error) {
+				postActivity(baseURL, relayID, map[string]interface{}{
+					"device_id": devID,
+					"event":     "relay_disconnected",
+					"project":   proj,
+					"relay_id":  relayID,
+					"agent":     agentNameFor(command),
+					"error":     err.Error(),
+				})
+			}
+		}
 	}
 
 	runErr := r.Run()
+	close(sessionDone)
+
+	// Tell the server how the agent ended, so the app can tell a crash
+	// from a clean exit; waited for below, before exiting
+	var exitPosted <-chan struct{}
+	if baseURL, err := serverBaseURL(relayURL); err == nil && r.cmd.ProcessState != nil {
+		payload := sessionExitPayload(r.cmd.ProcessState)
+		payload["device_id"] = devID
+		payload["project"] = proj
+		payload["relay_id"] = relayID
+		payload["agent"] = agentNameFor(command)
+		exitPosted = postActivity(baseURL, relayID, payload)
+	}
 
 	// Signal bridge tailer to drain remaining lines and wait for it
-	// to finish. This must happen before closing the WebSocket.
+	// to finish. This must happen before closing the WebSocket, but a
+	// wedged tailer mustn't keep us from exiting.
 	if bridgeDone != nil {
 		close(bridgeDone)
-		<-bridgeFinished
+		drain := bridgeDrainTimeout()
+		select {
+		case <-bridgeFinished:
+		case <-time.After(drain):
+			log.Printf("WARN: bridge did not drain within %v; undrained transcript lines may be lost", drain)
+		}
 	}
 
 	r.CloseWS()
+	if *verbose {
+		log.SetOutput(logOutput)
+	}
+	if err := r.recorder.close(); err != nil {
+		log.Printf("record: %v", err)
+	}
+	stopMetrics()
 
+	if *summary {
+		fmt.Fprintln(os.Stderr, sessionSummary(r, relayID))
+	}
+	os.Remove(decisionLogPath(relayID))
+	os.Remove(pendingRequestPath(relayID))
+	if exitPosted != nil {
+		waitBackground(exitPosted)
+	}
+
+	select {
+	case err := <-wsRejected:
+		fmt.Fprintf(os.Stderr, "greenlight: %s\n", explainFatal(err))
+		os.Exit(1)
+	default:
+	}
+	if r.IdledOut() {
+		fmt.Fprintf(os.Stderr, "greenlight: no activity for %v, session ended\n", *idleTimeout)
+		os.Exit(1)
+	}
 	if runErr != nil {
 		os.Exit(1)
 	}
 }
 
+// dryRunInfo is what `connect --dry-run` checks and reports.
+type dryRunInfo struct {
+	devID, proj, relayID string
+	dialURL, token       string
+	noEnroll             bool
+	settingsPath         string
+	hookEvents           []string
+	global               bool
+	noHooks              bool
+}
+
+// dryRunConnect finishes `connect --dry-run` once enrollment has succeeded:
+// it installs the hooks (unless --no-hooks), creates and removes the bridge file, and dials the
+// relay once, then prints a summary. Exits 1 if any step fails.
+func dryRunConnect(d dryRunInfo) {
+	failed := false
+
+	hooks := "skipped (--no-hooks)"
+	if !d.noHooks {
+		hooks = d.settingsPath + " (" + strings.Join(d.hookEvents, ", ") + ")"
+		if err := installHooks(d.settingsPath, d.hookEvents, d.global); err != nil {
+			hooks = "FAILED: " + err.Error()
+			failed = true
+		}
+	}
+
+	bridge := "ok"
+	bridgePath := filepath.Join(os.TempDir(), "greenlight-bridge-"+d.relayID)
+	if f, err := os.Create(bridgePath); err != nil {
+		bridge = "FAILED: " + err.Error()
+		failed = true
+	} else {
+		f.Close()
+		os.Remove(bridgePath)
+	}
+
+	enroll := "ok"
+	if d.noEnroll {
+		enroll = "skipped (--no-enroll)"
+	}
+
+	var ws string
+	if elapsed, err := dialCheck(d.dialURL, d.token); err != nil {
+		ws = "FAILED: " + err.Error()
+		failed = true
+	} else {
+		ws = fmt.Sprintf("ok (%v)", elapsed.Round(time.Millisecond))
+	}
+
+	fmt.Printf("Device ID:  %s\n", d.devID)
+	fmt.Printf("Project:    %s\n", d.proj)
+	fmt.Printf("Session:    %s\n", d.relayID)
+	fmt.Printf("Relay:      %s\n", d.dialURL)
+	fmt.Printf("Enrollment: %s\n", enroll)
+	fmt.Printf("Hooks:      %s\n", hooks)
+	fmt.Printf("Bridge:     %s\n", bridge)
+	fmt.Printf("WebSocket:  %s\n", ws)
+
+	if failed {
+		fmt.Fprintf(os.Stderr, "greenlight: dry run failed\n")
+		os.Exit(1)
+	}
+}
+
+// agentCommand resolves the agent command line to launch:
+// flag > env > config file > claude.
+func agentCommand(flagValue string) ([]string, error) {
+	agentCmd := flagValue
+	if agentCmd == "" {
+		agentCmd = envOrConfig("GREENLIGHT_AGENT", "agent")
+	}
+	if agentCmd == "" {
+		agentCmd = "claude"
+	}
+	fields := strings.Fields(agentCmd)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("invalid agent command %q", agentCmd)
+	}
+	return fields, nil
+}
+
+// checkAgentInstalled reports an actionable error if the agent command
+// can't be found, so we fail before enrolling the session and installing
+// hooks rather than when the child is started.
+func checkAgentInstalled(command string) error {
+	if _, err := exec.LookPath(command); err != nil {
+		if command == "claude" {
+			return fmt.Errorf("claude not found in PATH; install Claude Code or set --agent")
+		}
+		return fmt.Errorf("agent %q not found; check --agent, GREENLIGHT_AGENT or agent in the config file", command)
+	}
+	return nil
+}
+
+// enrollUnlessSkipped enrolls the session with the relay server, unless
+// the relay is pre-authorized and enrollment was explicitly skipped.
+func enrollUnlessSkipped(relayURL, devID, relayID, proj string, noEnroll bool) error {
+	if noEnroll {
+		log.Printf("Skipping session enrollment (--no-enroll)")
+		return nil
+	}
+
+	// Derive HTTP base URL for enrollment
+	baseURL, err := serverBaseURL(relayURL)
+	if err != nil {
+		return err
+	}
+	if err := enrollSession(baseURL, devID, relayID, proj); err != nil {
+		return fmt.Errorf("session enrollment failed: %w", err)
+	}
+	return nil
+}
+
+// enrollInBackground enrolls the session for connect --async-enroll,
+// retrying with backoff until it is approved or done is closed. Hooks deny
+// permission requests until the enrollment marker appears.
+func enrollInBackground(baseURL, devID, relayID, proj string, done <-chan struct{}) {
+	for attempt := 0; ; attempt++ {
+		err := enrollSession(baseURL, devID, relayID, proj)
+		if err == nil {
+			markEnrolled(relayID)
+			log.Printf("Session enrolled")
+			return
+		}
+		delay := backoff(attempt)
+		log.Printf("Background enrollment failed (%v), retrying in %v", err, delay)
+		select {
+		case <-done:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// bridgeDrainTimeout returns how long connect waits on exit for the bridge
+// tailer to send the remaining transcript lines.
+func bridgeDrainTimeout() time.Duration {
+	v := envOrConfig("GREENLIGHT_BRIDGE_DRAIN_TIMEOUT", "bridge_drain_timeout")
+	if v == "" {
+		return defaultBridgeDrainTimeout
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Warning: invalid bridge drain timeout %q, using %v", v, defaultBridgeDrainTimeout)
+		return defaultBridgeDrainTimeout
+	}
+	return d
+}
+
+// relayDialURL adds the session's relay ID and project to a relay URL.
+func relayDialURL(relayURL, relayID, project string) (string, error) {
+	u, err := relayWSURL(relayURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("relay_id", relayID)
+	q.Set("project", project)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
 func generateUUID() string {
 	var b [16]byte
 	rand.Read(b[:])
@@ -152,3 +700,13 @@ func generateUUID() string {
 	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
 	return fmt.Sprintf("%08x-%04x-%04x-%04x-%012x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
 }
+
+// agentNameFor returns the agent name reported to the server for a launched
+// command: "claude-code" for Claude Code, otherwise the command's base name.
+func agentNameFor(command string) string {
+	name := filepath.Base(command)
+	if name == "claude" {
+		return "claude-code"
+	}
+	return name
+}
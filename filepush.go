@@ -0,0 +1,128 @@
+//go:build darwin || linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// filePushDir is the subdirectory of the working directory that files
+// pushed from the relay are written into (connect --allow-file-push).
+const filePushDir = ".greenlight-inbox"
+
+// maxFilePushSize is the largest decoded file accepted from the relay.
+const maxFilePushSize = 10 << 20
+
+// fileFrame is a control frame asking to drop a file into the session:
+// {"type":"file","path":"notes/todo.md","content_b64":"..."}
+type fileFrame struct {
+	Type       string `json:"type"`
+	Path       string `json:"path"`
+	ContentB64 string `json:"content_b64"`
+}
+
+// parseFileFrame reports whether data is a file control frame.
+func parseFileFrame(data []byte) (*fileFrame, bool) {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return nil, false
+	}
+	var f fileFrame
+	if err := json.Unmarshal(data, &f); err != nil || f.Type != "file" {
+		return nil, false
+	}
+	return &f, true
+}
+
+// writePushedFile decodes a file frame and writes it below root. The path
+// must be relative and may not escape root, either with ".." or through a
+// symlink. Returns the path written.
+func writePushedFile(root string, f *fileFrame) (string, error) {
+	rel := f.Path
+	if rel == "" || filepath.IsAbs(rel) {
+		return "", fmt.Errorf("invalid path %q: must be relative", rel)
+	}
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if part == ".." {
+			return "", fmt.Errorf("invalid path %q: must not contain '..'", rel)
+		}
+	}
+	if len(f.ContentB64) > base64.StdEncoding.EncodedLen(maxFilePushSize) {
+		return "", fmt.Errorf("file %q too large (max %d bytes)", rel, maxFilePushSize)
+	}
+	content, err := base64.StdEncoding.DecodeString(f.ContentB64)
+	if err != nil {
+		return "", fmt.Errorf("decode %q: %w", rel, err)
+	}
+	if len(content) > maxFilePushSize {
+		return "", fmt.Errorf("file %q too large (max %d bytes)", rel, maxFilePushSize)
+	}
+
+	// Create root and parent directories one at a time, refusing to
+	// follow a symlink so nothing inside the sandbox, or the sandbox
+	// itself if a repository commits it as a symlink, can redirect the
+	// write.
+	fi, err := os.Lstat(root)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(root, 0755)
+	} else if err == nil && !fi.IsDir() {
+		err = fmt.Errorf("%s is not a directory", root)
+	}
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(filepath.Clean(rel), string(filepath.Separator))
+	dir := root
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(dir, 0755); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if !fi.IsDir() {
+			return "", fmt.Errorf("invalid path %q: %s is not a directory", rel, part)
+		}
+	}
+	dest := filepath.Join(dir, parts[len(parts)-1])
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := out.Write(content); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// handleFileFrame writes a pushed file if file push is enabled, and
+// otherwise drops it.
+func (c *WSClient) handleFileFrame(f *fileFrame) {
+	if c.fileRoot == "" {
+		log.Printf("ws: ignoring file push %q (not enabled; use --allow-file-push)", f.Path)
+		return
+	}
+	dest, err := writePushedFile(c.fileRoot, f)
+	if err != nil {
+		log.Printf("ws: file push rejected: %v", err)
+		return
+	}
+	log.Printf("ws: wrote pushed file %s", dest)
+}
@@ -3,7 +3,10 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -21,6 +24,7 @@ type hookInput struct {
 	HookEventName    string          `json:"hook_event_name"`
 	ToolName         string          `json:"tool_name"`
 	ToolInput        json.RawMessage `json:"tool_input"`
+	ToolResponse     json.RawMessage `json:"tool_response"`
 	SessionID        string          `json:"session_id"`
 	TranscriptPath   string          `json:"transcript_path"`
 	NotificationType string          `json:"notification_type"`
@@ -28,36 +32,110 @@ type hookInput struct {
 	Title            string          `json:"title"`
 }
 
+// Long-poll timeout for /request, overridable with GREENLIGHT_REQUEST_TIMEOUT
+// or request_timeout in the config file, within the given bounds.
+const (
+	defaultRequestTimeout = 595 * time.Second
+	minRequestTimeout     = 10 * time.Second
+	maxRequestTimeout     = 600 * time.Second
+)
+
+// A /request rejected with 401 is retried after re-enrolling up to
+// maxReenrollRetries times, waiting reenrollBackoff (doubling) between
+// later attempts.
+const (
+	maxReenrollRetries = 2
+	reenrollBackoff    = 500 * time.Millisecond
+)
+
+// agentName returns the agent reported in activity and request payloads.
+// connect exports it as GREENLIGHT_AGENT_NAME for the agent it launched.
+func agentName() string {
+	if name := os.Getenv("GREENLIGHT_AGENT_NAME"); name != "" {
+		return name
+	}
+	return "claude-code"
+}
+
+// hookRelayID is the relay the current hook invocation belongs to; its
+// permission decisions are tallied for connect --summary.
+var hookRelayID string
+
+// hookOutputFile, if set, receives a copy of the decision JSON written to
+// stdout (hook --output-file).
+var hookOutputFile string
+
+// hookPrettyOutput indents the decision JSON for reading (hook --test).
+var hookPrettyOutput bool
+
 func runHook(args []string) {
-	baseURL, err := serverBaseURL()
-	if err != nil {
-		denyAndExit("Greenlight server not configured: " + err.Error())
+	fs := flag.NewFlagSet("hook", flag.ExitOnError)
+	outputFile := fs.String("output-file", "", "Also write the decision JSON to this file")
+	connectedOnly := fs.Bool("connected-only", false, "Do nothing unless the agent was started by greenlight (used by global hooks)")
+	verbose := fs.Bool("verbose", false, "Also write log messages to stderr (shown in Claude Code's transcript view)")
+	testMode := fs.Bool("test", false, "Send a PermissionRequest built from --tool and --input instead of reading one from stdin, and print the decision")
+	testTool := fs.String("tool", "", "Tool name for --test (e.g. Bash)")
+	testInput := fs.String("input", "{}", `Tool input JSON for --test (e.g. '{"command":"ls"}')`)
+	fs.Parse(args)
+	if verboseLogs(*verbose) {
+		mirrorLogs(os.Stderr)
+	}
+	if *testMode {
+		if *testTool == "" {
+			fmt.Fprintf(os.Stderr, "greenlight hook: --test needs --tool\n")
+			os.Exit(1)
+		}
+		if !json.Valid([]byte(*testInput)) {
+			fmt.Fprintf(os.Stderr, "greenlight hook: --input is not valid JSON: %s\n", *testInput)
+			os.Exit(1)
+		}
+		hookPrettyOutput = true
 	}
 
-	// Resolve device ID: env > config file
-	deviceID := os.Getenv("GREENLIGHT_DEVICE_ID")
-	if deviceID == "" {
-		deviceID = readConfigValue("device_id")
+	// Global hooks fire for every Claude Code session; leave the ones
+	// greenlight didn't start to Claude Code's own prompts
+	if *connectedOnly && os.Getenv("GREENLIGHT_SESSION_ID") == "" {
+		os.Exit(0)
 	}
+
+	hookOutputFile = *outputFile
+
+	// Resolve device ID and project: env > config file
+	cfg := resolveConfig("", "")
+	deviceID := cfg.DeviceID
 	if deviceID == "" {
 		denyAndExit("Greenlight device ID not configured. See https://getgreenlight.github.io/support.html")
 	}
 
-	project := os.Getenv("GREENLIGHT_PROJECT")
+	project := cfg.Project
 	if project == "" {
 		denyAndExit("Greenlight project not configured. Run: greenlight connect --project PROJECT_NAME")
 	}
 
-	relayID := os.Getenv("GREENLIGHT_SESSION_ID")
-
-	// Read hook input from stdin
-	inputData, err := io.ReadAll(os.Stdin)
+	relayURL, err := relayURLFor(project)
+	if err != nil {
+		denyAndExit("Greenlight server not configured: " + err.Error())
+	}
+	baseURL, err := serverBaseURL(relayURL)
 	if err != nil {
-		denyAndExit("Failed to read hook input: " + err.Error())
+		denyAndExit("Greenlight server not configured: " + err.Error())
 	}
+	if _, err := relayTransport(); err != nil {
+		denyAndExit("Greenlight TLS configuration error: " + err.Error())
+	}
+
+	relayID := os.Getenv("GREENLIGHT_SESSION_ID")
 
+	// Decode hook input straight from stdin. The raw bytes are kept only
+	// for PermissionRequest, which forwards the whole payload.
 	var input hookInput
-	if err := json.Unmarshal(inputData, &input); err != nil {
+	var inputData []byte
+	if *testMode {
+		input, inputData, err = testPermissionRequest(*testTool, *testInput)
+	} else {
+		input, inputData, err = readHookInput(os.Stdin)
+	}
+	if err != nil {
 		denyAndExit("Failed to parse hook input: " + err.Error())
 	}
 
@@ -65,6 +143,9 @@ func runHook(args []string) {
 	if input.HookEventName == "" {
 		input.HookEventName = "PermissionRequest"
 	}
+	if input.HookEventName != "PermissionRequest" {
+		inputData = nil
+	}
 
 	log.Printf("hook: event=%s session=%s relay=%s", input.HookEventName, input.SessionID, relayID)
 
@@ -72,6 +153,10 @@ func runHook(args []string) {
 	if relayID == "" {
 		relayID = input.SessionID
 	}
+	if !*testMode {
+		// Test decisions don't count towards the session's summary
+		hookRelayID = relayID
+	}
 
 	switch input.HookEventName {
 	case "SessionStart":
@@ -80,8 +165,16 @@ func runHook(args []string) {
 		handlePermissionRequest(baseURL, deviceID, project, relayID, input, inputData)
 	case "Notification":
 		handleNotification(baseURL, deviceID, project, relayID, input)
+	case "Stop":
+		handleTurnEnd(baseURL, deviceID, project, relayID, input)
+	case "SessionEnd":
+		handleSessionEnd(baseURL, deviceID, project, relayID, input)
+	case "PreToolUse":
+		handleToolUse(baseURL, deviceID, project, relayID, "tool_pre", input)
+	case "PostToolUse":
+		handleToolUse(baseURL, deviceID, project, relayID, "tool_post", input)
 	default:
-		// Unknown event — exit silently
+		// Recognized but unhandled, or unknown event — exit silently
 		os.Exit(0)
 	}
 }
@@ -111,8 +204,8 @@ func handleSessionStart(baseURL, deviceID, project, relayID string, input hookIn
 		os.Exit(0)
 	}
 
-	// Eagerly enroll session
-	if err := enrollSessionWithMarker(baseURL, deviceID, relayID, project); err != nil {
+	// Eagerly enroll session, unless connect is already doing so
+	if err := enrollSessionWithMarker(baseURL, deviceID, relayID, project); err != nil && err != errEnrollmentPending {
 		log.Printf("Session enrollment failed: %v", err)
 		os.Exit(0)
 	}
@@ -125,15 +218,13 @@ func handleSessionStart(baseURL, deviceID, project, relayID string, input hookIn
 		"tool_input": map[string]interface{}{},
 		"project":    project,
 		"relay_id":   relayID,
-		"agent":      "claude-code",
+		"agent":      agentName(),
 	}
-	go func() {
-		postJSON(baseURL+"/activity", payload, 10*time.Second)
-	}()
+	activityDone := postActivity(baseURL, relayID, payload)
 
 	// Persist conversation → relay mapping so resumed sessions reuse the same relay ID
 	if input.SessionID != "" && relayID != "" {
-		saveRelayID(input.SessionID, relayID)
+		saveRelayID(input.SessionID, relayID, project)
 	}
 
 	// Start transcript streamer if transcript path is available
@@ -146,42 +237,116 @@ func handleSessionStart(baseURL, deviceID, project, relayID string, input hookIn
 		maybeStartStreamer(baseURL, deviceID, project, relayID, sessionID, transcriptPath)
 	}
 
+	waitBackground(activityDone)
 	os.Exit(0)
 }
 
+// readHookInput decodes a single JSON object from r, returning it along
+// with the bytes it was decoded from. The object is read once, as raw
+// bytes, and hookInput's fields are unmarshaled from those, so there is no
+// second copy of the input beside the decoder's buffer. Trailing data after
+// the object is an error, as it would be for json.Unmarshal.
+func readHookInput(r io.Reader) (hookInput, []byte, error) {
+	var input hookInput
+	var raw json.RawMessage
+	dec := json.NewDecoder(r)
+	if err := dec.Decode(&raw); err != nil {
+		return input, nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		if err == nil {
+			err = errors.New("unexpected data after hook input")
+		}
+		return input, nil, err
+	}
+	if err := json.Unmarshal(raw, &input); err != nil {
+		return input, nil, err
+	}
+	return input, raw, nil
+}
+
+// testPermissionRequest builds the PermissionRequest Claude Code would send
+// for a call to tool with the given input JSON (hook --test).
+func testPermissionRequest(tool, toolInput string) (hookInput, []byte, error) {
+	data, err := json.Marshal(map[string]interface{}{
+		"hook_event_name": "PermissionRequest",
+		"tool_name":       tool,
+		"tool_input":      json.RawMessage(toolInput),
+	})
+	if err != nil {
+		return hookInput{}, nil, err
+	}
+	return readHookInput(bytes.NewReader(data))
+}
+
 func handlePermissionRequest(baseURL, deviceID, project, relayID string, input hookInput, rawInput []byte) {
+	// Local rules answer without asking the server, or enrolling
+	if rule := matchRules(loadRules(), input.ToolName, input.ToolInput); rule != nil {
+		log.Printf("hook: %s %s by rule at %s", rule.behavior, input.ToolName, rule.source)
+		if rule.behavior == "allow" {
+			allowAndExit()
+		}
+		denyAndExit(fmt.Sprintf("Denied by Greenlight rule at %s", rule.source))
+	}
+
+	if enrollmentPending(relayID) {
+		denyAndExit("Greenlight is waiting for device approval: approve this session in the Greenlight app, then try again")
+	}
+
 	// Start transcript streamer if not already running
 	if relayID != "" && input.TranscriptPath != "" {
 		enrollSessionWithMarker(baseURL, deviceID, relayID, project)
 		maybeStartStreamer(baseURL, deviceID, project, relayID, input.SessionID, input.TranscriptPath)
 	}
 
-	// Build payload: merge original input with our metadata
+	// Build payload: merge original input with our metadata. Every field
+	// Claude Code sent is forwarded, including ones hookInput doesn't
+	// know; numbers are kept as written rather than rounded to float64.
 	var payload map[string]interface{}
-	if err := json.Unmarshal(rawInput, &payload); err != nil {
+	dec := json.NewDecoder(bytes.NewReader(rawInput))
+	dec.UseNumber()
+	if err := dec.Decode(&payload); err != nil {
 		denyAndExit("Failed to parse hook input: " + err.Error())
 	}
+	if payload == nil {
+		denyAndExit("Failed to parse hook input: not a JSON object")
+	}
+	if _, ok := payload["cwd"]; !ok {
+		// Claude Code sends it, but older versions didn't
+		if cwd, err := os.Getwd(); err == nil {
+			payload["cwd"] = cwd
+		}
+	}
 	payload["device_id"] = deviceID
 	payload["project"] = project
 	payload["relay_id"] = relayID
-	payload["agent"] = "claude-code"
+	payload["agent"] = agentName()
 
-	// Send to server (long-poll)
-	resp, err := postJSON(baseURL+"/request", payload, 595*time.Second)
+	// Send to server (long-poll). Waiting for the phone isn't idleness, so
+	// connect --idle-timeout leaves the session alone meanwhile.
+	holdPendingRequest(relayID)
+	timeout := requestTimeout()
+	resp, err := postJSON(baseURL+"/request", payload, timeout)
 	if err != nil {
 		denyInterruptAndExit("Failed to reach Greenlight server (timeout or connection error)")
 	}
 	defer resp.Body.Close()
 
-	// Handle 401 — enroll and retry
-	if resp.StatusCode == 401 && relayID != "" {
+	// Handle 401 — re-enroll and retry, in case the server session expired
+	// again between enrolling and retrying
+	backoff := reenrollBackoff
+	for attempt := 0; resp.StatusCode == 401 && relayID != "" && attempt < maxReenrollRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
 		clearEnrollmentMarker(relayID)
 		if err := enrollSessionWithMarker(baseURL, deviceID, relayID, project); err != nil {
 			denyAndExit("Greenlight session enrollment was rejected")
 		}
 		// Retry
 		resp.Body.Close()
-		resp, err = postJSON(baseURL+"/request", payload, 595*time.Second)
+		resp, err = postJSON(baseURL+"/request", payload, timeout)
 		if err != nil {
 			denyInterruptAndExit("Failed to reach Greenlight server (timeout or connection error)")
 		}
@@ -209,13 +374,22 @@ func handlePermissionRequest(baseURL, deviceID, project, relayID string, input h
 		denyAndExit(serverResp.Error)
 	}
 
-	if serverResp.Behavior == "allow" {
+	switch serverResp.Behavior {
+	case "allow":
 		if len(serverResp.UpdatedInput) > 0 {
 			allowWithUpdatedInput(serverResp.UpdatedInput)
 		} else {
 			allowAndExit()
 		}
-	} else {
+	case "ask":
+		// A PermissionRequest decision can only allow or deny, and only an
+		// allow can carry new input, so the user decides in the terminal
+		// on the original input
+		if len(serverResp.UpdatedInput) > 0 {
+			log.Printf("hook: ignoring updated_input for ask decision on %s", input.ToolName)
+		}
+		askAndExit(serverResp.Message)
+	default:
 		msg := serverResp.Message
 		if msg == "" {
 			msg = "Permission denied"
@@ -228,6 +402,32 @@ func handlePermissionRequest(baseURL, deviceID, project, relayID string, input h
 	}
 }
 
+// requestTimeout returns the configured /request long-poll timeout, clamped
+// to [minRequestTimeout, maxRequestTimeout].
+func requestTimeout() time.Duration {
+	v := envOrConfig("GREENLIGHT_REQUEST_TIMEOUT", "request_timeout")
+	if v == "" {
+		return defaultRequestTimeout
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Warning: invalid request timeout %q, using %v", v, defaultRequestTimeout)
+		return defaultRequestTimeout
+	}
+	if d < minRequestTimeout {
+		log.Printf("Warning: request timeout %v too short, using %v", d, minRequestTimeout)
+		return minRequestTimeout
+	}
+	if d > maxRequestTimeout {
+		log.Printf("Warning: request timeout %v too long, using %v", d, maxRequestTimeout)
+		return maxRequestTimeout
+	}
+	return d
+}
+
+// handleNotification forwards a notification to the app. Notifications
+// that need an answer go to /request; the rest go to /activity so they
+// don't clutter the approval queue (see notificationRoute).
 func handleNotification(baseURL, deviceID, project, relayID string, input hookInput) {
 	toolInput := map[string]string{
 		"notification_type": input.NotificationType,
@@ -239,37 +439,270 @@ func handleNotification(baseURL, deviceID, project, relayID string, input hookIn
 		"device_id":  deviceID,
 		"tool_name":  input.NotificationType,
 		"tool_input": toolInput,
+		"title":      input.Title,
+		"message":    input.Message,
 		"relay_id":   relayID,
-		"agent":      "claude-code",
+		"agent":      agentName(),
 	}
 	if project != "" {
 		payload["project"] = project
 	}
 
-	// Fire-and-forget
-	go func() {
-		postJSON(baseURL+"/request", payload, 10*time.Second)
-	}()
+	var done <-chan struct{}
+	if notificationRoute(input.NotificationType) == "activity" {
+		payload["event"] = "notification"
+		done = postActivity(baseURL, relayID, payload)
+	} else {
+		stampActivity(payload, relayID)
+
+		// Fire-and-forget, but give the POST a moment to go out before exiting
+		ch := make(chan struct{})
+		go func() {
+			defer close(ch)
+			if resp, err := postJSON(baseURL+"/request", payload, 10*time.Second); err == nil {
+				resp.Body.Close()
+			}
+		}()
+		done = ch
+	}
+	waitBackground(done)
+
+	os.Exit(0)
+}
+
+// defaultNotificationRoutes sends notifications the user has to act on to
+// /request; every other type goes to /activity.
+var defaultNotificationRoutes = map[string]string{
+	"permission_prompt":  "request",
+	"elicitation_dialog": "request",
+}
+
+// notificationRoute returns the endpoint ("request" or "activity") for a
+// notification type: notification_routes.<type> in the config file, then
+// notification_routes.default, then the built-in routes.
+func notificationRoute(notificationType string) string {
+	for _, key := range []string{"notification_routes." + notificationType, "notification_routes.default"} {
+		switch v := readConfigValue(key); v {
+		case "request", "activity":
+			return v
+		case "":
+		default:
+			log.Printf("Warning: invalid %s %q, ignoring", key, v)
+		}
+	}
+	if route, ok := defaultNotificationRoutes[notificationType]; ok {
+		return route
+	}
+	return "activity"
+}
+
+// handleTurnEnd reports a Stop event, which Claude Code fires at the end of
+// every turn, as turn_end. The session carries on, so its streamer,
+// enrollment and counters are left alone.
+func handleTurnEnd(baseURL, deviceID, project, relayID string, input hookInput) {
+	if relayID == "" {
+		os.Exit(0)
+	}
+	payload := map[string]interface{}{
+		"device_id":  deviceID,
+		"event":      "turn_end",
+		"tool_name":  input.HookEventName,
+		"tool_input": map[string]interface{}{},
+		"project":    project,
+		"relay_id":   relayID,
+		"agent":      agentName(),
+	}
+	waitBackground(postActivity(baseURL, relayID, payload))
+	os.Exit(0)
+}
+
+// handleSessionEnd reports session_end and cleans up after the session:
+// its streamer, stream offset, enrollment marker and seq counters.
+func handleSessionEnd(baseURL, deviceID, project, relayID string, input hookInput) {
+	if relayID == "" {
+		os.Exit(0)
+	}
+
+	payload := map[string]interface{}{
+		"device_id":  deviceID,
+		"event":      "session_end",
+		"tool_name":  input.HookEventName,
+		"tool_input": map[string]interface{}{},
+		"project":    project,
+		"relay_id":   relayID,
+		"agent":      agentName(),
+	}
+	activityDone := postActivity(baseURL, relayID, payload)
 
+	sessionID := input.SessionID
+	if sessionID == "" {
+		sessionID = relayID
+	}
+	stopStreamer(sessionID, relayID)
+	os.Remove(streamOffsetPath(sessionID))
+	clearEnrollmentMarker(relayID)
+	os.Remove(filepath.Join(os.TempDir(), "greenlight-seq-"+relayID))
+	os.Remove(transcriptSeqPath(relayID))
+
+	waitBackground(activityDone)
 	os.Exit(0)
 }
 
+// stopStreamer kills the transcript streamer for a session, if it is
+// running for relayID, and removes its PID file.
+func stopStreamer(sessionID, relayID string) {
+	pidFile := filepath.Join(os.TempDir(), "greenlight-stream-"+sessionID+".pid")
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		return
+	}
+	parts := strings.Fields(string(data))
+	if len(parts) < 2 || parts[1] != relayID {
+		return // not ours
+	}
+	if pid, _ := strconv.Atoi(parts[0]); pid > 0 {
+		terminateStreamer(pid)
+	}
+	os.Remove(pidFile)
+}
+
+// streamerStopGrace is how long terminateStreamer waits for a streamer
+// to send its pending batch and exit before killing it.
+const streamerStopGrace = 3 * time.Second
+
+// terminateStreamer sends the streamer SIGTERM, so it can send the lines
+// it has batched, and waits for it to exit, killing it after
+// streamerStopGrace.
+func terminateStreamer(pid int) {
+	syscall.Kill(pid, syscall.SIGTERM)
+	deadline := time.Now().Add(streamerStopGrace)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// handleToolUse reports a PreToolUse or PostToolUse event to /activity.
+// It never blocks the tool call beyond the activity grace period and
+// always exits 0 without a decision, so Claude proceeds as normal.
+func handleToolUse(baseURL, deviceID, project, relayID, event string, input hookInput) {
+	payload := map[string]interface{}{
+		"device_id":  deviceID,
+		"event":      event,
+		"tool_name":  input.ToolName,
+		"tool_input": rawOrEmpty(input.ToolInput),
+		"project":    project,
+		"relay_id":   relayID,
+		"agent":      agentName(),
+	}
+	if event == "tool_post" {
+		payload["tool_response"] = rawOrEmpty(input.ToolResponse)
+	}
+
+	waitBackground(postActivity(baseURL, relayID, payload))
+	os.Exit(0)
+}
+
+// rawOrEmpty returns msg, or an empty JSON object if msg is missing.
+func rawOrEmpty(msg json.RawMessage) json.RawMessage {
+	if len(msg) == 0 {
+		return json.RawMessage("{}")
+	}
+	return msg
+}
+
 // enrollSessionWithMarker enrolls the session if not already enrolled (marker file check).
+// Enrollment is skipped entirely when GREENLIGHT_NO_ENROLL=1 (set by connect --no-enroll).
 func enrollSessionWithMarker(baseURL, deviceID, relayID, project string) error {
-	marker := filepath.Join(os.TempDir(), "greenlight-enrolled-"+relayID)
-	if _, err := os.Stat(marker); err == nil {
+	if os.Getenv("GREENLIGHT_NO_ENROLL") == "1" {
+		return nil
+	}
+	if enrollmentPending(relayID) {
+		return errEnrollmentPending // connect is enrolling in the background
+	}
+	if _, err := os.Stat(enrollmentMarker(relayID)); err == nil {
 		return nil // already enrolled
 	}
 	if err := enrollSession(baseURL, deviceID, relayID, project); err != nil {
 		return err
 	}
-	os.WriteFile(marker, nil, 0644)
+	markEnrolled(relayID)
 	return nil
 }
 
+// errEnrollmentPending is returned while connect --async-enroll is still
+// waiting for the session to be approved.
+var errEnrollmentPending = errors.New("waiting for device approval")
+
+// enrollmentPending reports whether connect --async-enroll is enrolling the
+// session in the background and it hasn't been approved yet.
+func enrollmentPending(relayID string) bool {
+	if os.Getenv("GREENLIGHT_ASYNC_ENROLL") != "1" || relayID == "" {
+		return false
+	}
+	_, err := os.Stat(enrollmentMarker(relayID))
+	return err != nil
+}
+
+// enrollmentMarker returns the file whose existence records that relayID
+// has been enrolled, so later hooks don't enroll it again.
+func enrollmentMarker(relayID string) string {
+	return filepath.Join(os.TempDir(), "greenlight-enrolled-"+relayID)
+}
+
+// pendingRequestPath returns the file permission hooks hold a shared lock
+// on while they wait for an answer, so connect can tell a session that is
+// blocked on the phone from an idle one.
+func pendingRequestPath(relayID string) string {
+	return filepath.Join(os.TempDir(), "greenlight-pending-"+relayID)
+}
+
+// pendingRequestFile keeps the lock taken by holdPendingRequest until the
+// hook exits; the file must stay referenced so it isn't closed by GC.
+var pendingRequestFile *os.File
+
+// holdPendingRequest marks a permission request for relayID as waiting
+// for an answer until the hook exits.
+func holdPendingRequest(relayID string) {
+	if relayID == "" {
+		return
+	}
+	f, err := os.OpenFile(pendingRequestPath(relayID), os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+		f.Close()
+		return
+	}
+	pendingRequestFile = f
+}
+
+// requestPending reports whether a permission hook for relayID is waiting
+// for an answer (see holdPendingRequest).
+func requestPending(relayID string) bool {
+	f, err := os.Open(pendingRequestPath(relayID))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == nil {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		return false
+	}
+	return errors.Is(err, syscall.EWOULDBLOCK)
+}
+
+func markEnrolled(relayID string) {
+	os.WriteFile(enrollmentMarker(relayID), nil, 0644)
+}
+
 func clearEnrollmentMarker(relayID string) {
-	marker := filepath.Join(os.TempDir(), "greenlight-enrolled-"+relayID)
-	os.Remove(marker)
+	os.Remove(enrollmentMarker(relayID))
 }
 
 // maybeStartStreamer starts the transcript streamer subprocess if not already running.
@@ -283,26 +716,30 @@ func maybeStartStreamer(baseURL, deviceID, project, relayID, sessionID, transcri
 
 	pidFile := filepath.Join(os.TempDir(), "greenlight-stream-"+sessionID+".pid")
 
+	// Hold an exclusive lock on the PID file across the check and spawn, so
+	// hooks firing together (e.g. SessionStart and the first
+	// PermissionRequest) don't both start a streamer. Whoever doesn't get
+	// the lock leaves it to the one that did.
+	f, err := lockPIDFile(pidFile, true)
+	if err != nil {
+		if err != errLocked {
+			log.Printf("Failed to lock streamer PID file: %v", err)
+		}
+		return
+	}
+	defer f.Close()
+
 	// Check existing streamer
-	if data, err := os.ReadFile(pidFile); err == nil {
-		parts := strings.Fields(string(data))
-		if len(parts) >= 2 {
-			pid, _ := strconv.Atoi(parts[0])
-			existingRelay := parts[1]
-			if pid > 0 && existingRelay == relayID {
-				// Check if process is still alive
-				if proc, err := os.FindProcess(pid); err == nil {
-					if proc.Signal(nil) == nil {
-						return // streamer already running with correct relay ID
-					}
-				}
-			}
-			// Kill stale streamer
-			if pid > 0 {
-				if proc, err := os.FindProcess(pid); err == nil {
-					proc.Signal(os.Kill)
-				}
+	buf := make([]byte, 128)
+	n, _ := f.ReadAt(buf, 0)
+	if parts := strings.Fields(string(buf[:n])); len(parts) >= 2 {
+		pid, _ := strconv.Atoi(parts[0])
+		if processAlive(pid) {
+			if parts[1] == relayID {
+				return // streamer already running with correct relay ID
 			}
+			// Stop the stale streamer
+			terminateStreamer(pid)
 		}
 	}
 
@@ -310,6 +747,7 @@ func maybeStartStreamer(baseURL, deviceID, project, relayID, sessionID, transcri
 	exePath, err := os.Executable()
 	if err != nil {
 		log.Printf("Failed to resolve executable: %v", err)
+		os.Remove(pidFile)
 		return
 	}
 	// Resolve symlinks so we invoke the real binary (not greenlight-hook symlink)
@@ -345,16 +783,53 @@ func maybeStartStreamer(baseURL, deviceID, project, relayID, sessionID, transcri
 
 	if err := cmd.Start(); err != nil {
 		log.Printf("Failed to start streamer: %v", err)
+		os.Remove(pidFile)
 		return
 	}
 
 	// Write PID file
-	os.WriteFile(pidFile, []byte(fmt.Sprintf("%d %s", cmd.Process.Pid, relayID)), 0644)
+	f.Truncate(0)
+	f.WriteAt([]byte(fmt.Sprintf("%d %s", cmd.Process.Pid, relayID)), 0)
 
 	// Don't wait for the child — it's detached
 	cmd.Process.Release()
 }
 
+// errLocked is returned by lockPIDFile when another process holds the lock.
+var errLocked = errors.New("locked by another process")
+
+// lockPIDFile opens path, creating it if needed, and takes an exclusive
+// flock on it, failing with errLocked instead of waiting if nonblock is
+// set. The streamer removes its PID file when it exits, so the lock is only
+// kept if path still names the locked file afterwards; otherwise it is
+// retried on the new file.
+func lockPIDFile(path string, nonblock bool) (*os.File, error) {
+	how := syscall.LOCK_EX
+	if nonblock {
+		how |= syscall.LOCK_NB
+	}
+	for i := 0; i < 3; i++ {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := syscall.Flock(int(f.Fd()), how); err != nil {
+			f.Close()
+			if errors.Is(err, syscall.EWOULDBLOCK) {
+				return nil, errLocked
+			}
+			return nil, err
+		}
+		locked, err1 := f.Stat()
+		current, err2 := os.Stat(path)
+		if err1 == nil && err2 == nil && os.SameFile(locked, current) {
+			return f, nil
+		}
+		f.Close()
+	}
+	return nil, errLocked
+}
+
 // Hook output helpers
 
 func denyAndExit(message string) {
@@ -367,7 +842,7 @@ func denyAndExit(message string) {
 			},
 		},
 	}
-	json.NewEncoder(os.Stdout).Encode(output)
+	writeDecision(output)
 	os.Exit(0)
 }
 
@@ -382,7 +857,7 @@ func denyInterruptAndExit(message string) {
 			},
 		},
 	}
-	json.NewEncoder(os.Stdout).Encode(output)
+	writeDecision(output)
 	os.Exit(0)
 }
 
@@ -395,7 +870,7 @@ func allowAndExit() {
 			},
 		},
 	}
-	json.NewEncoder(os.Stdout).Encode(output)
+	writeDecision(output)
 	os.Exit(0)
 }
 
@@ -409,10 +884,47 @@ func allowWithUpdatedInput(updatedInput map[string]interface{}) {
 			},
 		},
 	}
-	json.NewEncoder(os.Stdout).Encode(output)
+	writeDecision(output)
 	os.Exit(0)
 }
 
+// askAndExit leaves the decision to Claude Code, which then shows its own
+// permission prompt in the terminal. A non-empty message is shown to the
+// user alongside it.
+func askAndExit(message string) {
+	output := map[string]interface{}{}
+	if message != "" {
+		output["systemMessage"] = message
+	}
+	writeDecision(output)
+	os.Exit(0)
+}
+
+// writeDecision writes the hook decision JSON to stdout, and tees the same
+// bytes to hookOutputFile if set.
+func writeDecision(output map[string]interface{}) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if hookPrettyOutput {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(output)
+	os.Stdout.Write(buf.Bytes())
+
+	if hookOutputFile != "" {
+		if err := os.WriteFile(hookOutputFile, buf.Bytes(), 0644); err != nil {
+			log.Printf("hook: write output file: %v", err)
+		}
+	}
+
+	if hso, ok := output["hookSpecificOutput"].(map[string]interface{}); ok {
+		if d, ok := hso["decision"].(map[string]interface{}); ok {
+			behavior, _ := d["behavior"].(string)
+			recordDecision(hookRelayID, behavior)
+		}
+	}
+}
+
 // detachedSysProcAttr returns SysProcAttr for a detached subprocess.
 func detachedSysProcAttr() *syscall.SysProcAttr {
 	return &syscall.SysProcAttr{
@@ -4,23 +4,340 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-// serverBaseURL derives the HTTPS base URL from the build-time wsURL.
+var (
+	transportOnce sync.Once
+	transport     *http.Transport
+	transportErr  error
+)
+
+// relayTransport returns the shared HTTP transport used for all requests to
+// the relay server, including the WebSocket handshake. It is built once from
+// the TLS and proxy settings; a bad setting is returned as an error on every
+// call.
+func relayTransport() (*http.Transport, error) {
+	transportOnce.Do(func() {
+		cfg, err := relayTLSConfig()
+		if err != nil {
+			transportErr = err
+			return
+		}
+		proxy, err := relayProxy()
+		if err != nil {
+			transportErr = err
+			return
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = cfg
+		t.Proxy = proxy
+		if proxy != nil {
+			t.Proxy = func(req *http.Request) (*url.URL, error) {
+				if _, ok := unixSockets.Load(req.URL.Hostname()); ok {
+					return nil, nil
+				}
+				return proxy(req)
+			}
+		}
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				if path, ok := unixSockets.Load(host); ok {
+					return dialer.DialContext(ctx, "unix", path.(string))
+				}
+			}
+			return dialer.DialContext(ctx, network, addr)
+		}
+		transport = t
+	})
+	return transport, transportErr
+}
+
+// relayProxy returns the proxy selection for relay connections.
+// GREENLIGHT_PROXY (or proxy in the config file) is used for every request,
+// and "none" connects directly. Otherwise HTTPS_PROXY, HTTP_PROXY and
+// NO_PROXY apply as usual, with ALL_PROXY used when neither of the first two
+// is set. Proxies may be http://, https:// or socks5:// URLs.
+func relayProxy() (func(*http.Request) (*url.URL, error), error) {
+	if v := envOrConfig("GREENLIGHT_PROXY", "proxy"); v != "" {
+		if v == "none" {
+			return nil, nil
+		}
+		u, err := parseProxyURL(v)
+		if err != nil {
+			return nil, fmt.Errorf("GREENLIGHT_PROXY: %w", err)
+		}
+		return http.ProxyURL(u), nil
+	}
+
+	all := getenvAny("ALL_PROXY", "all_proxy")
+	if all == "" || getenvAny("HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy") != "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := parseProxyURL(all)
+	if err != nil {
+		return nil, fmt.Errorf("ALL_PROXY: %w", err)
+	}
+	noProxy := getenvAny("NO_PROXY", "no_proxy")
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL.Hostname(), noProxy) {
+			return nil, nil
+		}
+		return u, nil
+	}, nil
+}
+
+// parseProxyURL parses a proxy setting. A bare host:port means an HTTP proxy.
+func parseProxyURL(v string) (*url.URL, error) {
+	if !strings.Contains(v, "://") {
+		v = "http://" + v
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		return nil, fmt.Errorf("bad proxy URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (want http, https or socks5)", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy URL %q has no host", v)
+	}
+	return u, nil
+}
+
+// bypassProxy reports whether host should be reached directly: loopback
+// hosts, and hosts matching a NO_PROXY entry ("*", a host name, or a domain
+// suffix such as ".example.com" or "example.com").
+func bypassProxy(host, noProxy string) bool {
+	if host == "localhost" {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		entry = strings.TrimPrefix(entry, ".")
+		host = strings.ToLower(host)
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// getenvAny returns the first non-empty value among the named env vars.
+func getenvAny(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// relayTLSConfig builds the TLS config for relay connections.
+// GREENLIGHT_CLIENT_CERT/GREENLIGHT_CLIENT_KEY (or client_cert/client_key in
+// the config file) name a PEM certificate and key presented for mutual TLS.
+// GREENLIGHT_CA_CERT (or ca_cert) names a PEM bundle of extra root CAs for
+// relays with a private or self-signed certificate.
+func relayTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{}
+
+	certFile := envOrConfig("GREENLIGHT_CLIENT_CERT", "client_cert")
+	keyFile := envOrConfig("GREENLIGHT_CLIENT_KEY", "client_key")
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("client certificate requires both GREENLIGHT_CLIENT_CERT and GREENLIGHT_CLIENT_KEY")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile := envOrConfig("GREENLIGHT_CA_CERT", "ca_cert"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA certificate: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if insecureSkipVerify() {
+		fmt.Fprintf(os.Stderr, "greenlight: WARNING: TLS certificate verification is disabled (GREENLIGHT_INSECURE_SKIP_VERIFY); anyone on the network path can read and alter the session. Use only for local testing.\n")
+		log.Printf("WARNING: TLS certificate verification is disabled")
+		cfg.InsecureSkipVerify = true
+	}
+
+	return cfg, nil
+}
+
+// insecureSkipVerify reports whether GREENLIGHT_INSECURE_SKIP_VERIFY turns
+// off certificate verification, for local testing against a relay with a
+// throwaway certificate. It is deliberately not read from the config file,
+// where it could be left on and forgotten.
+func insecureSkipVerify() bool {
+	v := os.Getenv("GREENLIGHT_INSECURE_SKIP_VERIFY")
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Warning: invalid GREENLIGHT_INSECURE_SKIP_VERIFY %q, using false", v)
+		return false
+	}
+	return b
+}
+
+// newHTTPClient returns an http.Client for the relay server using the
+// shared transport.
+func newHTTPClient(timeout time.Duration) (*http.Client, error) {
+	t, err := relayTransport()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: t, Timeout: timeout}, nil
+}
+
+// resolveRelayURL returns the relay URL to use in place of the build-time
+// wsURL: GREENLIGHT_RELAY_URL or relay_url in the config file, for
+// self-hosted relays, or wsURL if neither is set.
+func resolveRelayURL() (string, error) {
+	v := envOrConfig("GREENLIGHT_RELAY_URL", "relay_url")
+	if v == "" {
+		return wsURL, nil
+	}
+	if err := checkRelayURL(v); err != nil {
+		return "", err
+	}
+	return v, nil
+}
+
+// checkRelayURL returns an error unless v is a relay URL greenlight can
+// use: ws:// or wss://, or unix:// naming the socket of a relay on this
+// machine.
+func checkRelayURL(v string) error {
+	u, err := url.Parse(v)
+	if err == nil {
+		switch u.Scheme {
+		case "ws", "wss":
+			if u.Host != "" {
+				return nil
+			}
+		case "unix":
+			if u.Host == "" && u.Path != "" {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("invalid relay URL %q: must be a ws:// or wss:// URL, or unix:// for a local socket", v)
+}
+
+// unixRelayPath is the WebSocket endpoint on a unix:// relay's socket.
+const unixRelayPath = "/ws/relay"
+
+// unixSockets maps the hosts standing in for unix:// relays in derived
+// http:// and ws:// URLs to their socket paths (see unixRelayHost).
+var unixSockets sync.Map
+
+// unixRelayHost returns the host that stands in for the relay listening on
+// the unix socket at path. The relay transport dials the socket for it
+// rather than resolving it, and never sends it through a proxy.
+func unixRelayHost(path string) string {
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	host := fmt.Sprintf("unix-%08x.localhost", h.Sum32())
+	unixSockets.Store(host, path)
+	return host
+}
+
+// relayURLFor returns the relay WebSocket URL for a project: the
+// relay.<project> config key if set, otherwise the relay from
+// resolveRelayURL. Commands that dial the relay fail on its error.
+func relayURLFor(project string) (string, error) {
+	if project != "" {
+		if u := readConfigValue("relay." + project); u != "" {
+			return u, nil
+		}
+	}
+	return resolveRelayURL()
+}
+
+// displayRelayURL is relayURLFor for commands that only show the relay. An
+// invalid override gets a warning and the built-in wsURL instead, so help,
+// version and status still work while it's being fixed.
+func displayRelayURL(project string) string {
+	u, err := relayURLFor(project)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight: warning: %v, using %s\n", err, orNone(wsURL))
+		return wsURL
+	}
+	return u
+}
+
+// relayWSURL parses a relay URL for dialing the WebSocket. A unix:// relay
+// URL becomes a ws:// URL the relay transport dials the socket for.
+func relayWSURL(relayURL string) (*url.URL, error) {
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad relay URL: %w", err)
+	}
+	if u.Scheme == "unix" {
+		u = &url.URL{Scheme: "ws", Host: unixRelayHost(u.Path), Path: unixRelayPath}
+	}
+	return u, nil
+}
+
+// serverBaseURL derives the HTTPS base URL from a relay WebSocket URL.
 // e.g. "wss://permit.dnmfarrell.com/ws/relay" → "https://permit.dnmfarrell.com"
-func serverBaseURL() (string, error) {
-	if wsURL == "" {
+// A unix:// relay is served over plain HTTP on its socket.
+func serverBaseURL(relayURL string) (string, error) {
+	if relayURL == "" {
 		return "", fmt.Errorf("no relay server URL configured")
 	}
-	u, err := url.Parse(wsURL)
+	u, err := url.Parse(relayURL)
 	if err != nil {
 		return "", fmt.Errorf("bad relay URL: %w", err)
 	}
+	if u.Scheme == "unix" {
+		return "http://" + unixRelayHost(u.Path), nil
+	}
 	scheme := "https"
 	if u.Scheme == "ws" {
 		scheme = "http"
@@ -28,9 +345,54 @@ func serverBaseURL() (string, error) {
 	return fmt.Sprintf("%s://%s", scheme, u.Host), nil
 }
 
+// defaultEnrollAttempts is how many times enrollSession tries to reach the
+// server, overridable with GREENLIGHT_ENROLL_ATTEMPTS or enroll_attempts in
+// the config file.
+const defaultEnrollAttempts = 3
+
 // enrollSession registers a session with the server and blocks until the user
 // approves it on their phone. Returns an error if rejected or timed out.
 func enrollSession(baseURL, deviceID, sessionID, project string) error {
+	attempts := enrollAttempts()
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			delay := backoff(attempt - 1)
+			log.Printf("Enrollment failed (%v), retrying in %v", err, delay)
+			time.Sleep(delay)
+		}
+		var retry bool
+		retry, err = enrollOnce(baseURL, deviceID, sessionID, project)
+		if err == nil || !retry {
+			return err
+		}
+	}
+	if attempts > 1 {
+		return fmt.Errorf("%w (gave up after %d attempts)", err, attempts)
+	}
+	return err
+}
+
+// enrollAttempts returns the configured number of enrollment attempts.
+func enrollAttempts() int {
+	v := envOrConfig("GREENLIGHT_ENROLL_ATTEMPTS", "enroll_attempts")
+	if v == "" {
+		return defaultEnrollAttempts
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		log.Printf("Warning: invalid enroll attempts %q, using %d", v, defaultEnrollAttempts)
+		return defaultEnrollAttempts
+	}
+	return n
+}
+
+// enrollOnce makes a single enrollment request. retry reports whether the
+// failure may be transient: the server couldn't be reached, or answered
+// with a 5xx. Once the request has been sent the server is waiting for the
+// phone, so a timeout means nobody answered and asking again would only
+// prompt again.
+func enrollOnce(baseURL, deviceID, sessionID, project string) (retry bool, err error) {
 	payload := map[string]string{
 		"device_id":  deviceID,
 		"session_id": sessionID,
@@ -40,18 +402,32 @@ func enrollSession(baseURL, deviceID, sessionID, project string) error {
 	}
 	body, err := json.Marshal(payload)
 	if err != nil {
-		return fmt.Errorf("failed to encode request: %w", err)
+		return false, fmt.Errorf("failed to encode request: %w", err)
 	}
 
-	client := &http.Client{Timeout: 65 * time.Second}
-	resp, err := client.Post(baseURL+"/session/enroll", "application/json", bytes.NewReader(body))
+	client, err := newHTTPClient(65 * time.Second)
+	if err != nil {
+		return false, err
+	}
+	resp, err := postBody(client, baseURL+"/session/enroll", body)
 	if err != nil {
-		return fmt.Errorf("enrollment request failed: %w", err)
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return true, fmt.Errorf("enrollment request failed: %w", err)
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return false, fmt.Errorf("timed out waiting for approval on your device")
+		}
+		return false, fmt.Errorf("enrollment request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode >= 500 {
+		return true, fmt.Errorf("enrollment failed (HTTP %d)", resp.StatusCode)
+	}
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("enrollment rejected (HTTP %d)", resp.StatusCode)
+		return false, fmt.Errorf("enrollment rejected (HTTP %d)", resp.StatusCode)
 	}
 
 	var result struct {
@@ -59,15 +435,50 @@ func enrollSession(baseURL, deviceID, sessionID, project string) error {
 		Message  string `json:"message"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return fmt.Errorf("failed to decode response: %w", err)
+		return false, fmt.Errorf("failed to decode response: %w", err)
 	}
 	if !result.Approved {
 		if result.Message != "" {
-			return fmt.Errorf("session enrollment %s", result.Message)
+			return false, fmt.Errorf("session enrollment %s", result.Message)
 		}
-		return fmt.Errorf("session enrollment rejected")
+		return false, fmt.Errorf("session enrollment rejected")
+	}
+	return false, nil
+}
+
+// Activity and transcript POSTs are retried up to postAttempts times in
+// all, waiting postRetryDelay (doubling) between attempts, so a blip
+// doesn't lose the event without holding up a hook for long.
+const (
+	postAttempts   = 3
+	postRetryDelay = 250 * time.Millisecond
+)
+
+// postWithRetry calls post until it succeeds, returns a response that
+// retrying won't change (anything but 5xx or 429), or postAttempts have
+// been made, and returns the last result. what names the request in the
+// log.
+func postWithRetry(what string, post func() (*http.Response, error)) (*http.Response, error) {
+	delay := postRetryDelay
+	for attempt := 1; ; attempt++ {
+		resp, err := post()
+		if attempt == postAttempts {
+			return resp, err
+		}
+		var reason string
+		switch {
+		case err != nil:
+			reason = err.Error()
+		case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+			reason = fmt.Sprintf("HTTP %d", resp.StatusCode)
+			resp.Body.Close()
+		default:
+			return resp, nil
+		}
+		log.Printf("%s: POST failed (%s), retrying in %v", what, reason, delay)
+		time.Sleep(delay)
+		delay *= 2
 	}
-	return nil
 }
 
 // postJSON sends a JSON POST request and returns the response.
@@ -76,12 +487,50 @@ func postJSON(url string, payload interface{}, timeout time.Duration) (*http.Res
 	if err != nil {
 		return nil, fmt.Errorf("failed to encode payload: %w", err)
 	}
-	client := &http.Client{Timeout: timeout}
-	return client.Post(url, "application/json", bytes.NewReader(body))
+	client, err := newHTTPClient(timeout)
+	if err != nil {
+		return nil, err
+	}
+	return postBody(client, url, body)
 }
 
 // postRawJSON sends a pre-encoded JSON body as a POST request.
 func postRawJSON(url string, body []byte, timeout time.Duration) (*http.Response, error) {
-	client := &http.Client{Timeout: timeout}
-	return client.Post(url, "application/json", bytes.NewReader(body))
+	client, err := newHTTPClient(timeout)
+	if err != nil {
+		return nil, err
+	}
+	return postBody(client, url, body)
+}
+
+// postBody POSTs a JSON body, with the relay token (if any) as a bearer
+// Authorization header.
+func postBody(client *http.Client, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := relayToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	requestLatency.observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// relayToken returns the secret used to authenticate to the relay server:
+// GREENLIGHT_TOKEN or token in the config file. Empty if not set.
+func relayToken() string {
+	return envOrConfig("GREENLIGHT_TOKEN", "token")
+}
+
+// wsAuthToken returns the bearer token for the WebSocket connection: the
+// relay token, or the device ID for relays set up before tokens existed.
+func wsAuthToken(deviceID string) string {
+	if token := relayToken(); token != "" {
+		return token
+	}
+	return deviceID
 }
@@ -3,18 +3,35 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -33,6 +50,7 @@ var (
 type recordedRequest struct {
 	Method string
 	Path   string
+	Header http.Header
 	Body   []byte
 }
 
@@ -73,6 +91,7 @@ func newTestServer() *testServer {
 		ts.requests = append(ts.requests, recordedRequest{
 			Method: r.Method,
 			Path:   r.URL.Path,
+			Header: r.Header.Clone(),
 			Body:   body,
 		})
 		ts.mu.Unlock()
@@ -98,7 +117,7 @@ func newTestServer() *testServer {
 			fmt.Fprint(w, `{"behavior":"allow"}`)
 		case "/activity":
 			w.WriteHeader(200)
-		case "/transcript":
+		case "/transcript", "/transcript/batch":
 			w.WriteHeader(200)
 		default:
 			w.WriteHeader(404)
@@ -272,6 +291,20 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
+// newProjectDir creates a temporary working directory that looks like a
+// project (has a .git marker), so connect will install hooks in it.
+func newProjectDir(pattern string) (string, error) {
+	dir, err := os.MkdirTemp("", pattern)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Mkdir(filepath.Join(dir, ".git"), 0755); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
 // testServerURL is shared across tests
 var testServerURL *testServer
 
@@ -343,255 +376,206 @@ func TestIntegration_Version(t *testing.T) {
 	}
 }
 
-// ---------- connect arg validation ----------
+func TestIntegration_RelayURLOverride(t *testing.T) {
+	// A second server standing in for a self-hosted relay
+	var mu sync.Mutex
+	var paths []string
+	selfHosted := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"behavior":"allow"}`)
+	}))
+	defer selfHosted.Close()
+	relayURL := "ws" + strings.TrimPrefix(selfHosted.URL, "http") + "/ws/relay"
 
-func TestIntegration_Connect_MissingDeviceID(t *testing.T) {
-	r := run(t, []string{"connect"}, nil, "")
-	if r.ExitCode == 0 {
-		t.Error("expected non-zero exit code")
-	}
-	if !strings.Contains(r.Stderr, "device ID") {
-		t.Errorf("expected device ID error, got stderr=%q", r.Stderr)
-	}
-}
+	home := t.TempDir()
+	os.MkdirAll(filepath.Join(home, ".greenlight"), 0755)
 
-func TestIntegration_Connect_MissingProject(t *testing.T) {
-	r := run(t, []string{"connect", "--device-id", "test-device"}, nil, "")
-	if r.ExitCode == 0 {
-		t.Error("expected non-zero exit code")
-	}
-	if !strings.Contains(r.Stderr, "project") {
-		t.Errorf("expected project error, got stderr=%q", r.Stderr)
+	r := run(t, []string{"version"}, []string{"HOME=" + home, "GREENLIGHT_RELAY_URL=" + relayURL}, "")
+	if !strings.Contains(r.Stderr, "relay: "+relayURL) {
+		t.Errorf("expected relay from env in version output, got stderr=%q", r.Stderr)
 	}
-}
 
-func TestIntegration_Connect_DeviceIDFromEnv(t *testing.T) {
-	// Should get past device-id validation and fail on project
-	r := run(t, []string{"connect"}, []string{"GREENLIGHT_DEVICE_ID=test-device"}, "")
-	if r.ExitCode == 0 {
-		t.Error("expected non-zero exit code")
-	}
-	if !strings.Contains(r.Stderr, "project") {
-		t.Errorf("expected project error (past device-id), got stderr=%q", r.Stderr)
+	os.WriteFile(filepath.Join(home, ".greenlight", "config"), []byte("relay_url=wss://relay.example.com/ws/relay\n"), 0644)
+	r = run(t, []string{"version"}, []string{"HOME=" + home}, "")
+	if !strings.Contains(r.Stderr, "relay: wss://relay.example.com/ws/relay") {
+		t.Errorf("expected relay from config in version output, got stderr=%q", r.Stderr)
 	}
-}
 
-func TestIntegration_Connect_DeviceIDFromConfig(t *testing.T) {
-	// Create a temporary config file
-	home, err := os.MkdirTemp("", "greenlight-home-*")
-	if err != nil {
-		t.Fatal(err)
+	// An invalid override only warns in commands that don't dial the relay
+	badEnv := []string{"HOME=" + home, "GREENLIGHT_RELAY_URL=https://relay.example.com"}
+	r = run(t, []string{"version"}, badEnv, "")
+	if r.ExitCode != 0 || !strings.Contains(r.Stderr, "warning: invalid relay URL") || strings.Contains(r.Stderr, "relay: https://") {
+		t.Errorf("expected a warning and the built-in relay for an invalid relay URL, got exit %d, stderr=%q", r.ExitCode, r.Stderr)
 	}
-	defer os.RemoveAll(home)
-
-	configDir := filepath.Join(home, ".greenlight")
-	os.MkdirAll(configDir, 0755)
-	os.WriteFile(filepath.Join(configDir, "config"), []byte("device_id=config-device\n"), 0644)
-
-	// Should get past device-id validation and fail on project
-	r := run(t, []string{"connect"}, []string{"HOME=" + home}, "")
-	if r.ExitCode == 0 {
-		t.Error("expected non-zero exit code")
+	r = run(t, []string{"status"}, badEnv, "")
+	if !strings.Contains(r.Stderr, "warning: invalid relay URL") || !strings.Contains(r.Stdout, "Relay:") {
+		t.Errorf("expected status to warn about the invalid relay URL, got stdout=%q stderr=%q", r.Stdout, r.Stderr)
 	}
-	if !strings.Contains(r.Stderr, "project") {
-		t.Errorf("expected project error (past device-id from config), got stderr=%q", r.Stderr)
+	r = run(t, []string{"connect", "--device-id", "test-dev", "--project", "test-proj"}, badEnv, "")
+	if r.ExitCode == 0 || !strings.Contains(r.Stderr, "ws:// or wss://") {
+		t.Errorf("expected connect to fail for a non-WebSocket relay URL, got exit %d, stderr=%q", r.ExitCode, r.Stderr)
+	}
+	permInput := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","tool_input":{"command":"ls"},"session_id":"s1"}`
+	r = run(t, []string{"hook"}, append(badEnv, "GREENLIGHT_DEVICE_ID=test-dev", "GREENLIGHT_PROJECT=test-proj"), permInput)
+	if r.ExitCode != 0 || !strings.Contains(r.Stdout, `"deny"`) {
+		t.Errorf("expected hook to deny for an invalid relay URL, got exit %d, stdout=%q", r.ExitCode, r.Stdout)
 	}
-}
 
-func TestIntegration_Connect_ProjectFromEnv(t *testing.T) {
-	// Should get past project validation and reach enrollment
+	// Hooks talk to the overriding relay's server
 	testServerURL.clearHandlers()
-	r := run(t, []string{"connect"},
+	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","tool_input":{"command":"ls"},"session_id":"s1"}`
+	r = run(t, []string{"hook"},
 		[]string{
-			"GREENLIGHT_DEVICE_ID=test-device",
-			"GREENLIGHT_PROJECT=test-project",
-		}, "")
-	// It should at least get past arg validation. The binary will try to run
-	// claude which won't be in PATH, so it'll fail, but not on arg validation.
-	if strings.Contains(r.Stderr, "project name is required") {
-		t.Errorf("should have gotten past project validation, got stderr=%q", r.Stderr)
+			"HOME=" + home,
+			"GREENLIGHT_RELAY_URL=" + relayURL,
+			"GREENLIGHT_DEVICE_ID=test-dev",
+			"GREENLIGHT_PROJECT=test-proj",
+			"GREENLIGHT_NO_ENROLL=1",
+		}, input)
+	if !strings.Contains(r.Stdout, `"allow"`) {
+		t.Errorf("expected allow from the self-hosted server, got stdout=%q stderr=%q", r.Stdout, r.Stderr)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(paths) != 1 || paths[0] != "/request" {
+		t.Errorf("expected one /request to the self-hosted server, got %v", paths)
+	}
+	if n := len(testServerURL.getRequests("/request")); n != 0 {
+		t.Errorf("expected no /request to the built-in server, got %d", n)
 	}
 }
 
-// ---------- connect full flow ----------
-
-func TestIntegration_Connect_FullFlow(t *testing.T) {
-	testServerURL.clearHandlers()
-
-	// Create a working directory with .claude for hook installation
-	workDir, err := os.MkdirTemp("", "greenlight-connect-*")
+func TestIntegration_Status(t *testing.T) {
+	tmp, err := os.MkdirTemp("", "greenlight-status-*")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer os.RemoveAll(workDir)
+	defer os.RemoveAll(tmp)
 
-	// Put mock claude on PATH
-	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
-
-	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj")
-	cmd.Dir = workDir
-	cmd.Env = []string{
-		"HOME=" + os.Getenv("HOME"),
-		"PATH=" + pathWithMock,
-		"TMPDIR=" + os.TempDir(),
-		"TERM=xterm-256color",
+	live := exec.Command("sleep", "30")
+	if err := live.Start(); err != nil {
+		t.Fatal(err)
 	}
-	cmd.Stdin = strings.NewReader("")
-
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	done := make(chan error, 1)
-	if err := cmd.Start(); err != nil {
-		t.Fatalf("start: %v", err)
+	defer func() {
+		live.Process.Kill()
+		live.Wait()
+	}()
+	os.WriteFile(filepath.Join(tmp, "greenlight-stream-sess-live.pid"),
+		[]byte(fmt.Sprintf("%d relay-live", live.Process.Pid)), 0644)
+	os.WriteFile(filepath.Join(tmp, "greenlight-enrolled-relay-live"), nil, 0644)
+	os.WriteFile(filepath.Join(tmp, "greenlight-enrolled-relay-idle"), nil, 0644)
+
+	env := []string{
+		"TMPDIR=" + tmp,
+		"GREENLIGHT_DEVICE_ID=status-dev",
+		"GREENLIGHT_PROJECT=status-proj",
+	}
+	r := run(t, []string{"status"}, env, "")
+	if r.ExitCode != 0 {
+		t.Errorf("expected exit 0 with only live streamers, got %d; stderr=%q", r.ExitCode, r.Stderr)
 	}
-	go func() { done <- cmd.Wait() }()
-
-	select {
-	case err := <-done:
-		// We expect it to exit (mock claude exits immediately)
-		_ = err
-	case <-time.After(15 * time.Second):
-		cmd.Process.Kill()
-		t.Fatalf("connect timed out; stdout=%q stderr=%q", stdout.String(), stderr.String())
+	for _, want := range []string{"status-dev", "status-proj", "sess-live", "relay-live", "alive", "relay-idle", "enrolled"} {
+		if !strings.Contains(r.Stdout, want) {
+			t.Errorf("expected %q in status output, got:\n%s", want, r.Stdout)
+		}
 	}
 
-	// Verify enrollment request was sent
-	enrollReqs := testServerURL.getRequests("/session/enroll")
-	if len(enrollReqs) == 0 {
-		t.Fatal("expected enrollment request")
-	}
-	var enrollBody map[string]string
-	if err := json.Unmarshal(enrollReqs[0].Body, &enrollBody); err != nil {
-		t.Fatalf("parse enroll body: %v", err)
-	}
-	if enrollBody["device_id"] != "test-dev" {
-		t.Errorf("expected device_id=test-dev, got %q", enrollBody["device_id"])
-	}
-	if enrollBody["project"] != "test-proj" {
-		t.Errorf("expected project=test-proj, got %q", enrollBody["project"])
-	}
-	if enrollBody["session_id"] == "" {
-		t.Error("expected non-empty session_id")
+	// A PID file for a process that has exited is stale
+	dead := exec.Command("true")
+	if err := dead.Run(); err != nil {
+		t.Fatal(err)
 	}
+	os.WriteFile(filepath.Join(tmp, "greenlight-stream-sess-dead.pid"),
+		[]byte(fmt.Sprintf("%d relay-dead", dead.Process.Pid)), 0644)
 
-	// Verify hooks were installed
-	settingsPath := filepath.Join(workDir, ".claude", "settings.local.json")
-	settingsData, err := os.ReadFile(settingsPath)
-	if err != nil {
-		t.Fatalf("expected settings file at %s: %v", settingsPath, err)
+	r = run(t, []string{"status"}, env, "")
+	if r.ExitCode == 0 {
+		t.Error("expected non-zero exit with a dead streamer")
 	}
-	if !strings.Contains(string(settingsData), "greenlight") {
-		t.Error("expected greenlight hook in settings")
+	if !strings.Contains(r.Stdout, "sess-dead") || !strings.Contains(r.Stdout, "dead") {
+		t.Errorf("expected dead streamer in status output, got:\n%s", r.Stdout)
 	}
-	if !strings.Contains(string(settingsData), "SessionStart") {
-		t.Error("expected SessionStart hook in settings")
+}
+
+// ---------- connect arg validation ----------
+
+func TestIntegration_Connect_MissingDeviceID(t *testing.T) {
+	r := run(t, []string{"connect"}, nil, "")
+	if r.ExitCode == 0 {
+		t.Error("expected non-zero exit code")
 	}
-	if !strings.Contains(string(settingsData), "PermissionRequest") {
-		t.Error("expected PermissionRequest hook in settings")
+	if !strings.Contains(r.Stderr, "device ID") {
+		t.Errorf("expected device ID error, got stderr=%q", r.Stderr)
 	}
 }
 
-func TestIntegration_Connect_EnrollmentRejected(t *testing.T) {
-	testServerURL.clearHandlers()
-	testServerURL.setHandler("/session/enroll", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprint(w, `{"approved":false,"message":"rejected by test"}`)
-	})
-	defer testServerURL.clearHandlers()
-
-	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
-	r := run(t, []string{"connect", "--device-id", "test-dev", "--project", "test-proj"},
-		[]string{"PATH=" + pathWithMock}, "")
+func TestIntegration_Connect_MissingProject(t *testing.T) {
+	r := run(t, []string{"connect", "--device-id", "test-device"}, nil, "")
 	if r.ExitCode == 0 {
-		t.Error("expected non-zero exit code for rejected enrollment")
+		t.Error("expected non-zero exit code")
 	}
-	if !strings.Contains(r.Stderr, "enrollment") {
-		t.Errorf("expected enrollment error, got stderr=%q", r.Stderr)
+	if !strings.Contains(r.Stderr, "project") {
+		t.Errorf("expected project error, got stderr=%q", r.Stderr)
 	}
 }
 
-// ---------- connect — WebSocket input injection ----------
+func TestIntegration_Connect_InvalidProject(t *testing.T) {
+	for _, proj := range []string{"team//app", "/app", "team/../app", "my app", "team/app?x=1", strings.Repeat("a", 129)} {
+		r := run(t, []string{"connect", "--device-id", "test-device", "--project", proj}, nil, "")
+		if r.ExitCode == 0 {
+			t.Errorf("project %q: expected non-zero exit code", proj)
+		}
+		if !strings.Contains(r.Stderr, "invalid project name") {
+			t.Errorf("project %q: expected invalid project error, got stderr=%q", proj, r.Stderr)
+		}
+	}
+}
 
-func TestIntegration_Connect_WSInputInjection(t *testing.T) {
+func TestIntegration_Connect_NamespacedProject(t *testing.T) {
 	testServerURL.clearHandlers()
 
-	workDir, err := os.MkdirTemp("", "greenlight-wsinject-*")
+	workDir, err := newProjectDir("greenlight-nsproject-*")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(workDir)
 
-	// File where mock claude will write the input it received
-	outputFile := filepath.Join(workDir, "claude-received.txt")
-
-	// Collects all binary frames (PTY output) received back from the relay.
-	var wsReceived bytes.Buffer
-	var wsReceivedMu sync.Mutex
-	wsDone := make(chan struct{})
-
-	// Set up WebSocket handler: accept connection, wait briefly for the
-	// relay to be ready, then send a test message and collect responses.
+	var mu sync.Mutex
+	var rawQuery, project string
 	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
-		defer close(wsDone)
+		mu.Lock()
+		rawQuery = r.URL.RawQuery
+		project = r.URL.Query().Get("project")
+		mu.Unlock()
 		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
 			InsecureSkipVerify: true,
 		})
 		if err != nil {
-			t.Logf("ws accept error: %v", err)
-			return
-		}
-		defer conn.Close(websocket.StatusNormalClosure, "done")
-
-		// Give the relay a moment to start the child process
-		time.Sleep(500 * time.Millisecond)
-
-		// Send a binary frame with a newline — the relay will convert
-		// \n to \r and inject it into the PTY. The terminal driver
-		// translates \r back to \n for the child's stdin.
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		err = conn.Write(ctx, websocket.MessageBinary, []byte("HELLO_FROM_SERVER\n"))
-		if err != nil {
-			t.Logf("ws write error: %v", err)
 			return
 		}
-
-		// Read messages until the connection closes, collecting PTY output
-		for {
-			_, data, err := conn.Read(ctx)
-			if err != nil {
-				return
-			}
-			wsReceivedMu.Lock()
-			wsReceived.Write(data)
-			wsReceivedMu.Unlock()
-		}
+		conn.Close(websocket.StatusNormalClosure, "done")
 	})
-	defer testServerURL.clearHandlers()
 
-	// Allocate a PTY for the greenlight process so that its setRaw()
-	// ioctl succeeds (it requires a real terminal on stdin).
 	master, slave, err := openPTY()
 	if err != nil {
 		t.Fatalf("openPTY: %v", err)
 	}
 	defer master.Close()
-
-	// Set a reasonable window size so syncWinsize doesn't complain
 	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
 
 	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
 
-	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj")
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", " team/app ")
 	cmd.Dir = workDir
 	cmd.Env = []string{
 		"HOME=" + os.Getenv("HOME"),
 		"PATH=" + pathWithMock,
 		"TMPDIR=" + os.TempDir(),
 		"TERM=xterm-256color",
-		"MOCK_CLAUDE_OUTPUT=" + outputFile,
+		"MOCK_CLAUDE_STALL=1",
 	}
 	cmd.Stdin = slave
 	cmd.Stdout = slave
@@ -601,355 +585,506 @@ func TestIntegration_Connect_WSInputInjection(t *testing.T) {
 	if err := cmd.Start(); err != nil {
 		t.Fatalf("start: %v", err)
 	}
-	// Close slave in parent after child inherits it
 	slave.Close()
-
 	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
 
 	select {
-	case <-done:
-		// process exited
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected connect to accept a namespaced project: %v", err)
+		}
 	case <-time.After(15 * time.Second):
 		cmd.Process.Kill()
 		t.Fatal("connect timed out")
 	}
 
-	// Check that mock claude received the server's input
-	data, err := os.ReadFile(outputFile)
-	if err != nil {
-		t.Fatalf("mock claude output file not created: %v", err)
-	}
-	received := string(data)
-	if !strings.Contains(received, "HELLO_FROM_SERVER") {
-		t.Errorf("expected mock claude to receive 'HELLO_FROM_SERVER', got %q", received)
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(rawQuery, "project=team%2Fapp") {
+		t.Errorf("expected URL-encoded project in dial URL, got query %q", rawQuery)
 	}
-
-	// Wait for the WS handler to finish collecting PTY output
-	select {
-	case <-wsDone:
-	case <-time.After(5 * time.Second):
-		t.Log("WS handler did not finish in time")
+	if project != "team/app" {
+		t.Errorf("expected project team/app, got %q", project)
 	}
 
-	// Verify that PTY output was sent back to the server over WebSocket.
-	// The PTY echoes input in cooked mode, so "HELLO_FROM_SERVER" should
-	// appear in the binary frames. Mock claude's "MOCK_CLAUDE_STARTED"
-	// output should also be present.
-	wsReceivedMu.Lock()
-	wsOutput := wsReceived.String()
-	wsReceivedMu.Unlock()
-
-	if !strings.Contains(wsOutput, "HELLO_FROM_SERVER") {
-		t.Errorf("expected 'HELLO_FROM_SERVER' in WS output (PTY echo), got %q", wsOutput)
+	reqs := testServerURL.getRequests("/session/enroll")
+	if len(reqs) == 0 {
+		t.Fatal("expected enrollment request")
 	}
-	if !strings.Contains(wsOutput, "MOCK_CLAUDE_STARTED") {
-		t.Errorf("expected 'MOCK_CLAUDE_STARTED' in WS output, got %q", wsOutput)
+	var body map[string]string
+	json.Unmarshal(reqs[0].Body, &body)
+	if body["project"] != "team/app" {
+		t.Errorf("expected enrolled project team/app, got %q", body["project"])
 	}
 }
 
-// ---------- connect — suspend/resume (Ctrl-Z) ----------
-
-func TestIntegration_Connect_SuspendResume(t *testing.T) {
-	testServerURL.clearHandlers()
+func TestIntegration_Connect_DeviceIDFromEnv(t *testing.T) {
+	// Should get past device-id validation and fail on project
+	r := run(t, []string{"connect"}, []string{"GREENLIGHT_DEVICE_ID=test-device"}, "")
+	if r.ExitCode == 0 {
+		t.Error("expected non-zero exit code")
+	}
+	if !strings.Contains(r.Stderr, "project") {
+		t.Errorf("expected project error (past device-id), got stderr=%q", r.Stderr)
+	}
+}
 
-	workDir, err := os.MkdirTemp("", "greenlight-suspend-*")
+func TestIntegration_Connect_DeviceIDFromConfig(t *testing.T) {
+	// Create a temporary config file
+	home, err := os.MkdirTemp("", "greenlight-home-*")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer os.RemoveAll(workDir)
+	defer os.RemoveAll(home)
 
-	// File where mock claude writes the input it received
-	outputFile := filepath.Join(workDir, "claude-received.txt")
+	configDir := filepath.Join(home, ".greenlight")
+	os.MkdirAll(configDir, 0755)
+	os.WriteFile(filepath.Join(configDir, "config"), []byte("device_id=config-device\n"), 0644)
 
-	// Allocate a PTY for greenlight's stdin/stdout
-	master, slave, err := openPTY()
+	// Should get past device-id validation and fail on project
+	r := run(t, []string{"connect"}, []string{"HOME=" + home}, "")
+	if r.ExitCode == 0 {
+		t.Error("expected non-zero exit code")
+	}
+	if !strings.Contains(r.Stderr, "project") {
+		t.Errorf("expected project error (past device-id from config), got stderr=%q", r.Stderr)
+	}
+}
+
+func TestIntegration_Connect_DeviceIDFromJSONConfig(t *testing.T) {
+	home, err := os.MkdirTemp("", "greenlight-home-*")
 	if err != nil {
-		t.Fatalf("openPTY: %v", err)
+		t.Fatal(err)
 	}
-	defer master.Close()
-	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+	defer os.RemoveAll(home)
 
-	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	configDir := filepath.Join(home, ".greenlight")
+	os.MkdirAll(configDir, 0755)
+	os.WriteFile(filepath.Join(configDir, "config"), []byte(`{"device_id": "json-device"}`+"\n"), 0644)
 
-	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj")
-	cmd.Dir = workDir
-	cmd.Env = []string{
-		"HOME=" + os.Getenv("HOME"),
-		"PATH=" + pathWithMock,
-		"TMPDIR=" + os.TempDir(),
-		"TERM=xterm-256color",
-		"MOCK_CLAUDE_OUTPUT=" + outputFile,
+	// Should get past device-id validation and fail on project
+	r := run(t, []string{"connect"}, []string{"HOME=" + home}, "")
+	if r.ExitCode == 0 {
+		t.Error("expected non-zero exit code")
 	}
-	cmd.Stdin = slave
-	cmd.Stdout = slave
-	cmd.Stderr = slave
-	// Put greenlight in its own process group so that its
-	// Kill(0, SIGTSTP) doesn't stop the test runner.
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setpgid: true,
+	if strings.Contains(r.Stderr, "device ID is required") {
+		t.Errorf("expected device ID to be read from JSON config, got stderr=%q", r.Stderr)
 	}
-
-	done := make(chan error, 1)
-	if err := cmd.Start(); err != nil {
-		t.Fatalf("start: %v", err)
+	if !strings.Contains(r.Stderr, "project") {
+		t.Errorf("expected project error (past device-id from JSON config), got stderr=%q", r.Stderr)
 	}
-	slave.Close()
-	go func() { done <- cmd.Wait() }()
-
-	// Wait for mock claude to start up inside the PTY
-	time.Sleep(1 * time.Second)
+}
 
-	// Send Ctrl-Z — greenlight should intercept and suspend itself
-	if _, err := master.Write([]byte{0x1a}); err != nil {
-		t.Fatalf("write Ctrl-Z: %v", err)
+func TestIntegration_Config_XDGConfigHome(t *testing.T) {
+	home, err := os.MkdirTemp("", "greenlight-home-*")
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer os.RemoveAll(home)
+	xdg := filepath.Join(home, "xdg")
+	env := []string{"HOME=" + home, "XDG_CONFIG_HOME=" + xdg}
+	want := filepath.Join(xdg, "greenlight", "config")
 
-	// Give greenlight time to stop
-	time.Sleep(500 * time.Millisecond)
-
-	// Resume greenlight (simulates shell "fg")
-	syscall.Kill(cmd.Process.Pid, syscall.SIGCONT)
-
-	// Give greenlight time to re-enter raw mode
-	time.Sleep(500 * time.Millisecond)
-
-	// Send input after resume — mock claude should receive this
-	if _, err := master.Write([]byte("AFTER_RESUME\n")); err != nil {
-		t.Fatalf("write after resume: %v", err)
+	r := run(t, []string{"config-path"}, env, "")
+	if r.ExitCode != 0 {
+		t.Fatalf("config-path: exit %d, stderr=%q", r.ExitCode, r.Stderr)
 	}
-
-	select {
-	case <-done:
-		// process exited
-	case <-time.After(15 * time.Second):
-		cmd.Process.Kill()
-		t.Fatal("connect timed out")
+	if got := strings.TrimSpace(r.Stdout); got != want {
+		t.Errorf("config-path: expected %q, got %q", want, got)
 	}
 
-	// Verify mock claude received input after the suspend/resume cycle
-	data, err := os.ReadFile(outputFile)
+	// register writes to the XDG location
+	devID := "11111111-2222-3333-4444-555555555555"
+	r = run(t, []string{"register", devID}, env, "")
+	if r.ExitCode != 0 {
+		t.Fatalf("register: exit %d, stderr=%q", r.ExitCode, r.Stderr)
+	}
+	data, err := os.ReadFile(want)
 	if err != nil {
-		t.Fatalf("mock claude output file not created: %v", err)
+		t.Fatalf("config not written to XDG path: %v", err)
 	}
-	if !strings.Contains(string(data), "AFTER_RESUME") {
-		t.Errorf("expected 'AFTER_RESUME' after suspend/resume, got %q", string(data))
+	if !strings.Contains(string(data), devID) {
+		t.Errorf("expected device ID in XDG config, got %q", string(data))
+	}
+	if _, err := os.Stat(filepath.Join(home, ".greenlight", "config")); err == nil {
+		t.Error("register also wrote the legacy config file")
 	}
-}
-
-// ---------- connect — transcript relay pipeline ----------
 
-func TestIntegration_Connect_TranscriptRelay(t *testing.T) {
-	testServerURL.clearHandlers()
+	// connect reads the device ID back from the XDG location
+	r = run(t, []string{"connect"}, env, "")
+	if strings.Contains(r.Stderr, "device ID is required") {
+		t.Errorf("expected device ID to be read from XDG config, got stderr=%q", r.Stderr)
+	}
+	if !strings.Contains(r.Stderr, "project") {
+		t.Errorf("expected project error (past device-id from XDG config), got stderr=%q", r.Stderr)
+	}
+}
 
-	workDir, err := os.MkdirTemp("", "greenlight-transcript-*")
+func TestIntegration_Config_LegacyPathPreferred(t *testing.T) {
+	home, err := os.MkdirTemp("", "greenlight-home-*")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer os.RemoveAll(workDir)
+	defer os.RemoveAll(home)
 
-	transcriptPath := filepath.Join(workDir, "transcript.jsonl")
+	legacy := filepath.Join(home, ".greenlight", "config")
+	os.MkdirAll(filepath.Dir(legacy), 0755)
+	os.WriteFile(legacy, []byte("device_id=legacy-device\n"), 0644)
 
-	// Collect text frames (transcript data) from the WebSocket.
-	// tailBridge sends: {"type":"transcript","data":<line>}
-	var wsTextFrames []string
-	var wsTextMu sync.Mutex
-	wsDone := make(chan struct{})
+	// An existing ~/.greenlight/config keeps being used when the XDG
+	// file doesn't exist yet
+	r := run(t, []string{"config-path"}, []string{"HOME=" + home, "XDG_CONFIG_HOME=" + filepath.Join(home, "xdg")}, "")
+	if got := strings.TrimSpace(r.Stdout); got != legacy {
+		t.Errorf("expected legacy path %q, got %q", legacy, got)
+	}
+}
 
-	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
-		defer close(wsDone)
-		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-			InsecureSkipVerify: true,
-		})
+func TestIntegration_Config_ProjectFile(t *testing.T) {
+	root := t.TempDir()
+	home := filepath.Join(root, "home")
+	os.MkdirAll(filepath.Join(home, ".greenlight"), 0755)
+	os.WriteFile(filepath.Join(home, ".greenlight", "config"), []byte("device_id=global-dev\nproject=global-proj\n"), 0644)
+
+	// A repository with a .greenlight file at its root, which also tries
+	// to set keys only the global config may set
+	repo := filepath.Join(root, "src", "repo")
+	subdir := filepath.Join(repo, "pkg", "sub")
+	os.MkdirAll(subdir, 0755)
+	os.Mkdir(filepath.Join(repo, ".git"), 0755)
+	os.WriteFile(filepath.Join(repo, ".greenlight"), []byte("project=local-proj\ndevice_id=repo-dev\nrelay.local-proj=wss://relay.example.com/ws/relay\n"), 0644)
+
+	// A .greenlight above the repository root is out of reach
+	os.WriteFile(filepath.Join(root, "src", ".greenlight"), []byte("project=outer-proj\n"), 0644)
+	outside := filepath.Join(root, "src", "other")
+	os.MkdirAll(outside, 0755)
+	os.Mkdir(filepath.Join(outside, ".git"), 0755)
+
+	status := func(dir string, env ...string) string {
+		t.Helper()
+		cmd := exec.Command(greenlightBin, "status")
+		cmd.Dir = dir
+		cmd.Env = append([]string{
+			"HOME=" + home,
+			"PATH=" + os.Getenv("PATH"),
+			"TMPDIR=" + t.TempDir(),
+		}, env...)
+		out, err := cmd.Output()
 		if err != nil {
-			t.Logf("ws accept error: %v", err)
-			return
+			t.Fatalf("status in %s: %v", dir, err)
 		}
-		defer conn.Close(websocket.StatusNormalClosure, "done")
-
-		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-		defer cancel()
-
-		for {
-			msgType, data, err := conn.Read(ctx)
-			if err != nil {
-				return
-			}
-			if msgType == websocket.MessageText {
-				wsTextMu.Lock()
-				wsTextFrames = append(wsTextFrames, string(data))
-				wsTextMu.Unlock()
-			}
+		return string(out)
+	}
+	expect := func(out, label, want string) {
+		t.Helper()
+		m := regexp.MustCompile(label + `:\s+(\S+)`).FindStringSubmatch(out)
+		if m == nil || m[1] != want {
+			t.Errorf("expected %s %q, got:\n%s", label, want, out)
 		}
-	})
-	defer testServerURL.clearHandlers()
+	}
 
-	// Allocate a PTY for the greenlight process
-	master, slave, err := openPTY()
-	if err != nil {
-		t.Fatalf("openPTY: %v", err)
+	out := status(subdir)
+	expect(out, "Project", "local-proj")
+	expect(out, "Device ID", "global-dev")
+	if strings.Contains(out, "relay.example.com") {
+		t.Errorf("expected relay from the project file to be ignored, got:\n%s", out)
 	}
-	defer master.Close()
-	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
 
-	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	// Environment beats the project file
+	expect(status(subdir, "GREENLIGHT_PROJECT=env-proj"), "Project", "env-proj")
 
-	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj")
-	cmd.Dir = workDir
-	cmd.Env = []string{
-		"HOME=" + os.Getenv("HOME"),
-		"PATH=" + pathWithMock,
-		"TMPDIR=" + os.TempDir(),
-		"TERM=xterm-256color",
-		"MOCK_CLAUDE_TRANSCRIPT=" + transcriptPath,
+	expect(status(outside), "Project", "global-proj")
+}
+
+func TestIntegration_Config_JSONFile(t *testing.T) {
+	home := t.TempDir()
+	dir := filepath.Join(home, ".greenlight")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "config"), []byte("device_id=flat-dev\nproject=flat-proj\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"device_id": "json-dev", "relay": {"flat-proj": "wss://relay-json.example.com/ws/relay"}}`), 0644)
+
+	status := func(env ...string) string {
+		t.Helper()
+		cmd := exec.Command(greenlightBin, "status")
+		cmd.Dir = t.TempDir()
+		cmd.Env = append([]string{
+			"HOME=" + home,
+			"PATH=" + os.Getenv("PATH"),
+			"TMPDIR=" + t.TempDir(),
+		}, env...)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("status: %v", err)
+		}
+		return string(out)
 	}
-	cmd.Stdin = slave
-	cmd.Stdout = slave
-	cmd.Stderr = slave
 
-	done := make(chan error, 1)
-	if err := cmd.Start(); err != nil {
-		t.Fatalf("start: %v", err)
+	// config.json beats the flat file, which still supplies the rest
+	out := status()
+	for _, want := range []string{`Device ID:\s+json-dev\n`, `Project:\s+flat-proj\n`, `Relay:\s+wss://relay-json\.example\.com/ws/relay\n`} {
+		if !regexp.MustCompile(want).MatchString(out) {
+			t.Errorf("expected %s, got:\n%s", want, out)
+		}
 	}
-	slave.Close()
-	go func() { done <- cmd.Wait() }()
 
-	select {
-	case <-done:
-	case <-time.After(15 * time.Second):
-		cmd.Process.Kill()
-		t.Fatal("connect timed out")
+	// Environment beats config.json
+	if out := status("GREENLIGHT_DEVICE_ID=env-dev"); !regexp.MustCompile(`Device ID:\s+env-dev\n`).MatchString(out) {
+		t.Errorf("expected device ID from the environment, got:\n%s", out)
 	}
 
-	// Wait for WS handler to finish
-	select {
-	case <-wsDone:
-	case <-time.After(5 * time.Second):
-		t.Log("WS handler did not finish in time")
+	// config set warns when config.json shadows the key
+	r := run(t, []string{"config", "set", "device_id", "11111111-2222-3333-4444-555555555555"}, []string{"HOME=" + home}, "")
+	if r.ExitCode != 0 || !strings.Contains(r.Stderr, "takes precedence") {
+		t.Errorf("expected a precedence warning from config set, got exit %d, stderr:\n%s", r.ExitCode, r.Stderr)
 	}
 
-	// Verify that transcript text frames were received by the server.
-	// Each frame should be: {"type":"transcript","data":<jsonl-line>}
-	wsTextMu.Lock()
-	frames := make([]string, len(wsTextFrames))
-	copy(frames, wsTextFrames)
-	wsTextMu.Unlock()
+	// A malformed config.json is ignored
+	os.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"device_id": `), 0644)
+	if out := status(); !regexp.MustCompile(`Device ID:\s+11111111-2222-3333-4444-555555555555\n`).MatchString(out) {
+		t.Errorf("expected device ID from the flat file, got:\n%s", out)
+	}
+}
 
-	var foundLine1, foundLine2 bool
-	for _, frame := range frames {
-		if strings.Contains(frame, "TRANSCRIPT_TEST_LINE_1") {
-			foundLine1 = true
+func TestIntegration_Config_EnvExpansion(t *testing.T) {
+	home := t.TempDir()
+	os.MkdirAll(filepath.Join(home, ".greenlight"), 0755)
+	os.WriteFile(filepath.Join(home, ".greenlight", "config"), []byte("device_id=${MY_DEVICE}\nproject=$MY_TEAM-app\n"), 0644)
+
+	cmd := exec.Command(greenlightBin, "status")
+	cmd.Dir = t.TempDir()
+	cmd.Env = []string{
+		"HOME=" + home,
+		"PATH=" + os.Getenv("PATH"),
+		"TMPDIR=" + t.TempDir(),
+		"MY_DEVICE=dev-from-env",
+		"MY_TEAM=ops",
+	}
+	out, _ := cmd.Output()
+	if !regexp.MustCompile(`Device ID:\s+dev-from-env\n`).Match(out) || !regexp.MustCompile(`Project:\s+ops-app\n`).Match(out) {
+		t.Errorf("expected expanded device ID and project, got:\n%s", out)
+	}
+
+	t.Setenv("CFG_A", "alpha")
+	t.Setenv("CFG_EMPTY", "")
+	for _, tc := range []struct{ in, want string }{
+		{"plain", "plain"},
+		{"$CFG_A/x", "alpha/x"},
+		{"${CFG_A}x", "alphax"},
+		{"pa$$word", "pa$word"},
+		{"$$CFG_A", "$CFG_A"},
+		{"[$CFG_UNSET]", "[]"},
+		{"a${CFG_EMPTY}b", "ab"},
+		{"cost $5", "cost 5"},
+		{"trailing $", "trailing "},
+		{"${CFG_A", ""},
+		{"x${1bad}y", "xy"},
+		{"x${}y", "xy"},
+	} {
+		if got := expandConfigValue(tc.in); got != tc.want {
+			t.Errorf("expandConfigValue(%q) = %q, want %q", tc.in, got, tc.want)
 		}
-		if strings.Contains(frame, "TRANSCRIPT_TEST_LINE_2") {
-			foundLine2 = true
+	}
+}
+
+func TestIntegration_Config_Subcommand(t *testing.T) {
+	home := t.TempDir()
+	env := []string{"HOME=" + home}
+	path := filepath.Join(home, ".greenlight", "config")
+	const devID = "6f1c2a3b-4d5e-4f60-8a7b-9c0d1e2f3a4b"
+
+	// set creates the file and its directory
+	if r := run(t, []string{"config", "set", "device_id", devID}, env, ""); r.ExitCode != 0 {
+		t.Fatalf("config set: exit %d, stderr=%q", r.ExitCode, r.Stderr)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "device_id="+devID+"\n" {
+		t.Errorf("unexpected config after first set: %q", data)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("expected a new config file to be private, got %v (%v)", fi.Mode(), err)
+	}
+	if fi, err := os.Stat(filepath.Dir(path)); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("expected a new config directory to be private, got %v (%v)", fi.Mode(), err)
+	}
+
+	// Comments and the order of other keys survive a rewrite
+	os.WriteFile(path, []byte("# my settings\nproject=old\n\n# relays\nrelay.team=wss://a.example/ws\nproject=shadowed"), 0600)
+	os.Chmod(path, 0640)
+	for _, args := range [][]string{
+		{"config", "set", "project", "new-app"},
+		{"config", "set", "token", "s3cret"},
+	} {
+		if r := run(t, args, env, ""); r.ExitCode != 0 {
+			t.Fatalf("%v: exit %d, stderr=%q", args, r.ExitCode, r.Stderr)
 		}
 	}
+	want := "# my settings\nproject=new-app\n\n# relays\nrelay.team=wss://a.example/ws\nproject=shadowed\ntoken=s3cret\n"
+	if data, _ := os.ReadFile(path); string(data) != want {
+		t.Errorf("config = %q, want %q", data, want)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("expected the file mode to be kept, got %v (%v)", fi.Mode(), err)
+	}
 
-	if !foundLine1 {
-		t.Errorf("expected text frame containing 'TRANSCRIPT_TEST_LINE_1', got %d frames: %v", len(frames), frames)
+	if r := run(t, []string{"config", "get", "project"}, env, ""); r.ExitCode != 0 || r.Stdout != "new-app\n" {
+		t.Errorf("config get project: exit %d, stdout=%q", r.ExitCode, r.Stdout)
 	}
-	if !foundLine2 {
-		t.Errorf("expected text frame containing 'TRANSCRIPT_TEST_LINE_2', got %d frames: %v", len(frames), frames)
+	if r := run(t, []string{"config", "get", "nope"}, env, ""); r.ExitCode == 0 {
+		t.Error("expected config get of a missing key to fail")
+	}
+	r := run(t, []string{"config", "list"}, env, "")
+	if want := "project=new-app\nrelay.team=wss://a.example/ws\ntoken=s3cret\n"; r.Stdout != want {
+		t.Errorf("config list = %q, want %q", r.Stdout, want)
 	}
 
-	// Verify frames have the expected wrapper structure
-	if len(frames) > 0 {
-		var wrapper map[string]interface{}
-		if err := json.Unmarshal([]byte(frames[0]), &wrapper); err != nil {
-			t.Errorf("expected JSON text frame, got %q: %v", frames[0], err)
-		} else {
-			if wrapper["type"] != "transcript" {
-				t.Errorf("expected type=transcript, got %v", wrapper["type"])
-			}
-			if wrapper["data"] == nil {
-				t.Error("expected data field in transcript frame")
-			}
+	for _, tc := range []struct{ key, value, msg string }{
+		{"device_id", "not-a-uuid", "invalid device ID"},
+		{"project", "bad name!", "invalid project name"},
+		{"relay.team", "https://a.example", "invalid relay URL"},
+		{"settings_file", "other.json", "invalid settings file"},
+		{"bad key", "x", "invalid key"},
+	} {
+		r := run(t, []string{"config", "set", tc.key, tc.value}, env, "")
+		if r.ExitCode == 0 || !strings.Contains(r.Stderr, tc.msg) {
+			t.Errorf("config set %s %q: exit %d, stderr=%q, want %q", tc.key, tc.value, r.ExitCode, r.Stderr, tc.msg)
 		}
 	}
+	if data, _ := os.ReadFile(path); string(data) != want {
+		t.Errorf("rejected values changed the config: %q", data)
+	}
+
+	// get and list show what greenlight uses: config.json applied and
+	// environment variables expanded
+	os.WriteFile(filepath.Join(home, ".greenlight", "config.json"), []byte(`{"token": "$MY_TOKEN"}`), 0600)
+	env = append(env, "MY_TOKEN=from-env")
+	if r := run(t, []string{"config", "get", "token"}, env, ""); r.Stdout != "from-env\n" {
+		t.Errorf("config get token: exit %d, stdout=%q", r.ExitCode, r.Stdout)
+	}
+	r = run(t, []string{"config", "list"}, env, "")
+	if want := "project=new-app\nrelay.team=wss://a.example/ws\ntoken=from-env\n"; r.Stdout != want {
+		t.Errorf("config list = %q, want %q", r.Stdout, want)
+	}
 }
 
-// ---------- connect — incremental transcript relay with disconnection ----------
+func TestIntegration_Connect_ProjectFromEnv(t *testing.T) {
+	// Should get past project validation and reach enrollment
+	testServerURL.clearHandlers()
+	r := run(t, []string{"connect"},
+		[]string{
+			"GREENLIGHT_DEVICE_ID=test-device",
+			"GREENLIGHT_PROJECT=test-project",
+		}, "")
+	// It should at least get past arg validation. The binary will try to run
+	// claude which won't be in PATH, so it'll fail, but not on arg validation.
+	if strings.Contains(r.Stderr, "project name is required") {
+		t.Errorf("should have gotten past project validation, got stderr=%q", r.Stderr)
+	}
+}
 
-func TestIntegration_Connect_TranscriptRelayIncremental(t *testing.T) {
+func TestIntegration_Connect_RefusesHooksInHome(t *testing.T) {
 	testServerURL.clearHandlers()
 
-	workDir, err := os.MkdirTemp("", "greenlight-transcript-incr-*")
+	home, err := os.MkdirTemp("", "greenlight-home-*")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer os.RemoveAll(workDir)
-
-	transcriptPath := filepath.Join(workDir, "transcript.jsonl")
-
-	const totalLines = 10
+	defer os.RemoveAll(home)
 
-	// Collect text frames from the WebSocket across multiple connections.
-	// The server will close the first connection after a few frames to
-	// simulate a brief disconnection. The client should reconnect and
-	// re-deliver any messages that failed during the gap.
-	var wsTextFrames []string
-	var wsTextMu sync.Mutex
-	var connCount int32
-	wsDone := make(chan struct{})
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj")
+	cmd.Dir = home
+	cmd.Env = []string{
+		"HOME=" + home,
+		"PATH=" + os.Getenv("PATH"),
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err == nil {
+		t.Error("expected non-zero exit when run from $HOME without --force")
+	}
+	if !strings.Contains(stderr.String(), "--force") {
+		t.Errorf("expected --force hint, got stderr=%q", stderr.String())
+	}
+	if _, err := os.Stat(filepath.Join(home, ".claude")); err == nil {
+		t.Error("expected no .claude directory in $HOME")
+	}
+	if reqs := testServerURL.getRequests("/session/enroll"); len(reqs) != 0 {
+		t.Errorf("expected no enrollment request, got %d", len(reqs))
+	}
+}
 
-	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
-		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-			InsecureSkipVerify: true,
-		})
-		if err != nil {
-			t.Logf("ws accept error: %v", err)
-			return
-		}
+func TestIntegration_Connect_PerProjectRelay(t *testing.T) {
+	serverA := newTestServer()
+	defer serverA.Close()
+	serverB := newTestServer()
+	defer serverB.Close()
 
-		wsTextMu.Lock()
-		connCount++
-		thisConn := connCount
-		wsTextMu.Unlock()
+	home, err := os.MkdirTemp("", "greenlight-home-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	os.MkdirAll(filepath.Join(home, ".greenlight"), 0755)
+	config := "device_id=test-dev\n" +
+		"relay.projA=" + serverA.wsURL() + "\n" +
+		"relay.projB=" + serverB.wsURL() + "\n"
+	os.WriteFile(filepath.Join(home, ".greenlight", "config"), []byte(config), 0644)
 
-		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-		defer cancel()
+	workDir, err := newProjectDir("greenlight-perproject-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
 
-		frameCount := 0
-		for {
-			msgType, data, err := conn.Read(ctx)
-			if err != nil {
-				conn.CloseNow()
-				if thisConn == 1 {
-					// First connection was intentionally closed; continue
-					// accepting reconnections by returning (the HTTP
-					// handler will be called again for the next WS dial).
-					return
-				}
-				// Final connection: signal done
-				close(wsDone)
-				return
+	for _, tc := range []struct {
+		project     string
+		want, other *testServer
+	}{
+		{"projA", serverA, serverB},
+		{"projB", serverB, serverA},
+	} {
+		t.Run(tc.project, func(t *testing.T) {
+			serverA.clearHandlers()
+			serverB.clearHandlers()
+			testServerURL.clearHandlers()
+
+			// stdin isn't a terminal, so connect exits after enrolling
+			cmd := exec.Command(greenlightBin, "connect", "--project", tc.project)
+			cmd.Dir = workDir
+			cmd.Env = []string{
+				"HOME=" + home,
+				"PATH=" + os.Getenv("PATH"),
+				"TMPDIR=" + os.TempDir(),
 			}
-			if msgType == websocket.MessageText {
-				wsTextMu.Lock()
-				wsTextFrames = append(wsTextFrames, string(data))
-				wsTextMu.Unlock()
+			cmd.Run()
 
-				frameCount++
-				// After receiving 3 text frames on the first connection,
-				// close it abruptly to simulate a network disruption.
-				// The client should reconnect and the queued messages
-				// from the gap should eventually arrive.
-				if thisConn == 1 && frameCount >= 3 {
-					conn.Close(websocket.StatusGoingAway, "simulated disruption")
-					return
-				}
+			if reqs := tc.want.getRequests("/session/enroll"); len(reqs) != 1 {
+				t.Errorf("expected 1 enrollment on %s's relay, got %d", tc.project, len(reqs))
 			}
-		}
-	})
-	defer testServerURL.clearHandlers()
+			if reqs := tc.other.getRequests("/session/enroll"); len(reqs) != 0 {
+				t.Errorf("expected no enrollment on the other relay, got %d", len(reqs))
+			}
+			if reqs := testServerURL.getRequests("/session/enroll"); len(reqs) != 0 {
+				t.Errorf("expected no enrollment on the default relay, got %d", len(reqs))
+			}
+		})
+	}
+}
 
-	// Allocate a PTY for the greenlight process
-	master, slave, err := openPTY()
+// ---------- connect full flow ----------
+
+func TestIntegration_Connect_FullFlow(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	// Create a working directory with .claude for hook installation
+	workDir, err := newProjectDir("greenlight-connect-*")
 	if err != nil {
-		t.Fatalf("openPTY: %v", err)
+		t.Fatal(err)
 	}
-	defer master.Close()
-	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+	defer os.RemoveAll(workDir)
 
+	// Put mock claude on PATH
 	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
 
 	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj")
@@ -959,572 +1094,8536 @@ func TestIntegration_Connect_TranscriptRelayIncremental(t *testing.T) {
 		"PATH=" + pathWithMock,
 		"TMPDIR=" + os.TempDir(),
 		"TERM=xterm-256color",
-		"MOCK_CLAUDE_TRANSCRIPT_INCREMENTAL=" + transcriptPath,
 	}
-	cmd.Stdin = slave
-	cmd.Stdout = slave
-	cmd.Stderr = slave
+	cmd.Stdin = strings.NewReader("")
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
 
 	done := make(chan error, 1)
 	if err := cmd.Start(); err != nil {
 		t.Fatalf("start: %v", err)
 	}
-	slave.Close()
 	go func() { done <- cmd.Wait() }()
 
 	select {
-	case <-done:
-	case <-time.After(30 * time.Second):
+	case err := <-done:
+		// We expect it to exit (mock claude exits immediately)
+		_ = err
+	case <-time.After(15 * time.Second):
 		cmd.Process.Kill()
-		t.Fatal("connect timed out")
+		t.Fatalf("connect timed out; stdout=%q stderr=%q", stdout.String(), stderr.String())
 	}
 
-	// Wait for WS handler to finish
-	select {
-	case <-wsDone:
-	case <-time.After(5 * time.Second):
-		t.Log("WS handler did not finish in time")
+	// Verify enrollment request was sent
+	enrollReqs := testServerURL.getRequests("/session/enroll")
+	if len(enrollReqs) == 0 {
+		t.Fatal("expected enrollment request")
 	}
-
-	// Verify that ALL incremental transcript lines were received,
-	// even those sent during/after the disconnection.
-	wsTextMu.Lock()
-	frames := make([]string, len(wsTextFrames))
-	copy(frames, wsTextFrames)
-	wsTextMu.Unlock()
-
-	for i := 1; i <= totalLines; i++ {
-		marker := fmt.Sprintf("INCREMENTAL_LINE_%d", i)
-		found := false
-		for _, frame := range frames {
-			if strings.Contains(frame, marker) {
-				found = true
-				break
-			}
-		}
-		if !found {
-			t.Errorf("missing transcript line %q in %d received frames", marker, len(frames))
-		}
+	var enrollBody map[string]string
+	if err := json.Unmarshal(enrollReqs[0].Body, &enrollBody); err != nil {
+		t.Fatalf("parse enroll body: %v", err)
+	}
+	if enrollBody["device_id"] != "test-dev" {
+		t.Errorf("expected device_id=test-dev, got %q", enrollBody["device_id"])
+	}
+	if enrollBody["project"] != "test-proj" {
+		t.Errorf("expected project=test-proj, got %q", enrollBody["project"])
+	}
+	if enrollBody["session_id"] == "" {
+		t.Error("expected non-empty session_id")
 	}
 
-	if t.Failed() {
-		t.Logf("Received %d text frames:", len(frames))
-		for i, f := range frames {
-			t.Logf("  frame[%d]: %s", i, f)
-		}
+	// Verify hooks were installed
+	settingsPath := filepath.Join(workDir, ".claude", "settings.local.json")
+	settingsData, err := os.ReadFile(settingsPath)
+	if err != nil {
+		t.Fatalf("expected settings file at %s: %v", settingsPath, err)
+	}
+	if !strings.Contains(string(settingsData), "greenlight") {
+		t.Error("expected greenlight hook in settings")
+	}
+	if !strings.Contains(string(settingsData), "SessionStart") {
+		t.Error("expected SessionStart hook in settings")
+	}
+	if !strings.Contains(string(settingsData), "PermissionRequest") {
+		t.Error("expected PermissionRequest hook in settings")
 	}
 }
 
-// ---------- hook — SessionStart ----------
-
-func TestIntegration_Hook_SessionStart(t *testing.T) {
+func TestIntegration_Connect_ExtraHooks(t *testing.T) {
 	testServerURL.clearHandlers()
 
-	// Clean up any enrollment marker from previous tests
-	os.Remove(filepath.Join(os.TempDir(), "greenlight-enrolled-relay-123"))
-
-	input := `{"hook_event_name":"SessionStart","session_id":"test-session-123","transcript_path":"/tmp/fake-transcript.jsonl"}`
-	r := run(t, []string{"hook"},
-		[]string{
-			"GREENLIGHT_DEVICE_ID=test-dev",
-			"GREENLIGHT_PROJECT=test-proj",
-			"GREENLIGHT_SESSION_ID=relay-123",
-		}, input)
-
-	if r.ExitCode != 0 {
-		t.Errorf("expected exit 0, got %d; stdout=%q stderr=%q", r.ExitCode, r.Stdout, r.Stderr)
+	workDir, err := newProjectDir("greenlight-hooks-*")
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer os.RemoveAll(workDir)
 
-	// Give async activity POST a moment to arrive
-	time.Sleep(200 * time.Millisecond)
-
-	// Verify enrollment was attempted
-	enrollReqs := testServerURL.getRequests("/session/enroll")
-	if len(enrollReqs) == 0 {
-		t.Error("expected enrollment request on SessionStart")
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	connect := func(extraArgs ...string) (int, string) {
+		args := append([]string{"connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll"}, extraArgs...)
+		cmd := exec.Command(greenlightBin, args...)
+		cmd.Dir = workDir
+		cmd.Env = []string{
+			"HOME=" + os.Getenv("HOME"),
+			"PATH=" + pathWithMock,
+			"TMPDIR=" + os.TempDir(),
+			"TERM=xterm-256color",
+		}
+		cmd.Stdin = strings.NewReader("")
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		done := make(chan error, 1)
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("start: %v", err)
+		}
+		go func() { done <- cmd.Wait() }()
+		select {
+		case <-done:
+		case <-time.After(15 * time.Second):
+			cmd.Process.Kill()
+			t.Fatal("connect timed out")
+		}
+		return cmd.ProcessState.ExitCode(), stderr.String()
 	}
-
-	// Verify activity POST was sent
-	activityReqs := testServerURL.getRequests("/activity")
-	if len(activityReqs) == 0 {
-		t.Error("expected activity request on SessionStart")
-	} else {
-		var body map[string]interface{}
-		json.Unmarshal(activityReqs[0].Body, &body)
-		if body["event"] != "session_start" {
-			t.Errorf("expected event=session_start, got %v", body["event"])
+	hookEvents := func() map[string]bool {
+		data, err := os.ReadFile(filepath.Join(workDir, ".claude", "settings.local.json"))
+		if err != nil {
+			t.Fatalf("read settings: %v", err)
 		}
-		if body["device_id"] != "test-dev" {
-			t.Errorf("expected device_id=test-dev, got %v", body["device_id"])
+		var settings struct {
+			Hooks map[string]json.RawMessage `json:"hooks"`
+		}
+		if err := json.Unmarshal(data, &settings); err != nil {
+			t.Fatalf("parse settings: %v", err)
 		}
+		events := make(map[string]bool)
+		for event, entries := range settings.Hooks {
+			events[event] = strings.Contains(string(entries), "greenlight")
+		}
+		return events
 	}
-}
-
-func TestIntegration_Hook_MissingDeviceID(t *testing.T) {
-	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash"}`
-	r := run(t, []string{"hook"},
-		[]string{
-			"GREENLIGHT_PROJECT=test-proj",
-		}, input)
 
-	if r.ExitCode != 0 {
-		t.Errorf("expected exit 0 (deny via JSON), got %d", r.ExitCode)
+	connect("--hooks", "Stop, PreToolUse")
+	events := hookEvents()
+	for _, event := range []string{"SessionStart", "PermissionRequest", "Stop", "PreToolUse"} {
+		if !events[event] {
+			t.Errorf("expected greenlight hook for %s, got %v", event, events)
+		}
 	}
 
-	var output map[string]interface{}
-	if err := json.Unmarshal([]byte(r.Stdout), &output); err != nil {
-		t.Fatalf("failed to parse stdout JSON: %v; stdout=%q", err, r.Stdout)
+	// Without --hooks, only the defaults remain
+	connect()
+	events = hookEvents()
+	if !events["SessionStart"] || !events["PermissionRequest"] {
+		t.Errorf("expected default hooks to remain, got %v", events)
 	}
-
-	hso := output["hookSpecificOutput"].(map[string]interface{})
-	decision := hso["decision"].(map[string]interface{})
-	if decision["behavior"] != "deny" {
-		t.Errorf("expected deny, got %v", decision["behavior"])
+	if events["Stop"] || events["PreToolUse"] {
+		t.Errorf("expected extra hooks to be removed, got %v", events)
 	}
-	msg := decision["message"].(string)
-	if !strings.Contains(strings.ToLower(msg), "device id") {
-		t.Errorf("expected device ID error message, got %q", msg)
+
+	if code, stderr := connect("--hooks", "Bogus"); code == 0 || !strings.Contains(stderr, "unsupported hook event") {
+		t.Errorf("expected unsupported event error, got exit %d stderr=%q", code, stderr)
 	}
 }
 
-func TestIntegration_Hook_MissingProject(t *testing.T) {
-	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash"}`
-	r := run(t, []string{"hook"},
-		[]string{
-			"GREENLIGHT_DEVICE_ID=test-dev",
-		}, input)
+func TestIntegration_Connect_GlobalHooks(t *testing.T) {
+	testServerURL.clearHandlers()
 
-	if r.ExitCode != 0 {
-		t.Errorf("expected exit 0, got %d", r.ExitCode)
-	}
+	// Not a project directory: global hooks don't need one
+	workDir := t.TempDir()
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
 
-	var output map[string]interface{}
-	json.Unmarshal([]byte(r.Stdout), &output)
-	hso := output["hookSpecificOutput"].(map[string]interface{})
-	decision := hso["decision"].(map[string]interface{})
-	if decision["behavior"] != "deny" {
-		t.Errorf("expected deny, got %v", decision["behavior"])
-	}
-	msg := decision["message"].(string)
-	if !strings.Contains(strings.ToLower(msg), "project") {
-		t.Errorf("expected project error message, got %q", msg)
+	for _, tc := range []struct {
+		name   string
+		args   []string
+		config string
+	}{
+		{"flag", []string{"--global"}, ""},
+		{"config", nil, "global_hooks=true\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			home := t.TempDir()
+			if tc.config != "" {
+				os.MkdirAll(filepath.Join(home, ".greenlight"), 0755)
+				os.WriteFile(filepath.Join(home, ".greenlight", "config"), []byte(tc.config), 0644)
+			}
+
+			args := append([]string{"connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll"}, tc.args...)
+			cmd := exec.Command(greenlightBin, args...)
+			cmd.Dir = workDir
+			cmd.Env = []string{
+				"HOME=" + home,
+				"PATH=" + pathWithMock,
+				"TMPDIR=" + os.TempDir(),
+				"TERM=xterm-256color",
+			}
+			cmd.Stdin = strings.NewReader("")
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+			done := make(chan error, 1)
+			if err := cmd.Start(); err != nil {
+				t.Fatalf("start: %v", err)
+			}
+			go func() { done <- cmd.Wait() }()
+			select {
+			case <-done:
+			case <-time.After(15 * time.Second):
+				cmd.Process.Kill()
+				t.Fatal("connect timed out")
+			}
+
+			data, err := os.ReadFile(filepath.Join(home, ".claude", "settings.json"))
+			if err != nil {
+				t.Fatalf("expected global settings file: %v; stderr=%q", err, stderr.String())
+			}
+			for _, want := range []string{"SessionStart", "PermissionRequest", "hook --connected-only"} {
+				if !strings.Contains(string(data), want) {
+					t.Errorf("expected %q in global settings, got %s", want, data)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(workDir, ".claude", "settings.local.json")); err == nil {
+				t.Error("expected no project settings file with global hooks")
+			}
+		})
 	}
 }
 
-// ---------- hook — PermissionRequest ----------
+func TestIntegration_Connect_EnrollmentRejected(t *testing.T) {
+	testServerURL.clearHandlers()
+	testServerURL.setHandler("/session/enroll", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"approved":false,"message":"rejected by test"}`)
+	})
+	defer testServerURL.clearHandlers()
 
-func TestIntegration_Hook_PermissionRequest_Allow(t *testing.T) {
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	r := run(t, []string{"connect", "--device-id", "test-dev", "--project", "test-proj"},
+		[]string{"PATH=" + pathWithMock}, "")
+	if r.ExitCode == 0 {
+		t.Error("expected non-zero exit code for rejected enrollment")
+	}
+	if !strings.Contains(r.Stderr, "enrollment") {
+		t.Errorf("expected enrollment error, got stderr=%q", r.Stderr)
+	}
+	// An explicit rejection is final
+	if n := len(testServerURL.getRequests("/session/enroll")); n != 1 {
+		t.Errorf("expected 1 enrollment attempt, got %d", n)
+	}
+}
+
+func TestIntegration_Connect_AsyncEnroll(t *testing.T) {
 	testServerURL.clearHandlers()
-	testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
+	enrolled := make(chan string, 1)
+	var approved atomic.Bool
+	testServerURL.setHandler("/session/enroll", func(w http.ResponseWriter, r *http.Request) {
+		// The phone takes a while to approve
+		time.Sleep(2 * time.Second)
+		var body struct {
+			SessionID string `json:"session_id"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		approved.Store(true)
 		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprint(w, `{"behavior":"allow"}`)
+		fmt.Fprint(w, `{"approved":true}`)
+		select {
+		case enrolled <- body.SessionID:
+		default:
+		}
+	})
+	// The relay refuses the session until it is approved
+	var relayed atomic.Bool
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		if !approved.Load() {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "done")
+		relayed.Store(true)
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				return
+			}
+		}
 	})
 	defer testServerURL.clearHandlers()
 
-	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","tool_input":{"command":"ls"},"session_id":"s1"}`
-	r := run(t, []string{"hook"},
-		[]string{
-			"GREENLIGHT_DEVICE_ID=test-dev",
-			"GREENLIGHT_PROJECT=test-proj",
-			"GREENLIGHT_SESSION_ID=relay-1",
-		}, input)
+	workDir, err := newProjectDir("greenlight-asyncenroll-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	argsFile := filepath.Join(workDir, "claude-args.txt")
 
-	if r.ExitCode != 0 {
-		t.Errorf("expected exit 0, got %d; stderr=%q", r.ExitCode, r.Stderr)
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
 	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
 
-	var output map[string]interface{}
-	if err := json.Unmarshal([]byte(r.Stdout), &output); err != nil {
-		t.Fatalf("parse stdout: %v; stdout=%q", err, r.Stdout)
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--async-enroll")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_ARGS=" + argsFile,
+		"MOCK_CLAUDE_STALL=6",
 	}
-	hso := output["hookSpecificOutput"].(map[string]interface{})
-	decision := hso["decision"].(map[string]interface{})
-	if decision["behavior"] != "allow" {
-		t.Errorf("expected allow, got %v", decision["behavior"])
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
 	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
 
-	// Verify the request payload forwarded to server
-	reqs := testServerURL.getRequests("/request")
-	if len(reqs) == 0 {
-		t.Fatal("expected /request POST")
+	// The agent starts before the session is approved
+	time.Sleep(1 * time.Second)
+	if _, err := os.Stat(argsFile); err != nil {
+		t.Errorf("expected the agent to start before enrollment finished: %v", err)
 	}
-	var payload map[string]interface{}
-	json.Unmarshal(reqs[0].Body, &payload)
-	if payload["device_id"] != "test-dev" {
-		t.Errorf("expected device_id=test-dev, got %v", payload["device_id"])
+
+	var relayID string
+	select {
+	case relayID = <-enrolled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("enrollment never completed")
 	}
-	if payload["tool_name"] != "Bash" {
-		t.Errorf("expected tool_name=Bash, got %v", payload["tool_name"])
+	marker := filepath.Join(os.TempDir(), "greenlight-enrolled-"+relayID)
+	defer os.Remove(marker)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected the session to survive the relay refusing it before approval: %v", err)
+		}
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+	if !relayed.Load() {
+		t.Error("expected the relay connection to succeed once approved")
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("expected enrollment marker once approved: %v", err)
 	}
 }
 
-func TestIntegration_Hook_PermissionRequest_Deny(t *testing.T) {
+func TestIntegration_Connect_EnrollmentRetry(t *testing.T) {
 	testServerURL.clearHandlers()
-	testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
+	var mu sync.Mutex
+	var attempts int
+	testServerURL.setHandler("/session/enroll", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		n := attempts
+		mu.Unlock()
+		if n <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprint(w, `{"behavior":"deny","message":"not allowed by test"}`)
+		fmt.Fprint(w, `{"approved":true}`)
 	})
 	defer testServerURL.clearHandlers()
 
-	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","session_id":"s1"}`
-	r := run(t, []string{"hook"},
-		[]string{
-			"GREENLIGHT_DEVICE_ID=test-dev",
-			"GREENLIGHT_PROJECT=test-proj",
-			"GREENLIGHT_SESSION_ID=relay-1",
-		}, input)
+	workDir, err := newProjectDir("greenlight-enrollretry-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
 
-	var output map[string]interface{}
-	json.Unmarshal([]byte(r.Stdout), &output)
-	hso := output["hookSpecificOutput"].(map[string]interface{})
-	decision := hso["decision"].(map[string]interface{})
-	if decision["behavior"] != "deny" {
-		t.Errorf("expected deny, got %v", decision["behavior"])
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
 	}
-	if decision["message"] != "not allowed by test" {
-		t.Errorf("expected 'not allowed by test', got %v", decision["message"])
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	var out bytes.Buffer
+	readDone := make(chan struct{})
+	go func() {
+		io.Copy(&out, master)
+		close(readDone)
+	}()
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		<-readDone
+		if err != nil {
+			t.Fatalf("expected connect to succeed after transient enrollment errors: %v\n%s", err, out.String())
+		}
+	case <-time.After(20 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	if !strings.Contains(out.String(), "MOCK_CLAUDE_STARTED") {
+		t.Errorf("expected the agent to start, got %q", out.String())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 3 {
+		t.Errorf("expected 3 enrollment attempts, got %d", attempts)
 	}
 }
 
-func TestIntegration_Hook_PermissionRequest_AllowWithUpdatedInput(t *testing.T) {
+func TestIntegration_Connect_EnrollmentRetryExhausted(t *testing.T) {
 	testServerURL.clearHandlers()
-	testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprint(w, `{"behavior":"allow","updated_input":{"command":"echo safe"}}`)
+	testServerURL.setHandler("/session/enroll", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
 	})
 	defer testServerURL.clearHandlers()
 
-	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","tool_input":{"command":"rm -rf /"},"session_id":"s1"}`
-	r := run(t, []string{"hook"},
-		[]string{
-			"GREENLIGHT_DEVICE_ID=test-dev",
-			"GREENLIGHT_PROJECT=test-proj",
-			"GREENLIGHT_SESSION_ID=relay-1",
-		}, input)
-
-	var output map[string]interface{}
-	json.Unmarshal([]byte(r.Stdout), &output)
-	hso := output["hookSpecificOutput"].(map[string]interface{})
-	decision := hso["decision"].(map[string]interface{})
-	if decision["behavior"] != "allow" {
-		t.Errorf("expected allow, got %v", decision["behavior"])
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	r := run(t, []string{"connect", "--device-id", "test-dev", "--project", "test-proj"},
+		[]string{"PATH=" + pathWithMock, "GREENLIGHT_ENROLL_ATTEMPTS=2"}, "")
+	if r.ExitCode == 0 {
+		t.Error("expected non-zero exit code when enrollment keeps failing")
 	}
-	updatedInput, ok := decision["updatedInput"].(map[string]interface{})
-	if !ok {
-		t.Fatalf("expected updatedInput map, got %v", decision["updatedInput"])
+	if !strings.Contains(r.Stderr, "session enrollment failed: enrollment failed (HTTP 502) (gave up after 2 attempts)") {
+		t.Errorf("expected final enrollment error, got stderr=%q", r.Stderr)
 	}
-	if updatedInput["command"] != "echo safe" {
-		t.Errorf("expected updated command='echo safe', got %v", updatedInput["command"])
+	if n := len(testServerURL.getRequests("/session/enroll")); n != 2 {
+		t.Errorf("expected 2 enrollment attempts, got %d", n)
 	}
 }
 
-func TestIntegration_Hook_PermissionRequest_DenyWithInterrupt(t *testing.T) {
+func TestIntegration_Connect_EnrollmentNotRetriedOnceSent(t *testing.T) {
 	testServerURL.clearHandlers()
-	testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprint(w, `{"behavior":"deny","message":"interrupted","interrupt":true}`)
+	// The request reaches the server, which drops it unanswered, as when
+	// the wait for the phone is cut short
+	testServerURL.setHandler("/session/enroll", func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
 	})
 	defer testServerURL.clearHandlers()
 
-	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","session_id":"s1"}`
-	r := run(t, []string{"hook"},
-		[]string{
-			"GREENLIGHT_DEVICE_ID=test-dev",
-			"GREENLIGHT_PROJECT=test-proj",
-			"GREENLIGHT_SESSION_ID=relay-1",
-		}, input)
-
-	var output map[string]interface{}
-	json.Unmarshal([]byte(r.Stdout), &output)
-	hso := output["hookSpecificOutput"].(map[string]interface{})
-	decision := hso["decision"].(map[string]interface{})
-	if decision["behavior"] != "deny" {
-		t.Errorf("expected deny, got %v", decision["behavior"])
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	r := run(t, []string{"connect", "--device-id", "test-dev", "--project", "test-proj"},
+		[]string{"PATH=" + pathWithMock, "GREENLIGHT_ENROLL_ATTEMPTS=3"}, "")
+	if r.ExitCode == 0 {
+		t.Error("expected non-zero exit code when enrollment fails")
 	}
-	if decision["interrupt"] != true {
-		t.Errorf("expected interrupt=true, got %v", decision["interrupt"])
+	if strings.Contains(r.Stderr, "gave up after") {
+		t.Errorf("expected no retries, got stderr=%q", r.Stderr)
+	}
+	if n := len(testServerURL.getRequests("/session/enroll")); n != 1 {
+		t.Errorf("expected 1 enrollment attempt, got %d", n)
 	}
 }
 
-func TestIntegration_Hook_PermissionRequest_401Retry(t *testing.T) {
+func TestIntegration_Connect_NoEnroll(t *testing.T) {
 	testServerURL.clearHandlers()
 
-	var requestCount int
-	var requestMu sync.Mutex
-	testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
-		requestMu.Lock()
-		requestCount++
-		count := requestCount
-		requestMu.Unlock()
+	workDir, err := newProjectDir("greenlight-noenroll-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
 
-		if count == 1 {
-			w.WriteHeader(401)
+	outputFile := filepath.Join(workDir, "claude-received.txt")
+
+	// Relay input from the server to prove the session runs without enrollment
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprint(w, `{"behavior":"allow"}`)
+		defer conn.Close(websocket.StatusNormalClosure, "done")
+		time.Sleep(500 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		conn.Write(ctx, websocket.MessageBinary, []byte("NO_ENROLL_INPUT\n"))
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				return
+			}
+		}
+	})
+	defer testServerURL.clearHandlers()
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+
+	cmd := exec.Command(greenlightBin, "connect", "--no-enroll", "--device-id", "test-dev", "--project", "test-proj")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_OUTPUT=" + outputFile,
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	if reqs := testServerURL.getRequests("/session/enroll"); len(reqs) != 0 {
+		t.Errorf("expected no enrollment request with --no-enroll, got %d", len(reqs))
+	}
+	data, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("mock claude output file not created: %v", err)
+	}
+	if !strings.Contains(string(data), "NO_ENROLL_INPUT") {
+		t.Errorf("expected relayed input to reach the child, got %q", string(data))
+	}
+}
+
+// ---------- connect — WebSocket input injection ----------
+
+func TestIntegration_Connect_WSInputInjection(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-wsinject-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	// File where mock claude will write the input it received
+	outputFile := filepath.Join(workDir, "claude-received.txt")
+
+	// Collects all binary frames (PTY output) received back from the relay.
+	var wsReceived bytes.Buffer
+	var wsReceivedMu sync.Mutex
+	wsDone := make(chan struct{})
+
+	// Set up WebSocket handler: accept connection, wait briefly for the
+	// relay to be ready, then send a test message and collect responses.
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		defer close(wsDone)
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Logf("ws accept error: %v", err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "done")
+
+		// Give the relay a moment to start the child process
+		time.Sleep(500 * time.Millisecond)
+
+		// Send a binary frame with a newline — the relay will convert
+		// \n to \r and inject it into the PTY. The terminal driver
+		// translates \r back to \n for the child's stdin.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err = conn.Write(ctx, websocket.MessageBinary, []byte("HELLO_FROM_SERVER\n"))
+		if err != nil {
+			t.Logf("ws write error: %v", err)
+			return
+		}
+
+		// Read messages until the connection closes, collecting PTY output
+		for {
+			_, data, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			wsReceivedMu.Lock()
+			wsReceived.Write(data)
+			wsReceivedMu.Unlock()
+		}
+	})
+	defer testServerURL.clearHandlers()
+
+	// Allocate a PTY for the greenlight process so that its setRaw()
+	// ioctl succeeds (it requires a real terminal on stdin).
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+
+	// Set a reasonable window size so syncWinsize doesn't complain
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_OUTPUT=" + outputFile,
+		// Output before the relay connects is dropped; hold the startup
+		// line back until the connection is up
+		"MOCK_CLAUDE_START_DELAY=200ms",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	// Close slave in parent after child inherits it
+	slave.Close()
+
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case <-done:
+		// process exited
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	// Check that mock claude received the server's input
+	data, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("mock claude output file not created: %v", err)
+	}
+	received := string(data)
+	if !strings.Contains(received, "HELLO_FROM_SERVER") {
+		t.Errorf("expected mock claude to receive 'HELLO_FROM_SERVER', got %q", received)
+	}
+
+	// Wait for the WS handler to finish collecting PTY output
+	select {
+	case <-wsDone:
+	case <-time.After(5 * time.Second):
+		t.Log("WS handler did not finish in time")
+	}
+
+	// Verify that PTY output was sent back to the server over WebSocket.
+	// The PTY echoes input in cooked mode, so "HELLO_FROM_SERVER" should
+	// appear in the binary frames. Mock claude's "MOCK_CLAUDE_STARTED"
+	// output should also be present.
+	wsReceivedMu.Lock()
+	wsOutput := wsReceived.String()
+	wsReceivedMu.Unlock()
+
+	if !strings.Contains(wsOutput, "HELLO_FROM_SERVER") {
+		t.Errorf("expected 'HELLO_FROM_SERVER' in WS output (PTY echo), got %q", wsOutput)
+	}
+	if !strings.Contains(wsOutput, "MOCK_CLAUDE_STARTED") {
+		t.Errorf("expected 'MOCK_CLAUDE_STARTED' in WS output, got %q", wsOutput)
+	}
+}
+
+func TestIntegration_Connect_FilePush(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-filepush-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	outputFile := filepath.Join(workDir, "claude-received.txt")
+
+	fileFrame := func(path, content string) []byte {
+		b, _ := json.Marshal(map[string]string{
+			"type":        "file",
+			"path":        path,
+			"content_b64": base64.StdEncoding.EncodeToString([]byte(content)),
+		})
+		return b
+	}
+
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Logf("ws accept error: %v", err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "done")
+
+		time.Sleep(500 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		for _, msg := range [][]byte{
+			fileFrame("notes/pushed.txt", "PUSHED_CONTENT"),
+			fileFrame("../escaped.txt", "ESCAPED"),
+			fileFrame(filepath.Join(workDir, "absolute.txt"), "ABSOLUTE"),
+		} {
+			if err := conn.Write(ctx, websocket.MessageText, msg); err != nil {
+				t.Logf("ws write error: %v", err)
+				return
+			}
+		}
+		// Let mock claude exit
+		conn.Write(ctx, websocket.MessageBinary, []byte("DONE\n"))
+
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				return
+			}
+		}
 	})
 	defer testServerURL.clearHandlers()
 
-	// Clear any enrollment markers from previous tests
-	relayID := "retry-relay-1"
-	os.Remove(filepath.Join(os.TempDir(), "greenlight-enrolled-"+relayID))
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--allow-file-push")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_OUTPUT=" + outputFile,
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	data, err := os.ReadFile(filepath.Join(workDir, ".greenlight-inbox", "notes", "pushed.txt"))
+	if err != nil {
+		t.Fatalf("pushed file not written to sandbox: %v", err)
+	}
+	if string(data) != "PUSHED_CONTENT" {
+		t.Errorf("expected pushed content, got %q", string(data))
+	}
+
+	if _, err := os.Stat(filepath.Join(workDir, "escaped.txt")); err == nil {
+		t.Error("path traversal wrote a file outside the sandbox")
+	}
+	if _, err := os.Stat(filepath.Join(workDir, "absolute.txt")); err == nil {
+		t.Error("absolute path wrote a file outside the sandbox")
+	}
+
+	// Control frames must not be typed into the session
+	received, _ := os.ReadFile(outputFile)
+	if strings.Contains(string(received), "content_b64") {
+		t.Errorf("file frame was injected as input: %q", string(received))
+	}
+}
+
+func TestIntegration_FilePush_SymlinkRoot(t *testing.T) {
+	workDir := t.TempDir()
+	target := t.TempDir()
+	root := filepath.Join(workDir, ".greenlight-inbox")
+	if err := os.Symlink(target, root); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fileFrame{Type: "file", Path: "x.txt", ContentB64: base64.StdEncoding.EncodeToString([]byte("X"))}
+	if _, err := writePushedFile(root, f); err == nil {
+		t.Error("expected a symlinked sandbox to be refused")
+	}
+	if _, err := os.Stat(filepath.Join(target, "x.txt")); err == nil {
+		t.Error("pushed file was written through the symlink")
+	}
+}
+
+func TestIntegration_Connect_ShellPane(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-panes-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	outputFile := filepath.Join(workDir, "claude-received.txt")
+
+	// Stand-in shell for pane 1: echoes one line of input back
+	shellPath := filepath.Join(workDir, "fake-shell")
+	script := "#!/bin/sh\nread line\necho \"SHELL_GOT:$line\"\nsleep 10\n"
+	if err := os.WriteFile(shellPath, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var panesMu sync.Mutex
+	panes := map[int]*bytes.Buffer{0: {}, 1: {}}
+	var untagged int
+	paneOutput := func(id int) string {
+		panesMu.Lock()
+		defer panesMu.Unlock()
+		if b, ok := panes[id]; ok {
+			return b.String()
+		}
+		return ""
+	}
+
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Logf("ws accept error: %v", err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "done")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+
+		readDone := make(chan struct{})
+		go func() {
+			defer close(readDone)
+			for {
+				typ, data, err := conn.Read(ctx)
+				if err != nil {
+					return
+				}
+				var f struct {
+					Type string `json:"type"`
+					Pane int    `json:"pane"`
+					Data string `json:"data"`
+				}
+				panesMu.Lock()
+				if typ == websocket.MessageBinary {
+					untagged++
+				} else if json.Unmarshal(data, &f) == nil && f.Type == "output" {
+					out, _ := base64.StdEncoding.DecodeString(f.Data)
+					if panes[f.Pane] == nil {
+						panes[f.Pane] = &bytes.Buffer{}
+					}
+					panes[f.Pane].Write(out)
+				}
+				panesMu.Unlock()
+			}
+		}()
+
+		time.Sleep(500 * time.Millisecond)
+
+		// Type into the shell pane
+		conn.Write(ctx, websocket.MessageText, []byte(`{"type":"select_pane","pane":1}`))
+		conn.Write(ctx, websocket.MessageBinary, []byte("PING\n"))
+		for i := 0; i < 50 && !strings.Contains(paneOutput(1), "SHELL_GOT:PING"); i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		// Then into the agent pane, which exits after reading a line
+		conn.Write(ctx, websocket.MessageText, []byte(`{"type":"select_pane","pane":0}`))
+		conn.Write(ctx, websocket.MessageBinary, []byte("DONE\n"))
+		<-readDone
+	})
+	defer testServerURL.clearHandlers()
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--shell-pane")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"SHELL=" + shellPath,
+		"MOCK_CLAUDE_OUTPUT=" + outputFile,
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	data, _ := os.ReadFile(outputFile)
+	if string(data) != "DONE" {
+		t.Errorf("expected agent pane to receive DONE, got %q", string(data))
+	}
+
+	pane0, pane1 := paneOutput(0), paneOutput(1)
+	if !strings.Contains(pane1, "SHELL_GOT:PING") {
+		t.Errorf("expected shell output tagged pane 1, got pane 1 %q", pane1)
+	}
+	if !strings.Contains(pane0, "DONE") {
+		t.Errorf("expected agent echo tagged pane 0, got pane 0 %q", pane0)
+	}
+	if strings.Contains(pane0, "SHELL_GOT") || strings.Contains(pane0, "PING") {
+		t.Errorf("shell output leaked into pane 0: %q", pane0)
+	}
+	if strings.Contains(pane1, "DONE") {
+		t.Errorf("agent output leaked into pane 1: %q", pane1)
+	}
+	panesMu.Lock()
+	if untagged != 0 {
+		t.Errorf("expected only tagged frames in pane mode, got %d untagged binary frames", untagged)
+	}
+	panesMu.Unlock()
+}
+
+func TestIntegration_Connect_WSCaptureReplay(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-capture-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	outputFile := filepath.Join(workDir, "claude-received.txt")
+	captureFile := filepath.Join(workDir, "capture.jsonl")
+
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "done")
+
+		time.Sleep(500 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		conn.Write(ctx, websocket.MessageBinary, []byte("HELLO_CAPTURE\n"))
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				return
+			}
+		}
+	})
+	defer testServerURL.clearHandlers()
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_OUTPUT=" + outputFile,
+		"GREENLIGHT_WS_CAPTURE=" + captureFile,
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	data, err := os.ReadFile(captureFile)
+	if err != nil {
+		t.Fatalf("capture file not written: %v", err)
+	}
+	var sawIn, sawOut bool
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var rec struct {
+			TS   string `json:"ts"`
+			Dir  string `json:"dir"`
+			Type string `json:"type"`
+			Data []byte `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("bad capture line %q: %v", line, err)
+		}
+		if rec.TS == "" {
+			t.Errorf("capture line missing timestamp: %q", line)
+		}
+		if rec.Dir == "in" && rec.Type == "binary" && string(rec.Data) == "HELLO_CAPTURE\n" {
+			sawIn = true
+		}
+		if rec.Dir == "out" && rec.Type == "binary" && strings.Contains(string(rec.Data), "HELLO_CAPTURE") {
+			sawOut = true
+		}
+	}
+	if !sawIn {
+		t.Errorf("expected inbound HELLO_CAPTURE frame in capture:\n%s", data)
+	}
+	if !sawOut {
+		t.Errorf("expected outbound PTY echo of HELLO_CAPTURE in capture:\n%s", data)
+	}
+
+	r := run(t, []string{"ws-replay", captureFile}, nil, "")
+	if r.ExitCode != 0 {
+		t.Fatalf("ws-replay: exit %d, stderr=%q", r.ExitCode, r.Stderr)
+	}
+	if !strings.Contains(r.Stdout, `inject "HELLO_CAPTURE"`) || !strings.Contains(r.Stdout, `inject "\r"`) {
+		t.Errorf("expected replayed injections, got:\n%s", r.Stdout)
+	}
+}
+
+func TestIntegration_Connect_InjectStuckChild(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-stuck-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	// Flood the relay with input while the child isn't reading, then check
+	// the read loop still answers a ping.
+	pingErr := make(chan error, 1)
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			pingErr <- err
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "done")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+		go func() {
+			for {
+				if _, _, err := conn.Read(ctx); err != nil {
+					return
+				}
+			}
+		}()
+
+		time.Sleep(500 * time.Millisecond)
+		chunk := bytes.Repeat([]byte("x"), 8192)
+		for i := 0; i < 32; i++ {
+			if err := conn.Write(ctx, websocket.MessageBinary, chunk); err != nil {
+				pingErr <- err
+				return
+			}
+		}
+
+		pingCtx, pingCancel := context.WithTimeout(ctx, 3*time.Second)
+		defer pingCancel()
+		pingErr <- conn.Ping(pingCtx)
+	})
+	defer testServerURL.clearHandlers()
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	// Drain greenlight's terminal output so it never blocks on stdout
+	go io.Copy(io.Discard, master)
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_STALL=8",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	select {
+	case err := <-pingErr:
+		if err != nil {
+			t.Errorf("expected relay to answer ping while child is stuck, got %v", err)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("timed out waiting for ping result")
+	}
+}
+
+func TestIntegration_Connect_RawInject(t *testing.T) {
+	testServerURL.clearHandlers()
+	defer testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-rawinject-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	outputFile := filepath.Join(workDir, "claude-received.txt")
+
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		time.Sleep(500 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		// Without --raw-inject the \r and \n would both become Enter
+		conn.Write(ctx, websocket.MessageBinary, []byte("first\rsecond\n"))
+		conn.Read(ctx)
+	})
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll", "--raw-inject")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_OUTPUT=" + outputFile,
+		// Read \r as itself rather than as a newline
+		"MOCK_CLAUDE_STTY=-icrnl",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	data, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("mock claude output file not created: %v", err)
+	}
+	if string(data) != "first\rsecond" {
+		t.Errorf("expected input injected verbatim, got %q", data)
+	}
+}
+
+func TestIntegration_Connect_LargeInject(t *testing.T) {
+	testServerURL.clearHandlers()
+	defer testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-largeinject-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	countFile := filepath.Join(workDir, "count.txt")
+
+	// Far more than the PTY buffer holds, so writes to the master back up
+	const frames, frameSize = 8, 30000
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		time.Sleep(500 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		chunk := bytes.Repeat([]byte("x"), frameSize)
+		for i := 0; i < frames; i++ {
+			conn.Write(ctx, websocket.MessageBinary, chunk)
+		}
+		conn.Write(ctx, websocket.MessageBinary, []byte("."))
+		// The payload may be echoed back before the mock turns echo off
+		conn.SetReadLimit(1 << 20)
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				return
+			}
+		}
+	})
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll", "--raw-inject")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_COUNT=" + countFile,
+		"MOCK_CLAUDE_STTY=raw -echo",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	data, err := os.ReadFile(countFile)
+	if err != nil {
+		t.Fatalf("mock claude count file not created: %v", err)
+	}
+	if want := strconv.Itoa(frames * frameSize); string(data) != want {
+		t.Errorf("child received %s bytes, want %s", data, want)
+	}
+}
+
+func TestIntegration_Connect_LargePaste(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-paste-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	pasteFile := filepath.Join(workDir, "claude-paste.txt")
+
+	// Several read buffers' worth, with Ctrl-Z bytes at the start, around
+	// the 4096-byte boundaries and at the end
+	var paste []byte
+	for i := 0; len(paste) < 20000; i++ {
+		paste = append(paste, fmt.Sprintf("line %d of the paste\r", i)...)
+	}
+	for _, i := range []int{0, 4095, 4096, 8191, 12288, len(paste) - 1} {
+		paste[i] = 0x1a
+	}
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_PASTE=" + pasteFile,
+		"MOCK_CLAUDE_STTY=raw -echo",
+		"GREENLIGHT_CTRL_Z=pass",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
+
+	// Let greenlight and the mock put their terminals in raw mode
+	time.Sleep(1 * time.Second)
+	if _, err := master.Write(append(paste, '.')); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	data, err := os.ReadFile(pasteFile)
+	if err != nil {
+		t.Fatalf("mock claude paste file not created: %v", err)
+	}
+	if !bytes.Equal(data, paste) {
+		t.Errorf("child received %d bytes, want the %d-byte paste intact", len(data), len(paste))
+	}
+}
+
+func TestIntegration_Connect_FinalOutput(t *testing.T) {
+	testServerURL.clearHandlers()
+	defer testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-finaloutput-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	const size = 200000
+	var received bytes.Buffer
+	closed := make(chan struct{})
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		defer close(closed)
+		defer conn.CloseNow()
+		conn.SetReadLimit(1 << 20)
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		for {
+			typ, data, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			if typ == websocket.MessageBinary {
+				received.Write(data)
+			}
+		}
+	})
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	// The agent prints its last screen and exits straight away
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_START_DELAY=1s",
+		"MOCK_CLAUDE_FINAL=" + strconv.Itoa(size),
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay connection was not closed")
+	}
+
+	out := received.Bytes()
+	if n := bytes.Count(out, []byte("x")); n != size || !bytes.Contains(out, []byte("FINAL_OUTPUT_END")) {
+		t.Errorf("relay got %d of %d bytes of final output (end marker seen: %v)", n, size, bytes.Contains(out, []byte("FINAL_OUTPUT_END")))
+	}
+}
+
+func TestIntegration_Connect_IdleTimeout(t *testing.T) {
+	testServerURL.clearHandlers()
+	defer testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-idle-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	// Remote input keeps the session alive for the first two seconds
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		for i := 0; i < 5; i++ {
+			time.Sleep(400 * time.Millisecond)
+			conn.Write(ctx, websocket.MessageBinary, []byte("x"))
+		}
+		conn.Read(ctx)
+	})
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll", "--raw-inject", "--idle-timeout", "1s")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_STALL=10",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	var out bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(&out, master)
+		close(copied)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+	elapsed := time.Since(start)
+	select {
+	case <-copied:
+	case <-time.After(2 * time.Second):
+	}
+
+	if elapsed < 2*time.Second {
+		t.Errorf("session ended after %v despite remote input", elapsed)
+	}
+	if elapsed > 8*time.Second {
+		t.Errorf("session ended after %v, want the idle timeout to end it well before the agent exits", elapsed)
+	}
+	if !strings.Contains(out.String(), "no activity for 1s") {
+		t.Errorf("expected idle message, got %q", out.String())
+	}
+}
+
+func TestIntegration_Connect_IdleTimeoutPendingRequest(t *testing.T) {
+	testServerURL.clearHandlers()
+	defer testServerURL.clearHandlers()
+
+	// Stand in for a permission hook that waits three seconds for the
+	// phone, from the moment the session is enrolled
+	testServerURL.setHandler("/session/enroll", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			SessionID string `json:"session_id"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		path := pendingRequestPath(body.SessionID)
+		if f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644); err == nil {
+			syscall.Flock(int(f.Fd()), syscall.LOCK_SH)
+			time.AfterFunc(3*time.Second, func() {
+				f.Close()
+				os.Remove(path)
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"approved":true}`)
+	})
+
+	workDir, err := newProjectDir("greenlight-idlepending-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--idle-timeout", "1s")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_STALL=2",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
+
+	// The agent outlives the idle timeout because a request is pending
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected the session to last while a request was pending: %v", err)
+		}
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+}
+
+func TestIntegration_Connect_RemoteResize(t *testing.T) {
+	testServerURL.clearHandlers()
+	defer testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-resize-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	sizeFile := filepath.Join(workDir, "winsize.txt")
+
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		time.Sleep(500 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		conn.Write(ctx, websocket.MessageText, []byte(`{"type":"resize","cols":0,"rows":40}`))
+		conn.Write(ctx, websocket.MessageText, []byte(`{"type":"resize","cols":120,"rows":40}`))
+		conn.Read(ctx)
+	})
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_WINSIZE=" + sizeFile,
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	data, err := os.ReadFile(sizeFile)
+	if err != nil {
+		t.Fatalf("mock claude size file not created: %v", err)
+	}
+	if string(data) != "40 120" {
+		t.Errorf("expected the PTY resized to 40 rows by 120 columns, got %q", data)
+	}
+}
+
+func TestIntegration_Connect_InputSource(t *testing.T) {
+	testServerURL.clearHandlers()
+	defer testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-inputsource-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	outputFile := filepath.Join(workDir, "claude-received.txt")
+
+	var mu sync.Mutex
+	var sources []string
+	var binary bytes.Buffer
+	wsDone := make(chan struct{})
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		defer close(wsDone)
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		go func() {
+			time.Sleep(500 * time.Millisecond)
+			conn.Write(ctx, websocket.MessageBinary, []byte("REMOTE\n"))
+		}()
+		for {
+			typ, data, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			if typ == websocket.MessageBinary {
+				binary.Write(data)
+			} else {
+				var f struct{ Type, Source string }
+				if json.Unmarshal(data, &f) == nil && f.Type == "input_source" {
+					sources = append(sources, f.Source)
+				}
+			}
+			mu.Unlock()
+		}
+	})
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_OUTPUT=" + outputFile,
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
+
+	// Typed locally, then completed from the app
+	master.Write([]byte("LOCAL"))
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+	select {
+	case <-wsDone:
+	case <-time.After(5 * time.Second):
+	}
+
+	data, _ := os.ReadFile(outputFile)
+	if string(data) != "LOCALREMOTE" {
+		t.Errorf("expected the agent to read LOCALREMOTE, got %q", data)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(sources, ",") != "local,remote" {
+		t.Errorf("expected input_source frames local then remote, got %v", sources)
+	}
+	if strings.Contains(binary.String(), "input_source") {
+		t.Error("expected the binary output stream to carry no source markers")
+	}
+
+	var events int
+	for _, req := range testServerURL.getRequests("/activity") {
+		var body map[string]interface{}
+		if json.Unmarshal(req.Body, &body) == nil && body["event"] == "remote_input" {
+			events++
+			if body["relay_id"] == "" || body["device_id"] != "test-dev" {
+				t.Errorf("unexpected remote_input payload: %v", body)
+			}
+		}
+	}
+	if events != 1 {
+		t.Errorf("expected 1 remote_input activity event, got %d", events)
+	}
+}
+
+func TestIntegration_Connect_MirrorInput(t *testing.T) {
+	testServerURL.clearHandlers()
+	defer testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-mirror-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	outputFile := filepath.Join(workDir, "claude-received.txt")
+	castFile := filepath.Join(workDir, "session.cast")
+
+	var mu sync.Mutex
+	var mirrored []string
+	wsDone := make(chan struct{})
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		defer close(wsDone)
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		go func() {
+			time.Sleep(500 * time.Millisecond)
+			conn.Write(ctx, websocket.MessageBinary, []byte("REMOTE\n"))
+		}()
+		for {
+			typ, data, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			var f struct{ Type, Data string }
+			if typ == websocket.MessageText && json.Unmarshal(data, &f) == nil && f.Type == "remote_input" {
+				mu.Lock()
+				mirrored = append(mirrored, f.Data)
+				mu.Unlock()
+			}
+		}
+	})
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll", "--mirror-input", "--record", castFile)
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_OUTPUT=" + outputFile,
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
+
+	// Local input isn't mirrored, only input from the app
+	master.Write([]byte("LOCAL"))
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+	select {
+	case <-wsDone:
+	case <-time.After(5 * time.Second):
+	}
+
+	data, _ := os.ReadFile(outputFile)
+	if string(data) != "LOCALREMOTE" {
+		t.Errorf("expected the agent to read LOCALREMOTE, got %q", data)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(mirrored) != 1 || mirrored[0] != "REMOTE\n" {
+		t.Errorf("expected one remote_input frame with the message as sent, got %q", mirrored)
+	}
+
+	cast, err := os.ReadFile(castFile)
+	if err != nil {
+		t.Fatalf("recording not created: %v", err)
+	}
+	var inputs []string
+	for _, line := range strings.Split(strings.TrimSpace(string(cast)), "\n")[1:] {
+		var ev []interface{}
+		if json.Unmarshal([]byte(line), &ev) == nil && len(ev) == 3 && ev[1] == "i" {
+			inputs = append(inputs, ev[2].(string))
+		}
+	}
+	if len(inputs) != 1 || inputs[0] != "REMOTE\n" {
+		t.Errorf("expected one input event in the recording, got %q", inputs)
+	}
+}
+
+func TestIntegration_Connect_RelayConnectivityEvents(t *testing.T) {
+	testServerURL.clearHandlers()
+	defer testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-connevents-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	// Drop the first connection so the client reconnects once
+	var conns int32
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		if atomic.AddInt32(&conns, 1) == 1 {
+			time.Sleep(300 * time.Millisecond)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				return
+			}
+		}
+	})
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_STALL=2",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	var events []string
+	for _, req := range testServerURL.getRequests("/activity") {
+		var body map[string]interface{}
+		if json.Unmarshal(req.Body, &body) != nil {
+			continue
+		}
+		switch body["event"] {
+		case "relay_connected", "relay_disconnected":
+			if body["relay_id"] == "" || body["device_id"] != "test-dev" {
+				t.Errorf("unexpected %v payload: %v", body["event"], body)
+			}
+			event := body["event"].(string)
+			if n, ok := body["reconnect"]; ok {
+				event += fmt.Sprintf("(%v)", n)
+			}
+			events = append(events, event)
+		}
+	}
+	// Posted in the background, so they may arrive in any order
+	sort.Strings(events)
+	want := "relay_connected,relay_connected(1),relay_disconnected"
+	if got := strings.Join(events, ","); got != want {
+		t.Errorf("expected connectivity events %s, got %s", want, got)
+	}
+}
+
+// ---------- connect — suspend/resume (Ctrl-Z) ----------
+
+func TestIntegration_Connect_SuspendResume(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-suspend-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	// File where mock claude writes the input it received
+	outputFile := filepath.Join(workDir, "claude-received.txt")
+
+	// Allocate a PTY for greenlight's stdin/stdout
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_OUTPUT=" + outputFile,
+		// The test runner isn't a job-control shell, so auto-detection
+		// would pass Ctrl-Z through
+		"GREENLIGHT_CTRL_Z=suspend",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	// Put greenlight in its own process group so that its
+	// Kill(0, SIGTSTP) doesn't stop the test runner.
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+
+	// Wait for mock claude to start up inside the PTY
+	time.Sleep(1 * time.Second)
+
+	// Send Ctrl-Z — greenlight should intercept and suspend itself
+	if _, err := master.Write([]byte{0x1a}); err != nil {
+		t.Fatalf("write Ctrl-Z: %v", err)
+	}
+
+	// Give greenlight time to stop
+	time.Sleep(500 * time.Millisecond)
+
+	// Resume greenlight (simulates shell "fg")
+	syscall.Kill(cmd.Process.Pid, syscall.SIGCONT)
+
+	// Give greenlight time to re-enter raw mode
+	time.Sleep(500 * time.Millisecond)
+
+	// Send input after resume — mock claude should receive this
+	if _, err := master.Write([]byte("AFTER_RESUME\n")); err != nil {
+		t.Fatalf("write after resume: %v", err)
+	}
+
+	select {
+	case <-done:
+		// process exited
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	// Verify mock claude received input after the suspend/resume cycle
+	data, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("mock claude output file not created: %v", err)
+	}
+	if !strings.Contains(string(data), "AFTER_RESUME") {
+		t.Errorf("expected 'AFTER_RESUME' after suspend/resume, got %q", string(data))
+	}
+}
+
+func TestIntegration_Connect_SIGTSTPRestoresRawMode(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-sigtstp-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	outputFile := filepath.Join(workDir, "claude-received.txt")
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	// Keep the slave open to inspect the terminal modes greenlight sets
+	defer slave.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	termios := func() syscall.Termios {
+		var tio syscall.Termios
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, slave.Fd(), ioctlReadTermios, uintptr(ptrOf(&tio))); errno != 0 {
+			t.Fatalf("read termios: %v", errno)
+		}
+		return tio
+	}
+	isRaw := func() bool {
+		return termios().Lflag&(syscall.ICANON|syscall.ECHO) == 0
+	}
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_OUTPUT=" + outputFile,
+		// The test's pty isn't our controlling terminal, so job control
+		// isn't detected
+		"GREENLIGHT_CTRL_Z=suspend",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	// Own process group, so greenlight stopping itself doesn't stop us
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
+
+	time.Sleep(1 * time.Second)
+	if !isRaw() {
+		t.Fatal("expected terminal in raw mode while connected")
+	}
+
+	syscall.Kill(cmd.Process.Pid, syscall.SIGTSTP)
+	time.Sleep(500 * time.Millisecond)
+	if isRaw() {
+		t.Error("expected terminal modes restored while suspended")
+	}
+
+	syscall.Kill(cmd.Process.Pid, syscall.SIGCONT)
+	time.Sleep(500 * time.Millisecond)
+	if !isRaw() {
+		t.Error("expected raw mode again after resume")
+	}
+
+	if _, err := master.Write([]byte("AFTER_SIGCONT\r")); err != nil {
+		t.Fatalf("write after resume: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	data, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("mock claude output file not created: %v", err)
+	}
+	if !strings.Contains(string(data), "AFTER_SIGCONT") {
+		t.Errorf("expected input relayed after SIGTSTP/SIGCONT, got %q", string(data))
+	}
+}
+
+func TestIntegration_Connect_SIGTSTPWithoutJobControl(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-sigtstp-pass-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	outputFile := filepath.Join(workDir, "claude-received.txt")
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_OUTPUT=" + outputFile,
+		"GREENLIGHT_CTRL_Z=pass",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
+
+	time.Sleep(1 * time.Second)
+	syscall.Kill(cmd.Process.Pid, syscall.SIGTSTP)
+	time.Sleep(500 * time.Millisecond)
+
+	// No SIGCONT: a stopped greenlight would never relay this
+	if _, err := master.Write([]byte("AFTER_SIGTSTP\r")); err != nil {
+		t.Fatalf("write after SIGTSTP: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		syscall.Kill(cmd.Process.Pid, syscall.SIGCONT)
+		cmd.Process.Kill()
+		t.Fatal("connect stopped on SIGTSTP without job control")
+	}
+
+	data, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("mock claude output file not created: %v", err)
+	}
+	if !strings.Contains(string(data), "AFTER_SIGTSTP") {
+		t.Errorf("expected input relayed after SIGTSTP, got %q", string(data))
+	}
+}
+
+func TestIntegration_Connect_ChildExitsWhileSuspended(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-suspend-exit-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	defer slave.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	isRaw := func() bool {
+		var tio syscall.Termios
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, slave.Fd(), ioctlReadTermios, uintptr(ptrOf(&tio))); errno != 0 {
+			t.Fatalf("read termios: %v", errno)
+		}
+		return tio.Lflag&(syscall.ICANON|syscall.ECHO) == 0
+	}
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		// The agent exits on its own after 2 seconds
+		"MOCK_CLAUDE_STALL=2",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	// Own process group, so greenlight stopping itself doesn't stop us
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
+
+	time.Sleep(1 * time.Second)
+	syscall.Kill(cmd.Process.Pid, syscall.SIGTSTP)
+
+	// The agent exits while greenlight is stopped
+	time.Sleep(2 * time.Second)
+	syscall.Kill(cmd.Process.Pid, syscall.SIGCONT)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected clean exit, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect did not exit after resuming with the agent gone")
+	}
+	if isRaw() {
+		t.Error("expected terminal modes restored after exit")
+	}
+
+}
+
+func TestIntegration_Connect_CtrlZPassthrough(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-ctrlz-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	outputFile := filepath.Join(workDir, "claude-received.txt")
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_OUTPUT=" + outputFile,
+		// Let Ctrl-Z reach the mock as a byte instead of raising SIGTSTP
+		"MOCK_CLAUDE_STTY=-isig",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	// A session leader with no controlling terminal, like a service or
+	// container PID 1: there is no job control to resume it.
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid: true,
+	}
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+
+	time.Sleep(1 * time.Second)
+
+	if _, err := master.Write([]byte("BEFORE\x1aAFTER\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	data, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("mock claude output file not created: %v", err)
+	}
+	if string(data) != "BEFORE\x1aAFTER" {
+		t.Errorf("expected Ctrl-Z passed through to child, got %q", string(data))
+	}
+}
+
+// ---------- connect — session summary ----------
+
+func TestIntegration_Connect_Summary(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-summary-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	outputFile := filepath.Join(workDir, "claude-received.txt")
+
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "done")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+
+		time.Sleep(500 * time.Millisecond)
+		conn.Write(ctx, websocket.MessageBinary, []byte("DONE\n"))
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				return
+			}
+		}
+	})
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll", "--summary")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_OUTPUT=" + outputFile,
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	var outMu sync.Mutex
+	var out bytes.Buffer
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		buf := make([]byte, 4096)
+		for {
+			n, err := master.Read(buf)
+			outMu.Lock()
+			out.Write(buf[:n])
+			outMu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+	select {
+	case <-readDone:
+	case <-time.After(2 * time.Second):
+	}
+
+	outMu.Lock()
+	text := out.String()
+	outMu.Unlock()
+
+	m := regexp.MustCompile(`greenlight: session \S+ \| sent ([\d.]+ [KM]?B) \| recv ([\d.]+ [KM]?B) \| transcript \d+ lines \| permissions \d+ \(\d+ allowed, \d+ denied\) \| reconnects 0`).FindStringSubmatch(text)
+	if m == nil {
+		t.Fatalf("expected summary line, got %q", text)
+	}
+	if m[1] == "0 B" || m[2] == "0 B" {
+		t.Errorf("expected nonzero byte counts, got sent=%s recv=%s", m[1], m[2])
+	}
+}
+
+// ---------- connect — queue spill ----------
+
+func TestIntegration_Connect_QueueSpillReplay(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-spill-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	outputFile := filepath.Join(workDir, "claude-received.txt")
+
+	// A previous run of the resumed conversation left two undelivered
+	// transcript lines behind.
+	homeDir := t.TempDir()
+	os.MkdirAll(filepath.Join(homeDir, ".greenlight"), 0755)
+	relayID := fmt.Sprintf("spill-relay-%d", time.Now().UnixNano())
+	sessions := fmt.Sprintf(`{"conv-spill":%q}`, relayID)
+	if err := os.WriteFile(filepath.Join(homeDir, ".greenlight", "sessions.json"), []byte(sessions), 0644); err != nil {
+		t.Fatal(err)
+	}
+	spillFile := filepath.Join(os.TempDir(), "greenlight-queue-"+relayID)
+	pending := []string{`{"type":"transcript","data":"one"}`, `{"type":"transcript","data":"two"}`}
+	var spill string
+	for _, msg := range pending {
+		spill += base64.StdEncoding.EncodeToString([]byte(msg)) + "\n"
+	}
+	if err := os.WriteFile(spillFile, []byte(spill), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(spillFile)
+
+	var textMu sync.Mutex
+	var texts []string
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "done")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+
+		go func() {
+			time.Sleep(1 * time.Second)
+			conn.Write(ctx, websocket.MessageBinary, []byte("DONE\n"))
+		}()
+		for {
+			typ, data, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			if typ == websocket.MessageText {
+				textMu.Lock()
+				texts = append(texts, string(data))
+				textMu.Unlock()
+			}
+		}
+	})
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll", "--resume", "conv-spill")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + homeDir,
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_OUTPUT=" + outputFile,
+		"GREENLIGHT_QUEUE_SPILL=1",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	textMu.Lock()
+	got := append([]string(nil), texts...)
+	textMu.Unlock()
+	if len(got) < 2 || got[0] != pending[0] || got[1] != pending[1] {
+		t.Errorf("expected spilled messages replayed in order, got %q", got)
+	}
+	if _, err := os.Stat(spillFile); !os.IsNotExist(err) {
+		t.Errorf("expected spill file removed once delivered, stat err: %v", err)
+	}
+}
+
+// ---------- connect — resume last session ----------
+
+func TestIntegration_Connect_ResumeLast(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-resumelast-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	argsFile := filepath.Join(workDir, "claude-args.txt")
+
+	// Mix of the old flat format and the current one: the newest session
+	// belongs to another project.
+	homeDir := t.TempDir()
+	os.MkdirAll(filepath.Join(homeDir, ".greenlight"), 0755)
+	sessions := `{
+  "conv-flat": "relay-flat",
+  "conv-older": {"relay_id": "relay-older", "project": "test-proj", "updated_at": "2024-01-01T00:00:00Z"},
+  "conv-newer": {"relay_id": "relay-newer", "project": "test-proj", "updated_at": "2024-06-01T00:00:00Z"},
+  "conv-other": {"relay_id": "relay-other", "project": "other-proj", "updated_at": "2025-01-01T00:00:00Z"}
+}`
+	if err := os.WriteFile(filepath.Join(homeDir, ".greenlight", "sessions.json"), []byte(sessions), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll", "--resume-last")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + homeDir,
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_ARGS=" + argsFile,
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	data, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("mock claude args file not created: %v", err)
+	}
+	if string(data) != "--resume conv-newer" {
+		t.Errorf("expected claude resumed with the newest test-proj session, got %q", string(data))
+	}
+}
+
+func TestIntegration_Connect_PassthroughArgs(t *testing.T) {
+	workDir, err := newProjectDir("greenlight-passthrough-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	argsFile := filepath.Join(workDir, "claude-args.txt")
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	// Flags after -- belong to the agent, even ones greenlight also has
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll",
+		"--resume", "conv-1", "--", "--model", "fast", "--project", "other", "fix the tests")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_ARGS=" + argsFile,
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	data, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("mock claude args file not created: %v", err)
+	}
+	if want := "--resume conv-1 --model fast --project other fix the tests"; string(data) != want {
+		t.Errorf("expected claude args %q, got %q", want, string(data))
+	}
+
+	// Without -- a stray argument is an error rather than silently dropped
+	r := run(t, []string{"connect", "--device-id", "test-dev", "--project", "test-proj", "fix the tests"}, nil, "")
+	if r.ExitCode == 0 {
+		t.Fatal("expected connect to reject an argument without --")
+	}
+	if !strings.Contains(r.Stderr, "put arguments for the agent after --") {
+		t.Errorf("expected a hint about --, got: %s", r.Stderr)
+	}
+}
+
+func TestIntegration_Connect_ResumeLast_NoSession(t *testing.T) {
+	workDir, err := newProjectDir("greenlight-resumelast-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--resume-last")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + t.TempDir(),
+		"PATH=" + os.Getenv("PATH"),
+		"TMPDIR=" + os.TempDir(),
+	}
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatal("expected connect to fail with no previous session")
+	}
+	if !strings.Contains(string(out), `no previous session found for project "test-proj"`) {
+		t.Errorf("expected no-session error, got %q", string(out))
+	}
+}
+
+// ---------- connect — custom agent ----------
+
+func TestIntegration_Connect_Agent(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-agent-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	// Wrapper that records how it was launched, then runs the mock
+	argsFile := filepath.Join(workDir, "agent-args.txt")
+	wrapper := filepath.Join(workDir, "my-agent")
+	script := "#!/bin/sh\necho \"$GREENLIGHT_AGENT_NAME $*\" > " + argsFile + "\nexec " + mockClaudeBin + "\n"
+	if err := os.WriteFile(wrapper, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		env  []string
+	}{
+		{"flag", []string{"--agent", wrapper + " --model fast"}, nil},
+		{"env", nil, []string{"GREENLIGHT_AGENT=" + wrapper + " --model fast"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			os.Remove(argsFile)
+
+			master, slave, err := openPTY()
+			if err != nil {
+				t.Fatalf("openPTY: %v", err)
+			}
+			defer master.Close()
+			setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+			args := append([]string{"connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll", "--resume", "conv-1"}, tc.args...)
+			cmd := exec.Command(greenlightBin, args...)
+			cmd.Dir = workDir
+			cmd.Env = append([]string{
+				"HOME=" + t.TempDir(),
+				"PATH=" + os.Getenv("PATH"),
+				"TMPDIR=" + os.TempDir(),
+				"TERM=xterm-256color",
+			}, tc.env...)
+			cmd.Stdin = slave
+			cmd.Stdout = slave
+			cmd.Stderr = slave
+
+			done := make(chan error, 1)
+			if err := cmd.Start(); err != nil {
+				t.Fatalf("start: %v", err)
+			}
+			slave.Close()
+			go func() { done <- cmd.Wait() }()
+			go io.Copy(io.Discard, master)
+
+			select {
+			case <-done:
+			case <-time.After(15 * time.Second):
+				cmd.Process.Kill()
+				t.Fatal("connect timed out")
+			}
+
+			data, err := os.ReadFile(argsFile)
+			if err != nil {
+				t.Fatalf("agent wrapper was not launched: %v", err)
+			}
+			if got := strings.TrimSpace(string(data)); got != "my-agent --model fast --resume conv-1" {
+				t.Errorf("expected agent name and args %q, got %q", "my-agent --model fast --resume conv-1", got)
+			}
+		})
+	}
+}
+
+// ---------- connect — terminal title ----------
+
+func TestIntegration_Connect_TitleFrame(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-title-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	var textMu sync.Mutex
+	var texts []string
+	var binaryBeforeTitle bytes.Buffer // output received before the title frame
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "done")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		for {
+			typ, data, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			textMu.Lock()
+			if typ == websocket.MessageText {
+				texts = append(texts, string(data))
+			} else if len(texts) == 0 {
+				binaryBeforeTitle.Write(data)
+			}
+			textMu.Unlock()
+		}
+	})
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_TITLE=Fixing the build",
+		"MOCK_CLAUDE_STALL=2",
+		// Long enough that the end of the sequence is still buffered
+		// when the title frame is sent
+		"GREENLIGHT_WS_COALESCE=1s",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	var out bytes.Buffer
+	readDone := make(chan struct{})
+	go func() {
+		io.Copy(&out, master)
+		close(readDone)
+	}()
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+	<-readDone
+
+	textMu.Lock()
+	got := append([]string(nil), texts...)
+	before := binaryBeforeTitle.String()
+	textMu.Unlock()
+	want := `{"type":"title","title":"Fixing the build"}`
+	found := false
+	for _, text := range got {
+		if text == want {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected title frame %s, got %q", want, got)
+	}
+
+	// Output that produced the title reaches the app before the title frame
+	if !strings.Contains(before, "build\x07") {
+		t.Errorf("expected output before the title frame to end the sequence, got %q", before)
+	}
+
+	// The sequence is still passed through to the local terminal
+	if !strings.Contains(out.String(), "\x1b]0;Fixing the build\x07") {
+		t.Errorf("expected title sequence in local output, got %q", out.String())
+	}
+}
+
+// ---------- connect — ws mode ----------
+
+func TestIntegration_Connect_WSMode(t *testing.T) {
+	for _, tc := range []struct {
+		mode       string
+		wantOutput bool // agent output reaches the server
+		wantInput  bool // server input reaches the agent
+	}{
+		{"r", false, true},
+		{"w", true, false},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			testServerURL.clearHandlers()
+
+			workDir, err := newProjectDir("greenlight-wsmode-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(workDir)
+
+			var mu sync.Mutex
+			var binary bytes.Buffer
+			testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+					InsecureSkipVerify: true,
+				})
+				if err != nil {
+					return
+				}
+				defer conn.Close(websocket.StatusNormalClosure, "done")
+
+				ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+				defer cancel()
+				conn.Write(ctx, websocket.MessageText, []byte(`{"type":"file","path":"pushed.txt","content_b64":"WA=="}`))
+				conn.Write(ctx, websocket.MessageText, []byte("from the app"))
+				for {
+					typ, data, err := conn.Read(ctx)
+					if err != nil {
+						return
+					}
+					if typ == websocket.MessageBinary {
+						mu.Lock()
+						binary.Write(data)
+						mu.Unlock()
+					}
+				}
+			})
+
+			master, slave, err := openPTY()
+			if err != nil {
+				t.Fatalf("openPTY: %v", err)
+			}
+			defer master.Close()
+			setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+			outputFile := filepath.Join(workDir, "input.txt")
+			pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+			cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll", "--allow-file-push", "--ws-mode", tc.mode)
+			cmd.Dir = workDir
+			cmd.Env = []string{
+				"HOME=" + os.Getenv("HOME"),
+				"PATH=" + pathWithMock,
+				"TMPDIR=" + os.TempDir(),
+				"TERM=xterm-256color",
+				"MOCK_CLAUDE_START_DELAY=500ms",
+			}
+			if tc.wantInput {
+				cmd.Env = append(cmd.Env, "MOCK_CLAUDE_OUTPUT="+outputFile)
+			} else {
+				cmd.Env = append(cmd.Env, "MOCK_CLAUDE_STALL=2")
+			}
+			cmd.Stdin = slave
+			cmd.Stdout = slave
+			cmd.Stderr = slave
+
+			done := make(chan error, 1)
+			if err := cmd.Start(); err != nil {
+				t.Fatalf("start: %v", err)
+			}
+			slave.Close()
+			go func() { done <- cmd.Wait() }()
+			go io.Copy(io.Discard, master)
+
+			select {
+			case <-done:
+			case <-time.After(15 * time.Second):
+				cmd.Process.Kill()
+				t.Fatal("connect timed out")
+			}
+
+			mu.Lock()
+			gotOutput := strings.Contains(binary.String(), "MOCK_CLAUDE_STARTED")
+			mu.Unlock()
+			if gotOutput != tc.wantOutput {
+				t.Errorf("agent output relayed = %v, want %v", gotOutput, tc.wantOutput)
+			}
+			_, err = os.Stat(filepath.Join(workDir, ".greenlight-inbox", "pushed.txt"))
+			if pushed := err == nil; pushed != tc.wantInput {
+				t.Errorf("file push acted on = %v, want %v", pushed, tc.wantInput)
+			}
+			if tc.wantInput {
+				data, _ := os.ReadFile(outputFile)
+				if string(data) != "from the app" {
+					t.Errorf("expected input from the app, got %q", data)
+				}
+			}
+		})
+	}
+}
+
+func TestIntegration_Connect_OutputCoalescing(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-coalesce-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	var mu sync.Mutex
+	var frames int
+	var output bytes.Buffer
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "done")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		for {
+			typ, data, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			if typ == websocket.MessageBinary {
+				mu.Lock()
+				frames++
+				output.Write(data)
+				mu.Unlock()
+			}
+		}
+	})
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	const lines = 200
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_START_DELAY=500ms",
+		fmt.Sprintf("MOCK_CLAUDE_BURST=%d", lines),
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// Every line arrives, in order, including the last ones flushed on exit
+	got := output.String()
+	pos := 0
+	for i := 1; i <= lines; i++ {
+		idx := strings.Index(got[pos:], fmt.Sprintf("BURST_LINE_%d\r\n", i))
+		if idx < 0 {
+			t.Fatalf("line %d missing or out of order in relayed output", i)
+		}
+		pos += idx
+	}
+	if frames > lines/2 {
+		t.Errorf("expected output to be coalesced into fewer frames, got %d frames for %d writes", frames, lines)
+	}
+}
+
+func TestIntegration_Connect_AuthToken(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		env  []string
+		want string
+	}{
+		{"token", []string{"GREENLIGHT_TOKEN=s3cret"}, "Bearer s3cret"},
+		{"device id fallback", nil, "Bearer test-dev"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testServerURL.clearHandlers()
+
+			workDir, err := newProjectDir("greenlight-token-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(workDir)
+
+			authCh := make(chan string, 1)
+			testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case authCh <- r.Header.Get("Authorization"):
+				default:
+				}
+				conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+					InsecureSkipVerify: true,
+				})
+				if err != nil {
+					return
+				}
+				conn.Close(websocket.StatusNormalClosure, "done")
+			})
+
+			master, slave, err := openPTY()
+			if err != nil {
+				t.Fatalf("openPTY: %v", err)
+			}
+			defer master.Close()
+			setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+			pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+			cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj")
+			cmd.Dir = workDir
+			cmd.Env = append([]string{
+				"HOME=" + os.Getenv("HOME"),
+				"PATH=" + pathWithMock,
+				"TMPDIR=" + os.TempDir(),
+				"TERM=xterm-256color",
+				"MOCK_CLAUDE_STALL=1",
+			}, tc.env...)
+			cmd.Stdin = slave
+			cmd.Stdout = slave
+			cmd.Stderr = slave
+
+			done := make(chan error, 1)
+			if err := cmd.Start(); err != nil {
+				t.Fatalf("start: %v", err)
+			}
+			slave.Close()
+			go func() { done <- cmd.Wait() }()
+			go io.Copy(io.Discard, master)
+
+			select {
+			case <-done:
+			case <-time.After(15 * time.Second):
+				cmd.Process.Kill()
+				t.Fatal("connect timed out")
+			}
+
+			select {
+			case got := <-authCh:
+				if got != tc.want {
+					t.Errorf("expected WebSocket Authorization %q, got %q", tc.want, got)
+				}
+			default:
+				t.Fatal("WebSocket was never dialed")
+			}
+
+			reqs := testServerURL.getRequests("/session/enroll")
+			if len(reqs) == 0 {
+				t.Fatal("expected an enrollment request")
+			}
+			wantHTTP := ""
+			if tc.want == "Bearer s3cret" {
+				wantHTTP = tc.want
+			}
+			if got := reqs[0].Header.Get("Authorization"); got != wantHTTP {
+				t.Errorf("expected enroll Authorization %q, got %q", wantHTTP, got)
+			}
+		})
+	}
+}
+
+func TestIntegration_Connect_WSModeInvalid(t *testing.T) {
+	r := run(t, []string{"connect", "--device-id", "test-dev", "--project", "test-proj", "--ws-mode", "x"}, nil, "")
+	if r.ExitCode == 0 {
+		t.Error("expected non-zero exit for invalid --ws-mode")
+	}
+	if !strings.Contains(r.Stderr, "invalid WebSocket mode") {
+		t.Errorf("expected invalid mode error, got stderr=%q", r.Stderr)
+	}
+}
+
+// ---------- connect — recording ----------
+
+func TestIntegration_Connect_Record(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-record-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	outputFile := filepath.Join(workDir, "claude-received.txt")
+	castFile := filepath.Join(workDir, "session.cast")
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll", "--record", castFile)
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_OUTPUT=" + outputFile,
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
+
+	time.Sleep(1 * time.Second)
+
+	// Resize the outer terminal
+	setWinsize(slave.Fd(), &Winsize{Row: 30, Col: 100})
+	syscall.Kill(cmd.Process.Pid, syscall.SIGWINCH)
+	time.Sleep(300 * time.Millisecond)
+	slave.Close()
+
+	if _, err := master.Write([]byte("héllo\r")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	data, err := os.ReadFile(castFile)
+	if err != nil {
+		t.Fatalf("recording not created: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+
+	var hdr struct {
+		Version int `json:"version"`
+		Width   int `json:"width"`
+		Height  int `json:"height"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &hdr); err != nil {
+		t.Fatalf("parse header %q: %v", lines[0], err)
+	}
+	if hdr.Version != 2 || hdr.Width != 80 || hdr.Height != 24 {
+		t.Errorf("expected v2 header at 80x24, got %+v", hdr)
+	}
+
+	var output strings.Builder
+	var resizes []string
+	last := 0.0
+	for _, line := range lines[1:] {
+		var ev []interface{}
+		if err := json.Unmarshal([]byte(line), &ev); err != nil || len(ev) != 3 {
+			t.Fatalf("bad event line %q: %v", line, err)
+		}
+		ts, _ := ev[0].(float64)
+		if ts < last {
+			t.Errorf("event times go backwards: %v after %v", ts, last)
+		}
+		last = ts
+		switch ev[1] {
+		case "o":
+			output.WriteString(ev[2].(string))
+		case "r":
+			resizes = append(resizes, ev[2].(string))
+		}
+	}
+	if !strings.Contains(output.String(), "MOCK_CLAUDE_STARTED") {
+		t.Errorf("expected child output in recording, got %q", output.String())
+	}
+	if !strings.Contains(output.String(), "héllo") {
+		t.Errorf("expected echoed UTF-8 input in recording, got %q", output.String())
+	}
+	if len(resizes) != 1 || resizes[0] != "100x30" {
+		t.Errorf("expected one resize to 100x30, got %q", resizes)
+	}
+}
+
+func TestIntegration_Connect_RecordRotation(t *testing.T) {
+	dir := t.TempDir()
+	castFile := filepath.Join(dir, "session.cast")
+
+	r := run(t, []string{"connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll", "--record", castFile, "--record-max-size", "lots"}, nil, "")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, "invalid size") {
+		t.Errorf("expected a bad --record-max-size to fail, got exit %d: %s", r.ExitCode, r.Stderr)
+	}
+	r = run(t, []string{"connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll", "--record-gzip"}, nil, "")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, "need --record") {
+		t.Errorf("expected --record-gzip without --record to fail, got exit %d: %s", r.ExitCode, r.Stderr)
+	}
+
+	if n, err := parseByteSize("10M"); err != nil || n != 10<<20 {
+		t.Errorf("parseByteSize(10M) = %d, %v", n, err)
+	}
+
+	// A stale segment from an earlier recording is cleared away
+	os.WriteFile(castFile+".3.gz", []byte("stale"), 0600)
+
+	rec, err := newRecorder(castFile, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(castFile + ".3.gz"); !os.IsNotExist(err) {
+		t.Errorf("expected stale segment to be removed, got %v", err)
+	}
+	chunk := strings.Repeat("x", 200)
+	for i := 0; i < 12; i++ {
+		rec.output([]byte(chunk))
+	}
+	if err := rec.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// checkSegment verifies a segment is a replayable cast on its own and
+	// returns how much output it holds.
+	checkSegment := func(name string, data []byte) int {
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		var hdr struct {
+			Version int `json:"version"`
+		}
+		if err := json.Unmarshal([]byte(lines[0]), &hdr); err != nil || hdr.Version != 2 {
+			t.Fatalf("%s: expected an asciicast v2 header, got %q", name, lines[0])
+		}
+		total := 0
+		for _, line := range lines[1:] {
+			var ev []interface{}
+			if err := json.Unmarshal([]byte(line), &ev); err != nil || len(ev) != 3 {
+				t.Fatalf("%s: bad event line %q: %v", name, line, err)
+			}
+			if ts, _ := ev[0].(float64); ts > 5 {
+				t.Errorf("%s: expected times relative to the segment, got %v", name, ts)
+			}
+			total += len(ev[2].(string))
+		}
+		return total
+	}
+
+	total := 0
+	for n := 1; ; n++ {
+		seg := fmt.Sprintf("%s.%d", castFile, n)
+		if _, err := os.Stat(seg); err == nil {
+			t.Errorf("expected rotated segment %s to be gzipped", seg)
+		}
+		f, err := os.Open(seg + ".gz")
+		if err != nil {
+			if n < 3 {
+				t.Fatalf("expected at least 2 rotated segments, missing %s.gz", seg)
+			}
+			break
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("%s.gz: %v", seg, err)
+		}
+		data, err := io.ReadAll(zr)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s.gz: %v", seg, err)
+		}
+		if len(data) > 1024 {
+			t.Errorf("%s: %d bytes is over the cap", seg, len(data))
+		}
+		total += checkSegment(seg, data)
+	}
+	data, err := os.ReadFile(castFile)
+	if err != nil {
+		t.Fatalf("active segment: %v", err)
+	}
+	total += checkSegment(castFile, data)
+	if total != 12*len(chunk) {
+		t.Errorf("expected all %d bytes of output across the segments, got %d", 12*len(chunk), total)
+	}
+}
+
+func TestIntegration_Connect_VerboseRecord(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-verbose-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	castFile := filepath.Join(workDir, "session.cast")
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	env := []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_STALL=1",
+	}
+
+	// The terminal is the agent's, so there is nowhere else to put the log
+	r := run(t, []string{"connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll", "--verbose"}, env, "")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, "--verbose needs --record") {
+		t.Errorf("expected --verbose without --record to fail, got exit %d: %s", r.ExitCode, r.Stderr)
+	}
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll", "--record", castFile, "--verbose")
+	cmd.Dir = workDir
+	cmd.Env = env
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	var out bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(&out, master)
+		close(copied)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+	select {
+	case <-copied:
+	case <-time.After(2 * time.Second):
+	}
+
+	data, err := os.ReadFile(castFile)
+	if err != nil {
+		t.Fatalf("recording not created: %v", err)
+	}
+	var markers []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n")[1:] {
+		var ev []interface{}
+		if json.Unmarshal([]byte(line), &ev) == nil && len(ev) == 3 && ev[1] == "m" {
+			markers = append(markers, ev[2].(string))
+		}
+	}
+	found := false
+	for _, m := range markers {
+		if strings.Contains(m, "ws: ") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected log messages recorded as markers, got %q", markers)
+	}
+	if strings.Contains(out.String(), "ws: ") {
+		t.Errorf("expected no log messages on the terminal, got %q", out.String())
+	}
+}
+
+// ---------- connect — bridge drain timeout ----------
+
+func TestIntegration_Connect_BridgeDrainTimeout(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-drain-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	// Resume a known conversation so the bridge path is predictable, and
+	// make the bridge a FIFO held open by us: the tailer's reads block
+	// forever, as if the streamer were wedged.
+	homeDir := t.TempDir()
+	os.MkdirAll(filepath.Join(homeDir, ".greenlight"), 0755)
+	relayID := fmt.Sprintf("drain-relay-%d", time.Now().UnixNano())
+	sessions := fmt.Sprintf(`{"conv-drain":%q}`, relayID)
+	if err := os.WriteFile(filepath.Join(homeDir, ".greenlight", "sessions.json"), []byte(sessions), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bridgePath := filepath.Join(os.TempDir(), "greenlight-bridge-"+relayID)
+	if err := syscall.Mkfifo(bridgePath, 0600); err != nil {
+		t.Fatalf("mkfifo: %v", err)
+	}
+	defer os.Remove(bridgePath)
+	fifo, err := os.OpenFile(bridgePath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open fifo: %v", err)
+	}
+	defer fifo.Close()
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	logFile := filepath.Join(workDir, "greenlight.log")
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll", "--resume", "conv-drain")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + homeDir,
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"GREENLIGHT_LOG=" + logFile,
+		"GREENLIGHT_BRIDGE_DRAIN_TIMEOUT=1s",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	start := time.Now()
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect hung waiting for a stuck bridge tailer")
+	}
+	if elapsed := time.Since(start); elapsed > 8*time.Second {
+		t.Errorf("expected connect to exit shortly after the drain timeout, took %v", elapsed)
+	}
+
+	data, _ := os.ReadFile(logFile)
+	if !strings.Contains(string(data), "WARN: bridge did not drain within 1s") {
+		t.Errorf("expected drain timeout warning in log, got %q", string(data))
+	}
+}
+
+// ---------- run ----------
+
+func TestIntegration_Run_Prompt(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-run-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	outputFile := filepath.Join(workDir, "prompt.txt")
+	argsFile := filepath.Join(workDir, "args.txt")
+
+	cmd := exec.Command(greenlightBin, "run", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll",
+		"--prompt", "summarize the README", "--timeout", "10s")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + t.TempDir(),
+		"PATH=" + filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH"),
+		"TMPDIR=" + os.TempDir(),
+		"MOCK_CLAUDE_OUTPUT=" + outputFile,
+		"MOCK_CLAUDE_ARGS=" + argsFile,
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("run failed: %v\nstderr: %s", err, stderr.String())
+		}
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("run timed out")
+	}
+
+	data, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("mock agent did not receive the prompt: %v", err)
+	}
+	if string(data) != "summarize the README" {
+		t.Errorf("expected prompt %q, got %q", "summarize the README", data)
+	}
+	if !strings.Contains(stdout.String(), "MOCK_CLAUDE_STARTED") {
+		t.Errorf("expected collected agent output on stdout, got %q", stdout.String())
+	}
+	if args, _ := os.ReadFile(argsFile); !strings.Contains(string(args), "--print") {
+		t.Errorf("expected claude to be launched with --print, got %q", args)
+	}
+}
+
+func TestIntegration_Run_Timeout(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-run-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	cmd := exec.Command(greenlightBin, "run", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll",
+		"--prompt", "do something slow", "--timeout", "1s")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + t.TempDir(),
+		"PATH=" + filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH"),
+		"TMPDIR=" + os.TempDir(),
+		"MOCK_CLAUDE_STALL=30",
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected run to fail on timeout")
+		}
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("run did not stop the agent after --timeout")
+	}
+
+	if !strings.Contains(stderr.String(), "did not finish within 1s") {
+		t.Errorf("expected timeout message, got %q", stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "MOCK_CLAUDE_STARTED") {
+		t.Errorf("expected output collected before the timeout, got %q", stdout.String())
+	}
+}
+
+// ---------- connect — heartbeat ----------
+
+func TestIntegration_Connect_Heartbeat(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		interval string
+		want     bool
+	}{
+		{"enabled", "200ms", true},
+		{"disabled", "0", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testServerURL.clearHandlers()
+
+			workDir, err := newProjectDir("greenlight-heartbeat-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(workDir)
+
+			master, slave, err := openPTY()
+			if err != nil {
+				t.Fatalf("openPTY: %v", err)
+			}
+			defer master.Close()
+			setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+			pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+			cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll")
+			cmd.Dir = workDir
+			cmd.Env = []string{
+				"HOME=" + os.Getenv("HOME"),
+				"PATH=" + pathWithMock,
+				"TMPDIR=" + os.TempDir(),
+				"TERM=xterm-256color",
+				"MOCK_CLAUDE_STALL=1",
+				"GREENLIGHT_HEARTBEAT=" + tc.interval,
+			}
+			cmd.Stdin = slave
+			cmd.Stdout = slave
+			cmd.Stderr = slave
+
+			done := make(chan error, 1)
+			if err := cmd.Start(); err != nil {
+				t.Fatalf("start: %v", err)
+			}
+			slave.Close()
+			go func() { done <- cmd.Wait() }()
+			go io.Copy(io.Discard, master)
+
+			select {
+			case <-done:
+			case <-time.After(15 * time.Second):
+				cmd.Process.Kill()
+				t.Fatal("connect timed out")
+			}
+
+			heartbeats := func() []map[string]interface{} {
+				var beats []map[string]interface{}
+				for _, req := range testServerURL.getRequests("/activity") {
+					var body map[string]interface{}
+					if json.Unmarshal(req.Body, &body) == nil && body["event"] == "heartbeat" {
+						beats = append(beats, body)
+					}
+				}
+				return beats
+			}
+
+			beats := heartbeats()
+			if !tc.want {
+				if len(beats) != 0 {
+					t.Errorf("expected no heartbeats, got %d", len(beats))
+				}
+				return
+			}
+			if len(beats) < 2 {
+				t.Fatalf("expected at least 2 heartbeats, got %d", len(beats))
+			}
+			if beats[0]["device_id"] != "test-dev" || beats[0]["project"] != "test-proj" || beats[0]["relay_id"] == "" {
+				t.Errorf("unexpected heartbeat payload: %v", beats[0])
+			}
+
+			// Heartbeats stop with the session
+			time.Sleep(500 * time.Millisecond)
+			if after := heartbeats(); len(after) != len(beats) {
+				t.Errorf("expected heartbeats to stop after exit, got %d more", len(after)-len(beats))
+			}
+		})
+	}
+}
+
+// ---------- connect — session exit ----------
+
+func TestIntegration_Connect_SessionExit(t *testing.T) {
+	cases := []struct {
+		name, exit string
+		code       float64
+		signal     string
+	}{
+		{"clean", "0", 0, ""},
+		{"error", "3", 3, ""},
+		{"killed", "KILL", -1, "killed"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			testServerURL.clearHandlers()
+
+			workDir, err := newProjectDir("greenlight-exit-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(workDir)
+
+			master, slave, err := openPTY()
+			if err != nil {
+				t.Fatalf("openPTY: %v", err)
+			}
+			defer master.Close()
+			setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+			pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+			cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll")
+			cmd.Dir = workDir
+			cmd.Env = []string{
+				"HOME=" + os.Getenv("HOME"),
+				"PATH=" + pathWithMock,
+				"TMPDIR=" + os.TempDir(),
+				"TERM=xterm-256color",
+				"MOCK_CLAUDE_EXIT=" + tc.exit,
+			}
+			cmd.Stdin = slave
+			cmd.Stdout = slave
+			cmd.Stderr = slave
+
+			done := make(chan error, 1)
+			if err := cmd.Start(); err != nil {
+				t.Fatalf("start: %v", err)
+			}
+			slave.Close()
+			go func() { done <- cmd.Wait() }()
+			go io.Copy(io.Discard, master)
+
+			select {
+			case <-done:
+			case <-time.After(15 * time.Second):
+				cmd.Process.Kill()
+				t.Fatal("connect timed out")
+			}
+
+			// The event must have been sent before connect exited
+			var exits []map[string]interface{}
+			for _, req := range testServerURL.getRequests("/activity") {
+				var body map[string]interface{}
+				if json.Unmarshal(req.Body, &body) == nil && body["event"] == "session_exit" {
+					exits = append(exits, body)
+				}
+			}
+			if len(exits) != 1 {
+				t.Fatalf("expected one session_exit event, got %d", len(exits))
+			}
+			got := exits[0]
+			if got["exit_code"] != tc.code {
+				t.Errorf("exit_code = %v, want %v", got["exit_code"], tc.code)
+			}
+			if sig, _ := got["signal"].(string); sig != tc.signal {
+				t.Errorf("signal = %q, want %q", sig, tc.signal)
+			}
+			if got["device_id"] != "test-dev" || got["project"] != "test-proj" || got["relay_id"] == "" {
+				t.Errorf("unexpected session_exit payload: %v", got)
+			}
+		})
+	}
+}
+
+// ---------- connect — metrics ----------
+
+func TestIntegration_Connect_Metrics(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-metrics-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	// Reserve a free port, then hand it to connect without a host so the
+	// localhost default is exercised
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	metricsURL := fmt.Sprintf("http://127.0.0.1:%d/metrics", port)
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll",
+		"--metrics-addr", fmt.Sprintf(":%d", port))
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_STALL=3",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
+
+	var body string
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(metricsURL)
+		if err == nil {
+			data, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			body = string(data)
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if body == "" {
+		cmd.Process.Kill()
+		t.Fatal("metrics endpoint never answered")
+	}
+	for _, want := range []string{
+		"# TYPE greenlight_ws_reconnects_total counter",
+		"greenlight_ws_dropped_frames_total ",
+		"# TYPE greenlight_text_queue_depth gauge",
+		"greenlight_transcript_lines_sent_total ",
+		"# TYPE greenlight_request_latency_seconds histogram",
+		`greenlight_request_latency_seconds_bucket{le="+Inf"} `,
+		"greenlight_request_latency_seconds_count ",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q:\n%s", want, body)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	// The endpoint goes away with the session
+	if resp, err := http.Get(metricsURL); err == nil {
+		resp.Body.Close()
+		t.Error("metrics endpoint still answering after connect exited")
+	}
+}
+
+// ---------- connect — reattach ----------
+
+func TestIntegration_Connect_Reattach(t *testing.T) {
+	testServerURL.clearHandlers()
+	defer testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-reattach-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	homeDir := t.TempDir()
+
+	relayIDs := make(chan string, 1)
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case relayIDs <- r.URL.Query().Get("relay_id"):
+		default:
+		}
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		conn.Close(websocket.StatusNormalClosure, "done")
+	})
+
+	connect := func(extra ...string) string {
+		t.Helper()
+		master, slave, err := openPTY()
+		if err != nil {
+			t.Fatalf("openPTY: %v", err)
+		}
+		defer master.Close()
+		setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+		pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+		args := append([]string{"connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll"}, extra...)
+		cmd := exec.Command(greenlightBin, args...)
+		cmd.Dir = workDir
+		cmd.Env = []string{
+			"HOME=" + homeDir,
+			"PATH=" + pathWithMock,
+			"TMPDIR=" + os.TempDir(),
+			"TERM=xterm-256color",
+			"MOCK_CLAUDE_STALL=1",
+		}
+		cmd.Stdin = slave
+		cmd.Stdout = slave
+		cmd.Stderr = slave
+
+		done := make(chan error, 1)
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("start: %v", err)
+		}
+		slave.Close()
+		go func() { done <- cmd.Wait() }()
+		go io.Copy(io.Discard, master)
+
+		select {
+		case <-done:
+		case <-time.After(15 * time.Second):
+			cmd.Process.Kill()
+			t.Fatal("connect timed out")
+		}
+		select {
+		case id := <-relayIDs:
+			return id
+		default:
+			t.Fatal("WebSocket was never dialed")
+			return ""
+		}
+	}
+
+	first := connect()
+	if first == "" {
+		t.Fatal("expected a relay_id on the first connect")
+	}
+	if again := connect("--reattach"); again != first {
+		t.Errorf("expected --reattach to reuse relay ID %s, got %s", first, again)
+	}
+	if fresh := connect(); fresh == first {
+		t.Errorf("expected a new relay ID without --reattach, got %s again", fresh)
+	}
+}
+
+// ---------- connect — dry run ----------
+
+func TestIntegration_Connect_DryRun(t *testing.T) {
+	testServerURL.clearHandlers()
+	defer testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-dryrun-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	dialed := make(chan struct{}, 1)
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case dialed <- struct{}{}:
+		default:
+		}
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		conn.Read(context.Background())
+		conn.CloseNow()
+	})
+
+	argsFile := filepath.Join(workDir, "claude-args.txt")
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--dry-run")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"MOCK_CLAUDE_ARGS=" + argsFile,
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("connect --dry-run: %v\nstdout: %s\nstderr: %s", err, stdout.String(), stderr.String())
+	}
+
+	out := stdout.String()
+	for _, want := range []string{"Enrollment: ok", "WebSocket:  ok", "settings.local.json"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in summary, got:\n%s", want, out)
+		}
+	}
+	select {
+	case <-dialed:
+	default:
+		t.Error("WebSocket was never dialed")
+	}
+	if len(testServerURL.getRequests("/session/enroll")) == 0 {
+		t.Error("expected an enrollment request")
+	}
+	if _, err := os.Stat(filepath.Join(workDir, ".claude", "settings.local.json")); err != nil {
+		t.Errorf("expected hooks to be installed: %v", err)
+	}
+	if _, err := os.Stat(argsFile); !os.IsNotExist(err) {
+		t.Error("expected the agent not to be launched")
+	}
+
+	m := regexp.MustCompile(`Session:\s+(\S+)`).FindStringSubmatch(out)
+	if m == nil {
+		t.Fatalf("no session in summary:\n%s", out)
+	}
+	if _, err := os.Stat(filepath.Join(os.TempDir(), "greenlight-bridge-"+m[1])); !os.IsNotExist(err) {
+		t.Error("expected the bridge file to be removed")
+	}
+}
+
+func TestIntegration_Connect_AgentNotFound(t *testing.T) {
+	testServerURL.clearHandlers()
+	defer testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-noagent-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	before := len(testServerURL.getRequests("/session/enroll"))
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + t.TempDir(),
+		"TMPDIR=" + os.TempDir(),
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err == nil {
+		t.Fatal("expected connect to fail without claude on PATH")
+	}
+
+	if !strings.Contains(stderr.String(), "claude not found in PATH; install Claude Code or set --agent") {
+		t.Errorf("expected an actionable error, got: %s", stderr.String())
+	}
+	if n := len(testServerURL.getRequests("/session/enroll")); n != before {
+		t.Errorf("expected no enrollment, got %d new requests", n-before)
+	}
+	if _, err := os.Stat(filepath.Join(workDir, ".claude", "settings.local.json")); !os.IsNotExist(err) {
+		t.Error("expected no hooks to be installed")
+	}
+}
+
+func TestIntegration_Connect_DryRunUnreachable(t *testing.T) {
+	testServerURL.clearHandlers()
+	defer testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-dryrun-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll", "--dry-run")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + os.Getenv("PATH"),
+		"TMPDIR=" + os.TempDir(),
+	}
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Fatalf("expected exit 1, got %v", err)
+	}
+	if !strings.Contains(stdout.String(), "WebSocket:  FAILED") {
+		t.Errorf("expected WebSocket failure in summary, got:\n%s", stdout.String())
+	}
+	if !strings.Contains(stdout.String(), "Enrollment: skipped") {
+		t.Errorf("expected enrollment to be skipped, got:\n%s", stdout.String())
+	}
+}
+
+func TestIntegration_Connect_RelayRejected(t *testing.T) {
+	testServerURL.clearHandlers()
+	defer testServerURL.clearHandlers()
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad token", http.StatusUnauthorized)
+	})
+
+	workDir, err := newProjectDir("greenlight-rejected-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		// Would run for a minute if the session weren't ended
+		"MOCK_CLAUDE_STALL=60",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	var output bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(&output, master)
+		close(copied)
+	}()
+
+	select {
+	case err := <-done:
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok || exitErr.ExitCode() != 1 {
+			t.Errorf("expected exit 1, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect kept running after the relay rejected it")
+	}
+	<-copied
+	if !strings.Contains(output.String(), "relay rejected connection (HTTP 401): check your token") {
+		t.Errorf("expected rejection message, got %q", output.String())
+	}
+}
+
+func TestIntegration_Connect_RelayProtocol(t *testing.T) {
+	testServerURL.clearHandlers()
+	defer testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-protocol-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+
+	// A versioned relay picks greenlight.v1 from the protocols offered
+	offered := make(chan string, 1)
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case offered <- r.Header.Get("Sec-WebSocket-Protocol"):
+		default:
+		}
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+			Subprotocols:       []string{"greenlight.v1"},
+		})
+		if err != nil {
+			return
+		}
+		conn.Read(context.Background())
+		conn.CloseNow()
+	})
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll", "--dry-run")
+	cmd.Dir = workDir
+	cmd.Env = []string{"HOME=" + os.Getenv("HOME"), "PATH=" + pathWithMock, "TMPDIR=" + os.TempDir()}
+	out, err := cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "WebSocket:  ok") {
+		t.Errorf("expected the relay connection to succeed (%v):\n%s", err, out)
+	}
+	select {
+	case p := <-offered:
+		if p != "greenlight.v1" {
+			t.Errorf("expected greenlight.v1 to be offered, got %q", p)
+		}
+	default:
+		t.Error("WebSocket was never dialed")
+	}
+
+	// A relay that picks a version we don't speak ends the session
+	// instead of being retried
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\nSec-WebSocket-Protocol: greenlight.v9\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+		rw.Flush()
+	})
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	cmd = exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_STALL=60",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	var output bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(&output, master)
+		close(copied)
+	}()
+
+	select {
+	case err := <-done:
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok || exitErr.ExitCode() != 1 {
+			t.Errorf("expected exit 1, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect kept running after the relay picked an unknown protocol")
+	}
+	<-copied
+	if !strings.Contains(output.String(), `relay requires protocol "greenlight.v9"`) {
+		t.Errorf("expected unsupported protocol message, got %q", output.String())
+	}
+}
+
+func TestIntegration_UnixSocketRelay(t *testing.T) {
+	// Socket paths are limited to about 100 bytes, so keep it short
+	sockDir, err := os.MkdirTemp("", "gl-sock-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(sockDir)
+	sockPath := filepath.Join(sockDir, "relay.sock")
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var paths []string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/ws/relay":
+			conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{InsecureSkipVerify: true})
+			if err != nil {
+				return
+			}
+			conn.Read(context.Background())
+			conn.CloseNow()
+		case "/session/enroll":
+			fmt.Fprint(w, `{"approved":true}`)
+		case "/request":
+			fmt.Fprint(w, `{"behavior":"allow"}`)
+		}
+	}))
+	srv.Listener.Close()
+	srv.Listener = ln
+	srv.Start()
+	defer srv.Close()
+
+	// A proxy must not be used for the socket
+	env := []string{
+		"GREENLIGHT_RELAY_URL=unix://" + sockPath,
+		"HTTP_PROXY=http://127.0.0.1:1",
+	}
+
+	workDir, err := newProjectDir("greenlight-unix-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--dry-run")
+	cmd.Dir = workDir
+	cmd.Env = append([]string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH"),
+		"TMPDIR=" + os.TempDir(),
+	}, env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "WebSocket:  ok") {
+		t.Errorf("expected enrollment and the relay connection over the socket to succeed (%v):\n%s", err, out)
+	}
+
+	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","tool_input":{"command":"ls"},"session_id":"s1"}`
+	r := run(t, []string{"hook"}, append([]string{
+		"GREENLIGHT_DEVICE_ID=test-dev",
+		"GREENLIGHT_PROJECT=test-proj",
+		"GREENLIGHT_SESSION_ID=relay-unix-1",
+		"GREENLIGHT_NO_ENROLL=1",
+	}, env...), input)
+	if !strings.Contains(r.Stdout, `"behavior":"allow"`) {
+		t.Errorf("expected the server's allow over the socket, got stdout=%q stderr=%q", r.Stdout, r.Stderr)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(paths, ","); got != "/session/enroll,/ws/relay,/request" {
+		t.Errorf("expected enroll, WebSocket and request on the socket, got %s", got)
+	}
+}
+
+// ---------- connect — hangup and quit signals ----------
+
+func TestIntegration_Connect_HangupSignals(t *testing.T) {
+	cases := []struct {
+		name string
+		sig  syscall.Signal
+		env  []string
+	}{
+		// The child ignores the hangup, so greenlight has to kill it
+		{"SIGHUP", syscall.SIGHUP, []string{"MOCK_CLAUDE_IGNORE_HUP=1"}},
+		// The child ignores SIGTERM, so it is killed after the grace period
+		{"SIGTERM", syscall.SIGTERM, []string{"MOCK_CLAUDE_IGNORE_TERM=1", "GREENLIGHT_KILL_GRACE=1s"}},
+		// The Go runtime exits on SIGQUIT once it is forwarded
+		{"SIGQUIT", syscall.SIGQUIT, nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			testServerURL.clearHandlers()
+
+			workDir, err := newProjectDir("greenlight-hangup-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(workDir)
+
+			master, slave, err := openPTY()
+			if err != nil {
+				t.Fatalf("openPTY: %v", err)
+			}
+			defer master.Close()
+			setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+			pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+			pidFile := filepath.Join(workDir, "claude.pid")
+
+			cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll")
+			cmd.Dir = workDir
+			cmd.Env = append([]string{
+				"HOME=" + os.Getenv("HOME"),
+				"PATH=" + pathWithMock,
+				"TMPDIR=" + os.TempDir(),
+				"TERM=xterm-256color",
+				"MOCK_CLAUDE_PID=" + pidFile,
+				"MOCK_CLAUDE_STALL=30",
+			}, tc.env...)
+			cmd.Stdin = slave
+			cmd.Stdout = slave
+			cmd.Stderr = slave
+
+			done := make(chan error, 1)
+			if err := cmd.Start(); err != nil {
+				t.Fatalf("start: %v", err)
+			}
+			slave.Close()
+			go func() { done <- cmd.Wait() }()
+			go io.Copy(io.Discard, master)
+
+			time.Sleep(1 * time.Second)
+			cmd.Process.Signal(tc.sig)
+
+			select {
+			case <-done:
+			case <-time.After(8 * time.Second):
+				cmd.Process.Kill()
+				t.Fatalf("connect did not exit after %v", tc.sig)
+			}
+
+			data, err := os.ReadFile(pidFile)
+			if err != nil {
+				t.Fatalf("read child PID: %v", err)
+			}
+			pid, _ := strconv.Atoi(string(data))
+			if processAlive(pid) {
+				syscall.Kill(pid, syscall.SIGKILL)
+				t.Errorf("child %d still running after connect exited", pid)
+			}
+		})
+	}
+}
+
+// ---------- connect — status overlay ----------
+
+func TestIntegration_Connect_StatusOverlayKeys(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-status-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	outputFile := filepath.Join(workDir, "claude-received.txt")
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_OUTPUT=" + outputFile,
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+
+	// Collect everything greenlight writes to its terminal
+	var termOut bytes.Buffer
+	var termMu sync.Mutex
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := master.Read(buf)
+			termMu.Lock()
+			termOut.Write(buf[:n])
+			termMu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	// Ctrl-G Ctrl-G (split across writes) toggles the overlay and must not
+	// reach the child; the line that follows must.
+	master.Write([]byte{0x07})
+	time.Sleep(50 * time.Millisecond)
+	master.Write([]byte{0x07})
+	time.Sleep(200 * time.Millisecond)
+	if _, err := master.Write([]byte("AFTER_OVERLAY\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	data, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("mock claude output file not created: %v", err)
+	}
+	if string(data) != "AFTER_OVERLAY" {
+		t.Errorf("expected child to receive only 'AFTER_OVERLAY', got %q", string(data))
+	}
+
+	termMu.Lock()
+	out := termOut.String()
+	termMu.Unlock()
+	if !strings.Contains(out, "relay:") {
+		t.Errorf("expected status overlay on terminal, got %q", out)
+	}
+}
+
+func TestIntegration_Connect_StatusKeyMatcher(t *testing.T) {
+	for _, tc := range []struct {
+		seq, input string
+		want       string
+		triggers   int
+	}{
+		{"^G^G", "a\x07\x07b", "ab", 1},
+		{"^G^G", "\x07\x07\x07", "", 1}, // third byte held back
+		{"^G^G", "\x07x\x07\x07", "\x07x", 1},
+		{"aab", "aaab", "a", 1},
+		{"aab", "aaaab", "aa", 1},
+		{"abab", "abaabab", "aba", 1},
+		{"abc", "ababc", "ab", 1},
+		{"aab", "aabaab", "", 2},
+		{"aab", "aba", "ab", 0}, // trailing "a" held back
+	} {
+		seq, err := parseKeySequence(tc.seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := newKeyMatcher(seq)
+		// Byte at a time, as a sequence can be split across reads
+		var out []byte
+		triggers := 0
+		for i := 0; i < len(tc.input); i++ {
+			o, n := m.filter([]byte{tc.input[i]})
+			out = append(out, o...)
+			triggers += n
+		}
+		if string(out) != tc.want || triggers != tc.triggers {
+			t.Errorf("%q in %q: got %q with %d triggers, want %q with %d", tc.seq, tc.input, out, triggers, tc.want, tc.triggers)
+		}
+		// Whole input in one read gives the same result
+		m = newKeyMatcher(seq)
+		if o, n := m.filter([]byte(tc.input)); string(o) != tc.want || n != tc.triggers {
+			t.Errorf("%q in %q (one read): got %q with %d triggers, want %q with %d", tc.seq, tc.input, o, n, tc.want, tc.triggers)
+		}
+	}
+}
+
+// ---------- connect — transcript relay pipeline ----------
+
+func TestIntegration_Connect_TranscriptRelay(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-transcript-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	transcriptPath := filepath.Join(workDir, "transcript.jsonl")
+
+	// Collect text frames (transcript data) from the WebSocket.
+	// tailBridge sends: {"type":"transcript","data":<line>}
+	var wsTextFrames []string
+	var wsTextMu sync.Mutex
+	wsDone := make(chan struct{})
+
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		defer close(wsDone)
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Logf("ws accept error: %v", err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "done")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+
+		for {
+			msgType, data, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			if msgType == websocket.MessageText {
+				wsTextMu.Lock()
+				wsTextFrames = append(wsTextFrames, string(data))
+				wsTextMu.Unlock()
+			}
+		}
+	})
+	defer testServerURL.clearHandlers()
+
+	// Allocate a PTY for the greenlight process
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_TRANSCRIPT=" + transcriptPath,
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	// Wait for WS handler to finish
+	select {
+	case <-wsDone:
+	case <-time.After(5 * time.Second):
+		t.Log("WS handler did not finish in time")
+	}
+
+	// Verify that transcript text frames were received by the server.
+	// Each frame should be: {"type":"transcript","data":<jsonl-line>}
+	wsTextMu.Lock()
+	frames := make([]string, len(wsTextFrames))
+	copy(frames, wsTextFrames)
+	wsTextMu.Unlock()
+
+	var foundLine1, foundLine2 bool
+	for _, frame := range frames {
+		if strings.Contains(frame, "TRANSCRIPT_TEST_LINE_1") {
+			foundLine1 = true
+		}
+		if strings.Contains(frame, "TRANSCRIPT_TEST_LINE_2") {
+			foundLine2 = true
+		}
+	}
+
+	if !foundLine1 {
+		t.Errorf("expected text frame containing 'TRANSCRIPT_TEST_LINE_1', got %d frames: %v", len(frames), frames)
+	}
+	if !foundLine2 {
+		t.Errorf("expected text frame containing 'TRANSCRIPT_TEST_LINE_2', got %d frames: %v", len(frames), frames)
+	}
+
+	// Verify frames have the expected wrapper structure
+	if len(frames) > 0 {
+		var wrapper map[string]interface{}
+		if err := json.Unmarshal([]byte(frames[0]), &wrapper); err != nil {
+			t.Errorf("expected JSON text frame, got %q: %v", frames[0], err)
+		} else {
+			if wrapper["type"] != "transcript" {
+				t.Errorf("expected type=transcript, got %v", wrapper["type"])
+			}
+			if wrapper["data"] == nil {
+				t.Error("expected data field in transcript frame")
+			}
+		}
+	}
+}
+
+// ---------- connect --no-hooks ----------
+
+func TestIntegration_Connect_NoHooks(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-nohooks-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	home, err := os.MkdirTemp("", "greenlight-nohooks-home-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	argsPath := filepath.Join(workDir, "args.txt")
+
+	gotLine := make(chan struct{})
+	var once sync.Once
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{InsecureSkipVerify: true})
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "done")
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		for {
+			typ, data, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			if typ == websocket.MessageText && strings.Contains(string(data), "NOHOOKS_LINE") {
+				once.Do(func() { close(gotLine) })
+			}
+		}
+	})
+	defer testServerURL.clearHandlers()
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll", "--no-hooks")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + home,
+		"PATH=" + filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH"),
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_ARGS=" + argsPath,
+		"MOCK_CLAUDE_STALL=5",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
+	defer func() {
+		select {
+		case <-done:
+		case <-time.After(15 * time.Second):
+			cmd.Process.Kill()
+			t.Fatal("connect timed out")
+		}
+	}()
+
+	// connect picks the conversation ID and passes it to Claude Code
+	var sessionID string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		data, _ := os.ReadFile(argsPath)
+		if f := strings.Fields(string(data)); len(f) == 2 && f[0] == "--session-id" {
+			sessionID = f[1]
+			break
+		}
+	}
+	if sessionID == "" {
+		data, _ := os.ReadFile(argsPath)
+		t.Fatalf("agent args = %q, want --session-id <id>", data)
+	}
+
+	// Write the transcript where Claude Code would; connect should relay it
+	// without any hook having started a streamer
+	t.Setenv("HOME", home)
+	transcript := claudeTranscriptPath(workDir, sessionID)
+	if !strings.HasPrefix(transcript, filepath.Join(home, ".claude", "projects")+"/") {
+		t.Fatalf("transcript path %q is not under %s", transcript, home)
+	}
+	os.MkdirAll(filepath.Dir(transcript), 0755)
+	if err := os.WriteFile(transcript, []byte(`{"type":"assistant","message":"NOHOOKS_LINE"}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-gotLine:
+	case <-time.After(10 * time.Second):
+		t.Error("transcript line was not relayed")
+	}
+
+	if _, err := os.Stat(filepath.Join(workDir, ".claude", "settings.local.json")); !os.IsNotExist(err) {
+		t.Errorf("hooks were installed despite --no-hooks (stat: %v)", err)
+	}
+}
+
+func TestIntegration_Connect_WaitTranscript(t *testing.T) {
+	workDir, err := newProjectDir("greenlight-waittranscript-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	home := t.TempDir()
+	logFile := filepath.Join(workDir, "greenlight.log")
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	// The transcript never appears, so the streamer gives up after the
+	// wait instead of the default 30 seconds
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll",
+		"--no-hooks", "--wait-transcript", "300ms")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + home,
+		"PATH=" + filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH"),
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"GREENLIGHT_LOG=" + logFile,
+		"MOCK_CLAUDE_STALL=2",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+	go io.Copy(io.Discard, master)
+
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	data, _ := os.ReadFile(logFile)
+	if !strings.Contains(string(data), "did not appear within 300ms") {
+		t.Errorf("expected the streamer to give up after 300ms, log:\n%s", data)
+	}
+}
+
+// ---------- connect — incremental transcript relay with disconnection ----------
+
+func TestIntegration_Connect_TranscriptRelayIncremental(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-transcript-incr-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	transcriptPath := filepath.Join(workDir, "transcript.jsonl")
+
+	const totalLines = 10
+
+	// Collect text frames from the WebSocket across multiple connections.
+	// The server will close the first connection after a few frames to
+	// simulate a brief disconnection. The client should reconnect and
+	// re-deliver any messages that failed during the gap.
+	var wsTextFrames []string
+	var wsTextMu sync.Mutex
+	var connCount int32
+	wsDone := make(chan struct{})
+
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Logf("ws accept error: %v", err)
+			return
+		}
+
+		wsTextMu.Lock()
+		connCount++
+		thisConn := connCount
+		wsTextMu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+
+		frameCount := 0
+		for {
+			msgType, data, err := conn.Read(ctx)
+			if err != nil {
+				conn.CloseNow()
+				if thisConn == 1 {
+					// First connection was intentionally closed; continue
+					// accepting reconnections by returning (the HTTP
+					// handler will be called again for the next WS dial).
+					return
+				}
+				// Final connection: signal done
+				close(wsDone)
+				return
+			}
+			if msgType == websocket.MessageText {
+				wsTextMu.Lock()
+				wsTextFrames = append(wsTextFrames, string(data))
+				wsTextMu.Unlock()
+
+				frameCount++
+				// After receiving 3 text frames on the first connection,
+				// close it abruptly to simulate a network disruption.
+				// The client should reconnect and the queued messages
+				// from the gap should eventually arrive.
+				if thisConn == 1 && frameCount >= 3 {
+					conn.Close(websocket.StatusGoingAway, "simulated disruption")
+					return
+				}
+			}
+		}
+	})
+	defer testServerURL.clearHandlers()
+
+	// Allocate a PTY for the greenlight process
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	pathWithMock := filepath.Dir(mockClaudeBin) + ":" + os.Getenv("PATH")
+
+	cmd := exec.Command(greenlightBin, "connect", "--device-id", "test-dev", "--project", "test-proj")
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + pathWithMock,
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+		"MOCK_CLAUDE_TRANSCRIPT_INCREMENTAL=" + transcriptPath,
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("connect timed out")
+	}
+
+	// Wait for WS handler to finish
+	select {
+	case <-wsDone:
+	case <-time.After(5 * time.Second):
+		t.Log("WS handler did not finish in time")
+	}
+
+	// Verify that ALL incremental transcript lines were received,
+	// even those sent during/after the disconnection.
+	wsTextMu.Lock()
+	frames := make([]string, len(wsTextFrames))
+	copy(frames, wsTextFrames)
+	wsTextMu.Unlock()
+
+	for i := 1; i <= totalLines; i++ {
+		marker := fmt.Sprintf("INCREMENTAL_LINE_%d", i)
+		found := false
+		for _, frame := range frames {
+			if strings.Contains(frame, marker) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("missing transcript line %q in %d received frames", marker, len(frames))
+		}
+	}
+
+	if t.Failed() {
+		t.Logf("Received %d text frames:", len(frames))
+		for i, f := range frames {
+			t.Logf("  frame[%d]: %s", i, f)
+		}
+	}
+}
+
+// ---------- bridge tailer — fragment reassembly ----------
+
+func TestIntegration_Bridge_FragmentReassembly(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	var frames []string
+	var framesMu sync.Mutex
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		for {
+			typ, data, err := conn.Read(context.Background())
+			if err != nil {
+				return
+			}
+			if typ == websocket.MessageText {
+				framesMu.Lock()
+				frames = append(frames, string(data))
+				framesMu.Unlock()
+			}
+		}
+	})
+	defer testServerURL.clearHandlers()
+
+	tmpDir, err := os.MkdirTemp("", "greenlight-bridge-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	bridgePath := filepath.Join(tmpDir, "bridge")
+	if err := os.WriteFile(bridgePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ws := NewWSClient(testServerURL.wsURL(), "", WSModeRW, func([]byte) error { return nil })
+	go ws.Run()
+	defer ws.Close()
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	os.Remove(transcriptSeqPath("relay-1"))
+	defer os.Remove(transcriptSeqPath("relay-1"))
+	go func() {
+		tailBridge(bridgePath, "relay-1", ws, done)
+		close(finished)
+	}()
+
+	// Let the tailer open the file and seek to the end
+	time.Sleep(300 * time.Millisecond)
+
+	bridge, err := os.OpenFile(bridgePath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A JSON line split in two, a stray fragment that never completes,
+	// then a normal line
+	for _, line := range []string{
+		`{"type":"assistant",`,
+		`"message":"JOINED"}`,
+		`]`,
+		`{"type":"assistant","message":"NEXT"}`,
+	} {
+		fmt.Fprintln(bridge, line)
+		time.Sleep(150 * time.Millisecond)
+	}
+	bridge.Close()
+
+	close(done)
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tailBridge did not finish")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		framesMu.Lock()
+		n := len(frames)
+		framesMu.Unlock()
+		if n >= 2 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	framesMu.Lock()
+	defer framesMu.Unlock()
+	want := []string{
+		`{"type":"transcript","relay_id":"relay-1","seq":1,"data":{"type":"assistant","message":"JOINED"}}`,
+		`{"type":"transcript","relay_id":"relay-1","seq":2,"data":{"type":"assistant","message":"NEXT"}}`,
+	}
+	if len(frames) != len(want) {
+		t.Fatalf("expected %d frames, got %d: %q", len(want), len(frames), frames)
+	}
+	for i, f := range frames {
+		if !json.Valid([]byte(f)) {
+			t.Errorf("frame %d is not valid JSON: %q", i, f)
+		}
+		if f != want[i] {
+			t.Errorf("frame %d: expected %q, got %q", i, want[i], f)
+		}
+	}
+}
+
+// ---------- bridge tailer — batching ----------
+
+func TestIntegration_Bridge_Batch(t *testing.T) {
+	testServerURL.clearHandlers()
+	t.Setenv("GREENLIGHT_TRANSCRIPT_BATCH", "300ms")
+
+	var frames []string
+	var framesMu sync.Mutex
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		for {
+			typ, data, err := conn.Read(context.Background())
+			if err != nil {
+				return
+			}
+			if typ == websocket.MessageText {
+				framesMu.Lock()
+				frames = append(frames, string(data))
+				framesMu.Unlock()
+			}
+		}
+	})
+	defer testServerURL.clearHandlers()
+
+	tmpDir, err := os.MkdirTemp("", "greenlight-bridge-batch-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	bridgePath := filepath.Join(tmpDir, "bridge")
+	if err := os.WriteFile(bridgePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ws := NewWSClient(testServerURL.wsURL(), "", WSModeRW, func([]byte) error { return nil })
+	go ws.Run()
+	defer ws.Close()
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	os.Remove(transcriptSeqPath("relay-1"))
+	defer os.Remove(transcriptSeqPath("relay-1"))
+	go func() {
+		tailBridge(bridgePath, "relay-1", ws, done)
+		close(finished)
+	}()
+
+	// Let the tailer open the file and seek to the end
+	time.Sleep(300 * time.Millisecond)
+
+	bridge, err := os.OpenFile(bridgePath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A burst goes out as one frame; a line on its own after the window
+	// as a plain frame, which the drain sends even though done is closed
+	// before its window ends
+	fmt.Fprintln(bridge, `{"n":1}`)
+	fmt.Fprintln(bridge, `{"n":2}`)
+	fmt.Fprintln(bridge, `{"n":3}`)
+	time.Sleep(600 * time.Millisecond)
+	fmt.Fprintln(bridge, `{"n":4}`)
+	bridge.Close()
+
+	close(done)
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tailBridge did not finish")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		framesMu.Lock()
+		n := len(frames)
+		framesMu.Unlock()
+		if n >= 2 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	framesMu.Lock()
+	defer framesMu.Unlock()
+	want := []string{
+		`{"type":"transcript","relay_id":"relay-1","seq":1,"lines":[{"n":1},{"n":2},{"n":3}]}`,
+		`{"type":"transcript","relay_id":"relay-1","seq":4,"data":{"n":4}}`,
+	}
+	if strings.Join(frames, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected frames\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(frames, "\n"))
+	}
+}
+
+func TestIntegration_Bridge_Dedup(t *testing.T) {
+	testServerURL.clearHandlers()
+	t.Setenv("GREENLIGHT_TRANSCRIPT_DEDUP", "2")
+
+	var frames []string
+	var framesMu sync.Mutex
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		for {
+			typ, data, err := conn.Read(context.Background())
+			if err != nil {
+				return
+			}
+			if typ == websocket.MessageText {
+				framesMu.Lock()
+				frames = append(frames, string(data))
+				framesMu.Unlock()
+			}
+		}
+	})
+	defer testServerURL.clearHandlers()
+
+	bridgePath := filepath.Join(t.TempDir(), "bridge")
+	if err := os.WriteFile(bridgePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ws := NewWSClient(testServerURL.wsURL(), "", WSModeRW, func([]byte) error { return nil })
+	go ws.Run()
+	defer ws.Close()
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	os.Remove(transcriptSeqPath("relay-1"))
+	defer os.Remove(transcriptSeqPath("relay-1"))
+	go func() {
+		tailBridge(bridgePath, "relay-1", ws, done)
+		close(finished)
+	}()
+	time.Sleep(300 * time.Millisecond)
+
+	// The repeat of n=1 is dropped while it is among the last two lines,
+	// and sent again once it has been forgotten
+	bridge, err := os.OpenFile(bridgePath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{1, 2, 1, 3, 1} {
+		fmt.Fprintf(bridge, "{\"n\":%d}\n", n)
+	}
+	bridge.Close()
+
+	close(done)
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tailBridge did not finish")
+	}
+
+	want := []string{
+		`{"type":"transcript","relay_id":"relay-1","seq":1,"data":{"n":1}}`,
+		`{"type":"transcript","relay_id":"relay-1","seq":2,"data":{"n":2}}`,
+		`{"type":"transcript","relay_id":"relay-1","seq":3,"data":{"n":3}}`,
+		`{"type":"transcript","relay_id":"relay-1","seq":4,"data":{"n":1}}`,
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		framesMu.Lock()
+		n := len(frames)
+		framesMu.Unlock()
+		if n >= len(want) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	framesMu.Lock()
+	defer framesMu.Unlock()
+	if strings.Join(frames, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected frames\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(frames, "\n"))
+	}
+}
+
+func TestIntegration_Bridge_SeqPersists(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	frames := make(chan string, 10)
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		for {
+			typ, data, err := conn.Read(context.Background())
+			if err != nil {
+				return
+			}
+			if typ == websocket.MessageText {
+				frames <- string(data)
+			}
+		}
+	})
+	defer testServerURL.clearHandlers()
+
+	bridgePath := filepath.Join(t.TempDir(), "bridge")
+	os.WriteFile(bridgePath, nil, 0644)
+
+	ws := NewWSClient(testServerURL.wsURL(), "", WSModeRW, func([]byte) error { return nil })
+	go ws.Run()
+	defer ws.Close()
+
+	// An earlier connect for the same relay session sent five lines
+	seqPath := transcriptSeqPath("relay-seq")
+	os.WriteFile(seqPath, []byte("5"), 0644)
+	defer os.Remove(seqPath)
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		tailBridge(bridgePath, "relay-seq", ws, done)
+		close(finished)
+	}()
+	time.Sleep(300 * time.Millisecond)
+
+	bridge, err := os.OpenFile(bridgePath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(bridge, `{"n":6}`)
+	bridge.Close()
+
+	select {
+	case f := <-frames:
+		if want := `{"type":"transcript","relay_id":"relay-seq","seq":6,"data":{"n":6}}`; f != want {
+			t.Errorf("frame = %q, want %q", f, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no transcript frame received")
+	}
+	close(done)
+	<-finished
+	if data, _ := os.ReadFile(seqPath); string(data) != "6" {
+		t.Errorf("expected the counter to be saved as 6, got %q", data)
+	}
+}
+
+// ---------- WebSocket client — reconnect ----------
+
+// reconnectGap connects a WSClient to a server that drops the first
+// connection, and returns how long the client took to reconnect.
+func reconnectGap(t *testing.T) time.Duration {
+	t.Helper()
+	testServerURL.clearHandlers()
+	defer testServerURL.clearHandlers()
+
+	var mu sync.Mutex
+	var dropped time.Time
+	reconnected := make(chan time.Time, 1)
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		first := dropped.IsZero()
+		if first {
+			dropped = time.Now()
+		}
+		mu.Unlock()
+		if first {
+			conn.CloseNow()
+			return
+		}
+		select {
+		case reconnected <- time.Now():
+		default:
+		}
+		conn.Read(context.Background())
+		conn.CloseNow()
+	})
+
+	ws := NewWSClient(testServerURL.wsURL(), "", WSModeRW, func([]byte) error { return nil })
+	go ws.Run()
+	defer ws.Close()
+
+	select {
+	case at := <-reconnected:
+		mu.Lock()
+		defer mu.Unlock()
+		return at.Sub(dropped)
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not reconnect")
+		return 0
+	}
+}
+
+func TestIntegration_WS_InstantFirstReconnect(t *testing.T) {
+	if gap := reconnectGap(t); gap > 300*time.Millisecond {
+		t.Errorf("expected near-immediate first reconnect, took %v", gap)
+	}
+}
+
+func TestIntegration_WS_InstantRetryDisabled(t *testing.T) {
+	t.Setenv("GREENLIGHT_WS_INSTANT_RETRY", "0")
+	// backoff(0) is 1s ±25%
+	if gap := reconnectGap(t); gap < 700*time.Millisecond {
+		t.Errorf("expected backoff before reconnect with instant retry disabled, took %v", gap)
+	}
+}
+
+func TestIntegration_WS_BackoffBounds(t *testing.T) {
+	t.Setenv("GREENLIGHT_WS_BACKOFF_BASE", "100ms")
+	t.Setenv("GREENLIGHT_WS_BACKOFF_MAX", "2s")
+	ws := NewWSClient(testServerURL.wsURL(), "", WSModeRW, func([]byte) error { return nil })
+	if ws.baseDelay != 100*time.Millisecond || ws.maxDelay != 2*time.Second {
+		t.Fatalf("expected backoff 100ms..2s from env, got %v..%v", ws.baseDelay, ws.maxDelay)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		backoff   func(int) time.Duration
+		base, max time.Duration
+	}{
+		{"default", backoff, time.Second, 30 * time.Second},
+		{"client", ws.backoff, 100 * time.Millisecond, 2 * time.Second},
+		{"huge base", func(a int) time.Duration { return backoffDelay(a, time.Hour, 2*time.Hour, 0.25) }, time.Hour, 2 * time.Hour},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nominal := tc.base
+			for attempt := 0; attempt <= 40; attempt++ {
+				lo := time.Duration(float64(nominal) * 0.75)
+				hi := time.Duration(float64(nominal) * 1.25)
+				for i := 0; i < 50; i++ {
+					if d := tc.backoff(attempt); d < lo || d > hi {
+						t.Fatalf("attempt %d: delay %v outside [%v, %v]", attempt, d, lo, hi)
+					}
+				}
+				if nominal < tc.max {
+					nominal *= 2
+					if nominal > tc.max {
+						nominal = tc.max
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestIntegration_WS_KeepaliveDetectsDeadConnection(t *testing.T) {
+	testServerURL.clearHandlers()
+	defer testServerURL.clearHandlers()
+
+	var mu sync.Mutex
+	conns := 0
+	reconnected := make(chan struct{})
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		mu.Lock()
+		conns++
+		n := conns
+		mu.Unlock()
+		if n == 1 {
+			// Silently stop responding, like a connection dropped by a NAT:
+			// without a reader, pings are never answered.
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+			return
+		}
+		if n == 2 {
+			close(reconnected)
+		}
+		conn.Read(context.Background())
+	})
+
+	ws := NewWSClient(testServerURL.wsURL(), "", WSModeRW, func([]byte) error { return nil })
+	ws.pingInterval = 200 * time.Millisecond
+	ws.pingTimeout = 200 * time.Millisecond
+	go ws.Run()
+
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a failed ping to trigger a reconnect")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		ws.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Close did not return with keepalive running")
+	}
+}
+
+func TestIntegration_WS_InjectDelay(t *testing.T) {
+	for _, tc := range []struct {
+		setting  string
+		min, max time.Duration
+	}{
+		{"", 50 * time.Millisecond, 250 * time.Millisecond},
+		{"400ms", 400 * time.Millisecond, 600 * time.Millisecond},
+		{"0", 0, 30 * time.Millisecond},
+	} {
+		t.Run("delay="+tc.setting, func(t *testing.T) {
+			t.Setenv("GREENLIGHT_INJECT_DELAY", tc.setting)
+
+			var times []time.Time
+			var injected [][]byte
+			ws := NewWSClient("", "", WSModeRW, func(data []byte) error {
+				times = append(times, time.Now())
+				injected = append(injected, append([]byte(nil), data...))
+				return nil
+			})
+			ws.handleFrame(websocket.MessageBinary, []byte("hello\n"))
+
+			if len(injected) != 2 || string(injected[0]) != "hello" || string(injected[1]) != "\r" {
+				t.Fatalf("expected text then Enter, got %q", injected)
+			}
+			if gap := times[1].Sub(times[0]); gap < tc.min || gap > tc.max {
+				t.Errorf("expected Enter %v-%v after the text, got %v", tc.min, tc.max, gap)
+			}
+		})
+	}
+}
+
+func TestIntegration_WS_RejectedUpgradeIsFatal(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		fatal  bool
+	}{
+		{http.StatusUnauthorized, true},
+		{http.StatusForbidden, true},
+		{http.StatusServiceUnavailable, false},
+	} {
+		t.Run(strconv.Itoa(tc.status), func(t *testing.T) {
+			testServerURL.clearHandlers()
+			defer testServerURL.clearHandlers()
+
+			var attempts atomic.Int32
+			testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+				attempts.Add(1)
+				http.Error(w, "no", tc.status)
+			})
+
+			fatal := make(chan error, 1)
+			ws := NewWSClient(testServerURL.wsURL(), "bad-token", WSModeRW, func([]byte) error { return nil })
+			ws.onFatal = func(err error) { fatal <- err }
+			returned := make(chan struct{})
+			go func() {
+				ws.Run()
+				close(returned)
+			}()
+			defer ws.Close()
+
+			if !tc.fatal {
+				// The instant retry makes a second attempt straight away
+				time.Sleep(500 * time.Millisecond)
+				select {
+				case err := <-fatal:
+					t.Fatalf("expected HTTP %d to be retried, got fatal %v", tc.status, err)
+				case <-returned:
+					t.Fatal("expected Run to keep reconnecting")
+				default:
+				}
+				if n := attempts.Load(); n < 2 {
+					t.Errorf("expected retries, got %d attempts", n)
+				}
+				return
+			}
+
+			select {
+			case err := <-fatal:
+				if !strings.Contains(err.Error(), fmt.Sprintf("relay rejected connection (HTTP %d)", tc.status)) {
+					t.Errorf("unexpected error: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("onFatal was not called")
+			}
+			select {
+			case <-returned:
+			case <-time.After(time.Second):
+				t.Fatal("Run did not return after a rejected upgrade")
+			}
+			if n := attempts.Load(); n != 1 {
+				t.Errorf("expected 1 attempt, got %d", n)
+			}
+		})
+	}
+}
+
+// ---------- attach ----------
+
+func TestIntegration_Attach(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	var gotRelayID, gotRole string
+	var wsReceived bytes.Buffer
+	var wsMu sync.Mutex
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		wsMu.Lock()
+		gotRelayID = r.URL.Query().Get("relay_id")
+		gotRole = r.URL.Query().Get("role")
+		wsMu.Unlock()
+
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "done")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		conn.Write(ctx, websocket.MessageBinary, []byte("SERVER_OUTPUT\r\n"))
+		for {
+			_, data, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			wsMu.Lock()
+			wsReceived.Write(data)
+			wsMu.Unlock()
+		}
+	})
+	defer testServerURL.clearHandlers()
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY: %v", err)
+	}
+	defer master.Close()
+	setWinsize(slave.Fd(), &Winsize{Row: 24, Col: 80})
+
+	cmd := exec.Command(greenlightBin, "attach", "--relay-id", "attach-relay-1", "--device-id", "test-dev")
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + os.Getenv("PATH"),
+		"TMPDIR=" + os.TempDir(),
+		"TERM=xterm-256color",
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	slave.Close()
+	go func() { done <- cmd.Wait() }()
+
+	// Wait for the server's output to be displayed locally
+	var termOut bytes.Buffer
+	deadline := time.Now().Add(10 * time.Second)
+	buf := make([]byte, 4096)
+	for time.Now().Before(deadline) && !strings.Contains(termOut.String(), "SERVER_OUTPUT") {
+		n, err := master.Read(buf)
+		termOut.Write(buf[:n])
+		if err != nil {
+			break
+		}
+	}
+	if !strings.Contains(termOut.String(), "SERVER_OUTPUT") {
+		t.Fatalf("expected server output on the local terminal, got %q", termOut.String())
+	}
+	go io.Copy(io.Discard, master)
+
+	master.Write([]byte("LOCAL_INPUT"))
+	time.Sleep(500 * time.Millisecond)
+	master.Write([]byte{0x1d}) // Ctrl-] detaches
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("attach did not exit after detach key")
+	}
+
+	wsMu.Lock()
+	defer wsMu.Unlock()
+	if !strings.Contains(wsReceived.String(), "LOCAL_INPUT") {
+		t.Errorf("expected local input sent over WS, got %q", wsReceived.String())
+	}
+	if gotRelayID != "attach-relay-1" {
+		t.Errorf("expected relay_id=attach-relay-1, got %q", gotRelayID)
+	}
+	if gotRole != "viewer" {
+		t.Errorf("expected role=viewer, got %q", gotRole)
+	}
+}
+
+// ---------- hook — SessionStart ----------
+
+func TestIntegration_Hook_SessionStart(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	// Clean up any enrollment marker from previous tests
+	os.Remove(filepath.Join(os.TempDir(), "greenlight-enrolled-relay-123"))
+
+	input := `{"hook_event_name":"SessionStart","session_id":"test-session-123","transcript_path":"/tmp/fake-transcript.jsonl"}`
+	r := run(t, []string{"hook"},
+		[]string{
+			"GREENLIGHT_DEVICE_ID=test-dev",
+			"GREENLIGHT_PROJECT=test-proj",
+			"GREENLIGHT_SESSION_ID=relay-123",
+		}, input)
+
+	if r.ExitCode != 0 {
+		t.Errorf("expected exit 0, got %d; stdout=%q stderr=%q", r.ExitCode, r.Stdout, r.Stderr)
+	}
+
+	// Give async activity POST a moment to arrive
+	time.Sleep(200 * time.Millisecond)
+
+	// Verify enrollment was attempted
+	enrollReqs := testServerURL.getRequests("/session/enroll")
+	if len(enrollReqs) == 0 {
+		t.Error("expected enrollment request on SessionStart")
+	}
+
+	// Verify activity POST was sent
+	activityReqs := testServerURL.getRequests("/activity")
+	if len(activityReqs) == 0 {
+		t.Error("expected activity request on SessionStart")
+	} else {
+		var body map[string]interface{}
+		json.Unmarshal(activityReqs[0].Body, &body)
+		if body["event"] != "session_start" {
+			t.Errorf("expected event=session_start, got %v", body["event"])
+		}
+		if body["device_id"] != "test-dev" {
+			t.Errorf("expected device_id=test-dev, got %v", body["device_id"])
+		}
+	}
+}
+
+func TestIntegration_Hook_ConcurrentStreamerSpawn(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	tmpDir := t.TempDir()
+	sessionID := fmt.Sprintf("test-spawn-%d", time.Now().UnixNano())
+	relayID := "relay-" + sessionID
+	defer os.Remove(filepath.Join(os.TempDir(), "greenlight-stream-"+sessionID+".pid"))
+	defer os.Remove(filepath.Join(os.TempDir(), "greenlight-enrolled-"+relayID))
+
+	// The transcript never appears, so the streamer waits for it
+	transcriptPath := filepath.Join(tmpDir, "transcript.jsonl")
+	input := fmt.Sprintf(`{"hook_event_name":"SessionStart","session_id":%q,"transcript_path":%q}`, sessionID, transcriptPath)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cmd := exec.Command(greenlightBin, "hook")
+			cmd.Env = []string{
+				"HOME=" + os.Getenv("HOME"),
+				"PATH=" + os.Getenv("PATH"),
+				"TMPDIR=" + os.TempDir(),
+				"GREENLIGHT_DEVICE_ID=test-dev",
+				"GREENLIGHT_PROJECT=test-proj",
+				"GREENLIGHT_SESSION_ID=" + relayID,
+				"GREENLIGHT_TRANSCRIPT_WAIT=30s",
+			}
+			cmd.Stdin = strings.NewReader(input)
+			cmd.Run()
+		}()
+	}
+	wg.Wait()
+	time.Sleep(300 * time.Millisecond)
+
+	out, _ := exec.Command("pgrep", "-f", "stream --transcript "+transcriptPath+" --session-id "+sessionID).Output()
+	pids := strings.Fields(string(out))
+	for _, p := range pids {
+		if pid, err := strconv.Atoi(p); err == nil {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+	if len(pids) != 1 {
+		t.Errorf("expected exactly 1 streamer, found %d: %v", len(pids), pids)
+	}
+}
+
+func TestIntegration_Hook_SessionStart_RecordsSession(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	relayID := "relay-record-1"
+	os.Remove(filepath.Join(os.TempDir(), "greenlight-enrolled-"+relayID))
+	defer os.Remove(filepath.Join(os.TempDir(), "greenlight-enrolled-"+relayID))
+
+	homeDir := t.TempDir()
+	input := `{"hook_event_name":"SessionStart","session_id":"conv-record-1"}`
+	r := run(t, []string{"hook"},
+		[]string{
+			"HOME=" + homeDir,
+			"GREENLIGHT_DEVICE_ID=test-dev",
+			"GREENLIGHT_PROJECT=test-proj",
+			"GREENLIGHT_SESSION_ID=" + relayID,
+		}, input)
+	if r.ExitCode != 0 {
+		t.Fatalf("expected exit 0, got %d; stderr=%q", r.ExitCode, r.Stderr)
+	}
+
+	data, err := os.ReadFile(filepath.Join(homeDir, ".greenlight", "sessions.json"))
+	if err != nil {
+		t.Fatalf("expected sessions.json: %v", err)
+	}
+	var sessions map[string]struct {
+		RelayID   string    `json:"relay_id"`
+		Project   string    `json:"project"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		t.Fatalf("parse sessions.json: %v", err)
+	}
+	e := sessions["conv-record-1"]
+	if e.RelayID != relayID || e.Project != "test-proj" {
+		t.Errorf("expected relay %s in test-proj, got %+v", relayID, e)
+	}
+	if time.Since(e.UpdatedAt) > time.Minute {
+		t.Errorf("expected recent updated_at, got %v", e.UpdatedAt)
+	}
+}
+
+func TestIntegration_Hook_ActivitySequence(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	relayID := "relay-seq-1"
+	os.Remove(filepath.Join(os.TempDir(), "greenlight-enrolled-"+relayID))
+	os.Remove(filepath.Join(os.TempDir(), "greenlight-seq-"+relayID))
+	defer os.Remove(filepath.Join(os.TempDir(), "greenlight-seq-"+relayID))
+
+	env := []string{
+		"GREENLIGHT_DEVICE_ID=test-dev",
+		"GREENLIGHT_PROJECT=test-proj",
+		"GREENLIGHT_SESSION_ID=" + relayID,
+	}
+	for i := 0; i < 2; i++ {
+		r := run(t, []string{"hook"}, env, `{"hook_event_name":"SessionStart"}`)
+		if r.ExitCode != 0 {
+			t.Fatalf("expected exit 0, got %d; stderr=%q", r.ExitCode, r.Stderr)
+		}
+	}
+
+	reqs := testServerURL.getRequests("/activity")
+	if len(reqs) != 2 {
+		t.Fatalf("expected 2 activity requests, got %d", len(reqs))
+	}
+	var seqs []float64
+	for _, req := range reqs {
+		var body map[string]interface{}
+		if err := json.Unmarshal(req.Body, &body); err != nil {
+			t.Fatalf("parse activity body: %v", err)
+		}
+		seq, ok := body["seq"].(float64)
+		if !ok {
+			t.Fatalf("expected numeric seq, got %v", body["seq"])
+		}
+		seqs = append(seqs, seq)
+		ts, _ := body["client_ts"].(string)
+		if _, err := time.Parse(time.RFC3339Nano, ts); err != nil {
+			t.Errorf("expected RFC3339 client_ts, got %q", ts)
+		}
+	}
+	if seqs[1] <= seqs[0] {
+		t.Errorf("expected increasing seq values, got %v", seqs)
+	}
+}
+
+func TestIntegration_Hook_MissingDeviceID(t *testing.T) {
+	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash"}`
+	r := run(t, []string{"hook"},
+		[]string{
+			"GREENLIGHT_PROJECT=test-proj",
+		}, input)
+
+	if r.ExitCode != 0 {
+		t.Errorf("expected exit 0 (deny via JSON), got %d", r.ExitCode)
+	}
+
+	var output map[string]interface{}
+	if err := json.Unmarshal([]byte(r.Stdout), &output); err != nil {
+		t.Fatalf("failed to parse stdout JSON: %v; stdout=%q", err, r.Stdout)
+	}
+
+	hso := output["hookSpecificOutput"].(map[string]interface{})
+	decision := hso["decision"].(map[string]interface{})
+	if decision["behavior"] != "deny" {
+		t.Errorf("expected deny, got %v", decision["behavior"])
+	}
+	msg := decision["message"].(string)
+	if !strings.Contains(strings.ToLower(msg), "device id") {
+		t.Errorf("expected device ID error message, got %q", msg)
+	}
+}
+
+func TestIntegration_Hook_MissingProject(t *testing.T) {
+	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash"}`
+	r := run(t, []string{"hook"},
+		[]string{
+			"GREENLIGHT_DEVICE_ID=test-dev",
+		}, input)
+
+	if r.ExitCode != 0 {
+		t.Errorf("expected exit 0, got %d", r.ExitCode)
+	}
+
+	var output map[string]interface{}
+	json.Unmarshal([]byte(r.Stdout), &output)
+	hso := output["hookSpecificOutput"].(map[string]interface{})
+	decision := hso["decision"].(map[string]interface{})
+	if decision["behavior"] != "deny" {
+		t.Errorf("expected deny, got %v", decision["behavior"])
+	}
+	msg := decision["message"].(string)
+	if !strings.Contains(strings.ToLower(msg), "project") {
+		t.Errorf("expected project error message, got %q", msg)
+	}
+}
+
+// ---------- hook — Stop and SessionEnd ----------
+
+func TestIntegration_Hook_SessionEnd(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	relayID := "relay-stop-1"
+	sessionID := "session-stop-1"
+	marker := filepath.Join(os.TempDir(), "greenlight-enrolled-"+relayID)
+	pidFile := filepath.Join(os.TempDir(), "greenlight-stream-"+sessionID+".pid")
+	os.WriteFile(marker, nil, 0644)
+	defer os.Remove(marker)
+	defer os.Remove(pidFile)
+
+	// Stand-in for a running streamer
+	streamer := exec.Command("sleep", "30")
+	if err := streamer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		streamer.Wait()
+		close(exited)
+	}()
+	defer streamer.Process.Kill()
+	os.WriteFile(pidFile, []byte(fmt.Sprintf("%d %s", streamer.Process.Pid, relayID)), 0644)
+
+	input := fmt.Sprintf(`{"hook_event_name":"SessionEnd","session_id":%q}`, sessionID)
+	r := run(t, []string{"hook"},
+		[]string{
+			"GREENLIGHT_DEVICE_ID=test-dev",
+			"GREENLIGHT_PROJECT=test-proj",
+			"GREENLIGHT_SESSION_ID=" + relayID,
+		}, input)
+
+	if r.ExitCode != 0 {
+		t.Errorf("expected exit 0, got %d; stderr=%q", r.ExitCode, r.Stderr)
+	}
+
+	reqs := testServerURL.getRequests("/activity")
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 activity request, got %d", len(reqs))
+	}
+	var body map[string]interface{}
+	json.Unmarshal(reqs[0].Body, &body)
+	if body["event"] != "session_end" {
+		t.Errorf("expected event=session_end, got %v", body["event"])
+	}
+	if body["relay_id"] != relayID || body["project"] != "test-proj" || body["device_id"] != "test-dev" {
+		t.Errorf("unexpected payload: %v", body)
+	}
+
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("expected enrollment marker to be removed")
+	}
+	if _, err := os.Stat(pidFile); err == nil {
+		t.Error("expected stream PID file to be removed")
+	}
+	select {
+	case <-exited:
+	case <-time.After(2 * time.Second):
+		t.Error("expected streamer to be killed")
+	}
+}
+
+func TestIntegration_Hook_Stop(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	relayID := "relay-turn-1"
+	sessionID := "session-turn-1"
+	marker := filepath.Join(os.TempDir(), "greenlight-enrolled-"+relayID)
+	pidFile := filepath.Join(os.TempDir(), "greenlight-stream-"+sessionID+".pid")
+	os.WriteFile(marker, nil, 0644)
+	os.WriteFile(pidFile, []byte("999999 "+relayID), 0644)
+	defer os.Remove(marker)
+	defer os.Remove(pidFile)
+
+	// Stop ends a turn, not the session
+	r := run(t, []string{"hook"},
+		[]string{
+			"GREENLIGHT_DEVICE_ID=test-dev",
+			"GREENLIGHT_PROJECT=test-proj",
+			"GREENLIGHT_SESSION_ID=" + relayID,
+		}, fmt.Sprintf(`{"hook_event_name":"Stop","session_id":%q}`, sessionID))
+	if r.ExitCode != 0 {
+		t.Errorf("expected exit 0, got %d; stderr=%q", r.ExitCode, r.Stderr)
+	}
+
+	reqs := testServerURL.getRequests("/activity")
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 activity request, got %d", len(reqs))
+	}
+	var body map[string]interface{}
+	json.Unmarshal(reqs[0].Body, &body)
+	if body["event"] != "turn_end" || body["relay_id"] != relayID {
+		t.Errorf("expected turn_end for %s, got %v", relayID, body)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Error("expected enrollment marker to be kept")
+	}
+	if _, err := os.Stat(pidFile); err != nil {
+		t.Error("expected stream PID file to be kept")
+	}
+}
+
+func TestIntegration_Hook_Stop_ServerDown(t *testing.T) {
+	testServerURL.clearHandlers()
+	testServerURL.setHandler("/activity", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	})
+	defer testServerURL.clearHandlers()
+
+	r := run(t, []string{"hook"},
+		[]string{
+			"GREENLIGHT_DEVICE_ID=test-dev",
+			"GREENLIGHT_PROJECT=test-proj",
+			"GREENLIGHT_SESSION_ID=relay-stop-2",
+		}, `{"hook_event_name":"Stop","session_id":"session-stop-2"}`)
+
+	if r.ExitCode != 0 {
+		t.Errorf("expected exit 0 even when the POST fails, got %d", r.ExitCode)
+	}
+}
+
+func TestIntegration_Hook_ActivityRetry(t *testing.T) {
+	testServerURL.clearHandlers()
+	defer testServerURL.clearHandlers()
+	env := []string{
+		"GREENLIGHT_DEVICE_ID=test-dev",
+		"GREENLIGHT_PROJECT=test-proj",
+		"GREENLIGHT_SESSION_ID=relay-activity-retry",
+	}
+	input := `{"hook_event_name":"PreToolUse","tool_name":"Bash","tool_input":{"command":"ls"},"session_id":"s1"}`
+
+	// Transient failures are retried until the server accepts the event
+	var calls atomic.Int32
+	testServerURL.setHandler("/activity", func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	if r := run(t, []string{"hook"}, env, input); r.ExitCode != 0 {
+		t.Errorf("expected exit 0, got %d; stderr=%q", r.ExitCode, r.Stderr)
+	}
+	if n := len(testServerURL.getRequests("/activity")); n != 3 {
+		t.Errorf("expected 3 activity attempts, got %d", n)
+	}
+
+	// A 4xx won't change on retry
+	testServerURL.clearHandlers()
+	testServerURL.setHandler("/activity", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	run(t, []string{"hook"}, env, input)
+	if n := len(testServerURL.getRequests("/activity")); n != 1 {
+		t.Errorf("expected a 4xx not to be retried, got %d attempts", n)
+	}
+
+	// Retries are bounded
+	testServerURL.clearHandlers()
+	testServerURL.setHandler("/activity", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	run(t, []string{"hook"}, env, input)
+	if n := len(testServerURL.getRequests("/activity")); n != 3 {
+		t.Errorf("expected 3 attempts against a failing server, got %d", n)
+	}
+}
+
+// ---------- hook — PreToolUse / PostToolUse ----------
+
+func TestIntegration_Hook_PreToolUse(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	input := `{"hook_event_name":"PreToolUse","tool_name":"Bash","tool_input":{"command":"ls"},"session_id":"s1"}`
+	r := run(t, []string{"hook"},
+		[]string{
+			"GREENLIGHT_DEVICE_ID=test-dev",
+			"GREENLIGHT_PROJECT=test-proj",
+			"GREENLIGHT_SESSION_ID=relay-tool-pre",
+		}, input)
+
+	if r.ExitCode != 0 {
+		t.Errorf("expected exit 0, got %d; stderr=%q", r.ExitCode, r.Stderr)
+	}
+	if r.Stdout != "" {
+		t.Errorf("expected no decision on stdout, got %q", r.Stdout)
+	}
+
+	reqs := testServerURL.getRequests("/activity")
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 activity request, got %d", len(reqs))
+	}
+	var body map[string]interface{}
+	json.Unmarshal(reqs[0].Body, &body)
+	if body["event"] != "tool_pre" {
+		t.Errorf("expected event=tool_pre, got %v", body["event"])
+	}
+	if body["tool_name"] != "Bash" {
+		t.Errorf("expected tool_name=Bash, got %v", body["tool_name"])
+	}
+	if ti, _ := body["tool_input"].(map[string]interface{}); ti["command"] != "ls" {
+		t.Errorf("expected tool_input.command=ls, got %v", body["tool_input"])
+	}
+	if body["relay_id"] != "relay-tool-pre" || body["project"] != "test-proj" {
+		t.Errorf("expected relay_id and project, got %v / %v", body["relay_id"], body["project"])
+	}
+	if _, ok := body["tool_response"]; ok {
+		t.Error("tool_pre should not carry tool_response")
+	}
+	if len(testServerURL.getRequests("/request")) != 0 {
+		t.Error("PreToolUse should not POST /request")
+	}
+}
+
+func TestIntegration_Hook_PostToolUse(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	input := `{"hook_event_name":"PostToolUse","tool_name":"Bash","tool_input":{"command":"ls"},"tool_response":{"stdout":"a.txt"},"session_id":"s1"}`
+	r := run(t, []string{"hook"},
+		[]string{
+			"GREENLIGHT_DEVICE_ID=test-dev",
+			"GREENLIGHT_PROJECT=test-proj",
+			"GREENLIGHT_SESSION_ID=relay-tool-post",
+		}, input)
+
+	if r.ExitCode != 0 {
+		t.Errorf("expected exit 0, got %d; stderr=%q", r.ExitCode, r.Stderr)
+	}
+
+	reqs := testServerURL.getRequests("/activity")
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 activity request, got %d", len(reqs))
+	}
+	var body map[string]interface{}
+	json.Unmarshal(reqs[0].Body, &body)
+	if body["event"] != "tool_post" {
+		t.Errorf("expected event=tool_post, got %v", body["event"])
+	}
+	if tr, _ := body["tool_response"].(map[string]interface{}); tr["stdout"] != "a.txt" {
+		t.Errorf("expected tool_response.stdout=a.txt, got %v", body["tool_response"])
+	}
+}
+
+// ---------- hook — PermissionRequest ----------
+
+func TestIntegration_Hook_PermissionRequest_Allow(t *testing.T) {
+	testServerURL.clearHandlers()
+	testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"behavior":"allow"}`)
+	})
+	defer testServerURL.clearHandlers()
+
+	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","tool_input":{"command":"ls"},"session_id":"s1"}`
+	r := run(t, []string{"hook"},
+		[]string{
+			"GREENLIGHT_DEVICE_ID=test-dev",
+			"GREENLIGHT_PROJECT=test-proj",
+			"GREENLIGHT_SESSION_ID=relay-1",
+		}, input)
+
+	if r.ExitCode != 0 {
+		t.Errorf("expected exit 0, got %d; stderr=%q", r.ExitCode, r.Stderr)
+	}
+
+	var output map[string]interface{}
+	if err := json.Unmarshal([]byte(r.Stdout), &output); err != nil {
+		t.Fatalf("parse stdout: %v; stdout=%q", err, r.Stdout)
+	}
+	hso := output["hookSpecificOutput"].(map[string]interface{})
+	decision := hso["decision"].(map[string]interface{})
+	if decision["behavior"] != "allow" {
+		t.Errorf("expected allow, got %v", decision["behavior"])
+	}
+
+	// Verify the request payload forwarded to server
+	reqs := testServerURL.getRequests("/request")
+	if len(reqs) == 0 {
+		t.Fatal("expected /request POST")
+	}
+	var payload map[string]interface{}
+	json.Unmarshal(reqs[0].Body, &payload)
+	if payload["device_id"] != "test-dev" {
+		t.Errorf("expected device_id=test-dev, got %v", payload["device_id"])
+	}
+	if payload["tool_name"] != "Bash" {
+		t.Errorf("expected tool_name=Bash, got %v", payload["tool_name"])
+	}
+}
+
+func TestIntegration_Hook_PermissionRequest_ForwardsAllFields(t *testing.T) {
+	testServerURL.clearHandlers()
+	testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"behavior":"allow"}`)
+	})
+	defer testServerURL.clearHandlers()
+
+	env := []string{
+		"GREENLIGHT_DEVICE_ID=test-dev",
+		"GREENLIGHT_PROJECT=test-proj",
+		"GREENLIGHT_SESSION_ID=relay-1",
+	}
+	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","tool_input":{"command":"ls","timeout":9007199254740993},` +
+		`"session_id":"s1","cwd":"/work/app","permission_mode":"acceptEdits","future_field":{"nested":[1,"two",null]}}`
+	if r := run(t, []string{"hook"}, env, input); r.ExitCode != 0 {
+		t.Fatalf("expected exit 0, got %d; stderr=%q", r.ExitCode, r.Stderr)
+	}
+	reqs := testServerURL.getRequests("/request")
+	if len(reqs) != 1 {
+		t.Fatalf("expected one /request POST, got %d", len(reqs))
+	}
+	body := string(reqs[0].Body)
+	for _, want := range []string{
+		`"future_field":{"nested":[1,"two",null]}`,
+		`"permission_mode":"acceptEdits"`,
+		`"cwd":"/work/app"`,
+		`"timeout":9007199254740993`,
+		`"device_id":"test-dev"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %s in payload, got %s", want, body)
+		}
+	}
+
+	// Without a cwd from Claude Code, the hook's working directory is sent
+	testServerURL.clearHandlers()
+	testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"behavior":"allow"}`)
+	})
+	run(t, []string{"hook"}, env, `{"hook_event_name":"PermissionRequest","tool_name":"Bash","session_id":"s1"}`)
+	reqs = testServerURL.getRequests("/request")
+	if len(reqs) != 1 {
+		t.Fatalf("expected one /request POST, got %d", len(reqs))
+	}
+	var payload map[string]interface{}
+	json.Unmarshal(reqs[0].Body, &payload)
+	wd, _ := os.Getwd()
+	if payload["cwd"] != wd {
+		t.Errorf("expected cwd=%q, got %v", wd, payload["cwd"])
+	}
+}
+
+func TestIntegration_Hook_TestMode(t *testing.T) {
+	testServerURL.clearHandlers()
+	testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"behavior":"deny","message":"no deleting"}`)
+	})
+	defer testServerURL.clearHandlers()
+
+	env := []string{
+		"GREENLIGHT_DEVICE_ID=test-dev",
+		"GREENLIGHT_PROJECT=test-proj",
+	}
+	r := run(t, []string{"hook", "--test", "--tool", "Bash", "--input", `{"command":"rm -rf build"}`}, env, "")
+	if r.ExitCode != 0 {
+		t.Fatalf("expected exit 0, got %d; stderr=%q", r.ExitCode, r.Stderr)
+	}
+
+	reqs := testServerURL.getRequests("/request")
+	if len(reqs) != 1 {
+		t.Fatalf("expected one /request POST, got %d", len(reqs))
+	}
+	var payload struct {
+		HookEventName string                 `json:"hook_event_name"`
+		ToolName      string                 `json:"tool_name"`
+		ToolInput     map[string]interface{} `json:"tool_input"`
+		DeviceID      string                 `json:"device_id"`
+	}
+	json.Unmarshal(reqs[0].Body, &payload)
+	if payload.HookEventName != "PermissionRequest" || payload.ToolName != "Bash" ||
+		payload.ToolInput["command"] != "rm -rf build" || payload.DeviceID != "test-dev" {
+		t.Errorf("unexpected synthetic request: %s", reqs[0].Body)
+	}
+
+	if !strings.Contains(r.Stdout, "\n  \"hookSpecificOutput\"") {
+		t.Errorf("expected indented decision, got %q", r.Stdout)
+	}
+	var output map[string]interface{}
+	if err := json.Unmarshal([]byte(r.Stdout), &output); err != nil {
+		t.Fatalf("parse decision %q: %v", r.Stdout, err)
+	}
+	hso := output["hookSpecificOutput"].(map[string]interface{})
+	decision := hso["decision"].(map[string]interface{})
+	if decision["behavior"] != "deny" || decision["message"] != "no deleting" {
+		t.Errorf("expected the server's deny, got %v", decision)
+	}
+
+	for _, args := range [][]string{
+		{"hook", "--test"},
+		{"hook", "--test", "--tool", "Bash", "--input", "{not json"},
+	} {
+		if r := run(t, args, env, ""); r.ExitCode != 1 {
+			t.Errorf("%v: expected exit 1, got %d", args, r.ExitCode)
+		}
+	}
+}
+
+func TestIntegration_Hook_PermissionRequest_Deny(t *testing.T) {
+	testServerURL.clearHandlers()
+	testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"behavior":"deny","message":"not allowed by test"}`)
+	})
+	defer testServerURL.clearHandlers()
+
+	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","session_id":"s1"}`
+	r := run(t, []string{"hook"},
+		[]string{
+			"GREENLIGHT_DEVICE_ID=test-dev",
+			"GREENLIGHT_PROJECT=test-proj",
+			"GREENLIGHT_SESSION_ID=relay-1",
+		}, input)
+
+	var output map[string]interface{}
+	json.Unmarshal([]byte(r.Stdout), &output)
+	hso := output["hookSpecificOutput"].(map[string]interface{})
+	decision := hso["decision"].(map[string]interface{})
+	if decision["behavior"] != "deny" {
+		t.Errorf("expected deny, got %v", decision["behavior"])
+	}
+	if decision["message"] != "not allowed by test" {
+		t.Errorf("expected 'not allowed by test', got %v", decision["message"])
+	}
+}
+
+func TestIntegration_Hook_PermissionRequest_AllowWithUpdatedInput(t *testing.T) {
+	testServerURL.clearHandlers()
+	testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"behavior":"allow","updated_input":{"command":"echo safe"}}`)
+	})
+	defer testServerURL.clearHandlers()
+
+	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","tool_input":{"command":"rm -rf /"},"session_id":"s1"}`
+	r := run(t, []string{"hook"},
+		[]string{
+			"GREENLIGHT_DEVICE_ID=test-dev",
+			"GREENLIGHT_PROJECT=test-proj",
+			"GREENLIGHT_SESSION_ID=relay-1",
+		}, input)
+
+	var output map[string]interface{}
+	json.Unmarshal([]byte(r.Stdout), &output)
+	hso := output["hookSpecificOutput"].(map[string]interface{})
+	decision := hso["decision"].(map[string]interface{})
+	if decision["behavior"] != "allow" {
+		t.Errorf("expected allow, got %v", decision["behavior"])
+	}
+	updatedInput, ok := decision["updatedInput"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected updatedInput map, got %v", decision["updatedInput"])
+	}
+	if updatedInput["command"] != "echo safe" {
+		t.Errorf("expected updated command='echo safe', got %v", updatedInput["command"])
+	}
+}
+
+func TestIntegration_Hook_PermissionRequest_Ask(t *testing.T) {
+	testServerURL.clearHandlers()
+	testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"behavior":"ask","message":"check the path first","updated_input":{"command":"echo safe"}}`)
+	})
+	defer testServerURL.clearHandlers()
+
+	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","tool_input":{"command":"rm -rf build"},"session_id":"s1"}`
+	r := run(t, []string{"hook", "--verbose"},
+		[]string{
+			"GREENLIGHT_DEVICE_ID=test-dev",
+			"GREENLIGHT_PROJECT=test-proj",
+			"GREENLIGHT_SESSION_ID=relay-1",
+		}, input)
+
+	if r.ExitCode != 0 {
+		t.Fatalf("expected exit 0, got %d (stderr: %s)", r.ExitCode, r.Stderr)
+	}
+	var output map[string]interface{}
+	if err := json.Unmarshal([]byte(r.Stdout), &output); err != nil {
+		t.Fatalf("expected JSON output, got %q: %v", r.Stdout, err)
+	}
+	// No decision, so Claude Code prompts in the terminal
+	if _, ok := output["hookSpecificOutput"]; ok {
+		t.Errorf("expected no decision for ask, got %v", output["hookSpecificOutput"])
+	}
+	if output["systemMessage"] != "check the path first" {
+		t.Errorf("expected systemMessage 'check the path first', got %v", output["systemMessage"])
+	}
+	// --verbose mirrors the log to stderr
+	if !strings.Contains(r.Stderr, "ignoring updated_input for ask decision on Bash") {
+		t.Errorf("expected the ignored updated_input logged to stderr, got %q", r.Stderr)
+	}
+}
+
+func TestIntegration_Hook_PermissionRequest_DenyWithInterrupt(t *testing.T) {
+	testServerURL.clearHandlers()
+	testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"behavior":"deny","message":"interrupted","interrupt":true}`)
+	})
+	defer testServerURL.clearHandlers()
+
+	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","session_id":"s1"}`
+	r := run(t, []string{"hook"},
+		[]string{
+			"GREENLIGHT_DEVICE_ID=test-dev",
+			"GREENLIGHT_PROJECT=test-proj",
+			"GREENLIGHT_SESSION_ID=relay-1",
+		}, input)
+
+	var output map[string]interface{}
+	json.Unmarshal([]byte(r.Stdout), &output)
+	hso := output["hookSpecificOutput"].(map[string]interface{})
+	decision := hso["decision"].(map[string]interface{})
+	if decision["behavior"] != "deny" {
+		t.Errorf("expected deny, got %v", decision["behavior"])
+	}
+	if decision["interrupt"] != true {
+		t.Errorf("expected interrupt=true, got %v", decision["interrupt"])
+	}
+}
+
+func TestIntegration_Hook_PermissionRequest_Timeout(t *testing.T) {
+	testServerURL.clearHandlers()
+	testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
+		// Never answer — the hook should give up at its timeout
+		select {
+		case <-r.Context().Done():
+		case <-time.After(20 * time.Second):
+		}
+	})
+	defer testServerURL.clearHandlers()
+
+	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","session_id":"s1"}`
+	start := time.Now()
+	// Below the 10s minimum, so it is clamped up to 10s
+	r := runWithTimeout(t, []string{"hook"},
+		[]string{
+			"GREENLIGHT_DEVICE_ID=test-dev",
+			"GREENLIGHT_PROJECT=test-proj",
+			"GREENLIGHT_SESSION_ID=relay-1",
+			"GREENLIGHT_REQUEST_TIMEOUT=2s",
+		}, input, 30*time.Second)
+	elapsed := time.Since(start)
+
+	if elapsed < 10*time.Second || elapsed > 15*time.Second {
+		t.Errorf("expected the long-poll to time out after ~10s, took %v", elapsed)
+	}
+
+	var output map[string]interface{}
+	if err := json.Unmarshal([]byte(r.Stdout), &output); err != nil {
+		t.Fatalf("parse stdout: %v; stdout=%q", err, r.Stdout)
+	}
+	decision := output["hookSpecificOutput"].(map[string]interface{})["decision"].(map[string]interface{})
+	if decision["behavior"] != "deny" || decision["interrupt"] != true {
+		t.Errorf("expected deny with interrupt on timeout, got %v", decision)
+	}
+}
+
+func TestIntegration_Hook_OutputFile(t *testing.T) {
+	testServerURL.clearHandlers()
+	testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"behavior":"deny","message":"not today"}`)
+	})
+	defer testServerURL.clearHandlers()
+
+	dir, err := os.MkdirTemp("", "greenlight-hook-output-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outputFile := filepath.Join(dir, "decision.json")
+
+	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","tool_input":{"command":"rm -rf /"},"session_id":"s1"}`
+	r := run(t, []string{"hook", "--output-file", outputFile},
+		[]string{
+			"GREENLIGHT_DEVICE_ID=test-dev",
+			"GREENLIGHT_PROJECT=test-proj",
+			"GREENLIGHT_SESSION_ID=relay-1",
+		}, input)
+
+	if r.ExitCode != 0 {
+		t.Errorf("expected exit 0, got %d; stderr=%q", r.ExitCode, r.Stderr)
+	}
+	if !strings.Contains(r.Stdout, "not today") {
+		t.Errorf("expected deny decision on stdout, got %q", r.Stdout)
+	}
+
+	data, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("output file not written: %v", err)
+	}
+	if string(data) != r.Stdout {
+		t.Errorf("output file differs from stdout:\nfile:   %q\nstdout: %q", string(data), r.Stdout)
+	}
+}
+
+func TestIntegration_Hook_PermissionRequest_401Retry(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	var requestCount int
+	var requestMu sync.Mutex
+	testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
+		requestMu.Lock()
+		requestCount++
+		count := requestCount
+		requestMu.Unlock()
+
+		if count == 1 {
+			w.WriteHeader(401)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"behavior":"allow"}`)
+	})
+	defer testServerURL.clearHandlers()
+
+	// Clear any enrollment markers from previous tests
+	relayID := "retry-relay-1"
+	os.Remove(filepath.Join(os.TempDir(), "greenlight-enrolled-"+relayID))
+
+	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","session_id":"s1"}`
+	r := run(t, []string{"hook"},
+		[]string{
+			"GREENLIGHT_DEVICE_ID=test-dev",
+			"GREENLIGHT_PROJECT=test-proj",
+			"GREENLIGHT_SESSION_ID=" + relayID,
+		}, input)
+
+	var output map[string]interface{}
+	json.Unmarshal([]byte(r.Stdout), &output)
+	hso := output["hookSpecificOutput"].(map[string]interface{})
+	decision := hso["decision"].(map[string]interface{})
+	if decision["behavior"] != "allow" {
+		t.Errorf("expected allow after retry, got %v; stdout=%q", decision["behavior"], r.Stdout)
+	}
+
+	// Should have made 2 requests to /request
+	requestMu.Lock()
+	if requestCount != 2 {
+		t.Errorf("expected 2 requests to /request, got %d", requestCount)
+	}
+	requestMu.Unlock()
+}
+
+func TestIntegration_Hook_PermissionRequest_Repeated401(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		failures  int
+		wantAllow bool
+		wantCount int
+	}{
+		{"recovers after two 401s", 2, true, 3},
+		{"denies after retries exhausted", 3, false, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testServerURL.clearHandlers()
+
+			var requestCount, enrollCount int
+			var requestMu sync.Mutex
+			testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
+				requestMu.Lock()
+				requestCount++
+				count := requestCount
+				requestMu.Unlock()
+
+				if count <= tc.failures {
+					w.WriteHeader(401)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"behavior":"allow"}`)
+			})
+			testServerURL.setHandler("/session/enroll", func(w http.ResponseWriter, r *http.Request) {
+				requestMu.Lock()
+				enrollCount++
+				requestMu.Unlock()
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"approved":true}`)
+			})
+			defer testServerURL.clearHandlers()
+
+			relayID := "retry-relay-2"
+			os.Remove(filepath.Join(os.TempDir(), "greenlight-enrolled-"+relayID))
+			defer os.Remove(filepath.Join(os.TempDir(), "greenlight-enrolled-"+relayID))
+
+			input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","session_id":"s1"}`
+			r := run(t, []string{"hook"},
+				[]string{
+					"GREENLIGHT_DEVICE_ID=test-dev",
+					"GREENLIGHT_PROJECT=test-proj",
+					"GREENLIGHT_SESSION_ID=" + relayID,
+				}, input)
+
+			var output map[string]interface{}
+			json.Unmarshal([]byte(r.Stdout), &output)
+			hso, _ := output["hookSpecificOutput"].(map[string]interface{})
+			decision, _ := hso["decision"].(map[string]interface{})
+			if got := decision["behavior"] == "allow"; got != tc.wantAllow {
+				t.Errorf("expected allow=%v, got %v; stdout=%q", tc.wantAllow, decision["behavior"], r.Stdout)
+			}
+
+			requestMu.Lock()
+			defer requestMu.Unlock()
+			if requestCount != tc.wantCount {
+				t.Errorf("expected %d requests to /request, got %d", tc.wantCount, requestCount)
+			}
+			if enrollCount < 2 {
+				t.Errorf("expected a re-enrollment per 401 retry, got %d enrollments", enrollCount)
+			}
+		})
+	}
+}
+
+func TestIntegration_Hook_PermissionRequest_AgentName(t *testing.T) {
+	defer testServerURL.clearHandlers()
+
+	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","session_id":"s1"}`
+	for _, tc := range []struct {
+		env  []string
+		want string
+	}{
+		{nil, "claude-code"},
+		{[]string{"GREENLIGHT_AGENT_NAME=my-agent"}, "my-agent"},
+	} {
+		testServerURL.clearHandlers()
+		testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"behavior":"allow"}`)
+		})
+		env := append([]string{
+			"GREENLIGHT_DEVICE_ID=test-dev",
+			"GREENLIGHT_PROJECT=test-proj",
+			"GREENLIGHT_NO_ENROLL=1",
+		}, tc.env...)
+		run(t, []string{"hook"}, env, input)
+
+		reqs := testServerURL.getRequests("/request")
+		if len(reqs) != 1 {
+			t.Fatalf("expected 1 request, got %d", len(reqs))
+		}
+		var body map[string]interface{}
+		json.Unmarshal(reqs[0].Body, &body)
+		if body["agent"] != tc.want {
+			t.Errorf("expected agent=%q, got %v", tc.want, body["agent"])
+		}
+	}
+}
+
+func TestIntegration_Hook_PermissionRequest_ServerError(t *testing.T) {
+	testServerURL.clearHandlers()
+	testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+		fmt.Fprint(w, "internal server error")
+	})
+	defer testServerURL.clearHandlers()
+
+	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","session_id":"s1"}`
+	r := run(t, []string{"hook"},
+		[]string{
+			"GREENLIGHT_DEVICE_ID=test-dev",
+			"GREENLIGHT_PROJECT=test-proj",
+			"GREENLIGHT_SESSION_ID=relay-1",
+		}, input)
+
+	var output map[string]interface{}
+	json.Unmarshal([]byte(r.Stdout), &output)
+	hso := output["hookSpecificOutput"].(map[string]interface{})
+	decision := hso["decision"].(map[string]interface{})
+	if decision["behavior"] != "deny" {
+		t.Errorf("expected deny on server error, got %v", decision["behavior"])
+	}
+	msg := decision["message"].(string)
+	if !strings.Contains(msg, "500") {
+		t.Errorf("expected HTTP 500 in message, got %q", msg)
+	}
+}
+
+// ---------- uninstall ----------
+
+func TestIntegration_Uninstall(t *testing.T) {
+	workDir, err := newProjectDir("greenlight-uninstall-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	settingsPath := filepath.Join(workDir, ".claude", "settings.local.json")
+	os.MkdirAll(filepath.Dir(settingsPath), 0755)
+	settings := `{
+  "permissions": {"allow": ["Bash(ls)"]},
+  "hooks": {
+    "SessionStart": [
+      {"matcher": "", "hooks": [{"type": "command", "command": "/usr/local/bin/greenlight hook"}]}
+    ],
+    "PermissionRequest": [
+      {"matcher": "", "hooks": [{"type": "command", "command": "/usr/local/bin/greenlight hook"}]},
+      {"matcher": "Bash", "hooks": [{"type": "command", "command": "/usr/bin/audit-bash"}]}
+    ]
+  }
+}`
+	if err := os.WriteFile(settingsPath, []byte(settings), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	uninstall := func() string {
+		cmd := exec.Command(greenlightBin, "uninstall")
+		cmd.Dir = workDir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("uninstall: %v\n%s", err, out)
+		}
+		return string(out)
+	}
+
+	out := uninstall()
+	if !strings.Contains(out, "Removed greenlight hook for PermissionRequest") || !strings.Contains(out, "Removed greenlight hook for SessionStart") {
+		t.Errorf("expected removed events listed, got %q", out)
+	}
+
+	data, err := os.ReadFile(settingsPath)
+	if err != nil {
+		t.Fatalf("expected settings file kept: %v", err)
+	}
+	var got struct {
+		Permissions map[string]interface{}              `json:"permissions"`
+		Hooks       map[string][]map[string]interface{} `json:"hooks"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("parse settings: %v", err)
+	}
+	if got.Permissions == nil {
+		t.Error("expected permissions left untouched")
+	}
+	if _, ok := got.Hooks["SessionStart"]; ok {
+		t.Error("expected empty SessionStart event removed")
+	}
+	if pr := got.Hooks["PermissionRequest"]; len(pr) != 1 || pr[0]["matcher"] != "Bash" {
+		t.Errorf("expected only the non-greenlight PermissionRequest hook left, got %v", pr)
+	}
+
+	// Idempotent
+	before := string(data)
+	if out := uninstall(); !strings.Contains(out, "No greenlight hooks found") {
+		t.Errorf("expected nothing to remove on second run, got %q", out)
+	}
+	if data, _ := os.ReadFile(settingsPath); string(data) != before {
+		t.Errorf("expected settings unchanged on second run, got %s", data)
+	}
+}
+
+func TestIntegration_SettingsFile(t *testing.T) {
+	testServerURL.clearHandlers()
+	testServerURL.setWSHandler(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		conn.Read(context.Background())
+		conn.CloseNow()
+	})
+	defer testServerURL.clearHandlers()
+
+	workDir, err := newProjectDir("greenlight-settingsfile-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	greenlight := func(args ...string) (string, error) {
+		cmd := exec.Command(greenlightBin, args...)
+		cmd.Dir = workDir
+		cmd.Env = []string{
+			"HOME=" + os.Getenv("HOME"),
+			"PATH=" + os.Getenv("PATH"),
+			"TMPDIR=" + os.TempDir(),
+		}
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	out, err := greenlight("connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll", "--dry-run", "--settings-file", "settings.json")
+	if err != nil {
+		t.Fatalf("connect --dry-run: %v\n%s", err, out)
+	}
+	shared := filepath.Join(workDir, ".claude", "settings.json")
+	if data, err := os.ReadFile(shared); err != nil || !strings.Contains(string(data), "greenlight") {
+		t.Errorf("expected hooks in %s, got %q (err %v)", shared, data, err)
+	}
+	if _, err := os.Stat(filepath.Join(workDir, ".claude", "settings.local.json")); !os.IsNotExist(err) {
+		t.Errorf("expected settings.local.json left alone (stat: %v)", err)
+	}
+
+	out, err = greenlight("uninstall", "--settings-file", "settings.json")
+	if err != nil {
+		t.Fatalf("uninstall: %v\n%s", err, out)
+	}
+	if !strings.Contains(out, "Removed greenlight hook for PermissionRequest") {
+		t.Errorf("expected hooks removed from settings.json, got %q", out)
+	}
+
+	// Names Claude Code doesn't read are refused rather than ignored
+	out, err = greenlight("connect", "--device-id", "test-dev", "--project", "test-proj", "--no-enroll", "--dry-run", "--settings-file", "hooks.json")
+	if err == nil || !strings.Contains(out, `invalid settings file "hooks.json"`) {
+		t.Errorf("expected invalid settings file error, got %v: %q", err, out)
+	}
+}
+
+func TestIntegration_Uninstall_DeletesEmptySettings(t *testing.T) {
+	workDir, err := newProjectDir("greenlight-uninstall-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	uninstall := func() string {
+		cmd := exec.Command(greenlightBin, "uninstall")
+		cmd.Dir = workDir
+		cmd.Env = []string{"HOME=" + home, "PATH=" + os.Getenv("PATH"), "TMPDIR=" + os.TempDir()}
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("uninstall: %v\n%s", err, out)
+		}
+		return string(out)
+	}
+
+	// A settings file the user made is kept, even once empty
+	settingsPath := filepath.Join(workDir, ".claude", "settings.local.json")
+	os.MkdirAll(filepath.Dir(settingsPath), 0755)
+	settings := `{"hooks": {"SessionStart": [{"matcher": "", "hooks": [{"type": "command", "command": "/opt/greenlight hook"}]}]}}`
+	if err := os.WriteFile(settingsPath, []byte(settings), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out := uninstall(); !strings.Contains(out, "Updated") {
+		t.Errorf("expected the user's settings file to be updated, got %q", out)
+	}
+	if _, err := os.Stat(settingsPath); err != nil {
+		t.Errorf("expected the user's settings file kept, stat err: %v", err)
+	}
+
+	// One greenlight created is deleted once empty, and forgotten
+	os.Remove(settingsPath)
+	if err := installHooks(settingsPath, []string{"SessionStart", "PermissionRequest"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if !settingsCreated(settingsPath) {
+		t.Fatalf("expected installHooks to record creating %s", settingsPath)
+	}
+	if out := uninstall(); !strings.Contains(out, "Deleted") {
+		t.Errorf("expected the created settings file to be deleted, got %q", out)
+	}
+	if _, err := os.Stat(settingsPath); !os.IsNotExist(err) {
+		t.Errorf("expected settings file deleted once empty, stat err: %v", err)
+	}
+	if settingsCreated(settingsPath) {
+		t.Errorf("expected %s to be forgotten once deleted", settingsPath)
+	}
+}
+
+// ---------- logs ----------
+
+func TestIntegration_Logs(t *testing.T) {
+	tmpDir := t.TempDir()
+	older := filepath.Join(tmpDir, "greenlight-100.log")
+	newer := filepath.Join(tmpDir, "greenlight-200.log")
+	os.WriteFile(older, []byte("older log\n"), 0644)
+	os.WriteFile(newer, []byte("newer log\n"), 0644)
+	os.Chtimes(older, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour))
+	os.Chtimes(newer, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+	env := []string{"TMPDIR=" + tmpDir}
+
+	r := run(t, []string{"logs"}, env, "")
+	if r.ExitCode != 0 || strings.TrimSpace(r.Stdout) != newer {
+		t.Errorf("expected newest log %s, got exit %d stdout=%q stderr=%q", newer, r.ExitCode, r.Stdout, r.Stderr)
+	}
+
+	r = run(t, []string{"logs", "--all"}, env, "")
+	want := "==> " + older + " <==\nolder log\n==> " + newer + " <==\nnewer log\n"
+	if r.Stdout != want {
+		t.Errorf("expected --all output %q, got %q", want, r.Stdout)
+	}
+
+	// The logs command doesn't leave a log file of its own behind
+	if files, _ := filepath.Glob(filepath.Join(tmpDir, "greenlight-*.log")); len(files) != 2 {
+		t.Errorf("expected only the 2 existing logs, got %v", files)
+	}
+
+	custom := filepath.Join(tmpDir, "custom.log")
+	r = run(t, []string{"logs"}, append(env, "GREENLIGHT_LOG="+custom), "")
+	if strings.TrimSpace(r.Stdout) != custom {
+		t.Errorf("expected GREENLIGHT_LOG path %s, got %q", custom, r.Stdout)
+	}
+}
+
+func TestIntegration_Logs_Follow(t *testing.T) {
+	tmpDir := t.TempDir()
+	logFile := filepath.Join(tmpDir, "greenlight-300.log")
+	os.WriteFile(logFile, []byte("first line\n"), 0644)
+
+	cmd := exec.Command(greenlightBin, "logs", "-f")
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + os.Getenv("PATH"),
+		"TMPDIR=" + tmpDir,
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	lines := make(chan string, 10)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-lines:
+			if got != want {
+				t.Errorf("expected %q, got %q", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+	expect("first line")
+
+	f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(f, "appended line")
+	f.Close()
+	expect("appended line")
+}
+
+// ---------- sessions ----------
+
+func TestIntegration_Sessions(t *testing.T) {
+	home := t.TempDir()
+	sessionsFile := filepath.Join(home, ".greenlight", "sessions.json")
+	os.MkdirAll(filepath.Dir(sessionsFile), 0755)
+
+	now := time.Now().UTC()
+	sessions := map[string]interface{}{
+		"conv-recent": map[string]interface{}{"relay_id": "relay-recent", "project": "proj-a", "updated_at": now.Add(-2 * time.Hour)},
+		"conv-old":    map[string]interface{}{"relay_id": "relay-old", "project": "proj-a", "updated_at": now.Add(-45 * 24 * time.Hour)},
+		"conv-legacy": "relay-legacy",
+	}
+	data, _ := json.Marshal(sessions)
+	os.WriteFile(sessionsFile, data, 0644)
+
+	env := []string{"HOME=" + home}
+
+	r := run(t, []string{"sessions", "list"}, env, "")
+	if r.ExitCode != 0 {
+		t.Fatalf("list: expected exit 0, got %d; stderr=%q", r.ExitCode, r.Stderr)
+	}
+	lines := strings.Split(strings.TrimSpace(r.Stdout), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("list: expected header and 3 sessions, got %q", r.Stdout)
+	}
+	for i, want := range []string{"conv-recent", "conv-old", "conv-legacy"} {
+		if fields := strings.Fields(lines[i+1]); fields[0] != want {
+			t.Errorf("list: expected %s on line %d, got %q", want, i+1, lines[i+1])
+		}
+	}
+	if !strings.Contains(lines[1], "relay-recent") || !strings.Contains(lines[1], "proj-a") || !strings.Contains(lines[1], "2h") {
+		t.Errorf("list: unexpected line for recent session: %q", lines[1])
+	}
+	if !strings.Contains(lines[2], "45d") {
+		t.Errorf("list: expected age 45d for old session, got %q", lines[2])
+	}
+
+	r = run(t, []string{"sessions", "prune", "--older-than", "soon"}, env, "")
+	if r.ExitCode == 0 {
+		t.Error("prune: expected failure for an invalid --older-than")
+	}
+
+	r = run(t, []string{"sessions", "prune"}, env, "")
+	if r.ExitCode != 0 {
+		t.Fatalf("prune: expected exit 0, got %d; stderr=%q", r.ExitCode, r.Stderr)
+	}
+	if !strings.Contains(r.Stdout, "Pruned 2 of 3") {
+		t.Errorf("prune: unexpected output %q", r.Stdout)
+	}
+	var remaining map[string]json.RawMessage
+	data, _ = os.ReadFile(sessionsFile)
+	json.Unmarshal(data, &remaining)
+	if len(remaining) != 1 || remaining["conv-recent"] == nil {
+		t.Errorf("prune: expected only conv-recent to remain, got %s", data)
+	}
+
+	r = run(t, []string{"sessions", "prune", "--older-than", "1h"}, env, "")
+	if !strings.Contains(r.Stdout, "Pruned 1 of 1") {
+		t.Errorf("prune 1h: unexpected output %q", r.Stdout)
+	}
+
+	os.WriteFile(sessionsFile, []byte(`{"conv-x":"relay-x"}`), 0644)
+	r = run(t, []string{"sessions", "clear"}, env, "")
+	if r.ExitCode != 0 {
+		t.Fatalf("clear: expected exit 0, got %d; stderr=%q", r.ExitCode, r.Stderr)
+	}
+	if _, err := os.Stat(sessionsFile); !os.IsNotExist(err) {
+		t.Errorf("clear: expected sessions.json to be removed, got %v", err)
+	}
+
+	r = run(t, []string{"sessions", "bogus"}, env, "")
+	if r.ExitCode == 0 {
+		t.Error("expected failure for an unknown subcommand")
+	}
+}
+
+// ---------- stream — arg validation ----------
+
+func TestIntegration_Stream_MissingTranscript(t *testing.T) {
+	r := run(t, []string{"stream", "--session-id", "s1", "--bridge", "/tmp/b"}, nil, "")
+	if r.ExitCode == 0 {
+		t.Error("expected non-zero exit for missing --transcript")
+	}
+}
+
+func TestIntegration_Stream_MissingSessionID(t *testing.T) {
+	r := run(t, []string{"stream", "--transcript", "/tmp/t.jsonl", "--bridge", "/tmp/b"}, nil, "")
+	if r.ExitCode == 0 {
+		t.Error("expected non-zero exit for missing --session-id")
+	}
+}
+
+func TestIntegration_Stream_MissingServerOrBridge(t *testing.T) {
+	r := run(t, []string{"stream", "--transcript", "/tmp/t.jsonl", "--session-id", "s1", "--device-id", "d1"}, nil, "")
+	if r.ExitCode == 0 {
+		t.Error("expected non-zero exit for missing --server/--bridge")
+	}
+}
+
+// ---------- stream — bridge mode ----------
+
+func TestIntegration_Stream_BridgeMode(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "greenlight-stream-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	transcriptPath := filepath.Join(tmpDir, "transcript.jsonl")
+	bridgePath := filepath.Join(tmpDir, "bridge")
+
+	// Create bridge file
+	if err := os.WriteFile(bridgePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write transcript lines before starting (streamer reads from beginning)
+	lines := []string{
+		`{"type":"message","content":"hello"}`,
+		`{"type":"message","content":"world"}`,
+	}
+	if err := os.WriteFile(transcriptPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Start streamer
+	cmd := exec.Command(greenlightBin, "stream",
+		"--transcript", transcriptPath,
+		"--session-id", "test-stream-1",
+		"--relay-id", "relay-1",
+		"--bridge", bridgePath,
+	)
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + os.Getenv("PATH"),
+		"TMPDIR=" + os.TempDir(),
+	}
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the streamer to process the lines
+	deadline := time.Now().Add(5 * time.Second)
+	var bridgeContent string
+	for time.Now().Before(deadline) {
+		data, _ := os.ReadFile(bridgePath)
+		bridgeContent = string(data)
+		if strings.Contains(bridgeContent, "hello") && strings.Contains(bridgeContent, "world") {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	if !strings.Contains(bridgeContent, "hello") {
+		t.Errorf("expected 'hello' in bridge file, got %q", bridgeContent)
+	}
+	if !strings.Contains(bridgeContent, "world") {
+		t.Errorf("expected 'world' in bridge file, got %q", bridgeContent)
+	}
+}
+
+func TestIntegration_Stream_LateTranscript(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "greenlight-stream-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	transcriptPath := filepath.Join(tmpDir, "transcript.jsonl")
+	bridgePath := filepath.Join(tmpDir, "bridge")
+	if err := os.WriteFile(bridgePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(greenlightBin, "stream",
+		"--transcript", transcriptPath,
+		"--session-id", "test-stream-late",
+		"--relay-id", "relay-1",
+		"--bridge", bridgePath,
+	)
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + os.Getenv("PATH"),
+		"TMPDIR=" + os.TempDir(),
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	// Create the transcript well after the streamer started polling
+	time.Sleep(3 * time.Second)
+	if err := os.WriteFile(transcriptPath, []byte(`{"type":"message","content":"late"}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Backoff is capped at 2s, so the file is picked up within a few seconds
+	deadline := time.Now().Add(5 * time.Second)
+	var bridgeContent string
+	for time.Now().Before(deadline) {
+		data, _ := os.ReadFile(bridgePath)
+		bridgeContent = string(data)
+		if strings.Contains(bridgeContent, "late") {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !strings.Contains(bridgeContent, "late") {
+		t.Errorf("expected late transcript line in bridge file, got %q", bridgeContent)
+	}
+}
+
+func TestIntegration_Stream_TranscriptWaitDeadline(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "greenlight-stream-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	bridgePath := filepath.Join(tmpDir, "bridge")
+	if err := os.WriteFile(bridgePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	r := run(t, []string{"stream",
+		"--transcript", filepath.Join(tmpDir, "never.jsonl"),
+		"--session-id", "test-stream-deadline",
+		"--bridge", bridgePath,
+	}, []string{"GREENLIGHT_TRANSCRIPT_WAIT=1500ms"}, "")
+	elapsed := time.Since(start)
+
+	if r.ExitCode != 0 {
+		t.Errorf("expected exit 0, got %d; stderr=%q", r.ExitCode, r.Stderr)
+	}
+	if elapsed < 1500*time.Millisecond {
+		t.Errorf("streamer gave up after %v, before the 1.5s deadline", elapsed)
+	}
+	if elapsed > 4*time.Second {
+		t.Errorf("streamer took %v to give up, expected about 1.5s", elapsed)
+	}
+}
+
+func TestIntegration_Stream_Echo(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "greenlight-stream-echo-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	transcriptPath := filepath.Join(tmpDir, "transcript.jsonl")
+	bridgePath := filepath.Join(tmpDir, "bridge")
+	os.WriteFile(bridgePath, nil, 0644)
+	os.WriteFile(transcriptPath, []byte(`{"type":"message","content":"echoed"}`+"\n"), 0644)
+
+	cmd := exec.Command(greenlightBin, "stream",
+		"--transcript", transcriptPath,
+		"--session-id", "test-echo-1",
+		"--relay-id", "relay-1",
+		"--bridge", bridgePath,
+		"--echo",
+	)
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + os.Getenv("PATH"),
+		"TMPDIR=" + os.TempDir(),
+	}
+	var stderr bytes.Buffer
+	var stderrMu sync.Mutex
+	cmd.Stderr = writerFunc(func(p []byte) (int, error) {
+		stderrMu.Lock()
+		defer stderrMu.Unlock()
+		return stderr.Write(p)
+	})
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		stderrMu.Lock()
+		n := stderr.Len()
+		stderrMu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	want := `{"type":"transcript","data":{"type":"message","content":"echoed"}}`
+	if !strings.Contains(stderr.String(), want) {
+		t.Errorf("expected echoed frame %s on stderr, got %q", want, stderr.String())
+	}
+	bridgeContent, _ := os.ReadFile(bridgePath)
+	if !strings.Contains(string(bridgeContent), "echoed") {
+		t.Errorf("expected line still written to bridge, got %q", bridgeContent)
+	}
+}
+
+// writerFunc adapts a function to io.Writer.
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// ---------- stream — HTTP mode ----------
+
+func TestIntegration_Stream_HTTPMode(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	tmpDir, err := os.MkdirTemp("", "greenlight-stream-http-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	transcriptPath := filepath.Join(tmpDir, "transcript.jsonl")
+
+	// Write transcript lines
+	lines := []string{
+		`{"type":"message","content":"line1"}`,
+		`{"type":"message","content":"line2"}`,
+	}
+	if err := os.WriteFile(transcriptPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(greenlightBin, "stream",
+		"--transcript", transcriptPath,
+		"--session-id", "test-http-1",
+		"--device-id", "test-dev",
+		"--project", "test-proj",
+		"--relay-id", "relay-http-1",
+		"--server", testServerURL.baseURL(),
+	)
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + os.Getenv("PATH"),
+		"TMPDIR=" + os.TempDir(),
+	}
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for transcript POSTs
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		reqs := testServerURL.getRequests("/transcript")
+		if len(reqs) >= 2 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	reqs := testServerURL.getRequests("/transcript")
+	if len(reqs) < 2 {
+		t.Fatalf("expected at least 2 transcript POSTs, got %d", len(reqs))
+	}
+
+	// Check payload structure
+	var payload map[string]interface{}
+	json.Unmarshal(reqs[0].Body, &payload)
+	if payload["device_id"] != "test-dev" {
+		t.Errorf("expected device_id=test-dev, got %v", payload["device_id"])
+	}
+	if payload["session_id"] != "test-http-1" {
+		t.Errorf("expected session_id=test-http-1, got %v", payload["session_id"])
+	}
+	if payload["data"] == nil {
+		t.Error("expected data field in transcript POST")
+	}
+}
+
+func TestIntegration_Stream_HTTPMode_Retry(t *testing.T) {
+	testServerURL.clearHandlers()
+	defer testServerURL.clearHandlers()
+	var calls atomic.Int32
+	testServerURL.setHandler("/transcript", func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	})
+
+	transcriptPath := filepath.Join(t.TempDir(), "transcript.jsonl")
+	os.WriteFile(transcriptPath, []byte(`{"type":"msg"}`+"\n"), 0644)
+
+	cmd := exec.Command(greenlightBin, "stream",
+		"--transcript", transcriptPath,
+		"--session-id", "test-retry-1",
+		"--device-id", "test-dev",
+		"--project", "test-proj",
+		"--relay-id", "relay-retry-1",
+		"--server", testServerURL.baseURL(),
+	)
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + os.Getenv("PATH"),
+		"TMPDIR=" + os.TempDir(),
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(streamOffsetPath("test-retry-1"))
+
+	// The line is sent again after the 502 rather than dropped
+	var reqs []recordedRequest
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && len(reqs) < 2; time.Sleep(100 * time.Millisecond) {
+		reqs = testServerURL.getRequests("/transcript")
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	if len(reqs) != 2 {
+		t.Fatalf("expected the line to be retried once, got %d requests", len(reqs))
+	}
+	if !bytes.Equal(reqs[0].Body, reqs[1].Body) {
+		t.Errorf("expected the retry to repeat the request:\n%s\n%s", reqs[0].Body, reqs[1].Body)
+	}
+}
+
+func TestIntegration_Stream_HTTPMode_Dedup(t *testing.T) {
+	testServerURL.clearHandlers()
+	defer testServerURL.clearHandlers()
+
+	// A rewritten transcript repeats the first line
+	transcriptPath := filepath.Join(t.TempDir(), "transcript.jsonl")
+	os.WriteFile(transcriptPath, []byte(`{"uuid":"a"}`+"\n"+`{"uuid":"b"}`+"\n"+`{"uuid":"a"}`+"\n"), 0644)
+
+	cmd := exec.Command(greenlightBin, "stream",
+		"--transcript", transcriptPath,
+		"--session-id", "test-dedup-1",
+		"--device-id", "test-dev",
+		"--project", "test-proj",
+		"--relay-id", "relay-dedup-1",
+		"--server", testServerURL.baseURL(),
+	)
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + os.Getenv("PATH"),
+		"TMPDIR=" + os.TempDir(),
+		"GREENLIGHT_TRANSCRIPT_DEDUP=500",
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(streamOffsetPath("test-dedup-1"))
+
+	var reqs []recordedRequest
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && len(reqs) < 2; time.Sleep(100 * time.Millisecond) {
+		reqs = testServerURL.getRequests("/transcript")
+	}
+	// Allow time for a duplicate to arrive
+	time.Sleep(500 * time.Millisecond)
+	reqs = testServerURL.getRequests("/transcript")
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	if len(reqs) != 2 {
+		t.Fatalf("expected the repeated line to be skipped, got %d requests", len(reqs))
+	}
+	if !strings.Contains(string(reqs[1].Body), `"uuid":"b"`) {
+		t.Errorf("expected the second request to carry line b, got %s", reqs[1].Body)
+	}
+}
+
+func TestIntegration_Stream_HTTPMode_FatalError(t *testing.T) {
+	testServerURL.clearHandlers()
+	testServerURL.setHandler("/transcript", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+	})
+	defer testServerURL.clearHandlers()
+
+	tmpDir, err := os.MkdirTemp("", "greenlight-stream-fatal-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	transcriptPath := filepath.Join(tmpDir, "transcript.jsonl")
+	os.WriteFile(transcriptPath, []byte(`{"type":"msg"}`+"\n"), 0644)
+
+	cmd := exec.Command(greenlightBin, "stream",
+		"--transcript", transcriptPath,
+		"--session-id", "test-fatal-1",
+		"--device-id", "test-dev",
+		"--project", "test-proj",
+		"--relay-id", "relay-fatal-1",
+		"--server", testServerURL.baseURL(),
+	)
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + os.Getenv("PATH"),
+		"TMPDIR=" + os.TempDir(),
+	}
+
+	done := make(chan error, 1)
+	cmd.Start()
+	go func() { done <- cmd.Wait() }()
+
+	// Should exit on its own due to 400 error
+	select {
+	case <-done:
+		// good, streamer exited
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Error("streamer did not exit on fatal 400 error")
+	}
+}
+
+func TestIntegration_Stream_HTTPMode_Batch(t *testing.T) {
+	testServerURL.clearHandlers()
 
-	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","session_id":"s1"}`
-	r := run(t, []string{"hook"},
-		[]string{
-			"GREENLIGHT_DEVICE_ID=test-dev",
-			"GREENLIGHT_PROJECT=test-proj",
-			"GREENLIGHT_SESSION_ID=" + relayID,
-		}, input)
+	tmpDir, err := os.MkdirTemp("", "greenlight-stream-batch-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
 
-	var output map[string]interface{}
-	json.Unmarshal([]byte(r.Stdout), &output)
-	hso := output["hookSpecificOutput"].(map[string]interface{})
-	decision := hso["decision"].(map[string]interface{})
-	if decision["behavior"] != "allow" {
-		t.Errorf("expected allow after retry, got %v; stdout=%q", decision["behavior"], r.Stdout)
+	transcriptPath := filepath.Join(tmpDir, "transcript.jsonl")
+	lines := []string{
+		`{"type":"message","content":"line1"}`,
+		`{"type":"message","content":"line2"}`,
+		`{"type":"message","content":"line3"}`,
 	}
+	os.WriteFile(transcriptPath, []byte(strings.Join(lines, "\n")+"\n"), 0644)
 
-	// Should have made 2 requests to /request
-	requestMu.Lock()
-	if requestCount != 2 {
-		t.Errorf("expected 2 requests to /request, got %d", requestCount)
+	cmd := exec.Command(greenlightBin, "stream",
+		"--transcript", transcriptPath,
+		"--session-id", "test-batch-1",
+		"--device-id", "test-dev",
+		"--project", "test-proj",
+		"--relay-id", "relay-batch-1",
+		"--server", testServerURL.baseURL(),
+		"--batch-ms", "300",
+	)
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + os.Getenv("PATH"),
+		"TMPDIR=" + os.TempDir(),
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && len(testServerURL.getRequests("/transcript/batch")) == 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	if reqs := testServerURL.getRequests("/transcript"); len(reqs) != 0 {
+		t.Errorf("expected no single-line POSTs, got %d", len(reqs))
+	}
+	reqs := testServerURL.getRequests("/transcript/batch")
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 batch POST, got %d", len(reqs))
+	}
+	var payload struct {
+		SessionID string            `json:"session_id"`
+		RelayID   string            `json:"relay_id"`
+		Lines     []json.RawMessage `json:"lines"`
+	}
+	if err := json.Unmarshal(reqs[0].Body, &payload); err != nil {
+		t.Fatalf("invalid batch payload: %v\n%s", err, reqs[0].Body)
+	}
+	if payload.SessionID != "test-batch-1" || payload.RelayID != "relay-batch-1" {
+		t.Errorf("unexpected batch ids: %s", reqs[0].Body)
+	}
+	if len(payload.Lines) != len(lines) {
+		t.Fatalf("expected %d lines in batch, got %d", len(lines), len(payload.Lines))
+	}
+	for i, l := range payload.Lines {
+		if string(l) != lines[i] {
+			t.Errorf("line %d: expected %s, got %s", i, lines[i], l)
+		}
 	}
-	requestMu.Unlock()
 }
 
-func TestIntegration_Hook_PermissionRequest_ServerError(t *testing.T) {
+func TestIntegration_Stream_HTTPMode_BatchFlushOnTerm(t *testing.T) {
 	testServerURL.clearHandlers()
-	testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(500)
-		fmt.Fprint(w, "internal server error")
-	})
-	defer testServerURL.clearHandlers()
-
-	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","session_id":"s1"}`
-	r := run(t, []string{"hook"},
-		[]string{
-			"GREENLIGHT_DEVICE_ID=test-dev",
-			"GREENLIGHT_PROJECT=test-proj",
-			"GREENLIGHT_SESSION_ID=relay-1",
-		}, input)
 
-	var output map[string]interface{}
-	json.Unmarshal([]byte(r.Stdout), &output)
-	hso := output["hookSpecificOutput"].(map[string]interface{})
-	decision := hso["decision"].(map[string]interface{})
-	if decision["behavior"] != "deny" {
-		t.Errorf("expected deny on server error, got %v", decision["behavior"])
+	tmpDir, err := os.MkdirTemp("", "greenlight-stream-batchterm-*")
+	if err != nil {
+		t.Fatal(err)
 	}
-	msg := decision["message"].(string)
-	if !strings.Contains(msg, "500") {
-		t.Errorf("expected HTTP 500 in message, got %q", msg)
+	defer os.RemoveAll(tmpDir)
+	defer os.Remove(streamOffsetPath("test-batchterm-1"))
+
+	transcriptPath := filepath.Join(tmpDir, "transcript.jsonl")
+	lines := []string{
+		`{"type":"message","content":"line1"}`,
+		`{"type":"message","content":"line2"}`,
 	}
-}
+	os.WriteFile(transcriptPath, []byte(strings.Join(lines, "\n")+"\n"), 0644)
 
-// ---------- stream — arg validation ----------
+	// The window is far longer than the test, so the batch is only sent
+	// because of the SIGTERM
+	cmd := exec.Command(greenlightBin, "stream",
+		"--transcript", transcriptPath,
+		"--session-id", "test-batchterm-1",
+		"--device-id", "test-dev",
+		"--project", "test-proj",
+		"--relay-id", "relay-batchterm-1",
+		"--server", testServerURL.baseURL(),
+		"--batch-ms", "60000",
+	)
+	cmd.Env = []string{
+		"HOME=" + os.Getenv("HOME"),
+		"PATH=" + os.Getenv("PATH"),
+		"TMPDIR=" + os.TempDir(),
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
 
-func TestIntegration_Stream_MissingTranscript(t *testing.T) {
-	r := run(t, []string{"stream", "--session-id", "s1", "--bridge", "/tmp/b"}, nil, "")
-	if r.ExitCode == 0 {
-		t.Error("expected non-zero exit for missing --transcript")
+	time.Sleep(time.Second)
+	if reqs := testServerURL.getRequests("/transcript/batch"); len(reqs) != 0 {
+		t.Fatalf("expected no batch before SIGTERM, got %d", len(reqs))
 	}
-}
+	cmd.Process.Signal(syscall.SIGTERM)
 
-func TestIntegration_Stream_MissingSessionID(t *testing.T) {
-	r := run(t, []string{"stream", "--transcript", "/tmp/t.jsonl", "--bridge", "/tmp/b"}, nil, "")
-	if r.ExitCode == 0 {
-		t.Error("expected non-zero exit for missing --session-id")
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected clean exit after SIGTERM, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("streamer did not exit after SIGTERM")
 	}
-}
 
-func TestIntegration_Stream_MissingServerOrBridge(t *testing.T) {
-	r := run(t, []string{"stream", "--transcript", "/tmp/t.jsonl", "--session-id", "s1", "--device-id", "d1"}, nil, "")
-	if r.ExitCode == 0 {
-		t.Error("expected non-zero exit for missing --server/--bridge")
+	reqs := testServerURL.getRequests("/transcript/batch")
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 batch POST, got %d", len(reqs))
+	}
+	var payload struct {
+		Lines []json.RawMessage `json:"lines"`
+	}
+	if err := json.Unmarshal(reqs[0].Body, &payload); err != nil {
+		t.Fatalf("invalid batch payload: %v\n%s", err, reqs[0].Body)
+	}
+	if len(payload.Lines) != len(lines) {
+		t.Errorf("expected %d lines in batch, got %d", len(lines), len(payload.Lines))
 	}
 }
 
-// ---------- stream — bridge mode ----------
+func TestIntegration_Stream_HTTPMode_ResumeOffset(t *testing.T) {
+	testServerURL.clearHandlers()
 
-func TestIntegration_Stream_BridgeMode(t *testing.T) {
-	tmpDir, err := os.MkdirTemp("", "greenlight-stream-*")
+	tmpDir, err := os.MkdirTemp("", "greenlight-stream-offset-*")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(tmpDir)
+	defer os.Remove(filepath.Join(os.TempDir(), "greenlight-stream-test-offset-1.offset"))
 
 	transcriptPath := filepath.Join(tmpDir, "transcript.jsonl")
-	bridgePath := filepath.Join(tmpDir, "bridge")
+	os.WriteFile(transcriptPath, []byte(`{"n":1}`+"\n"+`{"n":2}`+"\n"+`{"n":3}`+"\n"), 0644)
+
+	stream := func(want int) {
+		t.Helper()
+		cmd := exec.Command(greenlightBin, "stream",
+			"--transcript", transcriptPath,
+			"--session-id", "test-offset-1",
+			"--device-id", "test-dev",
+			"--project", "test-proj",
+			"--relay-id", "relay-offset-1",
+			"--server", testServerURL.baseURL(),
+		)
+		cmd.Env = []string{
+			"HOME=" + os.Getenv("HOME"),
+			"PATH=" + os.Getenv("PATH"),
+			"TMPDIR=" + os.TempDir(),
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) && len(testServerURL.getRequests("/transcript")) < want {
+			time.Sleep(100 * time.Millisecond)
+		}
+		// Give a duplicate time to show up
+		time.Sleep(300 * time.Millisecond)
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
 
-	// Create bridge file
-	if err := os.WriteFile(bridgePath, nil, 0644); err != nil {
+	stream(3)
+
+	// A restarted streamer sends only what was appended since
+	f, err := os.OpenFile(transcriptPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
 		t.Fatal(err)
 	}
+	f.WriteString(`{"n":4}` + "\n" + `{"n":5}` + "\n")
+	f.Close()
 
-	// Write transcript lines before starting (streamer reads from beginning)
-	lines := []string{
-		`{"type":"message","content":"hello"}`,
-		`{"type":"message","content":"world"}`,
+	stream(5)
+
+	reqs := testServerURL.getRequests("/transcript")
+	if len(reqs) != 5 {
+		t.Fatalf("expected 5 transcript POSTs, got %d", len(reqs))
+	}
+	for i, req := range reqs {
+		var payload struct {
+			Seq  int64 `json:"seq"`
+			Data struct {
+				N int `json:"n"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(req.Body, &payload); err != nil {
+			t.Fatalf("invalid payload: %v\n%s", err, req.Body)
+		}
+		if payload.Data.N != i+1 {
+			t.Errorf("POST %d: expected line %d, got %d", i, i+1, payload.Data.N)
+		}
+		// Numbering carries on across the restart
+		if payload.Seq != int64(i+1) {
+			t.Errorf("POST %d: expected seq %d, got %d", i, i+1, payload.Seq)
+		}
 	}
-	if err := os.WriteFile(transcriptPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+}
+
+func TestIntegration_Stream_HTTPMode_BatchFallback(t *testing.T) {
+	testServerURL.clearHandlers()
+	testServerURL.setHandler("/transcript/batch", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+	})
+	defer testServerURL.clearHandlers()
+
+	tmpDir, err := os.MkdirTemp("", "greenlight-stream-batch-*")
+	if err != nil {
 		t.Fatal(err)
 	}
+	defer os.RemoveAll(tmpDir)
+
+	transcriptPath := filepath.Join(tmpDir, "transcript.jsonl")
+	lines := []string{
+		`{"type":"message","content":"line1"}`,
+		`{"type":"message","content":"line2"}`,
+		`{"type":"message","content":"line3"}`,
+	}
+	os.WriteFile(transcriptPath, []byte(strings.Join(lines, "\n")+"\n"), 0644)
 
-	// Start streamer
 	cmd := exec.Command(greenlightBin, "stream",
 		"--transcript", transcriptPath,
-		"--session-id", "test-stream-1",
-		"--relay-id", "relay-1",
-		"--bridge", bridgePath,
+		"--session-id", "test-batch-2",
+		"--device-id", "test-dev",
+		"--project", "test-proj",
+		"--relay-id", "relay-batch-2",
+		"--server", testServerURL.baseURL(),
+		"--batch-ms", "300",
 	)
 	cmd.Env = []string{
 		"HOME=" + os.Getenv("HOME"),
 		"PATH=" + os.Getenv("PATH"),
 		"TMPDIR=" + os.TempDir(),
 	}
-
 	if err := cmd.Start(); err != nil {
 		t.Fatal(err)
 	}
 
-	// Wait for the streamer to process the lines
-	deadline := time.Now().Add(5 * time.Second)
-	var bridgeContent string
-	for time.Now().Before(deadline) {
-		data, _ := os.ReadFile(bridgePath)
-		bridgeContent = string(data)
-		if strings.Contains(bridgeContent, "hello") && strings.Contains(bridgeContent, "world") {
-			break
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && len(testServerURL.getRequests("/transcript")) < len(lines) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	reqs := testServerURL.getRequests("/transcript")
+	if len(reqs) != len(lines) {
+		t.Fatalf("expected %d single-line POSTs after fallback, got %d", len(lines), len(reqs))
+	}
+	for i, req := range reqs {
+		var payload struct {
+			Data json.RawMessage `json:"data"`
+		}
+		json.Unmarshal(req.Body, &payload)
+		if string(payload.Data) != lines[i] {
+			t.Errorf("POST %d: expected %s, got %s", i, lines[i], payload.Data)
+		}
+	}
+}
+
+// ---------- stream — mutual TLS ----------
+
+// testPKI holds a throwaway CA plus server and client certificates
+// signed by it, written as PEM files under a temp dir.
+type testPKI struct {
+	caFile, clientCert, clientKey string
+	serverTLS                     *tls.Config
+}
+
+func newTestPKI(t *testing.T, dir string) *testPKI {
+	t.Helper()
+
+	newKey := func() *ecdsa.PrivateKey {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	writePEM := func(name, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	caKey := newKey()
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "greenlight test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	issue := func(serial int64, usage x509.ExtKeyUsage) ([]byte, *ecdsa.PrivateKey) {
+		key := newKey()
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "127.0.0.1"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der, key
+	}
+
+	serverDER, serverKey := issue(2, x509.ExtKeyUsageServerAuth)
+	clientDER, clientKey := issue(3, x509.ExtKeyUsageClientAuth)
+	clientKeyDER, _ := x509.MarshalECPrivateKey(clientKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	return &testPKI{
+		caFile:     writePEM("ca.pem", "CERTIFICATE", caDER),
+		clientCert: writePEM("client.pem", "CERTIFICATE", clientDER),
+		clientKey:  writePEM("client-key.pem", "EC PRIVATE KEY", clientKeyDER),
+		serverTLS: &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{serverDER}, PrivateKey: serverKey}},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		},
+	}
+}
+
+func TestIntegration_Stream_MutualTLS(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "greenlight-mtls-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	pki := newTestPKI(t, tmpDir)
+
+	var mu sync.Mutex
+	var received int
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/transcript" {
+			mu.Lock()
+			received++
+			mu.Unlock()
+		}
+		w.WriteHeader(200)
+	}))
+	srv.TLS = pki.serverTLS
+	srv.StartTLS()
+	defer srv.Close()
+
+	transcriptPath := filepath.Join(tmpDir, "transcript.jsonl")
+	os.WriteFile(transcriptPath, []byte(`{"type":"message","content":"mtls"}`+"\n"), 0644)
+
+	startStreamer := func(extraEnv ...string) *exec.Cmd {
+		cmd := exec.Command(greenlightBin, "stream",
+			"--transcript", transcriptPath,
+			"--session-id", "test-mtls-1",
+			"--device-id", "test-dev",
+			"--project", "test-proj",
+			"--relay-id", "relay-mtls-1",
+			"--server", srv.URL,
+		)
+		cmd.Env = append([]string{
+			"HOME=" + os.Getenv("HOME"),
+			"PATH=" + os.Getenv("PATH"),
+			"TMPDIR=" + os.TempDir(),
+			"GREENLIGHT_CA_CERT=" + pki.caFile,
+		}, extraEnv...)
+		return cmd
+	}
+
+	t.Run("without client cert", func(t *testing.T) {
+		cmd := startStreamer()
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(1 * time.Second)
+		cmd.Process.Kill()
+		cmd.Wait()
+
+		mu.Lock()
+		defer mu.Unlock()
+		if received != 0 {
+			t.Errorf("expected server to reject client without certificate, got %d requests", received)
+		}
+	})
+
+	t.Run("with client cert", func(t *testing.T) {
+		cmd := startStreamer(
+			"GREENLIGHT_CLIENT_CERT="+pki.clientCert,
+			"GREENLIGHT_CLIENT_KEY="+pki.clientKey,
+		)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			mu.Lock()
+			n := received
+			mu.Unlock()
+			if n > 0 {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+
+		mu.Lock()
+		defer mu.Unlock()
+		if received == 0 {
+			t.Error("expected transcript POST over mutual TLS")
+		}
+	})
+
+	t.Run("mismatched key", func(t *testing.T) {
+		cmd := startStreamer(
+			"GREENLIGHT_CLIENT_CERT="+pki.clientCert,
+			"GREENLIGHT_CLIENT_KEY="+pki.caFile,
+		)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err == nil {
+			t.Error("expected non-zero exit for unloadable key pair")
+		}
+		if !strings.Contains(stderr.String(), "client certificate") {
+			t.Errorf("expected client certificate error, got stderr=%q", stderr.String())
+		}
+	})
+}
+
+// ---------- proxy ----------
+
+// testProxy is a forward HTTP proxy that records what it was asked to
+// fetch: "METHOD /path" for proxied requests, "CONNECT host:port" for
+// tunnels.
+type testProxy struct {
+	*httptest.Server
+	mu   sync.Mutex
+	seen []string
+}
+
+func newTestProxy() *testProxy {
+	p := &testProxy{}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			p.record("CONNECT " + r.Host)
+			upstream, err := net.Dial("tcp", r.Host)
+			if err != nil {
+				w.WriteHeader(502)
+				return
+			}
+			client, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				upstream.Close()
+				return
+			}
+			client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+			go func() {
+				io.Copy(upstream, client)
+				upstream.Close()
+			}()
+			io.Copy(client, upstream)
+			client.Close()
+			return
+		}
+
+		p.record(r.Method + " " + r.URL.Path)
+		r.RequestURI = ""
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			w.WriteHeader(502)
+			return
 		}
-		time.Sleep(100 * time.Millisecond)
-	}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	return p
+}
 
-	cmd.Process.Kill()
-	cmd.Wait()
+func (p *testProxy) record(s string) {
+	p.mu.Lock()
+	p.seen = append(p.seen, s)
+	p.mu.Unlock()
+}
 
-	if !strings.Contains(bridgeContent, "hello") {
-		t.Errorf("expected 'hello' in bridge file, got %q", bridgeContent)
-	}
-	if !strings.Contains(bridgeContent, "world") {
-		t.Errorf("expected 'world' in bridge file, got %q", bridgeContent)
+func (p *testProxy) saw(s string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, x := range p.seen {
+		if x == s {
+			return true
+		}
 	}
+	return false
 }
 
-// ---------- stream — HTTP mode ----------
-
-func TestIntegration_Stream_HTTPMode(t *testing.T) {
+func TestIntegration_Proxy_HTTPRequests(t *testing.T) {
 	testServerURL.clearHandlers()
 
-	tmpDir, err := os.MkdirTemp("", "greenlight-stream-http-*")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer os.RemoveAll(tmpDir)
-
-	transcriptPath := filepath.Join(tmpDir, "transcript.jsonl")
+	proxy := newTestProxy()
+	defer proxy.Close()
 
-	// Write transcript lines
-	lines := []string{
-		`{"type":"message","content":"line1"}`,
-		`{"type":"message","content":"line2"}`,
+	relayID := fmt.Sprintf("relay-proxy-%d", time.Now().UnixNano())
+	defer os.Remove(filepath.Join(os.TempDir(), "greenlight-enrolled-"+relayID))
+	env := []string{
+		"GREENLIGHT_DEVICE_ID=test-dev",
+		"GREENLIGHT_PROJECT=test-proj",
+		"GREENLIGHT_SESSION_ID=" + relayID,
+		"GREENLIGHT_PROXY=" + proxy.URL,
 	}
-	if err := os.WriteFile(transcriptPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
-		t.Fatal(err)
+
+	// SessionStart enrolls the new session and reports activity
+	run(t, []string{"hook"}, env, `{"hook_event_name":"SessionStart"}`)
+	r := run(t, []string{"hook"}, env,
+		`{"hook_event_name":"PermissionRequest","tool_name":"Bash","tool_input":{"command":"ls"},"session_id":"s1"}`)
+	if !strings.Contains(r.Stdout, `"allow"`) {
+		t.Errorf("expected allow through the proxy, got stdout=%q stderr=%q", r.Stdout, r.Stderr)
 	}
 
+	tmpDir := t.TempDir()
+	transcriptPath := filepath.Join(tmpDir, "transcript.jsonl")
+	os.WriteFile(transcriptPath, []byte(`{"type":"message","content":"proxied"}`+"\n"), 0644)
 	cmd := exec.Command(greenlightBin, "stream",
 		"--transcript", transcriptPath,
-		"--session-id", "test-http-1",
+		"--session-id", "test-proxy-1",
 		"--device-id", "test-dev",
 		"--project", "test-proj",
-		"--relay-id", "relay-http-1",
+		"--relay-id", relayID,
 		"--server", testServerURL.baseURL(),
 	)
 	cmd.Env = []string{
 		"HOME=" + os.Getenv("HOME"),
 		"PATH=" + os.Getenv("PATH"),
 		"TMPDIR=" + os.TempDir(),
+		"GREENLIGHT_PROXY=" + proxy.URL,
 	}
-
 	if err := cmd.Start(); err != nil {
 		t.Fatal(err)
 	}
-
-	// Wait for transcript POSTs
 	deadline := time.Now().Add(5 * time.Second)
-	for time.Now().Before(deadline) {
-		reqs := testServerURL.getRequests("/transcript")
-		if len(reqs) >= 2 {
-			break
-		}
+	for time.Now().Before(deadline) && !proxy.saw("POST /transcript") {
 		time.Sleep(100 * time.Millisecond)
 	}
-
 	cmd.Process.Kill()
 	cmd.Wait()
 
-	reqs := testServerURL.getRequests("/transcript")
-	if len(reqs) < 2 {
-		t.Fatalf("expected at least 2 transcript POSTs, got %d", len(reqs))
+	for _, want := range []string{"POST /session/enroll", "POST /request", "POST /activity", "POST /transcript"} {
+		if !proxy.saw(want) {
+			t.Errorf("expected %s to go through the proxy, proxy saw %v", want, proxy.seen)
+		}
 	}
+}
 
-	// Check payload structure
-	var payload map[string]interface{}
-	json.Unmarshal(reqs[0].Body, &payload)
-	if payload["device_id"] != "test-dev" {
-		t.Errorf("expected device_id=test-dev, got %v", payload["device_id"])
-	}
-	if payload["session_id"] != "test-http-1" {
-		t.Errorf("expected session_id=test-http-1, got %v", payload["session_id"])
+func TestIntegration_Proxy_TLSTunnel(t *testing.T) {
+	tmpDir := t.TempDir()
+	pki := newTestPKI(t, tmpDir)
+
+	var mu sync.Mutex
+	var received int
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/transcript" {
+			mu.Lock()
+			received++
+			mu.Unlock()
+		}
+		w.WriteHeader(200)
+	}))
+	srv.TLS = pki.serverTLS
+	srv.StartTLS()
+	defer srv.Close()
+
+	proxy := newTestProxy()
+	defer proxy.Close()
+
+	transcriptPath := filepath.Join(tmpDir, "transcript.jsonl")
+	os.WriteFile(transcriptPath, []byte(`{"type":"message","content":"tunnel"}`+"\n"), 0644)
+
+	stream := func(extraEnv ...string) {
+		cmd := exec.Command(greenlightBin, "stream",
+			"--transcript", transcriptPath,
+			"--session-id", "test-tunnel-1",
+			"--device-id", "test-dev",
+			"--project", "test-proj",
+			"--relay-id", "relay-tunnel-1",
+			"--server", srv.URL,
+		)
+		cmd.Env = append([]string{
+			"HOME=" + os.Getenv("HOME"),
+			"PATH=" + os.Getenv("PATH"),
+			"TMPDIR=" + os.TempDir(),
+			"GREENLIGHT_PROXY=" + proxy.URL,
+			"GREENLIGHT_CLIENT_CERT=" + pki.clientCert,
+			"GREENLIGHT_CLIENT_KEY=" + pki.clientKey,
+		}, extraEnv...)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			mu.Lock()
+			n := received
+			mu.Unlock()
+			if n > 0 {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
 	}
-	if payload["data"] == nil {
-		t.Error("expected data field in transcript POST")
+
+	t.Run("untrusted server", func(t *testing.T) {
+		stream()
+		mu.Lock()
+		defer mu.Unlock()
+		if received != 0 {
+			t.Errorf("expected certificate verification to fail through the tunnel, got %d requests", received)
+		}
+	})
+
+	t.Run("trusted server", func(t *testing.T) {
+		stream("GREENLIGHT_CA_CERT=" + pki.caFile)
+		mu.Lock()
+		defer mu.Unlock()
+		if received == 0 {
+			t.Error("expected transcript POST through the CONNECT tunnel")
+		}
+	})
+
+	if !proxy.saw("CONNECT " + strings.TrimPrefix(srv.URL, "https://")) {
+		t.Errorf("expected a CONNECT tunnel to %s, proxy saw %v", srv.URL, proxy.seen)
 	}
 }
 
-func TestIntegration_Stream_HTTPMode_FatalError(t *testing.T) {
-	testServerURL.clearHandlers()
-	testServerURL.setHandler("/transcript", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(400)
-	})
-	defer testServerURL.clearHandlers()
+// ---------- stream — insecure skip verify ----------
 
-	tmpDir, err := os.MkdirTemp("", "greenlight-stream-fatal-*")
+func TestIntegration_Stream_InsecureSkipVerify(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "greenlight-insecure-*")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(tmpDir)
 
+	var mu sync.Mutex
+	var received int
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/transcript" {
+			mu.Lock()
+			received++
+			mu.Unlock()
+		}
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
 	transcriptPath := filepath.Join(tmpDir, "transcript.jsonl")
-	os.WriteFile(transcriptPath, []byte(`{"type":"msg"}`+"\n"), 0644)
+	os.WriteFile(transcriptPath, []byte(`{"type":"message","content":"insecure"}`+"\n"), 0644)
+
+	stream := func(extraEnv ...string) string {
+		mu.Lock()
+		received = 0
+		mu.Unlock()
+		cmd := exec.Command(greenlightBin, "stream",
+			"--transcript", transcriptPath,
+			"--session-id", "test-insecure-1",
+			"--device-id", "test-dev",
+			"--project", "test-proj",
+			"--relay-id", "relay-insecure-1",
+			"--server", srv.URL,
+		)
+		cmd.Env = append([]string{
+			"HOME=" + os.Getenv("HOME"),
+			"PATH=" + os.Getenv("PATH"),
+			"TMPDIR=" + os.TempDir(),
+		}, extraEnv...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			mu.Lock()
+			n := received
+			mu.Unlock()
+			if n > 0 {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+		return stderr.String()
+	}
 
-	cmd := exec.Command(greenlightBin, "stream",
-		"--transcript", transcriptPath,
-		"--session-id", "test-fatal-1",
-		"--device-id", "test-dev",
-		"--project", "test-proj",
-		"--relay-id", "relay-fatal-1",
-		"--server", testServerURL.baseURL(),
-	)
-	cmd.Env = []string{
-		"HOME=" + os.Getenv("HOME"),
-		"PATH=" + os.Getenv("PATH"),
-		"TMPDIR=" + os.TempDir(),
+	t.Run("verified by default", func(t *testing.T) {
+		stderr := stream()
+		mu.Lock()
+		defer mu.Unlock()
+		if received != 0 {
+			t.Errorf("expected certificate verification to fail, got %d requests", received)
+		}
+		if strings.Contains(stderr, "verification is disabled") {
+			t.Errorf("unexpected warning without GREENLIGHT_INSECURE_SKIP_VERIFY: %s", stderr)
+		}
+	})
+
+	t.Run("skipped with warning", func(t *testing.T) {
+		stderr := stream("GREENLIGHT_INSECURE_SKIP_VERIFY=1")
+		mu.Lock()
+		defer mu.Unlock()
+		if received == 0 {
+			t.Error("expected transcript POST with verification skipped")
+		}
+		if !strings.Contains(stderr, "WARNING: TLS certificate verification is disabled") {
+			t.Errorf("expected a warning on stderr, got: %s", stderr)
+		}
+	})
+}
+
+// ---------- hook — auth token ----------
+
+func TestIntegration_Hook_AuthToken(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	relayID := fmt.Sprintf("relay-token-%d", time.Now().UnixNano())
+	defer os.Remove(filepath.Join(os.TempDir(), "greenlight-enrolled-"+relayID))
+	env := []string{
+		"GREENLIGHT_DEVICE_ID=test-dev",
+		"GREENLIGHT_PROJECT=test-proj",
+		"GREENLIGHT_SESSION_ID=" + relayID,
+		"GREENLIGHT_TOKEN=s3cret",
+	}
+	run(t, []string{"hook"}, env, `{"hook_event_name":"SessionStart"}`)
+	run(t, []string{"hook"}, env, `{"hook_event_name":"PermissionRequest","tool_name":"Bash","tool_input":{"command":"ls"},"session_id":"s1"}`)
+
+	for _, path := range []string{"/session/enroll", "/activity", "/request"} {
+		reqs := testServerURL.getRequests(path)
+		if len(reqs) == 0 {
+			t.Errorf("expected a request to %s", path)
+			continue
+		}
+		if got := reqs[0].Header.Get("Authorization"); got != "Bearer s3cret" {
+			t.Errorf("%s: expected Authorization %q, got %q", path, "Bearer s3cret", got)
+		}
 	}
+}
 
-	done := make(chan error, 1)
-	cmd.Start()
-	go func() { done <- cmd.Wait() }()
+// ---------- hook — connected-only ----------
 
-	// Should exit on its own due to 400 error
-	select {
-	case <-done:
-		// good, streamer exited
-	case <-time.After(5 * time.Second):
-		cmd.Process.Kill()
-		t.Error("streamer did not exit on fatal 400 error")
+func TestIntegration_Hook_ConnectedOnly(t *testing.T) {
+	testServerURL.clearHandlers()
+
+	// A global hook firing in a session greenlight didn't start does nothing,
+	// even with no project configured
+	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","tool_input":{"command":"ls"},"session_id":"s1"}`
+	r := run(t, []string{"hook", "--connected-only"}, []string{"GREENLIGHT_DEVICE_ID=test-dev"}, input)
+	if r.ExitCode != 0 || r.Stdout != "" {
+		t.Errorf("expected silent exit 0, got exit %d stdout=%q", r.ExitCode, r.Stdout)
+	}
+	if reqs := testServerURL.getRequests("/request"); len(reqs) != 0 {
+		t.Errorf("expected no permission request, got %d", len(reqs))
+	}
+
+	// Under connect it behaves as usual
+	r = run(t, []string{"hook", "--connected-only"}, []string{
+		"GREENLIGHT_DEVICE_ID=test-dev",
+		"GREENLIGHT_PROJECT=test-proj",
+		"GREENLIGHT_SESSION_ID=relay-connected-only",
+	}, input)
+	if !strings.Contains(r.Stdout, `"allow"`) {
+		t.Errorf("expected allow decision under connect, got stdout=%q", r.Stdout)
 	}
 }
 
@@ -1543,6 +9642,212 @@ func TestIntegration_Hook_UnknownEvent(t *testing.T) {
 	}
 }
 
+// ---------- hook — async enrollment ----------
+
+func TestIntegration_Hook_AsyncEnrollPending(t *testing.T) {
+	testServerURL.clearHandlers()
+	testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"behavior":"allow"}`)
+	})
+	defer testServerURL.clearHandlers()
+
+	relayID := fmt.Sprintf("relay-async-%d", time.Now().UnixNano())
+	marker := filepath.Join(os.TempDir(), "greenlight-enrolled-"+relayID)
+	defer os.Remove(marker)
+
+	env := []string{
+		"GREENLIGHT_DEVICE_ID=test-dev",
+		"GREENLIGHT_PROJECT=test-proj",
+		"GREENLIGHT_SESSION_ID=" + relayID,
+		"GREENLIGHT_ASYNC_ENROLL=1",
+	}
+	input := `{"hook_event_name":"PermissionRequest","tool_name":"Bash","tool_input":{"command":"ls"},"session_id":"s1"}`
+
+	decision := func() map[string]interface{} {
+		t.Helper()
+		r := run(t, []string{"hook"}, env, input)
+		var output map[string]interface{}
+		if err := json.Unmarshal([]byte(r.Stdout), &output); err != nil {
+			t.Fatalf("expected JSON output, got %q", r.Stdout)
+		}
+		return output["hookSpecificOutput"].(map[string]interface{})["decision"].(map[string]interface{})
+	}
+
+	// Not approved yet: denied without asking the server
+	d := decision()
+	if d["behavior"] != "deny" {
+		t.Errorf("expected deny while enrollment is pending, got %v", d["behavior"])
+	}
+	if msg, _ := d["message"].(string); !strings.Contains(msg, "waiting for device approval") {
+		t.Errorf("expected waiting for approval message, got %q", msg)
+	}
+	if n := len(testServerURL.getRequests("/request")); n != 0 {
+		t.Errorf("expected no /request while pending, got %d", n)
+	}
+	if n := len(testServerURL.getRequests("/session/enroll")); n != 0 {
+		t.Errorf("expected the hook not to enroll itself, got %d enroll requests", n)
+	}
+
+	// Approved: requests flow normally
+	os.WriteFile(marker, nil, 0644)
+	if d := decision(); d["behavior"] != "allow" {
+		t.Errorf("expected allow once enrolled, got %v", d["behavior"])
+	}
+}
+
+// ---------- hook — local rules ----------
+
+func TestIntegration_Hook_LocalRules(t *testing.T) {
+	home := t.TempDir()
+	configDir := filepath.Join(home, ".greenlight")
+	os.MkdirAll(configDir, 0755)
+	rules := "# local rules\n" +
+		"allow Read\n" +
+		"allow Bash\n" +
+		"allow Grep TODO\n" +
+		"allow-compound Bash make( \\w+)? && make test\n" +
+		"deny Bash rm\\s+-rf.*\n" +
+		"deny * /etc/shadow\n"
+	os.WriteFile(filepath.Join(configDir, "rules"), []byte(rules), 0644)
+
+	for _, tc := range []struct {
+		name, tool, toolInput, want string
+		server                      bool
+	}{
+		{"allow tool", "Read", `{"file_path":"/tmp/x"}`, "allow", false},
+		{"deny pattern over allow", "Bash", `{"command":"rm -rf /"}`, "deny", false},
+		{"allow tool without deny match", "Bash", `{"command":"ls -la"}`, "allow", false},
+		{"deny any tool", "Edit", `{"file_path":"/etc/shadow"}`, "deny", false},
+		{"deny inside a command list", "Bash", `{"command":"cd /tmp && rm -rf x"}`, "deny", false},
+		{"allow needs the whole field", "Grep", `{"pattern":"TODO|FIXME"}`, "allow", true},
+		{"allow ignores other fields", "Grep", `{"pattern":"x","path":"TODO"}`, "allow", true},
+		{"allow skips command lists", "Bash", `{"command":"ls; curl example.com"}`, "allow", true},
+		{"allow-compound matches command lists", "Bash", `{"command":"make build && make test"}`, "allow", false},
+		{"no rule asks server", "Write", `{"file_path":"/tmp/x"}`, "allow", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testServerURL.clearHandlers()
+			testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"behavior":"allow"}`)
+			})
+			defer testServerURL.clearHandlers()
+
+			logFile := filepath.Join(t.TempDir(), "hook.log")
+			input := fmt.Sprintf(`{"hook_event_name":"PermissionRequest","tool_name":%q,"tool_input":%s,"session_id":"s1"}`, tc.tool, tc.toolInput)
+			r := run(t, []string{"hook"},
+				[]string{
+					"HOME=" + home,
+					"GREENLIGHT_LOG=" + logFile,
+					"GREENLIGHT_DEVICE_ID=test-dev",
+					"GREENLIGHT_PROJECT=test-proj",
+					"GREENLIGHT_NO_ENROLL=1",
+				}, input)
+
+			var output map[string]interface{}
+			if err := json.Unmarshal([]byte(r.Stdout), &output); err != nil {
+				t.Fatalf("expected JSON output, got %q", r.Stdout)
+			}
+			d := output["hookSpecificOutput"].(map[string]interface{})["decision"].(map[string]interface{})
+			if d["behavior"] != tc.want {
+				t.Errorf("expected %s, got %v", tc.want, d["behavior"])
+			}
+
+			n := len(testServerURL.getRequests("/request"))
+			logData, _ := os.ReadFile(logFile)
+			if tc.server {
+				if n != 1 {
+					t.Errorf("expected 1 /request, got %d", n)
+				}
+				return
+			}
+			if n != 0 {
+				t.Errorf("expected no /request for a rule match, got %d", n)
+			}
+			if !strings.Contains(string(logData), "by rule at "+filepath.Join(configDir, "rules")) {
+				t.Errorf("expected the matching rule to be logged, got %q", logData)
+			}
+		})
+	}
+
+	// A rule decides before the session is enrolled
+	testServerURL.clearHandlers()
+	defer testServerURL.clearHandlers()
+	r := run(t, []string{"hook"},
+		[]string{
+			"HOME=" + home,
+			"GREENLIGHT_DEVICE_ID=test-dev",
+			"GREENLIGHT_PROJECT=test-proj",
+			"GREENLIGHT_SESSION_ID=relay-rules-enroll",
+		}, `{"hook_event_name":"PermissionRequest","tool_name":"Read","tool_input":{"file_path":"/tmp/x"},"session_id":"s1","transcript_path":"/tmp/none.jsonl"}`)
+	if !strings.Contains(r.Stdout, `"allow"`) {
+		t.Errorf("expected allow, got %q", r.Stdout)
+	}
+	if n := len(testServerURL.getRequests("/session/enroll")); n != 0 {
+		t.Errorf("expected no enrollment for a rule match, got %d", n)
+	}
+}
+
+// ---------- hook — notification routing ----------
+
+func TestIntegration_Hook_NotificationRouting(t *testing.T) {
+	home := t.TempDir()
+	configDir := filepath.Join(home, ".greenlight")
+	os.MkdirAll(configDir, 0755)
+
+	for _, tc := range []struct {
+		name, config, notificationType, want string
+	}{
+		{"permission default", "", "permission_prompt", "/request"},
+		{"idle default", "", "idle_prompt", "/activity"},
+		{"unknown default", "", "auth_success", "/activity"},
+		{"configured type", `{"notification_routes":{"idle_prompt":"request"}}`, "idle_prompt", "/request"},
+		{"configured default", "notification_routes.default=request\n", "auth_success", "/request"},
+		{"configured over default", "notification_routes.default=request\nnotification_routes.permission_prompt=activity\n", "permission_prompt", "/activity"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testServerURL.clearHandlers()
+			os.WriteFile(filepath.Join(configDir, "config"), []byte(tc.config), 0644)
+
+			input := fmt.Sprintf(`{"hook_event_name":"Notification","notification_type":%q,"title":"Claude Code","message":"Waiting for input"}`, tc.notificationType)
+			r := run(t, []string{"hook"},
+				[]string{
+					"HOME=" + home,
+					"GREENLIGHT_DEVICE_ID=test-dev",
+					"GREENLIGHT_PROJECT=test-proj",
+					"GREENLIGHT_SESSION_ID=relay-notify-1",
+				}, input)
+			if r.ExitCode != 0 {
+				t.Fatalf("expected exit 0, got %d; stderr=%q", r.ExitCode, r.Stderr)
+			}
+
+			other := "/activity"
+			if tc.want == "/activity" {
+				other = "/request"
+			}
+			if reqs := testServerURL.getRequests(other); len(reqs) != 0 {
+				t.Errorf("expected nothing on %s, got %d requests", other, len(reqs))
+			}
+			reqs := testServerURL.getRequests(tc.want)
+			if len(reqs) != 1 {
+				t.Fatalf("expected 1 request on %s, got %d", tc.want, len(reqs))
+			}
+			var body map[string]interface{}
+			json.Unmarshal(reqs[0].Body, &body)
+			if body["tool_name"] != tc.notificationType {
+				t.Errorf("expected tool_name=%s, got %v", tc.notificationType, body["tool_name"])
+			}
+			if body["title"] != "Claude Code" || body["message"] != "Waiting for input" {
+				t.Errorf("expected title and message in payload, got %s", reqs[0].Body)
+			}
+			if tc.want == "/activity" && body["event"] != "notification" {
+				t.Errorf("expected event=notification, got %v", body["event"])
+			}
+		})
+	}
+}
+
 // ---------- hook — invalid JSON ----------
 
 func TestIntegration_Hook_InvalidJSON(t *testing.T) {
@@ -1564,6 +9869,74 @@ func TestIntegration_Hook_InvalidJSON(t *testing.T) {
 	}
 }
 
+func TestIntegration_Hook_TrailingData(t *testing.T) {
+	r := run(t, []string{"hook"},
+		[]string{
+			"GREENLIGHT_DEVICE_ID=test-dev",
+			"GREENLIGHT_PROJECT=test-proj",
+		}, `{"hook_event_name":"PermissionRequest","tool_name":"Bash"} {"tool_name":"Write"}`)
+
+	var output map[string]interface{}
+	if err := json.Unmarshal([]byte(r.Stdout), &output); err != nil {
+		t.Fatalf("expected JSON output, got %q", r.Stdout)
+	}
+	hso := output["hookSpecificOutput"].(map[string]interface{})
+	decision := hso["decision"].(map[string]interface{})
+	if decision["behavior"] != "deny" {
+		t.Errorf("expected deny for trailing data, got %v", decision["behavior"])
+	}
+}
+
+// ---------- hook — large permission request ----------
+
+func TestIntegration_Hook_LargeInput(t *testing.T) {
+	testServerURL.clearHandlers()
+	testServerURL.setHandler("/request", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"behavior":"allow"}`)
+	})
+	defer testServerURL.clearHandlers()
+
+	content := strings.Repeat("x", 4<<20)
+	input := fmt.Sprintf(`{"hook_event_name":"PermissionRequest","tool_name":"Write","tool_input":{"file_path":"big.txt","content":%q},"session_id":"s1"}`, content)
+	r := run(t, []string{"hook"},
+		[]string{
+			"GREENLIGHT_DEVICE_ID=test-dev",
+			"GREENLIGHT_PROJECT=test-proj",
+			"GREENLIGHT_SESSION_ID=relay-1",
+		}, input)
+
+	var output map[string]interface{}
+	if err := json.Unmarshal([]byte(r.Stdout), &output); err != nil {
+		t.Fatalf("expected JSON output, got %q", r.Stdout)
+	}
+	hso := output["hookSpecificOutput"].(map[string]interface{})
+	decision := hso["decision"].(map[string]interface{})
+	if decision["behavior"] != "allow" {
+		t.Errorf("expected allow, got %v", decision["behavior"])
+	}
+
+	reqs := testServerURL.getRequests("/request")
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 /request, got %d", len(reqs))
+	}
+	var payload struct {
+		DeviceID  string `json:"device_id"`
+		ToolInput struct {
+			Content string `json:"content"`
+		} `json:"tool_input"`
+	}
+	if err := json.Unmarshal(reqs[0].Body, &payload); err != nil {
+		t.Fatalf("parse /request body: %v", err)
+	}
+	if payload.DeviceID != "test-dev" {
+		t.Errorf("expected device_id test-dev, got %q", payload.DeviceID)
+	}
+	if payload.ToolInput.Content != content {
+		t.Errorf("expected %d bytes of tool_input content, got %d", len(content), len(payload.ToolInput.Content))
+	}
+}
+
 // ---------- hook — default event type ----------
 
 func TestIntegration_Hook_DefaultEventType(t *testing.T) {
@@ -0,0 +1,110 @@
+//go:build darwin || linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// runLogs prints the path of the greenlight log file, or with -f follows it
+// like tail -f. Without GREENLIGHT_LOG every process logs to its own
+// greenlight-<pid>.log in TMPDIR, so the most recently written one is used;
+// --all prints all of them, oldest first.
+func runLogs(args []string) {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	follow := fs.Bool("f", false, "Print the last lines of the log and keep printing new ones, like tail -f")
+	all := fs.Bool("all", false, "Print every greenlight-*.log in TMPDIR, oldest first")
+	fs.Parse(args)
+
+	if *follow && *all {
+		fmt.Fprintf(os.Stderr, "greenlight logs: -f and --all are mutually exclusive\n")
+		os.Exit(1)
+	}
+
+	// This command's own log is of no interest
+	if os.Getenv("GREENLIGHT_LOG") == "" {
+		log.SetOutput(io.Discard)
+		os.Remove(logPath())
+	}
+
+	if *all {
+		for _, path := range tmpLogFiles() {
+			f, err := os.Open(path)
+			if err != nil {
+				continue
+			}
+			fmt.Printf("==> %s <==\n", path)
+			io.Copy(os.Stdout, f)
+			f.Close()
+		}
+		return
+	}
+
+	path := os.Getenv("GREENLIGHT_LOG")
+	if path == "" {
+		files := tmpLogFiles()
+		if len(files) == 0 {
+			fmt.Fprintf(os.Stderr, "greenlight logs: no greenlight-*.log files in %s\n", os.TempDir())
+			os.Exit(1)
+		}
+		path = files[len(files)-1]
+	}
+
+	if !*follow {
+		fmt.Println(path)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight logs: %v\n", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	fmt.Fprintf(os.Stderr, "==> %s <==\n", path)
+	followFile(f, os.Stdout)
+}
+
+// tmpLogFiles returns the per-process log files in TMPDIR, oldest first.
+func tmpLogFiles() []string {
+	paths, _ := filepath.Glob(filepath.Join(os.TempDir(), "greenlight-*.log"))
+	mtimes := make(map[string]time.Time, len(paths))
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		mtimes[path] = info.ModTime()
+		files = append(files, path)
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return mtimes[files[i]].Before(mtimes[files[j]])
+	})
+	return files
+}
+
+// followFile copies the last lines of f to w, then keeps copying whatever
+// is appended until killed. If the file is truncated it starts again from
+// the beginning.
+func followFile(f *os.File, w io.Writer) {
+	seekToLastLines(f, 10)
+	for {
+		if _, err := io.Copy(w, f); err != nil {
+			fmt.Fprintf(os.Stderr, "greenlight logs: %v\n", err)
+			os.Exit(1)
+		}
+		time.Sleep(200 * time.Millisecond)
+		pos, _ := f.Seek(0, io.SeekCurrent)
+		if info, err := f.Stat(); err == nil && info.Size() < pos {
+			f.Seek(0, io.SeekStart)
+		}
+	}
+}
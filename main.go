@@ -4,9 +4,11 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 )
 
 // version is set at build time via -ldflags "-X main.version=..."
@@ -15,19 +17,16 @@ var version string
 // wsURL is the relay server URL, set at build time via:
 //
 //	go build -ldflags "-X main.wsURL=wss://permit.dnmfarrell.com/ws/relay" -o greenlight .
+//
+// GREENLIGHT_RELAY_URL or relay_url in the config file take its place if
+// set (see resolveRelayURL).
 var wsURL string
 
 func main() {
 	// Log to file to avoid polluting the terminal (which may be in raw mode)
-	if logPath := os.Getenv("GREENLIGHT_LOG"); logPath != "" {
-		if f, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err == nil {
-			log.SetOutput(f)
-		}
-	} else {
-		logPath = filepath.Join(os.TempDir(), fmt.Sprintf("greenlight-%d.log", os.Getpid()))
-		if f, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err == nil {
-			log.SetOutput(f)
-		}
+	if f, err := os.OpenFile(logPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err == nil {
+		logOutput = f
+		log.SetOutput(f)
 	}
 
 	if len(os.Args) < 2 {
@@ -38,12 +37,30 @@ func main() {
 	switch os.Args[1] {
 	case "connect":
 		runConnect(os.Args[2:])
+	case "run":
+		runRun(os.Args[2:])
+	case "attach":
+		runAttach(os.Args[2:])
 	case "hook":
 		runHook(os.Args[2:])
 	case "stream":
 		runStream(os.Args[2:])
 	case "register":
 		runRegister(os.Args[2:])
+	case "uninstall":
+		runUninstall(os.Args[2:])
+	case "logs":
+		runLogs(os.Args[2:])
+	case "status":
+		runStatus(os.Args[2:])
+	case "sessions":
+		runSessions(os.Args[2:])
+	case "config":
+		runConfig(os.Args[2:])
+	case "config-path":
+		runConfigPath(os.Args[2:])
+	case "ws-replay":
+		runWSReplay(os.Args[2:])
 	case "version", "--version", "-v":
 		printVersion()
 	case "help", "--help", "-h":
@@ -55,12 +72,43 @@ func main() {
 	}
 }
 
+// logOutput is where the log goes, normally the log file.
+var logOutput io.Writer = os.Stderr
+
+// verboseLogs reports whether a command's log should also be written
+// elsewhere: its --verbose flag, or GREENLIGHT_VERBOSE set to true.
+func verboseLogs(flagValue bool) bool {
+	if flagValue {
+		return true
+	}
+	b, _ := strconv.ParseBool(os.Getenv("GREENLIGHT_VERBOSE"))
+	return b
+}
+
+// mirrorLogs writes the log to w as well as to the log file. Commands that
+// use the terminal in raw mode must not mirror to stderr.
+func mirrorLogs(w io.Writer) {
+	if logOutput == os.Stderr && w == os.Stderr {
+		return
+	}
+	log.SetOutput(io.MultiWriter(logOutput, w))
+}
+
+// logPath returns the log file for this process: GREENLIGHT_LOG if set,
+// otherwise greenlight-<pid>.log in TMPDIR.
+func logPath() string {
+	if p := os.Getenv("GREENLIGHT_LOG"); p != "" {
+		return p
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("greenlight-%d.log", os.Getpid()))
+}
+
 func printVersion() {
 	v := version
 	if v == "" {
 		v = "dev"
 	}
-	fmt.Fprintf(os.Stderr, "greenlight %s (relay: %s)\n", v, wsURL)
+	fmt.Fprintf(os.Stderr, "greenlight %s (relay: %s)\n", v, displayRelayURL(""))
 }
 
 func printUsage() {
@@ -73,11 +121,20 @@ func printUsage() {
 Usage: greenlight <command> [flags]
 
 Commands:
-  connect    Start Claude Code with a remote relay to the Greenlight app
-  register   Register a device ID for the Greenlight app
-  hook       Handle Claude Code hook events (used by hooks, not called directly)
-  version    Print version and build settings
+  connect      Start Claude Code with a remote relay to the Greenlight app
+  run          Run Claude Code headlessly with one prompt and print its output
+  attach       Join an existing relay session as a viewer/controller
+  register     Register a device ID for the Greenlight app
+  uninstall    Remove greenlight hooks from Claude Code settings
+  status       Show settings, running streamers and enrolled sessions
+  sessions     List, prune or clear stored conversation → relay mappings
+  logs         Print the log file path, or follow it with -f
+  config       Get, set or list config file settings
+  config-path  Print the location of the config file
+  ws-replay    Replay the inbound frames of a GREENLIGHT_WS_CAPTURE file
+  hook         Handle Claude Code hook events (used by hooks, not called directly)
+  version      Print version and build settings
 
 Run 'greenlight <command> --help' for details on a command.
-`, v, wsURL)
+`, v, displayRelayURL(""))
 }
@@ -0,0 +1,133 @@
+//go:build darwin || linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Process-wide metrics served by --metrics-addr. The WebSocket counters
+// live on the WSClient; these cover the rest of the process.
+var (
+	// transcriptLinesPosted counts transcript lines the server accepted
+	// from `greenlight stream` in HTTP mode.
+	transcriptLinesPosted atomic.Int64
+
+	// requestLatency times every HTTP request to the server.
+	requestLatency = newHistogram([]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60})
+)
+
+// histogram is a fixed-bucket histogram in the Prometheus style: each
+// bucket counts observations less than or equal to its upper bound.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// write prints the histogram in the Prometheus text format.
+func (h *histogram) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cum uint64
+	for i, b := range h.bounds {
+		cum += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(b, 'g', -1, 64), cum)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// metricsHandler serves /metrics. ws may be nil, e.g. for `greenlight
+// stream`, in which case the WebSocket metrics read zero.
+func metricsHandler(ws *WSClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var reconnects, dropped, lines int64
+		var queued int
+		if ws != nil {
+			if n := ws.connects.Load(); n > 1 {
+				reconnects = n - 1
+			}
+			dropped = ws.framesDropped.Load()
+			lines = ws.transcriptLines.Load()
+			ws.textMu.Lock()
+			queued = len(ws.textQueue)
+			ws.textMu.Unlock()
+		}
+		lines += transcriptLinesPosted.Load()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetric(w, "greenlight_ws_reconnects_total", "counter", "Reconnections to the relay after the first connection.", reconnects)
+		writeMetric(w, "greenlight_ws_dropped_frames_total", "counter", "Frames dropped because the relay was unreachable or the text queue was full.", dropped)
+		writeMetric(w, "greenlight_text_queue_depth", "gauge", "Text frames queued for delivery when the relay is reachable again.", int64(queued))
+		writeMetric(w, "greenlight_transcript_lines_sent_total", "counter", "Transcript lines sent to the relay or server.", lines)
+		requestLatency.write(w, "greenlight_request_latency_seconds", "Latency of HTTP requests to the server.")
+	}
+}
+
+func writeMetric(w io.Writer, name, typ, help string, v int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, typ, name, v)
+}
+
+// startMetricsServer serves /metrics on addr until the returned stop
+// function is called. An address without a host, such as ":9100", binds
+// to localhost only.
+func startMetricsServer(addr string, ws *WSClient) (stop func(), err error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics address %q: %w", addr, err)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(ws))
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("metrics: %v", err)
+		}
+	}()
+	log.Printf("metrics: serving on http://%s/metrics", ln.Addr())
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}, nil
+}
@@ -0,0 +1,193 @@
+//go:build darwin || linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultStatusKeys toggles the status overlay: Ctrl-G pressed twice.
+const defaultStatusKeys = "^G^G"
+
+// statusKeyTimeout is how long a partial trigger sequence is held back
+// before being passed through to the child.
+const statusKeyTimeout = 300 * time.Millisecond
+
+// parseKeySequence converts caret notation (e.g. "^G^G") into raw bytes.
+// Characters not preceded by '^' are taken literally.
+func parseKeySequence(s string) ([]byte, error) {
+	var seq []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '^' {
+			seq = append(seq, s[i])
+			continue
+		}
+		if i+1 >= len(s) {
+			return nil, fmt.Errorf("invalid key sequence %q: trailing '^'", s)
+		}
+		i++
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z':
+			seq = append(seq, c-'a'+1)
+		case c >= '@' && c <= '_':
+			seq = append(seq, c-'@')
+		case c == '?':
+			seq = append(seq, 0x7f)
+		default:
+			return nil, fmt.Errorf("invalid key sequence %q: bad control character ^%c", s, c)
+		}
+	}
+	return seq, nil
+}
+
+// keyMatcher finds a trigger sequence in the stdin byte stream. Bytes that
+// may begin the sequence are held back until it either completes or fails
+// to match, so a sequence split across reads is still recognized.
+type keyMatcher struct {
+	seq  []byte
+	fail []int // fail[i]: longest proper prefix of seq[:i+1] that is also its suffix
+
+	mu      sync.Mutex
+	matched int // number of leading seq bytes currently held back
+}
+
+func newKeyMatcher(seq []byte) *keyMatcher {
+	fail := make([]int, len(seq))
+	for i, k := 1, 0; i < len(seq); i++ {
+		for k > 0 && seq[i] != seq[k] {
+			k = fail[k-1]
+		}
+		if seq[i] == seq[k] {
+			k++
+		}
+		fail[i] = k
+	}
+	return &keyMatcher{seq: seq, fail: fail}
+}
+
+// filter returns the bytes of data that should be passed through to the
+// child, along with the number of times the trigger sequence completed.
+func (m *keyMatcher) filter(data []byte) (out []byte, triggers int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, b := range data {
+		// On a mismatch, fall back to the longest held suffix that is
+		// still a prefix of seq, releasing the bytes in front of it.
+		k := m.matched
+		for k > 0 && b != m.seq[k] {
+			k = m.fail[k-1]
+		}
+		out = append(out, m.seq[:m.matched-k]...)
+		if b != m.seq[k] {
+			m.matched = 0
+			out = append(out, b)
+			continue
+		}
+		m.matched = k + 1
+		if m.matched == len(m.seq) {
+			m.matched = 0
+			triggers++
+		}
+	}
+	return out, triggers
+}
+
+// pending reports whether a partial match is being held back.
+func (m *keyMatcher) pending() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.matched > 0
+}
+
+// flush releases any held bytes of a partial match.
+func (m *keyMatcher) flush() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := append([]byte(nil), m.seq[:m.matched]...)
+	m.matched = 0
+	return out
+}
+
+// toggleStatus shows the status overlay on the bottom line of the local
+// terminal, or hides it if already shown. The child is sent SIGWINCH on
+// hide so it repaints the line the overlay covered.
+func (r *Relay) toggleStatus() {
+	// Back-to-back triggers each start a toggle; run them one at a time
+	// so each show or hide is drawn whole before the next begins.
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+
+	line := r.statusLine()
+
+	r.outMu.Lock()
+	defer r.outMu.Unlock()
+
+	ws, err := getWinsize(os.Stdin.Fd())
+	if err != nil || ws.Row == 0 {
+		return
+	}
+
+	// Save cursor, jump to the last row, clear it, draw, restore cursor.
+	var b strings.Builder
+	b.WriteString("\x1b7")
+	fmt.Fprintf(&b, "\x1b[%d;1H\x1b[2K", ws.Row)
+	if !r.statusShown {
+		if ws.Col > 0 && len(line) > int(ws.Col) {
+			line = line[:ws.Col]
+		}
+		b.WriteString("\x1b[7m" + line + "\x1b[0m")
+	}
+	b.WriteString("\x1b8")
+	os.Stdout.WriteString(b.String())
+
+	if r.statusShown && r.cmd.Process != nil {
+		r.cmd.Process.Signal(syscall.SIGWINCH)
+	}
+	r.statusShown = !r.statusShown
+}
+
+// statusLine builds the one-line overlay text. It has no viewer count:
+// the relay doesn't tell the agent side who is attached, only forwarding
+// their input and control frames.
+func (r *Relay) statusLine() string {
+	parts := []string{"greenlight"}
+	if r.ws == nil {
+		parts = append(parts, "relay: off")
+	} else if !r.ws.Connected() {
+		parts = append(parts, "relay: disconnected")
+	} else {
+		parts = append(parts, "relay: connected")
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if rtt, err := r.ws.Ping(ctx); err == nil {
+			parts = append(parts, fmt.Sprintf("latency %dms", rtt.Milliseconds()))
+		}
+		cancel()
+	}
+	if r.ws != nil {
+		parts = append(parts,
+			"sent "+formatBytes(r.ws.bytesSent.Load()),
+			"recv "+formatBytes(r.ws.bytesRecv.Load()))
+	}
+	parts = append(parts, "up "+time.Since(r.started).Round(time.Second).String())
+	return " " + strings.Join(parts, " | ") + " "
+}
+
+// formatBytes renders n as a short human-readable size.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
@@ -0,0 +1,195 @@
+//go:build darwin || linux
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// pane is an additional child process with its own PTY, relayed over the
+// same WebSocket as the primary child. Panes are headless: their output is
+// only sent to the relay, and their input only comes from the relay.
+// The primary child is pane 0; additional panes are numbered from 1.
+type pane struct {
+	id     int
+	cmd    *exec.Cmd
+	master *os.File
+	mu     sync.Mutex // serializes writes to master
+
+	injectCh chan []byte
+}
+
+// paneFrame is the text frame carrying a pane's output when more than one
+// pane is relayed: {"type":"output","pane":1,"data":"<base64>"}
+type paneFrame struct {
+	Type string `json:"type"`
+	Pane int    `json:"pane"`
+	Data string `json:"data"`
+}
+
+// selectPaneFrame is a control frame from the relay choosing which pane
+// receives remote input: {"type":"select_pane","pane":1}
+type selectPaneFrame struct {
+	Type string `json:"type"`
+	Pane *int   `json:"pane"`
+}
+
+// AddPane registers an additional command to run in its own PTY alongside
+// the primary child. Must be called before Run.
+func (r *Relay) AddPane(command string, args []string) error {
+	master, slave, err := openPTY()
+	if err != nil {
+		return fmt.Errorf("openPTY: %w", err)
+	}
+
+	cmd := exec.Command(command, args...)
+	cmd.Env = r.cmd.Env
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid:  true,
+		Setctty: true,
+		Ctty:    3,
+	}
+	cmd.ExtraFiles = []*os.File{slave}
+
+	r.panes = append(r.panes, &pane{
+		id:       len(r.panes) + 1,
+		cmd:      cmd,
+		master:   master,
+		injectCh: make(chan []byte, injectQueueSize),
+	})
+	r.paneSlaves = append(r.paneSlaves, slave)
+
+	if r.ws != nil {
+		r.ws.selectPane = r.selectPane
+	}
+	return nil
+}
+
+// startPanes starts the additional panes and their I/O loops.
+func (r *Relay) startPanes() {
+	for i, p := range r.panes {
+		if ws, err := getWinsize(os.Stdin.Fd()); err == nil {
+			setWinsize(p.master.Fd(), ws)
+		}
+		err := p.cmd.Start()
+		r.paneSlaves[i].Close()
+		if err != nil {
+			log.Printf("pane %d: start: %v", p.id, err)
+			continue
+		}
+		p := p
+		r.spawn(func() { p.injectLoop(r.done) })
+		r.spawn(func() { r.paneOutputLoop(p) })
+	}
+	r.paneSlaves = nil
+}
+
+// stopPanes hangs up the additional panes once the primary child exits.
+func (r *Relay) stopPanes() {
+	for _, p := range r.panes {
+		if p.cmd.Process != nil {
+			p.cmd.Process.Signal(syscall.SIGHUP)
+			exited := make(chan struct{})
+			go func() {
+				p.cmd.Wait()
+				close(exited)
+			}()
+			select {
+			case <-exited:
+			case <-time.After(2 * time.Second):
+				p.cmd.Process.Kill()
+				<-exited
+			}
+		}
+		p.master.Close()
+	}
+}
+
+// paneOutputLoop relays a pane's output until its PTY closes.
+func (r *Relay) paneOutputLoop(p *pane) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := p.master.Read(buf)
+		if n > 0 && r.ws != nil {
+			r.ws.SendPane(p.id, buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// injectLoop writes queued remote input to the pane until done is closed.
+func (p *pane) injectLoop(done <-chan struct{}) {
+	for {
+		select {
+		case data := <-p.injectCh:
+			p.mu.Lock()
+			err := writeAll(p.master, data)
+			p.mu.Unlock()
+			if err != nil {
+				log.Printf("pane %d: inject write error: %v", p.id, err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// selectPane sets which pane receives remote input. Returns false if there
+// is no such pane.
+func (r *Relay) selectPane(id int) bool {
+	if id < 0 || id > len(r.panes) {
+		return false
+	}
+	r.activePane.Store(int32(id))
+	return true
+}
+
+// injectRemote routes remote input to the selected pane.
+func (r *Relay) injectRemote(data []byte) error {
+	r.noteInput(inputRemote)
+	id := int(r.activePane.Load())
+	if id == 0 {
+		return r.Inject(data)
+	}
+	p := r.panes[id-1]
+	cp := make([]byte, len(data))
+	copy(cp, data)
+	select {
+	case p.injectCh <- cp:
+		return nil
+	default:
+		return errInjectQueueFull
+	}
+}
+
+// parseSelectPane reports whether data is a select_pane control frame.
+func parseSelectPane(data []byte) (int, bool) {
+	var f selectPaneFrame
+	if err := json.Unmarshal(data, &f); err != nil || f.Type != "select_pane" || f.Pane == nil {
+		return 0, false
+	}
+	return *f.Pane, true
+}
+
+// encodePaneFrame builds the text frame for a chunk of pane output.
+func encodePaneFrame(id int, data []byte) []byte {
+	b, _ := json.Marshal(paneFrame{
+		Type: "output",
+		Pane: id,
+		Data: base64.StdEncoding.EncodeToString(data),
+	})
+	return b
+}
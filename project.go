@@ -0,0 +1,40 @@
+//go:build darwin || linux
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxProjectLength is the longest project name accepted.
+const maxProjectLength = 128
+
+// normalizeProject trims surrounding whitespace from a project name and
+// checks that it is valid: one or more segments of letters, digits, '.',
+// '_' or '-', separated by '/' for namespaces (e.g. "team/app").
+func normalizeProject(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if len(name) > maxProjectLength {
+		return "", fmt.Errorf("invalid project name %q: longer than %d characters", name, maxProjectLength)
+	}
+	for _, seg := range strings.Split(name, "/") {
+		if seg == "" {
+			return "", fmt.Errorf("invalid project name %q: empty namespace segment", name)
+		}
+		if seg == "." || seg == ".." {
+			return "", fmt.Errorf("invalid project name %q: %q is not allowed as a segment", name, seg)
+		}
+		for _, c := range seg {
+			if !isProjectChar(c) {
+				return "", fmt.Errorf("invalid project name %q: character %q not allowed (use letters, digits, '.', '_', '-' and '/')", name, c)
+			}
+		}
+	}
+	return name, nil
+}
+
+func isProjectChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '.' || c == '_' || c == '-'
+}
@@ -84,3 +84,11 @@ func setWinsize(fd uintptr, ws *Winsize) error {
 	}
 	return nil
 }
+
+func getForegroundPgrp(fd uintptr) (int, error) {
+	var pgrp int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgrp))); errno != 0 {
+		return 0, errno
+	}
+	return int(pgrp), nil
+}
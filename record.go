@@ -0,0 +1,322 @@
+//go:build darwin || linux
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// recorder writes the child's output to a file in asciicast v2 format
+// (connect --record), replayable with "asciinema play". A nil *recorder
+// records nothing.
+//
+// With a size cap (--record-max-size), a segment that would grow past it
+// is renamed to <path>.1, <path>.2 and so on, oldest first, optionally
+// gzipped, and recording carries on in a new file at path. Every segment
+// starts with its own header and times, so each replays on its own.
+type recorder struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File
+	start  time.Time
+	width  int
+	height int
+
+	maxSize  int64 // 0: never rotate
+	compress bool
+	size     int64 // bytes in the active segment
+	hdrSize  int64 // of which the header
+	segments int   // rotated so far
+
+	// Trailing bytes of an incomplete UTF-8 sequence, held until the
+	// rest arrives so it isn't mangled when encoded as a JSON string.
+	partial []byte
+
+	// The first write error. Later events are dropped, and close returns
+	// it: event can't log it, since with --verbose the log writes into
+	// the recording and would re-enter r.mu.
+	err error
+}
+
+// castHeader is the first line of an asciicast v2 file.
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// newRecorder creates the recording at path and writes its header, sized
+// to the current terminal (80x24 if stdin isn't one). A maxSize above 0
+// turns on rotation, with rotated segments gzipped if compress is set;
+// segments left at path by an earlier recording are removed.
+func newRecorder(path string, maxSize int64, compress bool) (*recorder, error) {
+	rec := &recorder{path: path, width: 80, height: 24, maxSize: maxSize, compress: compress}
+	if ws, err := getWinsize(os.Stdin.Fd()); err == nil && ws.Col > 0 && ws.Row > 0 {
+		rec.width, rec.height = int(ws.Col), int(ws.Row)
+	}
+	if maxSize > 0 {
+		removeSegments(path)
+	}
+	if err := rec.open(); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// open starts a segment at r.path: it creates the file and writes a
+// header for the current terminal size. Caller holds r.mu, or owns r.
+func (r *recorder) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	r.start = time.Now()
+	hdr := castHeader{
+		Version:   2,
+		Width:     r.width,
+		Height:    r.height,
+		Timestamp: r.start.Unix(),
+	}
+	if term := os.Getenv("TERM"); term != "" {
+		hdr.Env = map[string]string{"TERM": term}
+	}
+	line, _ := json.Marshal(hdr)
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = int64(len(line) + 1)
+	r.hdrSize = r.size
+	return nil
+}
+
+// segmentPath returns the name of the nth rotated segment, before any
+// gzip.
+func (r *recorder) segmentPath(n int) string {
+	return fmt.Sprintf("%s.%d", r.path, n)
+}
+
+// removeSegments removes the rotated segments of a recording at path:
+// path.N and path.N.gz.
+func removeSegments(path string) {
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	prefix := filepath.Base(path) + "."
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		n := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".gz")
+		if _, err := strconv.Atoi(n); err == nil {
+			os.Remove(filepath.Join(filepath.Dir(path), name))
+		}
+	}
+}
+
+// rotate moves the active segment to the next segment name, gzipping it
+// if asked, and opens a new one. Caller holds r.mu.
+func (r *recorder) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.segments++
+	seg := r.segmentPath(r.segments)
+	if err := os.Rename(r.path, seg); err != nil {
+		return err
+	}
+	if r.compress {
+		if err := gzipFile(seg); err != nil {
+			return err
+		}
+	}
+	return r.open()
+}
+
+// gzipFile compresses path to path.gz and removes path.
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// parseByteSize parses a size in bytes with an optional K, M or G suffix
+// (powers of 1024), as in "512K" or "10M".
+func parseByteSize(s string) (int64, error) {
+	mult := int64(1)
+	num := strings.TrimSpace(s)
+	if num != "" {
+		switch strings.ToUpper(num[len(num)-1:]) {
+		case "K":
+			mult = 1 << 10
+		case "M":
+			mult = 1 << 20
+		case "G":
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			num = num[:len(num)-1]
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q: want bytes, optionally with a K, M or G suffix", s)
+	}
+	return n * mult, nil
+}
+
+// output records a chunk of the child's output.
+func (r *recorder) output(data []byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	buf := append(r.partial, data...)
+	cut := len(buf) - incompleteUTF8Tail(buf)
+	r.partial = append([]byte(nil), buf[cut:]...)
+	if cut > 0 {
+		r.event("o", string(buf[:cut]))
+	}
+}
+
+// input records input sent to the child from the app, as an asciicast
+// input event, which players don't display.
+func (r *recorder) input(data []byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event("i", string(data))
+}
+
+// resize records a terminal size change.
+func (r *recorder) resize(ws *Winsize) {
+	if r == nil || ws == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if int(ws.Col) == r.width && int(ws.Row) == r.height {
+		return
+	}
+	r.width, r.height = int(ws.Col), int(ws.Row)
+	r.event("r", fmt.Sprintf("%dx%d", r.width, r.height))
+}
+
+// marker records a marker event, shown as a chapter mark by players that
+// support them.
+func (r *recorder) marker(label string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event("m", label)
+}
+
+// recorderLog writes each log line into a recording as a marker (connect
+// --verbose), since the terminal can't show it.
+type recorderLog struct {
+	r *recorder
+}
+
+func (w recorderLog) Write(p []byte) (int, error) {
+	w.r.marker(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// event writes one [time, code, data] line, first rotating the segment
+// if the line would take it past the size cap. A segment always gets at
+// least one event, however large. Caller holds r.mu.
+func (r *recorder) event(code, data string) {
+	if r.err != nil {
+		return
+	}
+	line, _ := json.Marshal([]interface{}{time.Since(r.start).Seconds(), code, data})
+	if r.maxSize > 0 && r.size > r.hdrSize && r.size+int64(len(line)+1) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			r.err = err
+			return
+		}
+		line, _ = json.Marshal([]interface{}{time.Since(r.start).Seconds(), code, data})
+	}
+	n, err := r.f.Write(append(line, '\n'))
+	r.size += int64(n)
+	if err != nil {
+		r.err = err
+	}
+}
+
+// close flushes any held bytes and closes the recording, returning the
+// first error writing it. With --verbose, the log must stop writing into
+// the recording first.
+func (r *recorder) close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.partial) > 0 {
+		r.event("o", string(r.partial))
+		r.partial = nil
+	}
+	err := r.f.Close()
+	if r.err != nil {
+		err = r.err
+	}
+	r.err = os.ErrClosed
+	return err
+}
+
+// incompleteUTF8Tail returns the length of an incomplete UTF-8 sequence at
+// the end of b, or 0 if b ends on a rune boundary.
+func incompleteUTF8Tail(b []byte) int {
+	for i := 1; i <= utf8.UTFMax-1 && i <= len(b); i++ {
+		c := b[len(b)-i]
+		if c < 0x80 {
+			return 0 // ASCII
+		}
+		if utf8.RuneStart(c) {
+			if utf8.FullRune(b[len(b)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
@@ -23,21 +23,20 @@ func runRegister(args []string) {
 		os.Exit(1)
 	}
 
-	home, err := os.UserHomeDir()
+	path, err := configPath()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: cannot determine home directory: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error: cannot determine config path: %v\n", err)
 		os.Exit(1)
 	}
 
-	configDir := filepath.Join(home, ".greenlight")
+	configDir := filepath.Dir(path)
 	if err := os.MkdirAll(configDir, 0755); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: cannot create %s: %v\n", configDir, err)
 		os.Exit(1)
 	}
 
-	configPath := filepath.Join(configDir, "config")
-	if err := os.WriteFile(configPath, []byte("device_id="+deviceID+"\n"), 0644); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: cannot write %s: %v\n", configPath, err)
+	if err := os.WriteFile(path, []byte("device_id="+deviceID+"\n"), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: cannot write %s: %v\n", path, err)
 		os.Exit(1)
 	}
 
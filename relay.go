@@ -4,15 +4,34 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
 	"os/exec"
 	"os/signal"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
+// injectQueueSize is the max number of remote input writes buffered for the
+// PTY. When the child stops reading, further injected input is dropped
+// rather than blocking the WebSocket read loop.
+const injectQueueSize = 256
+
+// stdinBufSize is the read size for keyboard input, large enough that a
+// typical paste reaches the child in a few writes rather than hundreds.
+const stdinBufSize = 4096
+
+// errInjectQueueFull is returned by Inject when the input queue is full.
+var errInjectQueueFull = errors.New("inject queue full (child not reading input)")
+
 // Relay holds the state for a running PTY relay session.
 type Relay struct {
 	cmd         *exec.Cmd
@@ -20,7 +39,64 @@ type Relay struct {
 	slave       *os.File
 	origTermios syscall.Termios
 	mu          sync.Mutex // serializes writes to master
+	outMu       sync.Mutex // serializes writes to stdout
 	ws          *WSClient  // optional WebSocket client
+	started     time.Time
+
+	// Remote input waiting to be written to the master by injectLoop.
+	injectCh chan []byte
+	done     chan struct{} // closed when Run returns
+	exited   chan struct{} // closed once the child has been reaped
+
+	// Status overlay, toggled by statusKeys in the stdin stream.
+	// statusKeys is nil when the overlay is disabled.
+	statusKeys  *keyMatcher
+	statusShown bool       // protected by outMu
+	statusMu    sync.Mutex // serializes toggleStatus
+
+	// suspendOnCtrlZ makes Ctrl-Z suspend greenlight itself rather than
+	// being passed through to the child. Only safe with shell job control.
+	suspendOnCtrlZ bool
+
+	// tstpCh receives SIGTSTP sent to greenlight itself (e.g. "kill -TSTP"
+	// or a stop key when the outer terminal isn't in raw mode), which is
+	// handled like an intercepted Ctrl-Z.
+	tstpCh chan os.Signal
+
+	// Additional headless panes (see AddPane) and the pane that remote
+	// input is routed to; 0 is the primary child.
+	panes      []*pane
+	paneSlaves []*os.File // closed once the panes start
+	activePane atomic.Int32
+
+	// recorder, if set, saves the child's output (connect --record).
+	recorder *recorder
+
+	// titles finds terminal title changes in the child's output so they
+	// can be relayed. Only used by the output copier goroutine.
+	titles titleParser
+
+	// inputSource is where input last came from, so changes can be
+	// reported (see noteInput).
+	inputSource atomic.Int32
+
+	// onRemoteInput, if set, is called when input from the relay follows
+	// input from the local keyboard, or is the first input of the session.
+	onRemoteInput func()
+
+	// killGrace is how long the child gets to exit after SIGHUP or
+	// SIGTERM before it is killed (see killAfterGrace).
+	killGrace time.Duration
+
+	// idleTimeout, if positive, stops the child once there has been no
+	// input or output for that long (connect --idle-timeout).
+	idleTimeout  time.Duration
+	lastActivity atomic.Int64 // UnixNano of the last input or output
+	idledOut     atomic.Bool
+
+	// requestPending, if set, reports whether a permission request is
+	// waiting for an answer, which keeps the idle timeout from firing.
+	requestPending func() bool
 }
 
 // New creates a new Relay that will run the given command inside a PTY.
@@ -40,13 +116,18 @@ func New(command string, args []string, wsURL, wsToken string, wsMode WSMode, ex
 	}
 
 	r := &Relay{
-		cmd:    cmd,
-		master: master,
-		slave:  slave,
+		cmd:       cmd,
+		master:    master,
+		slave:     slave,
+		injectCh:  make(chan []byte, injectQueueSize),
+		done:      make(chan struct{}),
+		exited:    make(chan struct{}),
+		killGrace: killGrace(),
 	}
 
 	if wsURL != "" {
-		r.ws = NewWSClient(wsURL, wsToken, wsMode, r.Inject)
+		r.ws = NewWSClient(wsURL, wsToken, wsMode, r.injectRemote)
+		r.ws.resize = r.resizeRemote
 	}
 
 	return r, nil
@@ -56,6 +137,7 @@ func New(command string, args []string, wsURL, wsToken string, wsMode WSMode, ex
 // It blocks until the child exits.
 func (r *Relay) Run() error {
 	defer r.cleanup()
+	defer close(r.done)
 
 	// Copy outer terminal window size to inner PTY
 	if err := r.syncWinsize(); err != nil {
@@ -86,74 +168,141 @@ func (r *Relay) Run() error {
 	// We no longer need the slave in the parent
 	r.slave.Close()
 	r.slave = nil
+	r.started = time.Now()
+	r.touch()
+	if r.idleTimeout > 0 {
+		r.spawn(r.idleWatchdog)
+	}
+
+	master := r.master
+	r.spawn(func() { r.injectLoop(master) })
+	r.startPanes()
 
 	// Start WebSocket client if configured
 	if r.ws != nil {
-		go r.ws.Run()
+		r.spawn(r.ws.Run)
 	}
 
 	// Handle SIGWINCH — forward window resize to inner PTY
 	winchCh := make(chan os.Signal, 1)
 	signal.Notify(winchCh, syscall.SIGWINCH)
-	go func() {
+	r.spawn(func() {
 		for range winchCh {
 			if err := r.syncWinsize(); err != nil {
 				log.Printf("warn: syncWinsize on SIGWINCH: %v", err)
 			}
 		}
-	}()
+	})
+
+	// Handle SIGTSTP — suspend cleanly instead of stopping with the
+	// terminal left in raw mode. Without job control nothing would resume
+	// us, so it is ignored like the default action of an orphaned stop.
+	r.tstpCh = make(chan os.Signal, 1)
+	signal.Notify(r.tstpCh, syscall.SIGTSTP)
+	r.spawn(func() {
+		for range r.tstpCh {
+			if !r.suspendOnCtrlZ {
+				log.Printf("Ignoring SIGTSTP: nothing could resume greenlight (set GREENLIGHT_CTRL_Z=suspend to override)")
+				continue
+			}
+			r.suspend()
+		}
+	})
 
-	// Handle SIGINT/SIGTERM — forward to child process group
+	// Handle SIGINT/SIGTERM/SIGHUP/SIGQUIT — forward to child process
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	r.spawn(func() {
 		for sig := range sigCh {
 			if r.cmd.Process != nil {
 				r.cmd.Process.Signal(sig)
 			}
+			switch sig {
+			case syscall.SIGHUP:
+				r.hangup()
+			case syscall.SIGTERM:
+				r.killAfterGrace("SIGTERM")
+			}
 		}
-	}()
-
-	// Relay loop
-	done := make(chan error, 1)
+	})
 
 	// master → outer stdout (child output → user's terminal)
 	// If WebSocket is connected, also send output to the remote server.
-	go func() {
+	// outputDone is closed once the child's output has all been read.
+	outputDone := make(chan struct{})
+	r.spawn(func() {
+		defer close(outputDone)
 		buf := make([]byte, 4096)
 		for {
 			n, err := r.master.Read(buf)
 			if n > 0 {
-				os.Stdout.Write(buf[:n])
-				if r.ws != nil {
+				r.touch()
+				r.outMu.Lock()
+				writeAll(os.Stdout, buf[:n])
+				r.outMu.Unlock()
+				r.recorder.output(buf[:n])
+				if r.ws != nil && len(r.panes) > 0 {
+					r.ws.SendPane(0, buf[:n])
+				} else if r.ws != nil {
 					r.ws.Send(buf[:n])
 				}
+				if r.ws != nil {
+					for _, title := range r.titles.feed(buf[:n]) {
+						r.ws.SendText(encodeTitleFrame(title))
+					}
+				}
 			}
 			if err != nil {
-				done <- err
 				return
 			}
 		}
-	}()
+	})
 
 	// outer stdin → master (user keystrokes → Claude Code)
-	go func() {
-		buf := make([]byte, 256)
+	r.spawn(func() {
+		buf := make([]byte, stdinBufSize)
+		var flushTimer *time.Timer
 		for {
 			n, err := os.Stdin.Read(buf)
 			if n > 0 {
+				r.noteInput(inputLocal)
 				data := buf[:n]
+				if r.statusKeys != nil {
+					if flushTimer != nil {
+						flushTimer.Stop()
+					}
+					var triggers int
+					data, triggers = r.statusKeys.filter(data)
+					for i := 0; i < triggers; i++ {
+						r.spawn(r.toggleStatus)
+					}
+					// Release a held partial sequence if nothing follows it.
+					if r.statusKeys.pending() {
+						flushTimer = time.AfterFunc(statusKeyTimeout, func() {
+							defer r.restoreOnPanic()
+							if held := r.statusKeys.flush(); len(held) > 0 {
+								r.Inject(held)
+							}
+						})
+					}
+				}
+				// Ctrl-Z is a single byte, so wherever it falls in a read
+				// the input before it is written before suspending and the
+				// rest after resuming.
 				for len(data) > 0 {
-					idx := bytes.IndexByte(data, 0x1a) // Ctrl-Z
+					idx := -1
+					if r.suspendOnCtrlZ {
+						idx = bytes.IndexByte(data, 0x1a) // Ctrl-Z
+					}
 					if idx == -1 {
 						r.mu.Lock()
-						r.master.Write(data)
+						writeAll(r.master, data)
 						r.mu.Unlock()
 						break
 					}
 					if idx > 0 {
 						r.mu.Lock()
-						r.master.Write(data[:idx])
+						writeAll(r.master, data[:idx])
 						r.mu.Unlock()
 					}
 					r.suspend()
@@ -161,36 +310,160 @@ func (r *Relay) Run() error {
 				}
 			}
 			if err != nil {
-				done <- err
 				return
 			}
 		}
-	}()
+	})
 
 	// Wait for child to exit
 	waitErr := r.cmd.Wait()
+	close(r.exited)
 	signal.Stop(winchCh)
 	signal.Stop(sigCh)
+	signal.Stop(r.tstpCh)
+	r.stopPanes()
+
+	// Let the output copier relay whatever the child wrote before it
+	// exited; reads fail once that is drained. A process the child left
+	// behind can keep the PTY open, so don't wait for that forever.
+	select {
+	case <-outputDone:
+	case <-time.After(outputDrainTimeout):
+	}
 
 	// Close master so the output copier finishes
 	r.master.Close()
 	r.master = nil
-
-	// Drain remaining output
-	<-done
+	<-outputDone
 
 	return waitErr
 }
 
+// outputDrainTimeout bounds how long Run waits, once the child has exited,
+// for the rest of its output to be read from the PTY.
+const outputDrainTimeout = 500 * time.Millisecond
+
+// defaultKillGrace is how long the child gets to exit after a forwarded
+// SIGHUP or SIGTERM, or Stop, before it is killed, overridable with
+// GREENLIGHT_KILL_GRACE or kill_grace in the config file.
+const defaultKillGrace = 5 * time.Second
+
+// killGrace returns the configured grace period before the child is killed.
+func killGrace() time.Duration {
+	v := envOrConfig("GREENLIGHT_KILL_GRACE", "kill_grace")
+	if v == "" {
+		return defaultKillGrace
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Warning: invalid kill grace %q, using %v", v, defaultKillGrace)
+		return defaultKillGrace
+	}
+	return d
+}
+
+// hangup handles SIGHUP, usually sent because the controlling terminal
+// closed. The terminal settings are put back while the terminal may still
+// be there, and the child is killed if it ignores the hangup, so Run
+// returns and closes the PTY instead of relaying to a terminal that is gone.
+func (r *Relay) hangup() {
+	r.restoreTermios()
+	r.killAfterGrace("SIGHUP")
+}
+
+// Stop ends the session from outside the child: it is sent SIGTERM, and
+// killed if it hasn't exited within the kill grace period. Run then
+// returns as it does when the child exits by itself.
+func (r *Relay) Stop() {
+	if r.childExited() {
+		return
+	}
+	r.cmd.Process.Signal(syscall.SIGTERM)
+	r.killAfterGrace("SIGTERM")
+}
+
+// touch records PTY activity for the idle watchdog.
+func (r *Relay) touch() {
+	r.lastActivity.Store(time.Now().UnixNano())
+}
+
+// idleWatchdog stops the child once nothing has been read from or written
+// to the PTY for idleTimeout. A pending permission request counts as
+// activity, so the agent isn't stopped while it waits for an answer.
+func (r *Relay) idleWatchdog() {
+	for {
+		idle := time.Since(time.Unix(0, r.lastActivity.Load()))
+		if idle >= r.idleTimeout && r.requestPending != nil && r.requestPending() {
+			r.touch()
+			continue
+		}
+		if idle >= r.idleTimeout {
+			log.Printf("No activity for %v, stopping the agent", r.idleTimeout)
+			r.idledOut.Store(true)
+			r.Stop()
+			return
+		}
+		select {
+		case <-time.After(r.idleTimeout - idle):
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// IdledOut reports whether the session was ended by the idle timeout.
+func (r *Relay) IdledOut() bool {
+	return r.idledOut.Load()
+}
+
+// killAfterGrace kills the child, with everything else in its process
+// group, unless Run returns within the kill grace period of the child
+// being sent sig, so a child that ignores sig can't keep Wait from
+// returning.
+func (r *Relay) killAfterGrace(sig string) {
+	grace := r.killGrace
+	go func() {
+		select {
+		case <-r.done:
+		case <-time.After(grace):
+			log.Printf("child did not exit within %v of %s, killing it", grace, sig)
+			// The child leads its own session, so its process group
+			// has its PID
+			if err := syscall.Kill(-r.cmd.Process.Pid, syscall.SIGKILL); err != nil {
+				r.cmd.Process.Kill()
+			}
+		}
+	}()
+}
+
 // suspend stops the relay and suspends the process for shell job control.
 // When the user resumes (e.g. via "fg"), it re-enters raw mode and continues.
+// Once the child has exited there is nothing to come back to, so a Ctrl-Z
+// arriving while the session shuts down is ignored and Run is left to
+// return.
 func (r *Relay) suspend() {
+	if r.childExited() {
+		return
+	}
 	r.restoreTermios()
 
-	// Reset SIGTSTP to default so the kill actually stops us
-	signal.Reset(syscall.SIGTSTP)
-	syscall.Kill(0, syscall.SIGTSTP)
-	// Execution resumes here after SIGCONT (e.g. "fg")
+	// Stop with SIGSTOP: once SIGTSTP has been passed to signal.Notify the
+	// Go runtime keeps its own handler installed, so a re-raised SIGTSTP
+	// would be swallowed instead of stopping us. Other threads can run on
+	// briefly after kill returns, so wait for the SIGCONT (e.g. "fg")
+	// rather than assuming we have already been stopped and resumed.
+	contCh := make(chan os.Signal, 1)
+	signal.Notify(contCh, syscall.SIGCONT)
+	syscall.Kill(0, syscall.SIGSTOP)
+	<-contCh
+	signal.Stop(contCh)
+
+	// The child runs in its own session, so it keeps running while we are
+	// stopped and may have exited since. Leave the terminal restored for
+	// the shell rather than switching it back to raw mode for Run's exit.
+	if r.childExited() {
+		return
+	}
 
 	if err := r.setRaw(); err != nil {
 		log.Printf("warn: setRaw after resume: %v", err)
@@ -200,13 +473,194 @@ func (r *Relay) suspend() {
 	}
 }
 
-// Inject writes data directly to the PTY master as if it were typed.
+// childExited reports whether the child has exited and been reaped. A
+// signal-0 liveness check can't tell, since an unreaped child still exists.
+func (r *Relay) childExited() bool {
+	select {
+	case <-r.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// jobControl reports whether a shell is doing job control for us, i.e.
+// whether something will resume the process after it suspends itself.
+// That requires fd to be our controlling terminal with our process group
+// in the foreground, and a parent that put us in a process group of our
+// own. A session leader (e.g. container PID 1, a systemd service, or a
+// program exec'd by a login shell) has nobody to "fg" it.
+func jobControl(fd int) bool {
+	pgrp := syscall.Getpgrp()
+
+	if fg, err := getForegroundPgrp(uintptr(fd)); err != nil || fg != pgrp {
+		return false
+	}
+
+	sid, _, errno := syscall.RawSyscall(syscall.SYS_GETSID, 0, 0, 0)
+	if errno != 0 || int(sid) == os.Getpid() {
+		return false
+	}
+
+	// A non-interactive shell runs commands in its own process group
+	ppgrp, err := syscall.Getpgid(os.Getppid())
+	if err != nil || ppgrp == pgrp {
+		return false
+	}
+	return true
+}
+
+// Input sources reported in input_source frames.
+const (
+	inputLocal  int32 = 1 // the local keyboard
+	inputRemote int32 = 2 // injected from the relay
+)
+
+// inputSourceFrame is the control frame telling the relay where the input
+// that follows came from: {"type":"input_source","source":"remote"}. It is
+// sent only when the source changes, and the PTY output frames themselves
+// are unchanged.
+type inputSourceFrame struct {
+	Type   string `json:"type"`
+	Source string `json:"source"`
+}
+
+// noteInput records that input arrived from src, resetting the idle timer,
+// and if that differs from
+// the last input's source, tells the relay and, for remote input, calls
+// onRemoteInput.
+func (r *Relay) noteInput(src int32) {
+	r.touch()
+	if r.inputSource.Swap(src) == src {
+		return
+	}
+	name := "local"
+	if src == inputRemote {
+		name = "remote"
+	}
+	if r.ws != nil {
+		b, _ := json.Marshal(inputSourceFrame{Type: "input_source", Source: name})
+		r.ws.SendText(b)
+	}
+	if src == inputRemote && r.onRemoteInput != nil {
+		r.onRemoteInput()
+	}
+}
+
+// remoteInputFrame is the text frame mirroring input from the app back to
+// the relay (connect --mirror-input): {"type":"remote_input","data":"ls\n"}.
+// Pane is set when the input went to a pane other than the agent's.
+type remoteInputFrame struct {
+	Type string `json:"type"`
+	Data string `json:"data"`
+	Pane int    `json:"pane,omitempty"`
+}
+
+// mirrorInput records input from the app so it appears in the saved
+// session: as a remote_input frame to the relay, and as an input event in
+// the --record file. It is sent once per message as received, in its own
+// frame type, so it isn't confused with the agent's echo of the same
+// text in the output.
+func (r *Relay) mirrorInput(data []byte) {
+	if r.ws != nil {
+		b, _ := json.Marshal(remoteInputFrame{
+			Type: "remote_input",
+			Data: string(data),
+			Pane: int(r.activePane.Load()),
+		})
+		r.ws.SendText(b)
+	}
+	r.recorder.input(data)
+}
+
+// mirrorInputEnabled resolves whether input from the app is mirrored: flag
+// > GREENLIGHT_MIRROR_INPUT env > mirror_input in the config file.
+func mirrorInputEnabled(flagValue bool) bool {
+	if flagValue {
+		return true
+	}
+	v := envOrConfig("GREENLIGHT_MIRROR_INPUT", "mirror_input")
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Warning: invalid mirror input setting %q, using false", v)
+		return false
+	}
+	return b
+}
+
+// Inject queues data to be written to the PTY master as if it were typed.
+// It never blocks: if the child has stopped reading and the queue is full,
+// the data is dropped and errInjectQueueFull is returned.
 // Safe to call from any goroutine.
 func (r *Relay) Inject(data []byte) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	_, err := r.master.Write(data)
-	return err
+	cp := make([]byte, len(data))
+	copy(cp, data)
+	select {
+	case r.injectCh <- cp:
+		return nil
+	default:
+		return errInjectQueueFull
+	}
+}
+
+// injectLoop writes queued remote input to the master until Run returns.
+func (r *Relay) injectLoop(master *os.File) {
+	for {
+		select {
+		case data := <-r.injectCh:
+			r.mu.Lock()
+			err := writeAll(master, data)
+			r.mu.Unlock()
+			if err != nil {
+				log.Printf("inject: write error: %v", err)
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// writeAll writes all of p to w, continuing after short writes and retrying
+// writes that fail with EAGAIN or EINTR, as a PTY master can when its
+// buffer is full.
+func writeAll(w io.Writer, p []byte) error {
+	for len(p) > 0 {
+		n, err := w.Write(p)
+		p = p[n:]
+		if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+	}
+	return nil
+}
+
+// spawn runs f in a new goroutine. A panic there would end the process
+// without running Run's deferred cleanup and leave the user's terminal in
+// raw mode, so the terminal is restored before the panic carries on.
+func (r *Relay) spawn(f func()) {
+	go func() {
+		defer r.restoreOnPanic()
+		f()
+	}()
+}
+
+// restoreOnPanic restores the terminal if the calling goroutine is
+// panicking, then re-panics. It must be deferred directly.
+func (r *Relay) restoreOnPanic() {
+	if v := recover(); v != nil {
+		r.restoreTermios()
+		panic(v)
+	}
 }
 
 func (r *Relay) cleanup() {
@@ -217,6 +671,9 @@ func (r *Relay) cleanup() {
 	if r.slave != nil {
 		r.slave.Close()
 	}
+	for _, s := range r.paneSlaves {
+		s.Close()
+	}
 }
 
 // CloseWS shuts down the WebSocket client. Call after draining the bridge.
@@ -231,23 +688,74 @@ func (r *Relay) syncWinsize() error {
 	if err != nil {
 		return err
 	}
+	for _, p := range r.panes {
+		setWinsize(p.master.Fd(), ws)
+	}
+	r.recorder.resize(ws)
 	return setWinsize(r.master.Fd(), ws)
 }
 
+// resizeFrame is a control frame from the relay giving the size of the
+// remote viewer's terminal: {"type":"resize","cols":120,"rows":40}
+type resizeFrame struct {
+	Type string `json:"type"`
+	Cols int    `json:"cols"`
+	Rows int    `json:"rows"`
+}
+
+// parseResizeFrame reports whether data is a resize control frame.
+func parseResizeFrame(data []byte) (cols, rows int, ok bool) {
+	var f resizeFrame
+	if err := json.Unmarshal(data, &f); err != nil || f.Type != "resize" {
+		return 0, 0, false
+	}
+	return f.Cols, f.Rows, true
+}
+
+// resizeRemote sizes the PTYs to the remote viewer's terminal, so the
+// agent's output wraps to fit it. The local terminal's size is applied
+// again the next time it changes (SIGWINCH).
+func (r *Relay) resizeRemote(cols, rows int) {
+	if cols <= 0 || rows <= 0 || cols > math.MaxUint16 || rows > math.MaxUint16 {
+		log.Printf("ws: ignoring resize to %dx%d", cols, rows)
+		return
+	}
+	ws := &Winsize{Row: uint16(rows), Col: uint16(cols)}
+	for _, p := range r.panes {
+		setWinsize(p.master.Fd(), ws)
+	}
+	r.recorder.resize(ws)
+	if err := setWinsize(r.master.Fd(), ws); err != nil {
+		log.Printf("warn: remote resize: %v", err)
+	}
+}
+
 func (r *Relay) setRaw() error {
-	fd := int(os.Stdin.Fd())
+	return makeRaw(int(os.Stdin.Fd()), &r.origTermios)
+}
+
+func (r *Relay) restoreTermios() {
+	// Nothing was saved if the terminal never went into raw mode
+	if r.origTermios == (syscall.Termios{}) {
+		return
+	}
+	restoreTerm(int(os.Stdin.Fd()), &r.origTermios)
+}
 
+// makeRaw saves the current terminal state of fd into orig and puts the
+// terminal into raw mode.
+func makeRaw(fd int, orig *syscall.Termios) error {
 	// Save current termios
 	if _, _, errno := syscall.Syscall(
 		syscall.SYS_IOCTL,
 		uintptr(fd),
 		ioctlReadTermios,
-		uintptr(ptrOf(&r.origTermios)),
+		uintptr(ptrOf(orig)),
 	); errno != 0 {
 		return errno
 	}
 
-	raw := r.origTermios
+	raw := *orig
 	// cfmakeraw equivalent:
 	// Input flags: disable break, CR-to-NL, parity, strip, flow control
 	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK |
@@ -275,12 +783,12 @@ func (r *Relay) setRaw() error {
 	return nil
 }
 
-func (r *Relay) restoreTermios() {
-	fd := int(os.Stdin.Fd())
+// restoreTerm restores terminal state saved by makeRaw.
+func restoreTerm(fd int, orig *syscall.Termios) {
 	syscall.Syscall(
 		syscall.SYS_IOCTL,
 		uintptr(fd),
 		ioctlWriteTermios,
-		uintptr(ptrOf(&r.origTermios)),
+		uintptr(ptrOf(orig)),
 	)
 }
@@ -0,0 +1,182 @@
+//go:build darwin || linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// permissionRule is one line of the rules file: allow or deny a tool,
+// optionally only when its input matches a pattern.
+type permissionRule struct {
+	behavior string         // "allow" or "deny"
+	compound bool           // allow-compound: may allow shell command lists
+	tool     string         // tool name, or "*" for any tool
+	pattern  *regexp.Regexp // anchored; nil matches any input
+	source   string         // file:line, for logging
+}
+
+// ruleFields names the tool_input field a rule's pattern is matched
+// against for each tool. Patterns never match the input of other tools.
+var ruleFields = map[string]string{
+	"Bash":         "command",
+	"Read":         "file_path",
+	"Edit":         "file_path",
+	"MultiEdit":    "file_path",
+	"Write":        "file_path",
+	"NotebookEdit": "notebook_path",
+	"Glob":         "pattern",
+	"Grep":         "pattern",
+	"WebFetch":     "url",
+	"WebSearch":    "query",
+}
+
+// shellMetachars separate, substitute or redirect commands in a shell
+// command line. An allow rule only matches a Bash command containing one
+// of them if it is an allow-compound rule, so allowing "git status" doesn't
+// also allow "git status; rm -rf ~".
+const shellMetachars = ";&|<>`$\n"
+
+// rulesPath returns the rules file location, next to the config file
+// (normally ~/.greenlight/rules).
+func rulesPath() (string, error) {
+	path, err := configPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(path), "rules"), nil
+}
+
+// loadRules reads the rules file. Each non-blank line that doesn't start
+// with '#' has the form
+//
+//	allow|allow-compound|deny <tool> [<regexp>]
+//
+// where the regexp, which runs to the end of the line, must match the
+// whole of the tool's field in ruleFields. Invalid lines are logged and
+// skipped. Returns nil if the file doesn't exist.
+func loadRules() []permissionRule {
+	path, err := rulesPath()
+	if err != nil {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var rules []permissionRule
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", path, lineNo)
+
+		behavior, rest := cutField(line)
+		tool, expr := cutField(rest)
+		compound := behavior == "allow-compound"
+		if compound {
+			behavior = "allow"
+		}
+		if tool == "" || (behavior != "allow" && behavior != "deny") {
+			log.Printf("Warning: invalid rule at %s: %q", source, line)
+			continue
+		}
+		rule := permissionRule{behavior: behavior, compound: compound, tool: tool, source: source}
+		if expr != "" {
+			re, err := regexp.Compile("^(?:" + expr + ")$")
+			if err != nil {
+				log.Printf("Warning: invalid rule pattern at %s: %v", source, err)
+				continue
+			}
+			rule.pattern = re
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// matchRules returns the rule that decides a permission request, or nil if
+// none applies. Deny rules take precedence over allow rules, so a broad
+// allow can be narrowed by a later deny. A deny pattern for Bash is also
+// tried against each command in a command list, so it can't be sidestepped
+// by prefixing a harmless command.
+func matchRules(rules []permissionRule, toolName string, toolInput json.RawMessage) *permissionRule {
+	var fields map[string]interface{}
+	json.Unmarshal(toolInput, &fields)
+	value, hasValue := fields[ruleFields[toolName]].(string)
+	compound := toolName == "Bash" && strings.ContainsAny(value, shellMetachars)
+
+	var allow *permissionRule
+	for i := range rules {
+		r := &rules[i]
+		if r.tool != "*" && r.tool != toolName {
+			continue
+		}
+		if r.behavior == "deny" {
+			if r.pattern == nil || (hasValue && anyMatch(r.pattern, commandCandidates(toolName, value))) {
+				return r
+			}
+			continue
+		}
+		if compound && !r.compound {
+			continue
+		}
+		if r.pattern != nil && !(hasValue && r.pattern.MatchString(value)) {
+			continue
+		}
+		if allow == nil {
+			allow = r
+		}
+	}
+	return allow
+}
+
+// commandCandidates returns the strings a deny pattern is tried against:
+// value itself and, for Bash, each command between shell metacharacters.
+func commandCandidates(toolName, value string) []string {
+	candidates := []string{value}
+	if toolName != "Bash" {
+		return candidates
+	}
+	for _, part := range strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(shellMetachars, r) || r == '(' || r == ')'
+	}) {
+		if part = strings.TrimSpace(part); part != "" && part != value {
+			candidates = append(candidates, part)
+		}
+	}
+	return candidates
+}
+
+// cutField splits s into its first whitespace-separated field and the
+// trimmed rest.
+func cutField(s string) (field, rest string) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+func anyMatch(re *regexp.Regexp, strs []string) bool {
+	for _, s := range strs {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
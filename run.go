@@ -0,0 +1,238 @@
+//go:build darwin || linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultRunTimeout bounds how long `greenlight run` waits for the agent.
+const defaultRunTimeout = 10 * time.Minute
+
+// runRun launches the agent headlessly with a single prompt, for automation.
+// The agent's stdin and stdout are pipes rather than a PTY: the prompt is
+// written to stdin, which is then closed, and the agent's output is
+// collected and written to stdout once it exits or the timeout expires.
+// Enrollment, hooks and transcript relay work as they do for connect.
+func runRun(args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	prompt := fs.String("prompt", "", "Instruction to send to the agent (required)")
+	agent := fs.String("agent", "", `Agent command to launch, with any default args (overrides GREENLIGHT_AGENT env and config file; default "claude")`)
+	deviceID := fs.String("device-id", "", "Device ID (overrides GREENLIGHT_DEVICE_ID env and config file)")
+	project := fs.String("project", "", "Project name (overrides GREENLIGHT_PROJECT env and config file)")
+	timeout := fs.Duration("timeout", defaultRunTimeout, "How long to wait for the agent to finish")
+	noEnroll := fs.Bool("no-enroll", false, "Skip session enrollment (reduces security; only for relays pre-authorized out-of-band)")
+	force := fs.Bool("force", false, "Install hooks even if the current directory doesn't look like a project")
+	verbose := fs.Bool("verbose", false, "Also write log messages to stderr")
+	fs.Parse(args)
+	if verboseLogs(*verbose) {
+		mirrorLogs(os.Stderr)
+	}
+
+	if *prompt == "" {
+		fmt.Fprintf(os.Stderr, "greenlight run: --prompt is required\n")
+		os.Exit(1)
+	}
+	if *timeout <= 0 {
+		fmt.Fprintf(os.Stderr, "greenlight run: --timeout must be positive\n")
+		os.Exit(1)
+	}
+
+	// Resolve device ID and project: flag > env > config file
+	cfg := resolveConfig(*deviceID, *project)
+	devID := cfg.DeviceID
+	if devID == "" {
+		fmt.Fprintf(os.Stderr, "greenlight run: device ID is required (use --device-id, GREENLIGHT_DEVICE_ID, or set device_id in ~/.greenlight/config)\n")
+		os.Exit(1)
+	}
+
+	proj := cfg.Project
+	if proj == "" {
+		fmt.Fprintf(os.Stderr, "greenlight run: project name is required (use --project)\n")
+		os.Exit(1)
+	}
+	proj, err := normalizeProject(proj)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight run: %v\n", err)
+		os.Exit(1)
+	}
+
+	agentFields, err := agentCommand(*agent)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight run: %v\n", err)
+		os.Exit(1)
+	}
+	command := agentFields[0]
+	if err := checkAgentInstalled(command); err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight run: %v\n", err)
+		os.Exit(1)
+	}
+	cmdArgs := append([]string(nil), agentFields[1:]...)
+	if agentNameFor(command) == "claude-code" {
+		// Without a terminal Claude Code must be told to answer and exit
+		cmdArgs = append(cmdArgs, "--print")
+	}
+
+	relayURL, err := relayURLFor(proj)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight run: %v\n", err)
+		os.Exit(1)
+	}
+	if relayURL == "" {
+		fmt.Fprintf(os.Stderr, "greenlight run: no relay server URL configured (binary must be built with -ldflags, or set relay.%s in the config file)\n", proj)
+		os.Exit(1)
+	}
+
+	useGlobal := globalHooks(false)
+	settingsName, err := settingsFile("")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight run: %v\n", err)
+		os.Exit(1)
+	}
+	settingsPath, err := hookSettingsPath(useGlobal, settingsName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight run: %v\n", err)
+		os.Exit(1)
+	}
+	if !*force && !useGlobal {
+		if err := checkHookDir("."); err != nil {
+			fmt.Fprintf(os.Stderr, "greenlight run: refusing to install hooks: %v\n", err)
+			fmt.Fprintf(os.Stderr, "greenlight run: run from your project directory, or pass --force to install here anyway\n")
+			os.Exit(1)
+		}
+	}
+
+	if _, err := relayTransport(); err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight run: %v\n", err)
+		os.Exit(1)
+	}
+
+	relayID := generateUUID()
+	dialURL, err := relayDialURL(relayURL, relayID, proj)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight run: %v\n", err)
+		os.Exit(1)
+	}
+	if err := enrollUnlessSkipped(relayURL, devID, relayID, proj, *noEnroll); err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight run: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := installHooks(settingsPath, defaultHookEvents, useGlobal); err != nil {
+		log.Printf("Warning: failed to install hooks: %v", err)
+	}
+
+	bridgePath := filepath.Join(os.TempDir(), "greenlight-bridge-"+relayID)
+	if f, err := os.Create(bridgePath); err == nil {
+		f.Close()
+	}
+	defer os.Remove(bridgePath)
+
+	// Output only: there is no terminal for remote input to go to
+	ws := NewWSClient(dialURL, wsAuthToken(devID), WSModeW, func([]byte) error { return nil })
+	go ws.Run()
+
+	bridgeDone := make(chan struct{})
+	bridgeFinished := make(chan struct{})
+	go func() {
+		tailBridge(bridgePath, relayID, ws, bridgeDone)
+		close(bridgeFinished)
+	}()
+
+	cmd := exec.Command(command, cmdArgs...)
+	cmd.Env = os.Environ()
+	for k, v := range map[string]string{
+		"GREENLIGHT_DEVICE_ID":  devID,
+		"GREENLIGHT_SESSION_ID": relayID,
+		"GREENLIGHT_PROJECT":    proj,
+		"GREENLIGHT_BRIDGE":     bridgePath,
+		"GREENLIGHT_AGENT_NAME": agentNameFor(command),
+	} {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	if *noEnroll {
+		cmd.Env = append(cmd.Env, "GREENLIGHT_NO_ENROLL=1")
+	}
+	cmd.Stdin = bytes.NewBufferString(*prompt + "\n")
+	out := &runOutput{ws: ws}
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	// Own process group, so the agent's children are stopped with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	runErr := cmd.Start()
+	timedOut := false
+	if runErr == nil {
+		exited := make(chan error, 1)
+		go func() { exited <- cmd.Wait() }()
+		select {
+		case runErr = <-exited:
+		case <-time.After(*timeout):
+			timedOut = true
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+			select {
+			case runErr = <-exited:
+			case <-time.After(2 * time.Second):
+				syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+				runErr = <-exited
+			}
+		}
+	}
+
+	close(bridgeDone)
+	drain := bridgeDrainTimeout()
+	select {
+	case <-bridgeFinished:
+	case <-time.After(drain):
+		log.Printf("WARN: bridge did not drain within %v; undrained transcript lines may be lost", drain)
+	}
+	ws.Close()
+	os.Remove(bridgePath)
+	os.Remove(decisionLogPath(relayID))
+
+	os.Stdout.Write(out.Bytes())
+
+	switch {
+	case timedOut:
+		fmt.Fprintf(os.Stderr, "greenlight run: agent did not finish within %v\n", *timeout)
+		os.Exit(1)
+	case runErr != nil:
+		var exitErr *exec.ExitError
+		if errors.As(runErr, &exitErr) && exitErr.ExitCode() > 0 {
+			os.Exit(exitErr.ExitCode())
+		}
+		fmt.Fprintf(os.Stderr, "greenlight run: %v\n", runErr)
+		os.Exit(1)
+	}
+}
+
+// runOutput collects the agent's output for `greenlight run` and relays
+// each chunk as it arrives.
+type runOutput struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	ws  *WSClient
+}
+
+func (o *runOutput) Write(p []byte) (int, error) {
+	o.ws.Send(p)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.Write(p)
+}
+
+func (o *runOutput) Bytes() []byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.Bytes()
+}
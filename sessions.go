@@ -4,10 +4,24 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 )
 
+// sessionEntry is what sessions.json records for a Claude conversation.
+type sessionEntry struct {
+	RelayID   string    `json:"relay_id"`
+	Project   string    `json:"project,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
 // sessionsFilePath returns the path to ~/.greenlight/sessions.json.
 func sessionsFilePath() string {
 	home, err := os.UserHomeDir()
@@ -17,8 +31,10 @@ func sessionsFilePath() string {
 	return filepath.Join(home, ".greenlight", "sessions.json")
 }
 
-// loadSessions reads the conversation_id → relay_id mapping from disk.
-func loadSessions() map[string]string {
+// loadSessions reads the conversation_id → session mapping from disk.
+// Entries in the old flat format (conversation_id → relay_id) are loaded
+// with no project or timestamp.
+func loadSessions() map[string]sessionEntry {
 	path := sessionsFilePath()
 	if path == "" {
 		return nil
@@ -27,33 +43,253 @@ func loadSessions() map[string]string {
 	if err != nil {
 		return nil
 	}
-	var m map[string]string
-	if err := json.Unmarshal(data, &m); err != nil {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
 		return nil
 	}
+	m := make(map[string]sessionEntry, len(raw))
+	for id, v := range raw {
+		var e sessionEntry
+		if err := json.Unmarshal(v, &e.RelayID); err == nil {
+			m[id] = e
+			continue
+		}
+		if err := json.Unmarshal(v, &e); err == nil {
+			m[id] = e
+		}
+	}
 	return m
 }
 
 // lookupRelayID returns the stored relay_id for a conversation, or "".
 func lookupRelayID(conversationID string) string {
+	return loadSessions()[conversationID].RelayID
+}
+
+// lastSession returns the most recently used conversation for a project,
+// or "" if there is none.
+func lastSession(project string) string {
+	var last string
+	var lastAt time.Time
+	for id, e := range loadSessions() {
+		if e.Project != project || e.UpdatedAt.IsZero() {
+			continue
+		}
+		if last == "" || e.UpdatedAt.After(lastAt) {
+			last, lastAt = id, e.UpdatedAt
+		}
+	}
+	return last
+}
+
+// saveRelayID persists a conversation_id → relay_id mapping, recording the
+// project and when the conversation was last used.
+func saveRelayID(conversationID, relayID, project string) {
+	path := sessionsFilePath()
+	if path == "" {
+		return
+	}
 	m := loadSessions()
 	if m == nil {
-		return ""
+		m = make(map[string]sessionEntry)
 	}
-	return m[conversationID]
+	m[conversationID] = sessionEntry{
+		RelayID:   relayID,
+		Project:   project,
+		UpdatedAt: time.Now().UTC(),
+	}
+	saveSessions(path, m)
 }
 
-// saveRelayID persists a conversation_id → relay_id mapping.
-func saveRelayID(conversationID, relayID string) {
+// saveSessions writes the conversation_id → session mapping to path.
+func saveSessions(path string, m map[string]sessionEntry) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(path), 0755)
+	return os.WriteFile(path, data, 0644)
+}
+
+// defaultPruneAge is how old a conversation must be for `sessions prune`
+// to drop it when --older-than isn't given.
+const defaultPruneAge = 30 * 24 * time.Hour
+
+// runSessions lists or removes the conversation → relay mappings kept in
+// sessions.json for `connect --resume`.
+func runSessions(args []string) {
+	if len(args) == 0 || args[0] == "--help" || args[0] == "-h" {
+		fmt.Fprintf(os.Stderr, "Usage: greenlight sessions list|prune [--older-than 30d]|clear\n")
+		os.Exit(1)
+	}
+
 	path := sessionsFilePath()
+	if path == "" {
+		fmt.Fprintf(os.Stderr, "greenlight sessions: cannot determine home directory\n")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "list":
+		m := loadSessions()
+		ids := make([]string, 0, len(m))
+		for id := range m {
+			ids = append(ids, id)
+		}
+		// Most recently used first; entries without a timestamp last
+		sort.Slice(ids, func(i, j int) bool {
+			a, b := m[ids[i]].UpdatedAt, m[ids[j]].UpdatedAt
+			if !a.Equal(b) {
+				return a.After(b)
+			}
+			return ids[i] < ids[j]
+		})
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "CONVERSATION\tRELAY\tPROJECT\tAGE")
+		now := time.Now()
+		for _, id := range ids {
+			e := m[id]
+			age := "-"
+			if !e.UpdatedAt.IsZero() {
+				age = formatAge(now.Sub(e.UpdatedAt))
+			}
+			project := e.Project
+			if project == "" {
+				project = "-"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", id, e.RelayID, project, age)
+		}
+		tw.Flush()
+
+	case "prune":
+		fs := flag.NewFlagSet("sessions prune", flag.ExitOnError)
+		olderThan := fs.String("older-than", "30d", `Drop conversations last used longer ago than this, e.g. "30d" or "12h"`)
+		fs.Parse(args[1:])
+		maxAge, err := parseAge(*olderThan)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "greenlight sessions: invalid --older-than %q: %v\n", *olderThan, err)
+			os.Exit(1)
+		}
+
+		m := loadSessions()
+		cutoff := time.Now().Add(-maxAge)
+		pruned := 0
+		for id, e := range m {
+			// Entries without a timestamp predate timestamps, so are old
+			if e.UpdatedAt.Before(cutoff) {
+				delete(m, id)
+				pruned++
+			}
+		}
+		if pruned > 0 {
+			if err := saveSessions(path, m); err != nil {
+				fmt.Fprintf(os.Stderr, "greenlight sessions: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		fmt.Printf("Pruned %d of %d sessions\n", pruned, pruned+len(m))
+
+	case "clear":
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "greenlight sessions: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Cleared stored sessions")
+
+	default:
+		fmt.Fprintf(os.Stderr, "greenlight sessions: unknown subcommand %q\n", args[0])
+		os.Exit(1)
+	}
+}
+
+// parseAge parses a duration like time.ParseDuration, also accepting a
+// whole number of days such as "30d".
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("expected a number of days")
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("must not be negative")
+	}
+	return d, err
+}
+
+// formatAge prints d in its largest whole unit: days, hours or minutes.
+func formatAge(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd", int(d/(24*time.Hour)))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", int(d/time.Hour))
+	default:
+		return fmt.Sprintf("%dm", int(d/time.Minute))
+	}
+}
+
+// dirRelayEntry is what relays.json records for a working directory.
+type dirRelayEntry struct {
+	RelayID   string    `json:"relay_id"`
+	Project   string    `json:"project"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// dirRelaysFilePath returns the path to ~/.greenlight/relays.json, which
+// maps absolute working directories to the last relay ID used there.
+func dirRelaysFilePath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".greenlight", "relays.json")
+}
+
+func loadDirRelays() map[string]dirRelayEntry {
+	path := dirRelaysFilePath()
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var m map[string]dirRelayEntry
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil
+	}
+	return m
+}
+
+// lookupDirRelayID returns the relay ID last used for project in dir, or "".
+func lookupDirRelayID(dir, project string) string {
+	e := loadDirRelays()[dir]
+	if e.Project != project {
+		return ""
+	}
+	return e.RelayID
+}
+
+// saveDirRelayID records the relay ID used for project in dir, so
+// `connect --reattach` can reuse it.
+func saveDirRelayID(dir, relayID, project string) {
+	path := dirRelaysFilePath()
 	if path == "" {
 		return
 	}
-	m := loadSessions()
+	m := loadDirRelays()
 	if m == nil {
-		m = make(map[string]string)
+		m = make(map[string]dirRelayEntry)
+	}
+	m[dir] = dirRelayEntry{
+		RelayID:   relayID,
+		Project:   project,
+		UpdatedAt: time.Now().UTC(),
 	}
-	m[conversationID] = relayID
 
 	data, err := json.Marshal(m)
 	if err != nil {
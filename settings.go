@@ -8,13 +8,177 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 )
 
-// installHooks upserts .claude/settings.local.json in the current working
-// directory to register the greenlight hook for SessionStart and
-// PermissionRequest events.
-func installHooks() error {
+// projectMarkers are files or directories whose presence marks a directory
+// as a project root where it makes sense to install hooks.
+var projectMarkers = []string{
+	".git", ".hg", ".svn", ".claude",
+	"package.json", "go.mod", "Cargo.toml", "pyproject.toml", "setup.py",
+	"requirements.txt", "Gemfile", "pom.xml", "build.gradle", "Makefile",
+}
+
+// checkHookDir returns an error if dir is not a sensible place to install
+// hooks: the user's home directory, the filesystem root, or a directory
+// with no project marker in it or any parent below $HOME.
+func checkHookDir(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	home, _ := os.UserHomeDir()
+	if home != "" {
+		if h, err := filepath.Abs(home); err == nil {
+			home = h
+		}
+	}
+
+	if dir == string(filepath.Separator) {
+		return fmt.Errorf("%s is the filesystem root", dir)
+	}
+	if dir == home {
+		return fmt.Errorf("%s is your home directory", dir)
+	}
+
+	for d := dir; d != home && d != filepath.Dir(d); d = filepath.Dir(d) {
+		for _, marker := range projectMarkers {
+			if _, err := os.Stat(filepath.Join(d, marker)); err == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s does not look like a project directory (no .git, package.json, go.mod, ...)", dir)
+}
+
+// defaultHookEvents are the events the greenlight hook is always
+// registered for.
+var defaultHookEvents = []string{"SessionStart", "PermissionRequest"}
+
+// supportedHookEvents are the events `greenlight hook` handles, and so the
+// events connect --hooks may add. Stop fires after every turn, not once per
+// session, so its handler must stay cheap and leave the session intact.
+var supportedHookEvents = []string{
+	"SessionStart", "PermissionRequest", "Notification",
+	"PreToolUse", "PostToolUse", "Stop", "SessionEnd",
+}
+
+// parseHookEvents parses a comma-separated --hooks list, returning the
+// default events followed by any extra ones, without duplicates.
+func parseHookEvents(list string) ([]string, error) {
+	events := append([]string(nil), defaultHookEvents...)
+	for _, event := range strings.Split(list, ",") {
+		event = strings.TrimSpace(event)
+		if event == "" {
+			continue
+		}
+		supported := false
+		for _, e := range supportedHookEvents {
+			if e == event {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return nil, fmt.Errorf("unsupported hook event %q (supported: %s)", event, strings.Join(supportedHookEvents, ", "))
+		}
+		dup := false
+		for _, e := range events {
+			if e == event {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// globalHooks reports whether hooks go into the user's settings instead of
+// the project's: connect --global, or GREENLIGHT_GLOBAL_HOOKS or
+// global_hooks in the config file set to true.
+func globalHooks(flagValue bool) bool {
+	if flagValue {
+		return true
+	}
+	v := envOrConfig("GREENLIGHT_GLOBAL_HOOKS", "global_hooks")
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Warning: invalid global hooks setting %q, using false", v)
+		return false
+	}
+	return b
+}
+
+// defaultSettingsFile is the project settings file hooks go into unless
+// --settings-file or settings_file says otherwise. Claude Code keeps it out
+// of version control.
+const defaultSettingsFile = "settings.local.json"
+
+// settingsFile returns the name of the project settings file to install
+// hooks into: flagValue, GREENLIGHT_SETTINGS_FILE or settings_file in the
+// config file, or defaultSettingsFile. Only names Claude Code reads are
+// accepted, so hooks can't be installed where they would never run.
+func settingsFile(flagValue string) (string, error) {
+	name := flagValue
+	if name == "" {
+		name = envOrConfig("GREENLIGHT_SETTINGS_FILE", "settings_file")
+	}
+	switch name {
+	case "":
+		return defaultSettingsFile, nil
+	case "settings.json", "settings.local.json":
+		return name, nil
+	}
+	return "", fmt.Errorf("invalid settings file %q (want settings.json or settings.local.json)", name)
+}
+
+// hookSettingsPath returns the Claude Code settings file hooks are installed
+// into: ~/.claude/settings.json, shared by every project, when global, and
+// otherwise the settings file called name (see settingsFile) in .claude in
+// the current directory.
+func hookSettingsPath(global bool, name string) (string, error) {
+	if !global {
+		return filepath.Join(".claude", name), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".claude", "settings.json"), nil
+}
+
+// claudeTranscriptPath returns where Claude Code writes the transcript for
+// a conversation started in dir: ~/.claude/projects/<dir>/<id>.jsonl, with
+// every character of dir other than letters and digits replaced by '-'.
+func claudeTranscriptPath(dir, conversationID string) string {
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	mangled := []byte(dir)
+	for i, c := range mangled {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			mangled[i] = '-'
+		}
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".claude", "projects", string(mangled), conversationID+".jsonl")
+}
+
+// installHooks upserts the settings file at settingsPath (see
+// hookSettingsPath) to register the greenlight hook for the given events
+// (see parseHookEvents), and removes greenlight hooks from any other event
+// so the file reflects the latest set. Global hooks run for every Claude
+// Code session, so they are installed with --connected-only to stay out of
+// sessions not started by greenlight.
+func installHooks(settingsPath string, events []string, global bool) error {
 	exe, err := os.Executable()
 	if err != nil {
 		return fmt.Errorf("resolve executable path: %w", err)
@@ -25,17 +189,18 @@ func installHooks() error {
 	}
 
 	hookCmd := exe + " hook"
-
-	dir := ".claude"
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("create .claude dir: %w", err)
+	if global {
+		hookCmd += " --connected-only"
 	}
 
-	settingsPath := filepath.Join(dir, "settings.local.json")
+	if err := os.MkdirAll(filepath.Dir(settingsPath), 0755); err != nil {
+		return fmt.Errorf("create %s: %w", filepath.Dir(settingsPath), err)
+	}
 
 	// Read existing settings or start fresh
 	var settings map[string]interface{}
 	data, err := os.ReadFile(settingsPath)
+	created := os.IsNotExist(err)
 	if err == nil {
 		if err := json.Unmarshal(data, &settings); err != nil {
 			return fmt.Errorf("parse %s: %w", settingsPath, err)
@@ -65,19 +230,30 @@ func installHooks() error {
 
 	// Upsert our hook entries, replacing any existing greenlight hooks
 	// but preserving non-greenlight hooks on the same event
-	for _, event := range []string{"SessionStart", "PermissionRequest"} {
+	wanted := make(map[string]bool)
+	for _, event := range events {
 		hooks[event] = upsertGreenlightHook(hooks[event], hookEntry, hookCmd)
+		wanted[event] = true
 	}
 
-	// Remove old greenlight hooks from events we no longer use (e.g. UserPromptSubmit)
-	for _, oldEvent := range []string{"UserPromptSubmit"} {
-		if existing, ok := hooks[oldEvent]; ok {
-			cleaned := removeGreenlightHooks(existing)
-			if len(cleaned) == 0 {
-				delete(hooks, oldEvent)
-			} else {
-				hooks[oldEvent] = cleaned
-			}
+	// Remove greenlight hooks from events no longer in the set, whether
+	// dropped from --hooks or no longer used (e.g. UserPromptSubmit)
+	for event, existing := range hooks {
+		if wanted[event] {
+			continue
+		}
+		arr, ok := existing.([]interface{})
+		if !ok {
+			continue
+		}
+		cleaned := removeGreenlightHooks(arr)
+		if len(cleaned) == len(arr) {
+			continue
+		}
+		if len(cleaned) == 0 {
+			delete(hooks, event)
+		} else {
+			hooks[event] = cleaned
 		}
 	}
 
@@ -91,11 +267,104 @@ func installHooks() error {
 	if err := os.WriteFile(settingsPath, append(out, '\n'), 0644); err != nil {
 		return fmt.Errorf("write %s: %w", settingsPath, err)
 	}
+	if created {
+		markSettingsCreated(settingsPath, true)
+	}
 
 	log.Printf("Installed hooks in %s", settingsPath)
 	return nil
 }
 
+// createdSettingsFilePath returns the path to
+// ~/.greenlight/created-settings.json, which lists the settings files
+// installHooks created, so uninstall only deletes files that were ours.
+func createdSettingsFilePath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".greenlight", "created-settings.json")
+}
+
+func loadCreatedSettings() map[string]bool {
+	path := createdSettingsFilePath()
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var paths []string
+	if err := json.Unmarshal(data, &paths); err != nil {
+		return nil
+	}
+	m := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		m[p] = true
+	}
+	return m
+}
+
+// createdSettingsKey returns the name created-settings.json records a
+// settings file under: its absolute path with symlinks in the directory
+// resolved, so it matches however the project directory was reached.
+func createdSettingsKey(settingsPath string) (string, error) {
+	abs, err := filepath.Abs(settingsPath)
+	if err != nil {
+		return "", err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(abs)), nil
+}
+
+// settingsCreated reports whether installHooks created the settings file
+// at settingsPath.
+func settingsCreated(settingsPath string) bool {
+	key, err := createdSettingsKey(settingsPath)
+	if err != nil {
+		return false
+	}
+	return loadCreatedSettings()[key]
+}
+
+// markSettingsCreated records, or with created false forgets, that
+// installHooks created the settings file at settingsPath.
+func markSettingsCreated(settingsPath string, created bool) {
+	path := createdSettingsFilePath()
+	key, err := createdSettingsKey(settingsPath)
+	if path == "" || err != nil {
+		return
+	}
+	m := loadCreatedSettings()
+	if m[key] == created {
+		return
+	}
+	if m == nil {
+		m = make(map[string]bool)
+	}
+	if created {
+		m[key] = true
+	} else {
+		delete(m, key)
+	}
+
+	paths := make([]string, 0, len(m))
+	for p := range m {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	data, err := json.Marshal(paths)
+	if err != nil {
+		return
+	}
+	os.MkdirAll(filepath.Dir(path), 0755)
+	os.WriteFile(path, data, 0644)
+}
+
 // upsertGreenlightHook takes the existing hook array for an event and either
 // updates the greenlight entry or appends it. Non-greenlight hooks are preserved.
 func upsertGreenlightHook(existing interface{}, hookEntry []interface{}, hookCmd string) []interface{} {
@@ -0,0 +1,117 @@
+//go:build darwin || linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// textSpill mirrors a WSClient's text queue to an append-only file under
+// TMPDIR (GREENLIGHT_QUEUE_SPILL), so transcript lines that were never
+// delivered survive a crash and are replayed when the session is resumed.
+// Each line of the file is one base64-encoded message. A nil *textSpill
+// does nothing.
+type textSpill struct {
+	path string
+	f    *os.File
+}
+
+// spillPath returns the queue spill file for a relay.
+func spillPath(relayID string) string {
+	return filepath.Join(os.TempDir(), "greenlight-queue-"+relayID)
+}
+
+// spillEnabled reports whether GREENLIGHT_QUEUE_SPILL asks for the text
+// queue to be backed by disk.
+func spillEnabled() bool {
+	v := os.Getenv("GREENLIGHT_QUEUE_SPILL")
+	return v != "" && v != "0"
+}
+
+// openTextSpill opens the relay's spill file for appending and returns the
+// messages left in it by a previous run, oldest first.
+func openTextSpill(relayID string) (*textSpill, [][]byte) {
+	s := &textSpill{path: spillPath(relayID)}
+	pending := s.load()
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("ws: queue spill: %v", err)
+		return nil, pending
+	}
+	s.f = f
+	return s, pending
+}
+
+// load reads the messages in the spill file, keeping at most the newest
+// textQueueSize.
+func (s *textSpill) load() [][]byte {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var msgs [][]byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64<<20)
+	for scanner.Scan() {
+		msg, err := base64.StdEncoding.DecodeString(scanner.Text())
+		if err != nil {
+			// A torn final line from a crash mid-write
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) > textQueueSize {
+		msgs = msgs[len(msgs)-textQueueSize:]
+	}
+	return msgs
+}
+
+// append writes one message to the end of the spill file.
+func (s *textSpill) append(msg []byte) {
+	if s == nil {
+		return
+	}
+	line := base64.StdEncoding.EncodeToString(msg) + "\n"
+	if _, err := s.f.WriteString(line); err != nil {
+		log.Printf("ws: queue spill write: %v", err)
+	}
+}
+
+// rewrite replaces the spill file's contents with queue, dropping the
+// messages that have been delivered.
+func (s *textSpill) rewrite(queue [][]byte) {
+	if s == nil {
+		return
+	}
+	var buf bytes.Buffer
+	for _, msg := range queue {
+		buf.WriteString(base64.StdEncoding.EncodeToString(msg))
+		buf.WriteByte('\n')
+	}
+	if err := s.f.Truncate(0); err != nil {
+		log.Printf("ws: queue spill truncate: %v", err)
+		return
+	}
+	// O_APPEND writes always go to the end, so no seek is needed
+	if _, err := s.f.Write(buf.Bytes()); err != nil {
+		log.Printf("ws: queue spill write: %v", err)
+	}
+}
+
+// close closes the spill file, removing it if nothing is left to deliver.
+func (s *textSpill) close(empty bool) {
+	if s == nil {
+		return
+	}
+	s.f.Close()
+	if empty {
+		os.Remove(s.path)
+	}
+}
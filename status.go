@@ -0,0 +1,109 @@
+//go:build darwin || linux
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+// runStatus prints the resolved settings and the sessions greenlight has
+// state for in TMPDIR: transcript streamers (PID files) and enrolled relays
+// (marker files). Exits 1 if any PID file points at a dead process.
+func runStatus(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	verbose := fs.Bool("verbose", false, "Also write log messages to stderr")
+	fs.Parse(args)
+	if verboseLogs(*verbose) {
+		mirrorLogs(os.Stderr)
+	}
+
+	cfg := resolveConfig("", "")
+	devID, proj := cfg.DeviceID, cfg.Project
+
+	fmt.Printf("Device ID: %s\n", orNone(devID))
+	fmt.Printf("Project:   %s\n", orNone(proj))
+	fmt.Printf("Relay:     %s\n", orNone(displayRelayURL(proj)))
+	fmt.Println()
+
+	tmp := os.TempDir()
+	stale := false
+
+	pidFiles, _ := filepath.Glob(filepath.Join(tmp, "greenlight-stream-*.pid"))
+	sort.Strings(pidFiles)
+	streamerRelays := make(map[string]bool)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SESSION\tRELAY\tSTREAMER PID\tSTATUS")
+	for _, path := range pidFiles {
+		sessionID := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "greenlight-stream-"), ".pid")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		parts := strings.Fields(string(data))
+		relayID := "-"
+		if len(parts) >= 2 {
+			relayID = parts[1]
+			streamerRelays[relayID] = true
+		}
+		pid := 0
+		if len(parts) >= 1 {
+			pid, _ = strconv.Atoi(parts[0])
+		}
+
+		state := "dead"
+		if processAlive(pid) {
+			state = "alive"
+		} else {
+			stale = true
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", sessionID, relayID, pid, state)
+	}
+
+	// Enrolled relays without a streamer
+	markers, _ := filepath.Glob(filepath.Join(tmp, "greenlight-enrolled-*"))
+	sort.Strings(markers)
+	for _, path := range markers {
+		relayID := strings.TrimPrefix(filepath.Base(path), "greenlight-enrolled-")
+		if !streamerRelays[relayID] {
+			fmt.Fprintf(tw, "-\t%s\t-\tenrolled\n", relayID)
+		}
+	}
+	tw.Flush()
+
+	if stale {
+		fmt.Fprintf(os.Stderr, "greenlight status: stale PID files found in %s\n", tmp)
+		os.Exit(1)
+	}
+}
+
+// processAlive reports whether pid refers to a running process.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// Signal 0 checks for existence without delivering anything; EPERM
+	// means the process exists but belongs to another user.
+	err = proc.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(not set)"
+	}
+	return s
+}
@@ -8,11 +8,30 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
+// Transcript file-open wait: poll with exponential backoff from
+// transcriptPollMin up to transcriptPollMax until the deadline passes.
+const (
+	defaultTranscriptWait = 30 * time.Second
+	transcriptPollMin     = 100 * time.Millisecond
+	transcriptPollMax     = 2 * time.Second
+)
+
+// defaultBatchMax is the default for stream --batch-max.
+const defaultBatchMax = 50
+
+// echoFrames mirrors every outgoing transcript frame to stderr (stream --echo).
+var echoFrames bool
+
 func runStream(args []string) {
 	fs := flag.NewFlagSet("stream", flag.ExitOnError)
 	transcriptPath := fs.String("transcript", "", "Path to transcript JSONL file")
@@ -22,7 +41,18 @@ func runStream(args []string) {
 	relayID := fs.String("relay-id", "", "Relay ID")
 	server := fs.String("server", "", "Server base URL")
 	bridge := fs.String("bridge", "", "Bridge file path (write lines here instead of HTTP POST)")
+	echo := fs.Bool("echo", false, "Also print each outgoing transcript frame to stderr")
+	openTimeout := fs.Duration("open-timeout", 0, "How long to wait for the transcript file to appear (default 30s)")
+	batchMS := fs.Int("batch-ms", 0, "HTTP mode: batch lines for up to this many milliseconds per POST (0 disables batching)")
+	batchMax := fs.Int("batch-max", defaultBatchMax, "HTTP mode: most lines per batch POST")
+	metricsAddr := fs.String("metrics-addr", "", "Serve Prometheus metrics on this address (e.g. :9101; localhost unless a host is given)")
+	verbose := fs.Bool("verbose", false, "Also write log messages to stderr")
 	fs.Parse(args)
+	if verboseLogs(*verbose) {
+		mirrorLogs(os.Stderr)
+	}
+
+	echoFrames = *echo
 
 	if *transcriptPath == "" || *sessionID == "" {
 		fmt.Fprintf(os.Stderr, "greenlight stream: missing required flags\n")
@@ -35,33 +65,86 @@ func runStream(args []string) {
 		os.Exit(1)
 	}
 
-	// Write PID file for the hook to check
+	// Resolve transcript wait: flag > env > config file > default
+	wait := *openTimeout
+	if wait <= 0 {
+		d, err := transcriptWait()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "greenlight stream: %v\n", err)
+			os.Exit(1)
+		}
+		wait = d
+	}
+
+	if *batchMS < 0 || *batchMax < 1 {
+		fmt.Fprintf(os.Stderr, "greenlight stream: --batch-ms must be >= 0 and --batch-max >= 1\n")
+		os.Exit(1)
+	}
+
+	if *bridge == "" {
+		if _, err := relayTransport(); err != nil {
+			fmt.Fprintf(os.Stderr, "greenlight stream: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *metricsAddr != "" {
+		stop, err := startMetricsServer(*metricsAddr, nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "greenlight stream: metrics: %v\n", err)
+			os.Exit(1)
+		}
+		defer stop()
+	}
+
+	// Write PID file for the hook to check, under the lock the hook holds
+	// while it checks, so it never sees the file half-written
 	pidFile := filepath.Join(os.TempDir(), "greenlight-stream-"+*sessionID+".pid")
-	os.WriteFile(pidFile, []byte(fmt.Sprintf("%d %s", os.Getpid(), *relayID)), 0644)
+	if f, err := lockPIDFile(pidFile, false); err == nil {
+		f.Truncate(0)
+		f.WriteAt([]byte(fmt.Sprintf("%d %s", os.Getpid(), *relayID)), 0)
+		f.Close()
+	}
 	defer os.Remove(pidFile)
 
 	if *bridge != "" {
-		streamToBridge(*transcriptPath, *sessionID, *bridge)
+		streamToBridge(*transcriptPath, *sessionID, *bridge, wait)
 	} else {
-		streamTranscript(*transcriptPath, *sessionID, *deviceID, *project, *relayID, *server)
+		ts := &transcriptSender{
+			sessionID: *sessionID,
+			deviceID:  *deviceID,
+			project:   *project,
+			relayID:   *relayID,
+			server:    *server,
+			window:    time.Duration(*batchMS) * time.Millisecond,
+			max:       *batchMax,
+		}
+		streamTranscript(*transcriptPath, ts, wait)
+	}
+}
+
+// transcriptWait returns how long to wait for the transcript file to
+// appear, from GREENLIGHT_TRANSCRIPT_WAIT or transcript_wait in the config
+// file, or the default.
+func transcriptWait() (time.Duration, error) {
+	v := envOrConfig("GREENLIGHT_TRANSCRIPT_WAIT", "transcript_wait")
+	if v == "" {
+		return defaultTranscriptWait, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid transcript wait %q", v)
 	}
+	return d, nil
 }
 
 // streamToBridge tails a JSONL transcript file and appends each line to the bridge file.
 // The bridge file is tailed by `connect` which sends lines over the relay WebSocket.
-func streamToBridge(transcriptPath, sessionID, bridgePath string) {
+func streamToBridge(transcriptPath, sessionID, bridgePath string, wait time.Duration) {
 	// Wait for transcript file to appear (may not exist at SessionStart)
-	var f *os.File
-	for i := 0; i < 300; i++ { // up to 30 seconds
-		var err error
-		f, err = os.Open(transcriptPath)
-		if err == nil {
-			break
-		}
-		time.Sleep(100 * time.Millisecond)
-	}
+	f := waitForFile(transcriptPath, wait)
 	if f == nil {
-		log.Printf("Transcript file never appeared: %s", transcriptPath)
+		log.Printf("Transcript file %s did not appear within %v; its lines won't be relayed (raise GREENLIGHT_TRANSCRIPT_WAIT or connect --wait-transcript)", transcriptPath, wait)
 		return
 	}
 	defer f.Close()
@@ -92,6 +175,9 @@ func streamToBridge(transcriptPath, sessionID, bridgePath string) {
 					log.Printf("Bridge write error: %v", werr)
 					return
 				}
+				if echoFrames {
+					fmt.Fprintln(os.Stderr, transcriptFrame(fullLine, "", 0))
+				}
 			}
 		} else if line != "" {
 			// Partial line (no newline yet) — buffer it
@@ -108,39 +194,64 @@ func streamToBridge(transcriptPath, sessionID, bridgePath string) {
 	}
 }
 
-// streamTranscript tails a JSONL transcript file and POSTs each line to the server.
-func streamTranscript(path, sessionID, deviceID, project, relayID, server string) {
+// streamTranscript tails a JSONL transcript file and POSTs each line to the
+// server, in batches if ts has a batch window.
+func streamTranscript(path string, ts *transcriptSender, wait time.Duration) {
 	// Wait for transcript file to appear (may not exist at SessionStart)
-	var f *os.File
-	for i := 0; i < 300; i++ { // up to 30 seconds
-		var err error
-		f, err = os.Open(path)
-		if err == nil {
-			break
-		}
-		time.Sleep(100 * time.Millisecond)
-	}
+	f := waitForFile(path, wait)
 	if f == nil {
-		log.Printf("Transcript file never appeared: %s", path)
+		log.Printf("Transcript file %s did not appear within %v; its lines won't be relayed (raise GREENLIGHT_TRANSCRIPT_WAIT or connect --wait-transcript)", path, wait)
 		return
 	}
 	defer f.Close()
 
-	// Seek to approximately the last 50 lines for backfill
-	seekToLastLines(f, 50)
+	// The hook sends SIGTERM when the session ends or the streamer is
+	// replaced (see terminateStreamer); the batch collected so far is sent
+	// before exiting rather than lost.
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM)
+
+	// Pick up where an earlier streamer for this session left off, or
+	// seek to approximately the last 50 lines for backfill
+	if off, seq, ok := readStreamOffset(ts.sessionID, path); ok && off <= fileSize(f) {
+		f.Seek(off, io.SeekStart)
+		ts.seq = seq
+	} else {
+		seekToLastLines(f, 50)
+	}
+	pos, _ := f.Seek(0, io.SeekCurrent)
 
 	reader := bufio.NewReader(f)
 	var partial string
+	var batch []string
+	var batchStart time.Time
+	var batchEnd int64
+	dedup := newLineDedup(transcriptDedupSize())
 
 	for {
 		line, err := reader.ReadString('\n')
+		pos += int64(len(line))
 		if err == nil {
 			// Complete line (delimiter found) — safe to send
 			fullLine := trimNewline(partial + line)
 			partial = ""
-			if fullLine != "" {
-				if !sendTranscriptLine(fullLine, sessionID, deviceID, project, relayID, server) {
-					return // fatal error
+			if fullLine != "" && dedup.duplicate(fullLine) {
+				log.Printf("Skipping duplicate transcript line")
+			} else if fullLine != "" {
+				if ts.window <= 0 {
+					ok, delivered := ts.send([]string{fullLine})
+					if !ok {
+						return // fatal error
+					}
+					if delivered {
+						writeStreamOffset(ts.sessionID, path, pos, ts.seq)
+					}
+				} else {
+					if len(batch) == 0 {
+						batchStart = time.Now()
+					}
+					batch = append(batch, fullLine)
+					batchEnd = pos
 				}
 			}
 		} else if line != "" {
@@ -148,39 +259,236 @@ func streamTranscript(path, sessionID, deviceID, project, relayID, server string
 			partial += line
 		}
 
+		// Flush a full batch, or one whose window has closed
+		if len(batch) > 0 && (len(batch) >= ts.max || time.Since(batchStart) >= ts.window) {
+			ok, delivered := ts.send(batch)
+			if !ok {
+				return // fatal error
+			}
+			if delivered {
+				writeStreamOffset(ts.sessionID, path, batchEnd, ts.seq)
+			}
+			batch = nil
+		}
+
 		if err != nil {
 			if err != io.EOF {
 				log.Printf("Transcript read error: %v", err)
 				return
 			}
-			time.Sleep(100 * time.Millisecond)
+			delay := 100 * time.Millisecond
+			if len(batch) > 0 {
+				if left := ts.window - time.Since(batchStart); left < delay {
+					delay = left
+				}
+			}
+			select {
+			case <-term:
+				if len(batch) > 0 {
+					if ok, delivered := ts.send(batch); ok && delivered {
+						writeStreamOffset(ts.sessionID, path, batchEnd, ts.seq)
+					}
+				}
+				// Exit without the deferred cleanup: the PID file now
+				// belongs to the hook that signalled us.
+				os.Exit(0)
+			case <-time.After(delay):
+			}
+		}
+	}
+}
+
+// transcriptSender POSTs transcript lines to the server for one session.
+type transcriptSender struct {
+	sessionID, deviceID, project, relayID, server string
+
+	// Batching: up to max lines collected for up to window per POST to
+	// /transcript/batch. A zero window sends each line on its own.
+	window time.Duration
+	max    int
+
+	// batchUnsupported is set once the server 404s the batch endpoint;
+	// lines are sent one at a time from then on.
+	batchUnsupported bool
+
+	// seq is the sequence number of the last line sent, delivered or not,
+	// so the server can detect lines it missed. Saved with the stream
+	// offset, so a restarted streamer carries on numbering.
+	seq int64
+}
+
+// send delivers lines in order. Returns false if the server returned a
+// fatal error (4xx except 429), and delivered if every line was accepted
+// rather than dropped after a transient error.
+func (ts *transcriptSender) send(lines []string) (ok, delivered bool) {
+	first := ts.seq + 1
+	ts.seq += int64(len(lines))
+	if len(lines) > 1 && !ts.batchUnsupported {
+		ok, delivered, notFound := sendTranscriptBatch(lines, first, ts.sessionID, ts.deviceID, ts.project, ts.relayID, ts.server)
+		if !notFound {
+			return ok, delivered
 		}
+		log.Printf("Transcript batch endpoint not found, sending lines individually")
+		ts.batchUnsupported = true
+	}
+	delivered = true
+	for i, line := range lines {
+		ok, sent := sendTranscriptLine(line, first+int64(i), ts.sessionID, ts.deviceID, ts.project, ts.relayID, ts.server)
+		if !ok {
+			return false, false
+		}
+		delivered = delivered && sent
+	}
+	return true, delivered
+}
+
+// sendTranscriptBatch POSTs several transcript lines to /transcript/batch
+// as a "lines" array, with seq numbering the first of them. Returns false if the server returned a fatal error
+// (4xx except 429), delivered if the server accepted the lines, and
+// notFound if the server has no batch endpoint.
+func sendTranscriptBatch(lines []string, seq int64, sessionID, deviceID, project, relayID, server string) (ok, delivered, notFound bool) {
+	// Lines are valid JSON — embed them raw, as in sendTranscriptLine.
+	payloadJSON := fmt.Sprintf(
+		`{"device_id":%q,"session_id":%q,"project":%q,"relay_id":%q,"seq":%d,"lines":[%s]}`,
+		deviceID, sessionID, project, relayID, seq, strings.Join(lines, ","),
+	)
+
+	if echoFrames {
+		fmt.Fprintln(os.Stderr, payloadJSON)
+	}
+
+	resp, err := postWithRetry("Transcript batch", func() (*http.Response, error) {
+		return postRawJSON(server+"/transcript/batch", []byte(payloadJSON), 5*time.Second)
+	})
+	if err != nil {
+		log.Printf("Transcript batch POST error: %v", err)
+		return true, false, false // transient, keep going
 	}
+	defer resp.Body.Close()
+
+	code := resp.StatusCode
+	if code == 404 {
+		return true, false, true
+	}
+	if code >= 400 && code < 500 && code != 429 {
+		log.Printf("Transcript batch POST fatal error: HTTP %d", code)
+		return false, false, false
+	}
+	if code >= 400 {
+		return true, false, false
+	}
+	transcriptLinesPosted.Add(int64(len(lines)))
+	return true, true, false
 }
 
 // sendTranscriptLine POSTs a single transcript line to the server.
-// Returns false if the server returned a fatal error (4xx except 429).
-func sendTranscriptLine(line, sessionID, deviceID, project, relayID, server string) bool {
+// Returns false if the server returned a fatal error (4xx except 429), and
+// delivered if the server accepted the line.
+func sendTranscriptLine(line string, seq int64, sessionID, deviceID, project, relayID, server string) (ok, delivered bool) {
 	// The line is valid JSON — embed it as raw JSON in the data field.
 	// We build the JSON manually to avoid double-encoding the transcript line.
 	payloadJSON := fmt.Sprintf(
-		`{"device_id":%q,"session_id":%q,"project":%q,"relay_id":%q,"data":%s}`,
-		deviceID, sessionID, project, relayID, line,
+		`{"device_id":%q,"session_id":%q,"project":%q,"relay_id":%q,"seq":%d,"data":%s}`,
+		deviceID, sessionID, project, relayID, seq, line,
 	)
 
-	resp, err := postRawJSON(server+"/transcript", []byte(payloadJSON), 5*time.Second)
+	if echoFrames {
+		fmt.Fprintln(os.Stderr, payloadJSON)
+	}
+
+	resp, err := postWithRetry("Transcript", func() (*http.Response, error) {
+		return postRawJSON(server+"/transcript", []byte(payloadJSON), 5*time.Second)
+	})
 	if err != nil {
 		log.Printf("Transcript POST error: %v", err)
-		return true // transient, keep going
+		return true, false // transient, keep going
 	}
 	defer resp.Body.Close()
 
 	code := resp.StatusCode
 	if code >= 400 && code < 500 && code != 429 {
 		log.Printf("Transcript POST fatal error: HTTP %d", code)
-		return false
+		return false, false
+	}
+	if code >= 400 {
+		return true, false
+	}
+	transcriptLinesPosted.Add(1)
+	return true, true
+}
+
+// waitForFile opens path, retrying with exponential backoff until it
+// appears or timeout elapses. Returns nil if the deadline passes.
+func waitForFile(path string, timeout time.Duration) *os.File {
+	deadline := time.Now().Add(timeout)
+	delay := transcriptPollMin
+	for {
+		f, err := os.Open(path)
+		if err == nil {
+			return f
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil
+		}
+		if delay > remaining {
+			delay = remaining
+		}
+		time.Sleep(delay)
+		delay *= 2
+		if delay > transcriptPollMax {
+			delay = transcriptPollMax
+		}
+	}
+}
+
+// streamOffsetPath returns the state file recording how far into its
+// transcript the HTTP streamer for sessionID has sent, so a restarted
+// streamer doesn't send the same lines again.
+func streamOffsetPath(sessionID string) string {
+	return filepath.Join(os.TempDir(), "greenlight-stream-"+sessionID+".offset")
+}
+
+// readStreamOffset returns the saved offset for sessionID, and the
+// sequence number of the last line sent, if there is one for this
+// transcript.
+func readStreamOffset(sessionID, transcriptPath string) (off, seq int64, ok bool) {
+	data, err := os.ReadFile(streamOffsetPath(sessionID))
+	if err != nil {
+		return 0, 0, false
+	}
+	offStr, rest, _ := strings.Cut(strings.TrimSpace(string(data)), " ")
+	seqStr, path, found := strings.Cut(rest, " ")
+	if !found || path != transcriptPath {
+		return 0, 0, false
+	}
+	off, err1 := strconv.ParseInt(offStr, 10, 64)
+	seq, err2 := strconv.ParseInt(seqStr, 10, 64)
+	if err1 != nil || err2 != nil || off < 0 || seq < 0 {
+		return 0, 0, false
+	}
+	return off, seq, true
+}
+
+// writeStreamOffset records that the transcript has been sent up to off,
+// the last line having sequence number seq. The file is replaced
+// atomically so a streamer killed mid-write leaves the previous offset
+// intact.
+func writeStreamOffset(sessionID, transcriptPath string, off, seq int64) {
+	path := streamOffsetPath(sessionID)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d %s", off, seq, transcriptPath)), 0644); err != nil {
+		return
+	}
+	os.Rename(tmp, path)
+}
+
+func fileSize(f *os.File) int64 {
+	info, err := f.Stat()
+	if err != nil {
+		return 0
 	}
-	return true
+	return info.Size()
 }
 
 // seekToLastLines positions the reader near the last N lines of the file.
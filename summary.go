@@ -0,0 +1,72 @@
+//go:build darwin || linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// decisionLogPath is where hooks tally permission decisions for a relay,
+// one behavior ("allow" or "deny") per line.
+func decisionLogPath(relayID string) string {
+	return filepath.Join(os.TempDir(), "greenlight-decisions-"+relayID)
+}
+
+// recordDecision appends a permission decision to the relay's tally.
+func recordDecision(relayID, behavior string) {
+	if relayID == "" || behavior == "" {
+		return
+	}
+	f, err := os.OpenFile(decisionLogPath(relayID), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, behavior)
+}
+
+// readDecisions returns the number of allowed and denied permission
+// requests recorded for a relay.
+func readDecisions(relayID string) (allowed, denied int) {
+	data, err := os.ReadFile(decisionLogPath(relayID))
+	if err != nil {
+		return 0, 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		switch strings.TrimSpace(line) {
+		case "allow":
+			allowed++
+		case "deny":
+			denied++
+		}
+	}
+	return allowed, denied
+}
+
+// sessionSummary builds the one-line connect --summary report.
+func sessionSummary(r *Relay, relayID string) string {
+	parts := []string{"session " + time.Since(r.started).Round(time.Second).String()}
+
+	var sent, recv, lines, reconnects int64
+	if r.ws != nil {
+		sent = r.ws.bytesSent.Load()
+		recv = r.ws.bytesRecv.Load()
+		lines = r.ws.transcriptLines.Load()
+		if n := r.ws.connects.Load(); n > 1 {
+			reconnects = n - 1
+		}
+	}
+	allowed, denied := readDecisions(relayID)
+
+	parts = append(parts,
+		"sent "+formatBytes(sent),
+		"recv "+formatBytes(recv),
+		fmt.Sprintf("transcript %d lines", lines),
+		fmt.Sprintf("permissions %d (%d allowed, %d denied)", allowed+denied, allowed, denied),
+		fmt.Sprintf("reconnects %d", reconnects))
+	return "greenlight: " + strings.Join(parts, " | ")
+}
@@ -14,24 +14,143 @@
 // MOCK_CLAUDE_TRANSCRIPT_INCREMENTAL — Like MOCK_CLAUDE_TRANSCRIPT but
 // writes lines incrementally with delays to simulate a real conversation
 // where transcript entries arrive over time.
+//
+// MOCK_CLAUDE_STTY — Run stty with these (space-separated) arguments on
+// stdin before any other mode, e.g. "-isig" so control characters are read
+// as input instead of raising signals.
+//
+// MOCK_CLAUDE_BURST — Print this many numbered lines, one write each with a
+// short pause between them, like a verbose build.
+//
+// MOCK_CLAUDE_STALL — Put the terminal in raw mode and stop reading stdin
+// for this many seconds, so input written to the PTY backs up.
+//
+// MOCK_CLAUDE_PID — Write the process ID to this file on startup.
+//
+// MOCK_CLAUDE_WINSIZE — Wait for the terminal to be resized (SIGWINCH),
+// then write its new size as "rows cols" to this file.
+//
+// MOCK_CLAUDE_COUNT — Read stdin up to a '.' and write the number of bytes
+// before it to this file. Use with MOCK_CLAUDE_STTY="raw -echo" so input
+// longer than a terminal line arrives intact.
+//
+// MOCK_CLAUDE_PASTE — Read stdin up to a '.' and write the bytes before it
+// to this file. Use with MOCK_CLAUDE_STTY="raw -echo" so they arrive
+// unaltered.
+//
+// MOCK_CLAUDE_FINAL — Write this many bytes of output in one go, then
+// "FINAL_OUTPUT_END", and exit at once, like an agent printing its last
+// screen on the way out.
+//
+// MOCK_CLAUDE_EXIT — Exit with this status after starting, or kill itself
+// with SIGKILL if set to "KILL".
+//
+// MOCK_CLAUDE_IGNORE_HUP — Ignore SIGHUP, like an agent that keeps running
+// after its terminal goes away.
+//
+// MOCK_CLAUDE_IGNORE_TERM — Ignore SIGTERM, like an agent that hangs on
+// shutdown.
 package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
 func main() {
+	if os.Getenv("MOCK_CLAUDE_IGNORE_HUP") != "" {
+		signal.Ignore(syscall.SIGHUP)
+	}
+	if os.Getenv("MOCK_CLAUDE_IGNORE_TERM") != "" {
+		signal.Ignore(syscall.SIGTERM)
+	}
+
+	if args := os.Getenv("MOCK_CLAUDE_STTY"); args != "" {
+		stty := exec.Command("stty", strings.Fields(args)...)
+		stty.Stdin = os.Stdin
+		stty.Run()
+	}
+
+	if path := os.Getenv("MOCK_CLAUDE_PID"); path != "" {
+		os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())), 0644)
+	}
+
+	if path := os.Getenv("MOCK_CLAUDE_ARGS"); path != "" {
+		os.WriteFile(path, []byte(strings.Join(os.Args[1:], " ")), 0644)
+	}
+
+	if d := os.Getenv("MOCK_CLAUDE_START_DELAY"); d != "" {
+		delay, _ := time.ParseDuration(d)
+		time.Sleep(delay)
+	}
+
+	// Listen before announcing ourselves, so no resize is missed
+	var winch chan os.Signal
+	if os.Getenv("MOCK_CLAUDE_WINSIZE") != "" {
+		winch = make(chan os.Signal, 1)
+		signal.Notify(winch, syscall.SIGWINCH)
+	}
+
 	fmt.Println("MOCK_CLAUDE_STARTED")
 
+	if title := os.Getenv("MOCK_CLAUDE_TITLE"); title != "" {
+		// Split the sequence across two writes so it arrives in two reads
+		half := len(title) / 2
+		os.Stdout.WriteString("\x1b]0;" + title[:half])
+		time.Sleep(200 * time.Millisecond)
+		os.Stdout.WriteString(title[half:] + "\x07")
+	}
+
+	if n := os.Getenv("MOCK_CLAUDE_BURST"); n != "" {
+		count, _ := strconv.Atoi(n)
+		for i := 1; i <= count; i++ {
+			fmt.Printf("BURST_LINE_%d\n", i)
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if code := os.Getenv("MOCK_CLAUDE_EXIT"); code != "" {
+		if code == "KILL" {
+			syscall.Kill(os.Getpid(), syscall.SIGKILL)
+		}
+		n, _ := strconv.Atoi(code)
+		os.Exit(n)
+	}
+
+	if n := os.Getenv("MOCK_CLAUDE_FINAL"); n != "" {
+		size, _ := strconv.Atoi(n)
+		os.Stdout.Write(append(bytes.Repeat([]byte{'x'}, size), "FINAL_OUTPUT_END\n"...))
+		return
+	}
+
+	if path := os.Getenv("MOCK_CLAUDE_WINSIZE"); path != "" {
+		reportWinsize(path, winch)
+		return
+	}
+
 	if path := os.Getenv("MOCK_CLAUDE_OUTPUT"); path != "" {
 		readStdinToFile(path)
 		return
 	}
 
+	if path := os.Getenv("MOCK_CLAUDE_COUNT"); path != "" {
+		countStdin(path)
+		return
+	}
+
+	if path := os.Getenv("MOCK_CLAUDE_PASTE"); path != "" {
+		readPaste(path)
+		return
+	}
+
 	if path := os.Getenv("MOCK_CLAUDE_TRANSCRIPT"); path != "" {
 		runTranscriptTest(path)
 		return
@@ -41,6 +160,52 @@ func main() {
 		runTranscriptTestIncremental(path)
 		return
 	}
+
+	if secs := os.Getenv("MOCK_CLAUDE_STALL"); secs != "" {
+		stall(secs)
+		return
+	}
+}
+
+func countStdin(path string) {
+	data, err := bufio.NewReader(os.Stdin).ReadBytes('.')
+	if err != nil {
+		os.WriteFile(path, []byte("ERROR: "+err.Error()), 0644)
+		return
+	}
+	os.WriteFile(path, []byte(strconv.Itoa(len(data)-1)), 0644)
+}
+
+func readPaste(path string) {
+	data, err := bufio.NewReader(os.Stdin).ReadBytes('.')
+	if err != nil {
+		os.WriteFile(path, []byte("ERROR: "+err.Error()), 0644)
+		return
+	}
+	os.WriteFile(path, data[:len(data)-1], 0644)
+}
+
+func stall(secs string) {
+	// Raw mode so the line discipline buffers input instead of discarding it
+	stty := exec.Command("stty", "raw", "-echo")
+	stty.Stdin = os.Stdin
+	stty.Run()
+
+	n, _ := strconv.Atoi(secs)
+	time.Sleep(time.Duration(n) * time.Second)
+}
+
+func reportWinsize(path string, winch chan os.Signal) {
+	select {
+	case <-winch:
+	case <-time.After(10 * time.Second):
+		os.WriteFile(path, []byte("TIMEOUT: no resize"), 0644)
+		return
+	}
+	stty := exec.Command("stty", "size")
+	stty.Stdin = os.Stdin
+	out, _ := stty.Output()
+	os.WriteFile(path, bytes.TrimSpace(out), 0644)
 }
 
 func readStdinToFile(outputPath string) {
@@ -0,0 +1,90 @@
+//go:build darwin || linux
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// maxOSCLength bounds how much of an unterminated OSC sequence titleParser
+// holds while waiting for its terminator.
+const maxOSCLength = 4096
+
+// titleFrame is the control frame reporting a terminal title set by the
+// agent: {"type":"title","title":"..."}
+type titleFrame struct {
+	Type  string `json:"type"`
+	Title string `json:"title"`
+}
+
+// titleParser finds OSC 0 and OSC 2 title-set sequences
+// (ESC ] 0 ; title BEL, or terminated by ESC \) in PTY output. It keeps
+// state between calls, so a sequence split across reads is still found.
+// The output itself is not modified.
+type titleParser struct {
+	esc   bool // previous byte was ESC
+	inOSC bool
+	buf   []byte
+}
+
+// feed scans a chunk of output and returns the titles completed in it.
+func (p *titleParser) feed(data []byte) []string {
+	var titles []string
+	for _, b := range data {
+		if !p.inOSC {
+			if p.esc && b == ']' {
+				p.inOSC = true
+				p.buf = p.buf[:0]
+			}
+			p.esc = b == 0x1b
+			continue
+		}
+
+		if p.esc {
+			// ESC \ is the string terminator; any other ESC aborts the OSC
+			p.esc = false
+			if b == '\\' {
+				titles = p.finish(titles)
+				continue
+			}
+			p.inOSC = false
+			if b == ']' {
+				p.inOSC = true
+				p.buf = p.buf[:0]
+			}
+			continue
+		}
+
+		switch b {
+		case 0x07:
+			titles = p.finish(titles)
+		case 0x1b:
+			p.esc = true
+		default:
+			if len(p.buf) >= maxOSCLength {
+				p.inOSC = false
+				continue
+			}
+			p.buf = append(p.buf, b)
+		}
+	}
+	return titles
+}
+
+// finish ends the current OSC sequence, appending its title to titles if
+// it was a title-set sequence.
+func (p *titleParser) finish(titles []string) []string {
+	p.inOSC = false
+	s := string(p.buf)
+	if strings.HasPrefix(s, "0;") || strings.HasPrefix(s, "2;") {
+		titles = append(titles, s[2:])
+	}
+	return titles
+}
+
+// encodeTitleFrame builds the control frame for a title change.
+func encodeTitleFrame(title string) []byte {
+	b, _ := json.Marshal(titleFrame{Type: "title", Title: title})
+	return b
+}
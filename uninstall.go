@@ -0,0 +1,117 @@
+//go:build darwin || linux
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// runUninstall removes the greenlight hooks that connect installed into
+// .claude/settings.local.json (or the --settings-file) in the current
+// directory, or with --global into ~/.claude/settings.json. Other hooks and settings are left alone.
+// Running it again is a no-op.
+func runUninstall(args []string) {
+	fs := flag.NewFlagSet("uninstall", flag.ExitOnError)
+	global := fs.Bool("global", false, "Remove the hooks from ~/.claude/settings.json instead")
+	settingsFileFlag := fs.String("settings-file", "", `Project settings file in .claude to remove the hooks from: "settings.local.json" (default) or "settings.json"`)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Usage: greenlight uninstall [--global] [--settings-file NAME]\n")
+		os.Exit(1)
+	}
+
+	settingsName, err := settingsFile(*settingsFileFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight uninstall: %v\n", err)
+		os.Exit(1)
+	}
+	settingsPath, err := hookSettingsPath(*global, settingsName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight uninstall: %v\n", err)
+		os.Exit(1)
+	}
+	removed, deleted, err := uninstallHooks(settingsPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "greenlight uninstall: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(removed) == 0 {
+		fmt.Printf("No greenlight hooks found in %s\n", settingsPath)
+		return
+	}
+	for _, event := range removed {
+		fmt.Printf("Removed greenlight hook for %s\n", event)
+	}
+	if deleted {
+		fmt.Printf("Deleted %s (no other settings left)\n", settingsPath)
+	} else {
+		fmt.Printf("Updated %s\n", settingsPath)
+	}
+}
+
+// uninstallHooks strips greenlight hook entries from every event in the
+// settings file at path, dropping events and a "hooks" map left empty. The
+// file is deleted if nothing else remains in it and installHooks created it
+// (see settingsCreated); a file the user made is kept, if empty. Returns
+// the events that had a greenlight hook, and whether the file was deleted.
+func uninstallHooks(path string) ([]string, bool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var settings map[string]interface{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, false, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	hooks, _ := settings["hooks"].(map[string]interface{})
+	var removed []string
+	for event, existing := range hooks {
+		arr, ok := existing.([]interface{})
+		if !ok {
+			continue
+		}
+		cleaned := removeGreenlightHooks(arr)
+		if len(cleaned) == len(arr) {
+			continue
+		}
+		removed = append(removed, event)
+		if len(cleaned) == 0 {
+			delete(hooks, event)
+		} else {
+			hooks[event] = cleaned
+		}
+	}
+	if len(removed) == 0 {
+		return nil, false, nil
+	}
+	sort.Strings(removed)
+
+	if len(hooks) == 0 {
+		delete(settings, "hooks")
+	}
+	if len(settings) == 0 && settingsCreated(path) {
+		if err := os.Remove(path); err != nil {
+			return nil, false, err
+		}
+		markSettingsCreated(path, false)
+		return removed, true, nil
+	}
+
+	out, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return nil, false, fmt.Errorf("marshal settings: %w", err)
+	}
+	if err := os.WriteFile(path, append(out, '\n'), 0644); err != nil {
+		return nil, false, fmt.Errorf("write %s: %w", path, err)
+	}
+	return removed, false, nil
+}
@@ -5,10 +5,14 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"nhooyr.io/websocket"
@@ -23,6 +27,42 @@ const (
 	WSModeW                // write output to server only
 )
 
+// parseWSMode parses a connect --ws-mode value: "rw", "r" or "w".
+func parseWSMode(s string) (WSMode, error) {
+	switch s {
+	case "rw":
+		return WSModeRW, nil
+	case "r":
+		return WSModeR, nil
+	case "w":
+		return WSModeW, nil
+	}
+	return 0, fmt.Errorf("invalid WebSocket mode %q (want rw, r or w)", s)
+}
+
+// Keepalive defaults: ping the server every defaultPingInterval and treat
+// no pong within defaultPingTimeout as a dead connection.
+const (
+	defaultPingInterval = 30 * time.Second
+	defaultPingTimeout  = 10 * time.Second
+)
+
+// Output coalescing defaults: binary output is merged into one frame per
+// defaultCoalesceInterval, overridable with GREENLIGHT_WS_COALESCE or
+// ws_coalesce in the config file, and flushed early once coalesceMaxBytes
+// are buffered.
+const (
+	defaultCoalesceInterval = 16 * time.Millisecond
+	coalesceMaxBytes        = 64 << 10
+)
+
+// Relay protocol versions, offered to the relay as WebSocket subprotocols
+// in order of preference. A relay that predates versioning picks none and
+// is spoken to as wsProtocolV1.
+const wsProtocolV1 = "greenlight.v1"
+
+var wsSubprotocols = []string{wsProtocolV1}
+
 // textQueueSize is the max number of text messages buffered during disconnection.
 const textQueueSize = 1024
 
@@ -35,6 +75,76 @@ type WSClient struct {
 	mode   WSMode
 	inject func([]byte) error
 
+	// verbatim passes received frames to inject unchanged, without the
+	// newline translation and delayed Enter used for typing into a TUI
+	// (attach, and connect --raw-inject).
+	verbatim bool
+
+	// injectDelay is how long handleFrame waits between typing received
+	// text and sending the Enter that submits it.
+	injectDelay time.Duration
+
+	// fileRoot is the sandbox directory for file control frames pushed by
+	// the relay. Empty disables file push.
+	fileRoot string
+
+	// instantRetry makes the first reconnect after a disconnect immediate,
+	// before falling back to exponential backoff.
+	instantRetry bool
+
+	// Reconnect backoff: baseDelay doubles per attempt up to maxDelay,
+	// with ±jitterFraction of random jitter.
+	baseDelay      time.Duration
+	maxDelay       time.Duration
+	jitterFraction float64
+
+	// Keepalive pings detect connections silently dropped by NATs.
+	// A zero pingInterval disables them.
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+
+	// Output coalescing for Send (see coalesceInterval). A zero coalesce
+	// sends every chunk as its own frame. Protected by outMu.
+	coalesce  time.Duration
+	outMu     sync.Mutex
+	outBuf    []byte
+	outTimer  *time.Timer
+	lastFlush time.Time
+
+	// capture records every frame when GREENLIGHT_WS_CAPTURE is set.
+	capture *wsCapture
+
+	// selectPane, if set, handles select_pane control frames choosing
+	// which pane remote input goes to (see AddPane).
+	selectPane func(int) bool
+
+	// resize, if set, handles resize control frames giving the remote
+	// viewer's terminal size (see resizeFrame).
+	resize func(cols, rows int)
+
+	// onInput, if set, is called with each message that is about to be
+	// injected as input, as received (connect --mirror-input).
+	onInput func([]byte)
+
+	// onFatal, if set, is called when the relay refuses the connection in
+	// a way retrying won't fix (see relayRejectedError and
+	// unsupportedProtocolError). Run stops reconnecting and returns after
+	// calling it.
+	onFatal func(error)
+
+	// awaitingApproval, if set, reports whether the session is still
+	// waiting to be approved (connect --async-enroll). Until it is, a
+	// relay rejection is retried like any other failure, since the relay
+	// may refuse a session it doesn't know is approved yet.
+	awaitingApproval func() bool
+
+	// onConnect and onDisconnect, if set, are called when a connection to
+	// the relay is established and when an established connection drops.
+	// reconnect is 0 for the first connection and counts up after that.
+	// Neither is called for the close at shutdown.
+	onConnect    func(reconnect int)
+	onDisconnect func(err error)
+
 	done chan struct{}
 	wg   sync.WaitGroup
 
@@ -47,27 +157,84 @@ type WSClient struct {
 	// a write fails, and drained on reconnection.
 	textMu    sync.Mutex
 	textQueue [][]byte
+
+	// spill mirrors textQueue to disk when GREENLIGHT_QUEUE_SPILL is set
+	// (see EnableSpill). Protected by textMu.
+	spill *textSpill
+
+	// Byte counters for frames sent to and received from the server.
+	bytesSent atomic.Int64
+	bytesRecv atomic.Int64
+
+	// Session statistics for connect --summary and --metrics-addr.
+	connects        atomic.Int64 // successful connections, including the first
+	transcriptLines atomic.Int64 // transcript frames handed to SendText
+	framesDropped   atomic.Int64 // frames lost while disconnected or to a full queue
 }
 
 // NewWSClient creates a new WebSocket client. Call Run to start connecting.
 func NewWSClient(url, token string, mode WSMode, inject func([]byte) error) *WSClient {
 	return &WSClient{
-		url:    url,
-		token:  token,
-		mode:   mode,
-		inject: inject,
-		done:   make(chan struct{}),
+		url:            url,
+		token:          token,
+		mode:           mode,
+		inject:         inject,
+		instantRetry:   envOrConfig("GREENLIGHT_WS_INSTANT_RETRY", "ws_instant_retry") != "0",
+		baseDelay:      backoffSetting("GREENLIGHT_WS_BACKOFF_BASE", "ws_backoff_base", defaultBackoffBase),
+		maxDelay:       backoffSetting("GREENLIGHT_WS_BACKOFF_MAX", "ws_backoff_max", defaultBackoffMax),
+		jitterFraction: defaultBackoffJitter,
+		pingInterval:   defaultPingInterval,
+		pingTimeout:    defaultPingTimeout,
+		coalesce:       coalesceInterval(),
+		injectDelay:    injectDelay(),
+		capture:        openCapture(),
+		done:           make(chan struct{}),
 	}
 }
 
+// relayRejectedError is returned when the relay answers the WebSocket
+// upgrade with 401 or 403, e.g. because the token is wrong.
+type relayRejectedError struct {
+	status int
+}
+
+func (e *relayRejectedError) Error() string {
+	return fmt.Sprintf("relay rejected connection (HTTP %d)", e.status)
+}
+
+// unsupportedProtocolError is returned when the relay accepts the WebSocket
+// upgrade but picks a protocol version greenlight doesn't speak.
+type unsupportedProtocolError struct {
+	protocol string
+}
+
+func (e *unsupportedProtocolError) Error() string {
+	return fmt.Sprintf("relay requires protocol %q, which this version of greenlight doesn't support; upgrade greenlight", e.protocol)
+}
+
+// explainFatal describes an error passed to onFatal, with advice on fixing
+// it where there is some.
+func explainFatal(err error) string {
+	var rejected *relayRejectedError
+	if errors.As(err, &rejected) {
+		return err.Error() + ": check your token (GREENLIGHT_TOKEN or token in the config file)"
+	}
+	return err.Error()
+}
+
 // Run connects to the WebSocket server and reads messages in a loop.
-// On disconnect, it reconnects with exponential backoff.
-// Blocks until Close is called.
+// On disconnect, it reconnects immediately once (if instantRetry is set),
+// then with exponential backoff. If the relay rejects the connection (see
+// relayRejectedError) or speaks an unknown protocol version (see
+// unsupportedProtocolError) it calls onFatal and gives up, except that
+// rejections are retried while awaitingApproval reports true.
+// Blocks until Close is called or the relay rejects the connection.
 func (c *WSClient) Run() {
 	c.wg.Add(1)
 	defer c.wg.Done()
 
 	var attempt int
+	instant := c.instantRetry
 	for {
 		select {
 		case <-c.done:
@@ -81,11 +248,23 @@ func (c *WSClient) Run() {
 			// Clean shutdown via Close()
 			return
 		}
+		var rejected *relayRejectedError
+		var unsupported *unsupportedProtocolError
+		if errors.As(err, &rejected) && c.awaitingApproval != nil && c.awaitingApproval() {
+			log.Printf("ws: %v, retrying until the session is approved", err)
+		} else if errors.As(err, &rejected) || errors.As(err, &unsupported) {
+			log.Printf("ws: %v, not reconnecting", err)
+			if c.onFatal != nil {
+				c.onFatal(err)
+			}
+			return
+		}
 
 		// Reset backoff if the connection lasted more than 60s,
 		// so transient failures after a long session start fresh.
 		if time.Since(connStart) > 60*time.Second {
 			attempt = 0
+			instant = c.instantRetry
 		}
 
 		select {
@@ -94,9 +273,16 @@ func (c *WSClient) Run() {
 		default:
 		}
 
-		delay := backoff(attempt)
+		// A brief blip usually clears at once, so retry immediately
+		// before starting the backoff schedule.
+		var delay time.Duration
+		if instant {
+			instant = false
+		} else {
+			delay = c.backoff(attempt)
+			attempt++
+		}
 		log.Printf("ws: disconnected (%v), reconnecting in %v", err, delay)
-		attempt++
 
 		select {
 		case <-time.After(delay):
@@ -108,16 +294,69 @@ func (c *WSClient) Run() {
 
 // Send writes PTY output to the remote server as a binary frame. Safe to call
 // from any goroutine. Silently drops data if not connected or if mode is read-only.
+//
+// With coalescing enabled (see coalesceInterval), output arriving within
+// the interval of the last frame is buffered and sent as one frame when
+// the interval ends or the buffer reaches coalesceMaxBytes. Output after
+// an idle period is sent straight away, so typing stays responsive.
+// SendText and SendPane flush the buffer first, so frames keep their order.
 func (c *WSClient) Send(data []byte) {
 	if c.mode == WSModeR {
 		return
 	}
+	if c.coalesce <= 0 {
+		c.writeBinary(data)
+		return
+	}
+
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+
+	since := time.Since(c.lastFlush)
+	if len(c.outBuf) == 0 && since >= c.coalesce {
+		c.writeBinary(data)
+		c.lastFlush = time.Now()
+		return
+	}
 
+	c.outBuf = append(c.outBuf, data...)
+	if len(c.outBuf) >= coalesceMaxBytes {
+		c.flushOutputLocked()
+		return
+	}
+	if c.outTimer == nil {
+		c.outTimer = time.AfterFunc(c.coalesce-since, c.flushOutput)
+	}
+}
+
+// flushOutput sends any output buffered by Send.
+func (c *WSClient) flushOutput() {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	c.flushOutputLocked()
+}
+
+func (c *WSClient) flushOutputLocked() {
+	if c.outTimer != nil {
+		c.outTimer.Stop()
+		c.outTimer = nil
+	}
+	if len(c.outBuf) == 0 {
+		return
+	}
+	c.writeBinary(c.outBuf)
+	c.outBuf = c.outBuf[:0]
+	c.lastFlush = time.Now()
+}
+
+// writeBinary sends one binary frame, dropping it if not connected.
+func (c *WSClient) writeBinary(data []byte) {
 	c.connMu.Lock()
 	conn := c.conn
 	c.connMu.Unlock()
 
 	if conn == nil {
+		c.framesDropped.Add(1)
 		return
 	}
 
@@ -126,7 +365,41 @@ func (c *WSClient) Send(data []byte) {
 
 	if err := conn.Write(ctx, websocket.MessageBinary, data); err != nil {
 		log.Printf("ws: binary write error: %v", err)
+		c.framesDropped.Add(1)
+		return
 	}
+	c.bytesSent.Add(int64(len(data)))
+	c.capture.record("out", websocket.MessageBinary, data)
+}
+
+// SendPane writes a chunk of PTY output from the given pane as a tagged
+// text frame. Like Send, it drops data if not connected.
+func (c *WSClient) SendPane(id int, data []byte) {
+	if c.mode == WSModeR {
+		return
+	}
+	c.flushOutput()
+
+	c.connMu.Lock()
+	conn := c.conn
+	c.connMu.Unlock()
+
+	if conn == nil {
+		c.framesDropped.Add(1)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	frame := encodePaneFrame(id, data)
+	if err := conn.Write(ctx, websocket.MessageText, frame); err != nil {
+		log.Printf("ws: pane write error: %v", err)
+		c.framesDropped.Add(1)
+		return
+	}
+	c.bytesSent.Add(int64(len(frame)))
+	c.capture.record("out", websocket.MessageText, frame)
 }
 
 // SendText writes a text frame to the remote server. Used for JSON messages
@@ -136,6 +409,9 @@ func (c *WSClient) SendText(data []byte) {
 	if c.mode == WSModeR {
 		return
 	}
+	// Output still waiting in the coalesce buffer was produced before
+	// this frame, so it has to reach the app first.
+	c.flushOutput()
 
 	c.connMu.Lock()
 	conn := c.conn
@@ -152,7 +428,10 @@ func (c *WSClient) SendText(data []byte) {
 	if err := conn.Write(ctx, websocket.MessageText, data); err != nil {
 		log.Printf("ws: text write error: %v", err)
 		c.enqueueText(data)
+		return
 	}
+	c.bytesSent.Add(int64(len(data)))
+	c.capture.record("out", websocket.MessageText, data)
 }
 
 // enqueueText adds a text message to the retry queue. If the queue is full,
@@ -167,9 +446,29 @@ func (c *WSClient) enqueueText(data []byte) {
 	if len(c.textQueue) >= textQueueSize {
 		// Drop the oldest message to make room.
 		log.Printf("ws: text queue full (%d), dropping oldest message", textQueueSize)
+		c.framesDropped.Add(1)
 		c.textQueue = c.textQueue[1:]
+		c.textQueue = append(c.textQueue, cp)
+		c.spill.rewrite(c.textQueue)
+		return
 	}
 	c.textQueue = append(c.textQueue, cp)
+	c.spill.append(cp)
+}
+
+// EnableSpill backs the text queue with a file keyed by relayID and queues
+// any messages a previous run for the same relay failed to deliver. Must be
+// called before Run.
+func (c *WSClient) EnableSpill(relayID string) {
+	spill, pending := openTextSpill(relayID)
+
+	c.textMu.Lock()
+	defer c.textMu.Unlock()
+	c.spill = spill
+	if len(pending) > 0 {
+		log.Printf("ws: replaying %d undelivered text messages", len(pending))
+		c.textQueue = append(pending, c.textQueue...)
+	}
 }
 
 // drainTextQueue sends all queued text messages over the connection.
@@ -199,16 +498,55 @@ func (c *WSClient) drainTextQueue(conn *websocket.Conn) {
 			if len(c.textQueue) > textQueueSize {
 				c.textQueue = c.textQueue[:textQueueSize]
 			}
+			c.spill.rewrite(c.textQueue)
 			c.textMu.Unlock()
 			return
 		}
+		c.bytesSent.Add(int64(len(msg)))
+		c.capture.record("out", websocket.MessageText, msg)
 	}
+
+	// Everything drained was delivered; keep only what arrived meanwhile
+	c.textMu.Lock()
+	c.spill.rewrite(c.textQueue)
+	c.textMu.Unlock()
 }
 
-// Close signals the client to stop and waits for it to exit.
+// Close sends any buffered output, then signals the client to stop and
+// waits for it to exit.
 func (c *WSClient) Close() {
+	c.flushOutput()
 	close(c.done)
 	c.wg.Wait()
+	c.capture.close()
+
+	c.textMu.Lock()
+	c.spill.close(len(c.textQueue) == 0)
+	c.spill = nil
+	c.textMu.Unlock()
+}
+
+// Connected reports whether the client currently has a live connection.
+func (c *WSClient) Connected() bool {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.conn != nil
+}
+
+// Ping sends a ping to the server and returns the round-trip time.
+func (c *WSClient) Ping(ctx context.Context) (time.Duration, error) {
+	c.connMu.Lock()
+	conn := c.conn
+	c.connMu.Unlock()
+
+	if conn == nil {
+		return 0, errors.New("not connected")
+	}
+	start := time.Now()
+	if err := conn.Ping(ctx); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
 }
 
 func (c *WSClient) setConn(conn *websocket.Conn) {
@@ -217,6 +555,15 @@ func (c *WSClient) setConn(conn *websocket.Conn) {
 	c.connMu.Unlock()
 }
 
+// negotiatedProtocol returns the protocol version the relay picked for
+// conn. One that picked none predates versioning and speaks v1.
+func negotiatedProtocol(conn *websocket.Conn) string {
+	if p := conn.Subprotocol(); p != "" {
+		return p
+	}
+	return wsProtocolV1
+}
+
 func (c *WSClient) connectAndRead() error {
 	// Create a context that cancels when Close() is called,
 	// so conn.Read unblocks immediately on shutdown.
@@ -230,20 +577,17 @@ func (c *WSClient) connectAndRead() error {
 	}()
 	defer cancel()
 
-	// Build dial options with optional auth header
-	opts := &websocket.DialOptions{}
-	if c.token != "" {
-		opts.HTTPHeader = http.Header{
-			"Authorization": []string{"Bearer " + c.token},
-		}
+	opts, err := wsDialOptions(c.token)
+	if err != nil {
+		return err
 	}
 
 	dialCtx, dialCancel := context.WithTimeout(ctx, 10*time.Second)
 	defer dialCancel()
 
-	conn, _, err := websocket.Dial(dialCtx, c.url, opts)
+	conn, resp, err := websocket.Dial(dialCtx, c.url, opts)
 	if err != nil {
-		return err
+		return dialError(resp, err)
 	}
 	defer func() {
 		c.setConn(nil)
@@ -251,14 +595,22 @@ func (c *WSClient) connectAndRead() error {
 	}()
 
 	c.setConn(conn)
-	log.Printf("ws: connected to %s", c.url)
+	n := c.connects.Add(1)
+	log.Printf("ws: connected to %s (protocol %s)", c.url, negotiatedProtocol(conn))
+	if c.onConnect != nil {
+		c.onConnect(int(n - 1))
+	}
 
 	// Drain any text messages that were queued during disconnection.
 	c.drainTextQueue(conn)
 
+	if c.pingInterval > 0 {
+		go c.keepalive(ctx, conn)
+	}
+
 	// Read loop: each message is raw bytes to inject
 	for {
-		_, data, err := conn.Read(ctx)
+		typ, data, err := conn.Read(ctx)
 		if err != nil {
 			// If we're shutting down, report clean exit
 			select {
@@ -267,49 +619,256 @@ func (c *WSClient) connectAndRead() error {
 				return nil
 			default:
 			}
+			if c.onDisconnect != nil {
+				c.onDisconnect(err)
+			}
 			return err
 		}
 
-		if len(data) > 0 && c.mode != WSModeW {
-			// In raw mode, Enter is \r (0x0D), not \n (0x0A).
-			data = bytes.ReplaceAll(data, []byte{'\n'}, []byte{'\r'})
+		c.bytesRecv.Add(int64(len(data)))
+		c.capture.record("in", typ, data)
+		c.handleFrame(typ, data)
+	}
+}
 
-			// Strip any trailing \r — we'll send it separately below.
-			text := bytes.TrimRight(data, "\r")
-			needsSubmit := len(text) < len(data) || len(text) > 0
+// wsDialOptions builds the dial options for the relay, with the auth
+// header if there is a token.
+func wsDialOptions(token string) (*websocket.DialOptions, error) {
+	t, err := relayTransport()
+	if err != nil {
+		return nil, err
+	}
+	opts := &websocket.DialOptions{
+		HTTPClient:   &http.Client{Transport: t},
+		Subprotocols: wsSubprotocols,
+	}
+	if token != "" {
+		opts.HTTPHeader = http.Header{
+			"Authorization": []string{"Bearer " + token},
+		}
+	}
+	return opts, nil
+}
 
-			// Inject the text content first.
-			if len(text) > 0 {
-				if err := c.inject(text); err != nil {
-					log.Printf("ws: inject error: %v", err)
-				}
+// dialError turns a failed upgrade the relay answered with 401 or 403 into
+// a relayRejectedError, and one where it picked a protocol version we
+// didn't offer into an unsupportedProtocolError. Other failures are
+// returned as they are.
+func dialError(resp *http.Response, err error) error {
+	if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		return &relayRejectedError{status: resp.StatusCode}
+	}
+	if resp != nil && resp.StatusCode == http.StatusSwitchingProtocols {
+		if p := resp.Header.Get("Sec-WebSocket-Protocol"); p != "" && !knownProtocol(p) {
+			return &unsupportedProtocolError{protocol: p}
+		}
+	}
+	return err
+}
+
+func knownProtocol(p string) bool {
+	for _, known := range wsSubprotocols {
+		if strings.EqualFold(p, known) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialCheck opens a WebSocket to url and closes it again, reporting how
+// long the handshake took.
+func dialCheck(url, token string) (time.Duration, error) {
+	opts, err := wsDialOptions(token)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	conn, resp, err := websocket.Dial(ctx, url, opts)
+	if err != nil {
+		return 0, dialError(resp, err)
+	}
+	elapsed := time.Since(start)
+	conn.Close(websocket.StatusNormalClosure, "dry run")
+	return elapsed, nil
+}
+
+// keepalive pings the server every pingInterval until ctx is done. A failed
+// ping closes the connection, which ends the read loop and triggers a
+// reconnect.
+func (c *WSClient) keepalive(ctx context.Context, conn *websocket.Conn) {
+	ticker := time.NewTicker(c.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, c.pingTimeout)
+		err := conn.Ping(pingCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("ws: keepalive ping failed: %v", err)
+				conn.CloseNow()
 			}
+			return
+		}
+	}
+}
 
-			// Then send \r separately after a brief delay, simulating
-			// the user pressing Enter. Sending it in one write with the
-			// text can cause TUI apps to treat it as a paste.
-			if needsSubmit {
-				time.Sleep(50 * time.Millisecond)
-				if err := c.inject([]byte{'\r'}); err != nil {
-					log.Printf("ws: inject error: %v", err)
+// handleFrame processes one frame received from the server: control frames
+// are handled here, anything else is injected as input.
+func (c *WSClient) handleFrame(typ websocket.MessageType, data []byte) {
+	// A write-only client sends output and acts on nothing it receives
+	if c.mode == WSModeW {
+		return
+	}
+	if typ == websocket.MessageText {
+		if f, ok := parseFileFrame(data); ok {
+			c.handleFileFrame(f)
+			return
+		}
+		if cols, rows, ok := parseResizeFrame(data); ok {
+			if c.resize != nil {
+				c.resize(cols, rows)
+			}
+			return
+		}
+		if c.selectPane != nil {
+			if id, ok := parseSelectPane(data); ok {
+				if !c.selectPane(id) {
+					log.Printf("ws: no such pane %d", id)
 				}
+				return
 			}
 		}
 	}
+
+	if len(data) == 0 {
+		return
+	}
+	if c.onInput != nil {
+		c.onInput(data)
+	}
+	if c.verbatim {
+		if err := c.inject(data); err != nil {
+			log.Printf("ws: inject error: %v", err)
+		}
+		return
+	}
+
+	// In raw mode, Enter is \r (0x0D), not \n (0x0A).
+	data = bytes.ReplaceAll(data, []byte{'\n'}, []byte{'\r'})
+
+	// Strip any trailing \r — we'll send it separately below.
+	text := bytes.TrimRight(data, "\r")
+	needsSubmit := len(text) < len(data) || len(text) > 0
+
+	// Inject the text content first.
+	if len(text) > 0 {
+		if err := c.inject(text); err != nil {
+			log.Printf("ws: inject error: %v", err)
+		}
+	}
+
+	// Then send \r separately after a brief delay, simulating
+	// the user pressing Enter. Sending it in one write with the
+	// text can cause TUI apps to treat it as a paste.
+	if needsSubmit {
+		time.Sleep(c.injectDelay)
+		if err := c.inject([]byte{'\r'}); err != nil {
+			log.Printf("ws: inject error: %v", err)
+		}
+	}
+}
+
+// coalesceInterval returns the configured output coalescing interval;
+// "0" disables coalescing.
+func coalesceInterval() time.Duration {
+	v := envOrConfig("GREENLIGHT_WS_COALESCE", "ws_coalesce")
+	if v == "" {
+		return defaultCoalesceInterval
+	}
+	if v == "0" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("Warning: invalid coalesce interval %q, using %v", v, defaultCoalesceInterval)
+		return defaultCoalesceInterval
+	}
+	return d
+}
+
+// defaultInjectDelay is the pause between typing remote input and the
+// Enter that submits it, overridable with GREENLIGHT_INJECT_DELAY or
+// inject_delay in the config file. Slow terminals may need longer to keep
+// the two from arriving as one paste.
+const defaultInjectDelay = 50 * time.Millisecond
+
+// injectDelay returns the configured pause before the submitting Enter.
+func injectDelay() time.Duration {
+	v := envOrConfig("GREENLIGHT_INJECT_DELAY", "inject_delay")
+	if v == "" {
+		return defaultInjectDelay
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("Warning: invalid inject delay %q, using %v", v, defaultInjectDelay)
+		return defaultInjectDelay
+	}
+	return d
 }
 
-// backoff returns a duration for the given attempt number.
-// Exponential: 1s, 2s, 4s, 8s, 16s, 30s (capped) with ±25% jitter.
+// Reconnect backoff defaults. The base and cap can be overridden with
+// GREENLIGHT_WS_BACKOFF_BASE and GREENLIGHT_WS_BACKOFF_MAX (or
+// ws_backoff_base and ws_backoff_max in the config file).
+const (
+	defaultBackoffBase   = time.Second
+	defaultBackoffMax    = 30 * time.Second
+	defaultBackoffJitter = 0.25
+)
+
+// backoff returns a duration for the given attempt number using the default
+// schedule: 1s, 2s, 4s, 8s, 16s, 30s (capped) with ±25% jitter.
 func backoff(attempt int) time.Duration {
-	const maxDelay = 30 * time.Second
+	return backoffDelay(attempt, defaultBackoffBase, defaultBackoffMax, defaultBackoffJitter)
+}
+
+// backoff returns the reconnect delay for the given attempt number using
+// the client's schedule.
+func (c *WSClient) backoff(attempt int) time.Duration {
+	return backoffDelay(attempt, c.baseDelay, c.maxDelay, c.jitterFraction)
+}
+
+// backoffDelay doubles base for each attempt up to maxDelay, then adds up
+// to ±jitter of the result at random.
+func backoffDelay(attempt int, base, maxDelay time.Duration, jitter float64) time.Duration {
 	if attempt > 30 {
 		attempt = 30 // prevent integer overflow in shift
 	}
-	base := time.Second * time.Duration(1<<uint(attempt))
-	if base > maxDelay {
-		base = maxDelay
+	d := base * time.Duration(1<<uint(attempt))
+	if d > maxDelay || d/time.Duration(1<<uint(attempt)) != base {
+		d = maxDelay
+	}
+	return d + time.Duration(float64(d)*jitter*(2*rand.Float64()-1))
+}
+
+// backoffSetting reads a backoff duration from env or the config file,
+// falling back to def if it is unset or invalid.
+func backoffSetting(env, key string, def time.Duration) time.Duration {
+	v := envOrConfig(env, key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Warning: invalid %s %q, using %v", env, v, def)
+		return def
 	}
-	// Add jitter: ±25%
-	jitter := time.Duration(float64(base) * (0.5*rand.Float64() - 0.25))
-	return base + jitter
+	return d
 }